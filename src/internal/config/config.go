@@ -7,7 +7,11 @@ package config
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/linuxdeepin/go-lib/dbusutil"
@@ -64,6 +68,7 @@ type Config struct {
 	CleanIntervalCacheOverLimit    time.Duration
 	AppstoreRegion                 string
 	LastCheckTime                  time.Time
+	LastCheckResult                CheckResult // 最近一次检查更新任务结束时的结果
 	LastCleanTime                  time.Time
 	LastCheckCacheSizeTime         time.Time
 	Repository                     string
@@ -110,6 +115,62 @@ type Config struct {
 	SystemRepoType          RepoType      // 系统更新仓库类型
 	SecurityRepoType        RepoType      // 安全更新仓库类型
 
+	ExcludedPackages       []string // 不参与自动下载和更新的包
+	AutoFixDpkgInterrupted bool     // dpkg被中断导致job失败时,自动修复并重试一次
+
+	PartialFileMaxAge    time.Duration // 检查更新前清理超过该时间的未下载完成的文件,小于等于0时全部清理
+	NotifyThrottleWindow time.Duration // 相同通知的去重窗口期
+
+	StagingPolicy StagingPolicy // 自动下载策略
+
+	ProtectedPackages []string // 受保护的包,任务需要卸载这些包时终止 来源dconfig和/etc/deepin/lastore-daemon/protected-packages.conf.d
+
+	UpdateSourceRetryCount int                 // 检查更新失败后的重试次数
+	UpdateSourceRetryDelay time.Duration       // 第一次重试前的等待时间,之后每次重试翻倍
+	UpdateSourceRetryTypes []system.UpdateType // 每次重试检查的仓库类型,重试次数超出时使用最后一项
+
+	AutoRollbackOnBrokenUpgrade bool // 更新后检查到依赖损坏时,自动通过A/B备份回滚
+
+	ParallelUpdateSource bool // 检查更新时每个仓库文件单独并行执行,部分仓库失败时使用成功的索引
+
+	PlatformDowngradeStrict bool // 检查更新平台必装清单中目标版本低于已安装版本的包,作为警告上报
+
+	IgnorePhasedUpdates bool // 忽略仓库的Phased-Update-Percentage,立即安装所有分阶段推送的更新
+
+	MaxCacheSize int64 // 下载和安装任务结束后,将deb缓存裁剪到该大小(MB)以内,小于等于0时不限制
+
+	DownloadQueueMode             string   // apt下载队列模式 host或access,为空时使用apt默认值
+	DownloadPipelineDepth         int      // http流水线深度,小于0时使用apt默认值
+	DownloadPipelineDepthOverride []string // 按主机覆盖流水线深度,格式为"主机=深度"
+
+	BatteryDownloadLimit int64 // 使用电池时自动下载的大小上限(MB),超过时推迟到接通电源,小于等于0时不限制
+
+	UpdateNotifyDismissCooldown time.Duration // 用户关闭可更新通知后不再提醒的时间,期间出现新的包时仍然提醒
+	UpdateNotifyDismissed       string        // 用户关闭可更新通知时的记录(json),重启后继续生效
+
+	OfflineUnzipDir string // 离线更新包的解压目录,为空时使用默认目录,空间不足时选择可用空间最大的备用目录
+	OfflineMountDir string // 离线更新包的挂载目录,为空时使用默认目录
+
+	AllowUnauthenticated bool // 允许安装无法验证签名的包,只应在管理员确认仓库可信时开启
+
+	DownloadJobMaxRuntime time.Duration // 下载任务没有进度更新的最长时间,超时后任务失败,0表示不限制
+	UpgradeJobMaxRuntime  time.Duration // 安装更新任务没有进度更新的最长时间,超时后任务失败,0表示不限制
+
+	OfflineHelperSha256 []string // 离线更新辅助程序的sha256,格式同sha256sum输出"<sha256>  <路径>",配置后执行前校验
+
+	DownloadReadyNotify bool // 自动下载完成后是否发送可以安装的通知
+
+	PDiffsEnabled   bool // 检查更新时是否使用增量索引(Acquire::PDiffs)
+	DebDeltaEnabled bool // 下载时是否先通过debdelta下载增量包重建deb,需要安装debdelta
+
+	ExtraAptOptions map[string]map[string]string // 按任务类型配置的额外apt参数,从AptOptionsDir读取
+
+	SecuritySafeMode      bool     // 安全更新时推迟需要重启的包,只安装不需要重启的包
+	SafeModeDeferPackages []string // 安全模式下除需要重启的包之外额外推迟安装的包
+
+	PlatformRetryCount int           // 检查更新时从更新平台获取数据失败后的重试次数,与apt的重试相互独立
+	PlatformRetryDelay time.Duration // 第一次重试更新平台请求前的等待时间,之后每次重试翻倍
+
 	filePath string
 	statusMu sync.RWMutex
 
@@ -168,6 +229,7 @@ const (
 	dSettingsKeyCleanIntervalCacheOverLimit          = "clean-internal-cache-over-limit"
 	dSettingsKeyAppstoreRegion                       = "appstore-region"
 	dSettingsKeyLastCheckTime                        = "last-check-time"
+	dSettingsKeyLastCheckResult                      = "last-check-result"
 	dSettingsKeyLastCleanTime                        = "last-clean-time"
 	dSettingsKeyLastCheckCacheSizeTime               = "last-check-cache-size-time"
 	dSettingsKeyRepository                           = "repository"
@@ -198,12 +260,162 @@ const (
 	dSettingsKeySecurityCustomSource                 = "security-custom-source"
 	dSettingsKeySystemRepoType                       = "system-repo-type"
 	dSettingsKeySecurityRepoType                     = "security-repo-type"
+	dSettingsKeyExcludedPackages                     = "excluded-packages"
+	dSettingsKeyAutoFixDpkgInterrupted               = "auto-fix-dpkg-interrupted"
+	dSettingsKeyPartialFileMaxAge                    = "partial-file-max-age"
+	dSettingsKeyNotifyThrottleWindow                 = "notify-throttle-window"
+	dSettingsKeyStagingPolicy                        = "staging-policy"
+	dSettingsKeyProtectedPackages                    = "protected-packages"
+	dSettingsKeyUpdateSourceRetryCount               = "update-source-retry-count"
+	dSettingsKeyUpdateSourceRetryDelay               = "update-source-retry-delay"
+	dSettingsKeyUpdateSourceRetryTypes               = "update-source-retry-types"
+	dSettingsKeyAutoRollbackOnBrokenUpgrade          = "auto-rollback-on-broken-upgrade"
+	dSettingsKeyParallelUpdateSource                 = "parallel-update-source"
+	dSettingsKeyPlatformDowngradeStrict              = "platform-downgrade-strict"
+	dSettingsKeyIgnorePhasedUpdates                  = "ignore-phased-updates"
+	dSettingsKeyMaxCacheSize                         = "max-cache-size"
+	dSettingsKeyDownloadQueueMode                    = "download-queue-mode"
+	dSettingsKeyDownloadPipelineDepth                = "download-pipeline-depth"
+	dSettingsKeyDownloadPipelineDepthOverride        = "download-pipeline-depth-override"
+	dSettingsKeyBatteryDownloadLimit                 = "battery-download-limit"
+	dSettingsKeyUpdateNotifyDismissCooldown          = "update-notify-dismiss-cooldown"
+	dSettingsKeyUpdateNotifyDismissed                = "update-notify-dismissed"
+	dSettingsKeyOfflineUnzipDir                      = "offline-unzip-dir"
+	dSettingsKeyOfflineMountDir                      = "offline-mount-dir"
+	dSettingsKeyAllowUnauthenticated                 = "allow-unauthenticated"
+	dSettingsKeyDownloadJobMaxRuntime                = "download-job-max-runtime"
+	dSettingsKeyUpgradeJobMaxRuntime                 = "upgrade-job-max-runtime"
+	dSettingsKeyOfflineHelperSha256                  = "offline-helper-sha256"
+	dSettingsKeyDownloadReadyNotify                  = "download-ready-notify"
+	dSettingsKeyPDiffsEnabled                        = "pdiffs-enabled"
+	dSettingsKeyDebDeltaEnabled                      = "debdelta-enabled"
+	dSettingsKeySecuritySafeMode                     = "security-safe-mode"
+	dSettingsKeySafeModeDeferPackages                = "safe-mode-defer-packages"
+	dSettingsKeyPlatformRetryCount                   = "platform-retry-count"
+	dSettingsKeyPlatformRetryDelay                   = "platform-retry-delay"
+)
+
+// ProtectedPackagesDir 下的*.conf文件每行一个受保护的包名,#开头为注释
+const ProtectedPackagesDir = "/etc/deepin/lastore-daemon/protected-packages.conf.d"
+
+func loadProtectedPackagesDir(dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		logger.Warning(err)
+		return nil
+	}
+	sort.Strings(files)
+	var packages []string
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			packages = append(packages, line)
+		}
+	}
+	return packages
+}
+
+// AptOptionsDir 下的*.conf文件每行为"<任务类型> <apt配置项>=<值>",为该类型的任务添加apt参数,任务类型为*时对所有任务生效,#开头为注释.
+// 文件需要属于root且不能被其他用户修改,否则忽略;配置项是否允许设置由apt.ValidateExtraOption检查
+const AptOptionsDir = "/etc/deepin/lastore-daemon/apt-options.conf.d"
+
+// loadAptOptionsDir 按文件名顺序读取dir中的额外apt参数,后读取的同名配置项覆盖之前的,不属于trustedUid的文件会被忽略
+func loadAptOptionsDir(dir string, trustedUid uint32) map[string]map[string]string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		logger.Warning(err)
+		return nil
+	}
+	sort.Strings(files)
+	var options map[string]map[string]string
+	for _, file := range files {
+		info, err := os.Lstat(file)
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !info.Mode().IsRegular() || !ok || stat.Uid != trustedUid || info.Mode().Perm()&0022 != 0 {
+			logger.Warningf("ignore untrusted apt options file %q", file)
+			continue
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			var key, value string
+			ok := len(fields) == 2
+			if ok {
+				key, value, ok = strings.Cut(fields[1], "=")
+			}
+			if !ok || key == "" {
+				logger.Warningf("ignore invalid apt option %q in %q", line, file)
+				continue
+			}
+			if options == nil {
+				options = make(map[string]map[string]string)
+			}
+			if options[fields[0]] == nil {
+				options[fields[0]] = make(map[string]string)
+			}
+			options[fields[0]][key] = value
+		}
+	}
+	return options
+}
+
+// appendProtectedPackages 合并并去重
+func appendProtectedPackages(packages []string, extra []string) []string {
+	seen := make(map[string]bool, len(packages)+len(extra))
+	var result []string
+	for _, pkg := range append(packages, extra...) {
+		if seen[pkg] {
+			continue
+		}
+		seen[pkg] = true
+		result = append(result, pkg)
+	}
+	return result
+}
+
+// StagingPolicy 自动下载策略,所有策略都不会自动安装,安装需要用户操作或更新平台强制更新触发
+type StagingPolicy string
+
+const (
+	StagingPolicyOff               StagingPolicy = "off"                 // 不自动下载
+	StagingPolicyDownloadOnly      StagingPolicy = "download-only"       // 静默下载,下载完成后不发通知,也不会触发任何安装
+	StagingPolicyDownloadAndNotify StagingPolicy = "download-and-notify" // 自动下载,下载完成后通知用户
 )
 
+func (p StagingPolicy) IsValid() bool {
+	switch p {
+	case StagingPolicyOff, StagingPolicyDownloadOnly, StagingPolicyDownloadAndNotify:
+		return true
+	}
+	return false
+}
+
 const configTimeLayout = "2006-01-02T15:04:05.999999999-07:00"
 
 func getConfigFromDSettings() *Config {
-	c := &Config{}
+	c := &Config{
+		PDiffsEnabled: true,
+	}
 	sysBus, err := dbus.SystemBus()
 	if err != nil {
 		return c
@@ -329,6 +541,16 @@ func getConfigFromDSettings() *Config {
 		}
 	}
 
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyLastCheckResult)
+	if err != nil {
+		logger.Warning(err)
+	} else if s := v.Value().(string); s != "" {
+		err = json.Unmarshal([]byte(s), &c.LastCheckResult)
+		if err != nil {
+			logger.Warning(err)
+		}
+	}
+
 	v, err = c.dsLastoreManager.Value(0, dSettingsKeyLastCleanTime)
 	if err != nil {
 		logger.Warning(err)
@@ -611,6 +833,270 @@ func getConfigFromDSettings() *Config {
 		c.SecurityRepoType = RepoType(v.Value().(string))
 	}
 
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyExcludedPackages)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		for _, s := range v.Value().([]dbus.Variant) {
+			c.ExcludedPackages = append(c.ExcludedPackages, s.Value().(string))
+		}
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyAutoFixDpkgInterrupted)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.AutoFixDpkgInterrupted = v.Value().(bool)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyPartialFileMaxAge)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.PartialFileMaxAge = time.Duration(v.Value().(int64))
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyNotifyThrottleWindow)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.NotifyThrottleWindow = time.Duration(v.Value().(int64))
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyStagingPolicy)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.StagingPolicy = StagingPolicy(v.Value().(string))
+	}
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyProtectedPackages)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		for _, s := range v.Value().([]dbus.Variant) {
+			c.ProtectedPackages = append(c.ProtectedPackages, s.Value().(string))
+		}
+	}
+	c.ProtectedPackages = appendProtectedPackages(c.ProtectedPackages, loadProtectedPackagesDir(ProtectedPackagesDir))
+	c.ExtraAptOptions = loadAptOptionsDir(AptOptionsDir, 0)
+
+	c.UpdateSourceRetryCount = 1
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyUpdateSourceRetryCount)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.UpdateSourceRetryCount = int(v.Value().(int64))
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyUpdateSourceRetryDelay)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.UpdateSourceRetryDelay = time.Duration(v.Value().(int64))
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyUpdateSourceRetryTypes)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		for _, s := range v.Value().([]dbus.Variant) {
+			switch t := s.Value().(type) {
+			case int64:
+				c.UpdateSourceRetryTypes = append(c.UpdateSourceRetryTypes, system.UpdateType(t))
+			case float64:
+				c.UpdateSourceRetryTypes = append(c.UpdateSourceRetryTypes, system.UpdateType(t))
+			}
+		}
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyAutoRollbackOnBrokenUpgrade)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.AutoRollbackOnBrokenUpgrade = v.Value().(bool)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyParallelUpdateSource)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.ParallelUpdateSource = v.Value().(bool)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyPlatformDowngradeStrict)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.PlatformDowngradeStrict = v.Value().(bool)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyIgnorePhasedUpdates)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.IgnorePhasedUpdates = v.Value().(bool)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyMaxCacheSize)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.MaxCacheSize = v.Value().(int64)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyDownloadQueueMode)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.DownloadQueueMode = v.Value().(string)
+	}
+
+	c.DownloadPipelineDepth = -1
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyDownloadPipelineDepth)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.DownloadPipelineDepth = int(v.Value().(int64))
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyDownloadPipelineDepthOverride)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		for _, s := range v.Value().([]dbus.Variant) {
+			c.DownloadPipelineDepthOverride = append(c.DownloadPipelineDepthOverride, s.Value().(string))
+		}
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyBatteryDownloadLimit)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.BatteryDownloadLimit = v.Value().(int64)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyUpdateNotifyDismissCooldown)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.UpdateNotifyDismissCooldown = time.Duration(v.Value().(int64))
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyUpdateNotifyDismissed)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.UpdateNotifyDismissed = v.Value().(string)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyOfflineUnzipDir)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.OfflineUnzipDir = v.Value().(string)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyOfflineMountDir)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.OfflineMountDir = v.Value().(string)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyAllowUnauthenticated)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.AllowUnauthenticated = v.Value().(bool)
+	}
+
+	c.DownloadJobMaxRuntime = 30 * time.Minute
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyDownloadJobMaxRuntime)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.DownloadJobMaxRuntime = time.Duration(v.Value().(int64))
+	}
+
+	c.UpgradeJobMaxRuntime = 2 * time.Hour
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyUpgradeJobMaxRuntime)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.UpgradeJobMaxRuntime = time.Duration(v.Value().(int64))
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyOfflineHelperSha256)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		for _, s := range v.Value().([]dbus.Variant) {
+			c.OfflineHelperSha256 = append(c.OfflineHelperSha256, s.Value().(string))
+		}
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyDownloadReadyNotify)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.DownloadReadyNotify = v.Value().(bool)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyPDiffsEnabled)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.PDiffsEnabled = v.Value().(bool)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyDebDeltaEnabled)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.DebDeltaEnabled = v.Value().(bool)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeySecuritySafeMode)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.SecuritySafeMode = v.Value().(bool)
+	}
+
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeySafeModeDeferPackages)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		for _, s := range v.Value().([]dbus.Variant) {
+			c.SafeModeDeferPackages = append(c.SafeModeDeferPackages, s.Value().(string))
+		}
+	}
+
+	c.PlatformRetryCount = 3
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyPlatformRetryCount)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.PlatformRetryCount = int(v.Value().(int64))
+	}
+
+	c.PlatformRetryDelay = 2 * time.Second
+	v, err = c.dsLastoreManager.Value(0, dSettingsKeyPlatformRetryDelay)
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		c.PlatformRetryDelay = time.Duration(v.Value().(int64))
+	}
+
+	// 未配置时兼容旧的自动下载开关
+	if !c.StagingPolicy.IsValid() {
+		if c.AutoDownloadUpdates {
+			c.StagingPolicy = StagingPolicyDownloadAndNotify
+		} else {
+			c.StagingPolicy = StagingPolicyOff
+		}
+	}
+
 	err = c.recoveryAndApplyOemFlag(system.SystemUpdate)
 	if err != nil {
 		logger.Warning(err)
@@ -683,6 +1169,23 @@ func (c *Config) UpdateLastCheckTime() error {
 	return c.save(dSettingsKeyLastCheckTime, c.LastCheckTime.Format(configTimeLayout))
 }
 
+// CheckResult 检查更新任务的结果,时间、是否成功和错误类型一起保存
+type CheckResult struct {
+	Time      time.Time
+	Succeeded bool
+	Error     string `json:",omitempty"` // 失败时的错误类型
+	Attempt   int    `json:",omitempty"` // 第几次尝试得到的结果,从1开始
+}
+
+func (c *Config) SetLastCheckResult(result CheckResult) error {
+	c.LastCheckResult = result
+	content, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return c.save(dSettingsKeyLastCheckResult, string(content))
+}
+
 func (c *Config) UpdateLastCleanTime() error {
 	c.LastCleanTime = time.Now()
 	return c.save(dSettingsKeyLastCleanTime, c.LastCleanTime.Format(configTimeLayout))
@@ -718,6 +1221,16 @@ func (c *Config) SetAutoDownloadUpdates(enable bool) error {
 	return c.save(dSettingsKeyAutoDownloadUpdates, enable)
 }
 
+func (c *Config) SetPDiffsEnabled(enable bool) error {
+	c.PDiffsEnabled = enable
+	return c.save(dSettingsKeyPDiffsEnabled, enable)
+}
+
+func (c *Config) SetStagingPolicy(policy StagingPolicy) error {
+	c.StagingPolicy = policy
+	return c.save(dSettingsKeyStagingPolicy, string(policy))
+}
+
 func (c *Config) SetAutoClean(enable bool) error {
 	c.AutoClean = enable
 	return c.save(dSettingsKeyAutoClean, enable)
@@ -854,6 +1367,11 @@ func (c *Config) SetUpdateStatus(status string) error {
 	return c.save(dSettingsKeyUpdateStatus, status)
 }
 
+func (c *Config) SetUpdateNotifyDismissed(dismissed string) error {
+	c.UpdateNotifyDismissed = dismissed
+	return c.save(dSettingsKeyUpdateNotifyDismissed, dismissed)
+}
+
 func (c *Config) SetInstallUpdateTime(delayed string) error {
 	c.UpdateTime = delayed
 	return c.save(dSettingsKeyUpdateTime, c.UpdateTime)
@@ -879,6 +1397,11 @@ func (c *Config) SetSecurityRepoType(typ RepoType) error {
 	return c.save(dSettingsKeySecurityRepoType, typ)
 }
 
+func (c *Config) SetExcludedPackages(packages []string) error {
+	c.ExcludedPackages = packages
+	return c.save(dSettingsKeyExcludedPackages, packages)
+}
+
 const (
 	onlineCachePath     = "/tmp/platform_cache.json"
 	classifiedCachePath = "/tmp/classified_cache.json"
@@ -7,6 +7,7 @@ package config
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -78,3 +79,42 @@ func TestConfig(t *testing.T) {
 	assert.Equal(t, configAfter.AppstoreRegion, configBefore.AppstoreRegion+"Test")
 	assert.Equal(t, configAfter.UpdateMode, configBefore.UpdateMode+1)
 }
+
+func TestLoadProtectedPackagesDir(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "10-dde.conf"), []byte("# desktop\ndde\n\n  dde-dock  \n"), 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "20-oem.conf"), []byte("oem-desktop\ndde\n"), 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "ignored.list"), []byte("foo\n"), 0644)
+	require.NoError(t, err)
+
+	packages := loadProtectedPackagesDir(dir)
+	assert.Equal(t, []string{"dde", "dde-dock", "oem-desktop", "dde"}, packages)
+	assert.Equal(t, []string{"dde", "startdde", "dde-dock", "oem-desktop"}, appendProtectedPackages([]string{"dde", "startdde"}, packages))
+	assert.Nil(t, loadProtectedPackagesDir(filepath.Join(dir, "not-exist")))
+}
+
+func TestLoadAptOptionsDir(t *testing.T) {
+	dir := t.TempDir()
+	uid := uint32(os.Getuid())
+	err := os.WriteFile(filepath.Join(dir, "10-proxy.conf"), []byte("# proxy\n* Acquire::http::Proxy=http://proxy:3128\n"+
+		"prepare_dist_upgrade Acquire::Retries=3\ninvalid line here\nupdate_source =1\n"), 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "20-override.conf"), []byte("prepare_dist_upgrade Acquire::Retries=5\n"), 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "30-writable.conf"), []byte("* Acquire::Retries=9\n"), 0644)
+	require.NoError(t, err)
+	require.NoError(t, os.Chmod(filepath.Join(dir, "30-writable.conf"), 0666))
+	err = os.WriteFile(filepath.Join(dir, "ignored.list"), []byte("* Acquire::Retries=9\n"), 0644)
+	require.NoError(t, err)
+
+	options := loadAptOptionsDir(dir, uid)
+	assert.Equal(t, map[string]map[string]string{
+		"*":                    {"Acquire::http::Proxy": "http://proxy:3128"},
+		"prepare_dist_upgrade": {"Acquire::Retries": "5"},
+	}, options)
+	// 不属于可信用户的文件被忽略
+	assert.Nil(t, loadAptOptionsDir(dir, uid+1))
+	assert.Nil(t, loadAptOptionsDir(filepath.Join(dir, "not-exist"), uid))
+}
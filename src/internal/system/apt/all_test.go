@@ -5,7 +5,14 @@
 package apt
 
 import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
 	C "gopkg.in/check.v1"
@@ -25,3 +32,960 @@ func (*testWrap) TestParseInfo(c *C.C) {
 	c.Check(info.Status, C.Equals, system.RunningStatus)
 	c.Check(info.JobId, C.Equals, "jobid")
 }
+
+func (*testWrap) TestParseMediaChange(c *C.C) {
+	line := "media-change: Deepin 23 amd64 DVD:/media/cdrom/:Please insert the disc labeled: 'Deepin 23 amd64 DVD' in the drive '/media/cdrom/' and press enter.\n"
+	info, err := parseProgressInfo("jobid", line)
+	c.Assert(err, C.IsNil)
+	c.Check(info.Status, C.Equals, system.RunningStatus)
+	c.Check(info.Cancelable, C.Equals, true)
+	c.Assert(info.MediaChange, C.NotNil)
+	c.Check(info.MediaChange.Medium, C.Equals, "Deepin 23 amd64 DVD")
+	c.Check(info.MediaChange.Drive, C.Equals, "/media/cdrom/")
+	c.Check(info.Description, C.Equals, info.MediaChange.Message)
+}
+
+func (*testWrap) TestParsePmstatusPackage(c *C.C) {
+	info, err := parseProgressInfo("jobid", "pmstatus:dde-dock:80.0000:Installed dde-dock\n")
+	c.Assert(err, C.IsNil)
+	c.Check(info.Package, C.Equals, "dde-dock")
+	c.Check(info.Progress, C.Equals, 0.8)
+	c.Check(info.Description, C.Equals, "Installed dde-dock")
+
+	// 多架构的包名带有架构
+	info, err = parseProgressInfo("jobid", "pmstatus:libc6:amd64:20.0000:Unpacking libc6 (amd64)\n")
+	c.Assert(err, C.IsNil)
+	c.Check(info.Package, C.Equals, "libc6")
+	c.Check(info.Progress, C.Equals, 0.2)
+	c.Check(info.Description, C.Equals, "Unpacking libc6 (amd64)")
+
+	info, err = parseProgressInfo("jobid", "dlstatus:1:10:Retrieving file 1 of 10")
+	c.Assert(err, C.IsNil)
+	c.Check(info.Package, C.Equals, "")
+}
+
+// chunkReader 每次最多返回n个字节,模拟慢速链路下一条记录被拆分读取的情况
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > cr.n {
+		p = p[:cr.n]
+	}
+	return cr.r.Read(p)
+}
+
+func (*testWrap) TestScanProgressInfo(c *C.C) {
+	stream := "dlstatus:1:10.5:Downloading dde-dock\n" +
+		"broken line\n" +
+		"\n" +
+		"dlstatus:2:50:Downloading dde-control-center\n" +
+		"pmstatus:dde-dock:80:Installing dde-dock\n" +
+		"dlstatus:3:9"
+	for n := 1; n <= len(stream); n++ {
+		var infos []system.JobProgressInfo
+		system.ScanProgressInfo(&chunkReader{r: strings.NewReader(stream), n: n}, "jobid", parseProgressInfo,
+			func(info system.JobProgressInfo) {
+				infos = append(infos, info)
+			})
+		c.Assert(len(infos), C.Equals, 3)
+		c.Check(infos[0].Progress, C.Equals, 0.105)
+		c.Check(infos[0].Description, C.Equals, "Downloading dde-dock")
+		c.Check(infos[1].Progress, C.Equals, 0.5)
+		c.Check(infos[2].Progress, C.Equals, 0.8)
+		c.Check(infos[2].Cancelable, C.Equals, false)
+	}
+}
+
+func (*testWrap) TestMergePackageInfoMap(c *C.C) {
+	dst := map[string]system.PackageInfo{
+		"dde-dock": {Name: "dde-dock", Version: "1.0"},
+	}
+	conflict := mergePackageInfoMap(dst, map[string]system.PackageInfo{
+		"dde-dock":     {Name: "dde-dock", Version: "1.0"},
+		"dde-launcher": {Name: "dde-launcher", Version: "2.0"},
+	})
+	c.Check(conflict, C.Equals, false)
+	c.Check(len(dst), C.Equals, 2)
+
+	conflict = mergePackageInfoMap(dst, map[string]system.PackageInfo{
+		"dde-dock": {Name: "dde-dock", Version: "1.1"},
+	})
+	c.Check(conflict, C.Equals, true)
+}
+
+func (*testWrap) TestParseFixBrokenSimulate(c *C.C) {
+	out := `NOTE: This is only a simulation!
+Reading package lists...
+0 upgraded, 0 newly installed, 0 to remove and 10 not upgraded.`
+	c.Check(parseFixBrokenSimulate([]byte(out)), C.HasLen, 0)
+
+	out = `Correcting dependencies... Done
+The following additional packages will be installed:
+  libfoo1
+Inst libfoo1 (1.2-1 stable [amd64])
+Remv bar [0.1-1]
+Conf libfoo1 (1.2-1 stable [amd64])`
+	c.Check(parseFixBrokenSimulate([]byte(out)), C.DeepEquals, []string{"libfoo1", "bar"})
+}
+
+func (*testWrap) TestParseProtectedRemoval(c *C.C) {
+	protected := []string{"dde", "dde-session-shell", "deepin-desktop-base"}
+	out := `NOTE: This is only a simulation!
+Reading package lists...
+Remv dde [5.6.3]
+Remv dde-session-shell:amd64 [5.6.3-1] [dde:amd64 ]
+Remv dde-calendar [5.9.1]
+Inst libfoo1 (1.2-1 stable [amd64])
+Conf libfoo1 (1.2-1 stable [amd64])`
+	c.Check(parseProtectedRemoval([]byte(out), protected), C.DeepEquals, []string{"dde", "dde-session-shell"})
+
+	// 只有前缀相同的包不算
+	out = `Remv dde-calendar [5.9.1]
+Inst dde (5.6.4 stable [amd64])`
+	c.Check(parseProtectedRemoval([]byte(out), protected), C.HasLen, 0)
+	c.Check(parseProtectedRemoval([]byte("Remv dde [5.6.3]"), nil), C.HasLen, 0)
+}
+
+func (*testWrap) TestAllowProtectedRemoval(c *C.C) {
+	AllowProtectedRemoval("dist_upgrade", []string{"dde-dock"})
+	allowed := takeAllowedRemoval("dist_upgrade")
+	c.Check(filterAllowedRemoval([]string{"dde", "dde-dock"}, allowed), C.DeepEquals, []string{"dde"})
+	// 授权只生效一次
+	c.Check(takeAllowedRemoval("dist_upgrade"), C.HasLen, 0)
+}
+
+func (*testWrap) TestParseSpaceDelta(c *C.C) {
+	var data = []struct {
+		out   string
+		delta int64
+		ok    bool
+	}{
+		{"After this operation, 12.3 MB of additional disk space will be used.", 12300000, true},
+		{"After this operation, 1,024 kB disk space will be freed.", -1024000, true},
+		{"After this operation, 0 B of additional disk space will be used.", 0, true},
+		{"After this operation, 2.5 GB of additional disk space will be used.", 2500000000, true},
+		{"After this operation, 1.234,5 kB of additional disk space will be used.", 1234500, true},
+		{"After this operation, 12,3 MB disk space will be freed.", -12300000, true},
+		{"解压缩后会消耗 52.2 MB 的额外空间。", 52200000, true},
+		{"解压缩后将会空出 870 kB 的空间。", -870000, true},
+		{"Need to get 12.3 MB of archives.\n0 upgraded, 0 newly installed, 0 to remove and 0 not upgraded.", 0, false},
+	}
+	for _, d := range data {
+		delta, ok := parseSpaceDelta([]byte("Reading package lists...\n" + d.out + "\nDo you want to continue? [Y/n] Abort."))
+		c.Check(ok, C.Equals, d.ok, C.Commentf("%s", d.out))
+		c.Check(delta, C.Equals, d.delta, C.Commentf("%s", d.out))
+	}
+}
+
+func (*testWrap) TestRunSafecacheScript(c *C.C) {
+	dir := c.MkDir()
+	c.Check(runSafecacheScript(filepath.Join(dir, "missing.sh"), time.Second), C.Equals, false)
+
+	script := filepath.Join(dir, "build_safecache.sh")
+	for _, data := range []struct {
+		content string
+		timeout time.Duration
+		ready   bool
+	}{
+		{"exit 0", time.Second * 5, true},
+		{"echo broken; exit 2", time.Second * 5, false},
+		{"exec sleep 10", time.Millisecond * 200, false},
+	} {
+		c.Assert(os.WriteFile(script, []byte("#!/bin/sh\n"+data.content+"\n"), 0755), C.IsNil)
+		c.Check(runSafecacheScript(script, data.timeout), C.Equals, data.ready, C.Commentf("%s", data.content))
+	}
+}
+
+func (*testWrap) TestParseDownloadItem(c *C.C) {
+	var data = []struct {
+		line string
+		item *system.DownloadItem
+	}{
+		{"dlstatus:1:0.0000:Retrieving file 1 of 3", &system.DownloadItem{Index: 1, Total: 3}},
+		{"dlstatus:1:9.8046:Retrieving file 1 of 3 (4s remaining)", &system.DownloadItem{Index: 1, Total: 3, Remaining: "4s"}},
+		{"dlstatus:2:31.4541:Retrieving file 2 of 12 (1min 12s remaining)",
+			&system.DownloadItem{Index: 2, Total: 12, Remaining: "1min 12s"}},
+		{"dlstatus:7:45.0021:Retrieving file 7 of 40 (1h 2min 3s remaining)",
+			&system.DownloadItem{Index: 7, Total: 40, Remaining: "1h 2min 3s"}},
+		{"dlstatus:3:100.0000:Retrieving file 3 of 3", &system.DownloadItem{Index: 3, Total: 3}},
+		{"dlstatus:1:5.0000:Waiting for headers", nil},
+	}
+	for _, d := range data {
+		info, err := parseProgressInfo("jobid", d.line)
+		c.Assert(err, C.IsNil)
+		c.Check(info.CurrentItem, C.DeepEquals, d.item, C.Commentf("%s", d.line))
+	}
+
+	// pmstatus不包含下载文件,百分比仍按原有方式计算
+	info, err := parseProgressInfo("jobid", "pmstatus:dpkg-exec:50:Running dpkg")
+	c.Assert(err, C.IsNil)
+	c.Check(info.CurrentItem, C.IsNil)
+	info, err = parseProgressInfo("jobid", "dlstatus:2:20.0000:Retrieving file 2 of 12 (1min 12s remaining)")
+	c.Assert(err, C.IsNil)
+	c.Check(info.Progress, C.Equals, 0.2)
+}
+
+func (*testWrap) TestDownloadItemTracker(c *C.C) {
+	tracker := newDownloadItemTracker()
+	// 标准输出可能被拆分写入
+	stdout := "Reading package lists...\n" +
+		"Get:1 http://mirror.example.com/deepin apricot/main libbar amd64 2.0 [512 B]\n" +
+		"Get:2 http://mirror.example.com/deepin apricot/main amd64 libfoo amd64 1.2-1 [3,248 kB]\nGet:3 http://mir"
+	_, err := tracker.Write([]byte(stdout))
+	c.Assert(err, C.IsNil)
+	_, err = tracker.Write([]byte("ror.example.com/deepin apricot/main amd64 libbaz all 1:0.1 [1.5 MB]\n"))
+	c.Assert(err, C.IsNil)
+
+	var data = []struct {
+		line string
+		item *system.DownloadItem
+	}{
+		{"dlstatus:0:0.0000:Retrieving file 1 of 3",
+			&system.DownloadItem{URI: "http://mirror.example.com/deepin", Name: "libbar", Size: 512, Index: 1, Total: 3}},
+		{"dlstatus:1:35.1142:Retrieving file 2 of 3 (4s remaining)",
+			&system.DownloadItem{URI: "http://mirror.example.com/deepin", Name: "libfoo", Size: 3248000, Index: 2, Total: 3, Remaining: "4s"}},
+		{"dlstatus:2:80.2013:Retrieving file 3 of 3 (1s remaining)",
+			&system.DownloadItem{URI: "http://mirror.example.com/deepin", Name: "libbaz", Size: 1500000, Index: 3, Total: 3, Remaining: "1s"}},
+		// 还没有读到对应的Get行时只有进度
+		{"dlstatus:2:80.2013:Retrieving file 4 of 5", &system.DownloadItem{Index: 4, Total: 5}},
+		{"dlstatus:1:5.0000:Waiting for headers", nil},
+	}
+	for _, d := range data {
+		info, err := tracker.parseProgressInfo("jobid", d.line)
+		c.Assert(err, C.IsNil)
+		c.Check(info.CurrentItem, C.DeepEquals, d.item, C.Commentf("%s", d.line))
+	}
+}
+
+func (*testWrap) TestRemoveUnreferencedDebs(c *C.C) {
+	dir := c.MkDir()
+	files := map[string]int{
+		"libfoo_1.0-1_amd64.deb":   10,
+		"libbar_2%3a1.0_amd64.deb": 20,
+		"obsolete_0.1_all.deb":     30,
+		"lock":                     0,
+		"libfoo-doc_1.0-1_all.deb": 40,
+		"libbaz_1.0_i386.deb":      50,
+	}
+	for name, size := range files {
+		c.Assert(os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644), C.IsNil)
+	}
+	c.Check(archivesSize(dir), C.Equals, int64(150))
+
+	removeUnreferencedDebs(dir, []string{"libfoo", "libbar", "libbaz:i386"})
+	c.Check(archivesSize(dir), C.Equals, int64(80))
+	for _, name := range []string{"libfoo_1.0-1_amd64.deb", "libbar_2%3a1.0_amd64.deb", "libbaz_1.0_i386.deb", "lock"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		c.Check(err, C.IsNil, C.Commentf("%s", name))
+	}
+}
+
+func (*testWrap) TestTrimArchives(c *C.C) {
+	dir := c.MkDir()
+	now := time.Now()
+	files := []struct {
+		path string
+		size int
+		age  time.Duration
+	}{
+		{filepath.Join(dir, "oldest_1.0_amd64.deb"), 30, 5 * time.Hour},
+		{filepath.Join(dir, "pending_1%3a2.0_amd64.deb"), 40, 4 * time.Hour},
+		{filepath.Join(dir, "pending_1%3a1.0_amd64.deb"), 15, 3 * time.Hour},
+		{filepath.Join(dir, "older_1.0_amd64.deb"), 20, 2 * time.Hour},
+		{filepath.Join(dir, "newest_1.0_amd64.deb"), 10, time.Hour},
+	}
+	for _, f := range files {
+		c.Assert(os.WriteFile(f.path, make([]byte, f.size), 0644), C.IsNil)
+		c.Assert(os.Chtimes(f.path, now.Add(-f.age), now.Add(-f.age)), C.IsNil)
+	}
+	c.Check(archivesSize(dir), C.Equals, int64(115))
+
+	// 只保留待更新包的目标版本,其他包从最旧的开始删除
+	trimArchives(dir, 60, []string{"pending=1:2.0"})
+	c.Check(archivesSize(dir), C.Equals, int64(50))
+	for i, f := range files {
+		_, err := os.Stat(f.path)
+		c.Check(err == nil, C.Equals, i == 1 || i == 4, C.Commentf("%s", f.path))
+	}
+
+	// 只剩待更新的包时不再删除
+	trimArchives(dir, 0, []string{"pending:amd64=1:2.0"})
+	c.Check(archivesSize(dir), C.Equals, int64(40))
+}
+
+func (*testWrap) TestKeepDebs(c *C.C) {
+	keep := newKeepDebs([]string{"libfoo=1.0", "libfoo:i386=2.0", "libbar", "libbar=1.0"})
+	c.Check(keep.contains("/tmp/libfoo_1.0_amd64.deb"), C.Equals, true)
+	c.Check(keep.contains("/tmp/libfoo_2.0_i386.deb"), C.Equals, true)
+	c.Check(keep.contains("/tmp/libfoo_3.0_amd64.deb"), C.Equals, false)
+	// 没有指定版本时保留所有版本
+	c.Check(keep.contains("/tmp/libbar_2%3a3.0_amd64.deb"), C.Equals, true)
+	c.Check(keep.contains("/tmp/libbaz_1.0_amd64.deb"), C.Equals, false)
+}
+
+func (*testWrap) TestClassifyIndexError(c *C.C) {
+	var data = []struct {
+		fixture   string
+		errType   system.JobErrorType
+		reason    string
+		permanent bool
+		ok        bool
+	}{
+		{"dns.txt", system.ErrorIndexNetworkFailed, "Temporary failure resolving", false, true},
+		{"tls.txt", system.ErrorIndexNetworkFailed, "Certificate verification failed", false, true},
+		{"tls_handshake.txt", system.ErrorIndexNetworkFailed, "Could not handshake", false, true},
+		{"timeout.txt", system.ErrorIndexNetworkFailed, "Could not connect to", false, true},
+		{"not_found.txt", system.ErrorIndexNotFound, "404  Not Found", true, true},
+		{"no_release.txt", system.ErrorIndexNotFound, "does not have a Release file", true, true},
+		{"expired.txt", system.ErrorReleaseExpired, "is expired", true, true},
+		{"mixed.txt", system.ErrorIndexNotFound, "404  Not Found", true, true},
+		// 5xx不区分原因,按默认的IndexDownloadFailed处理
+		{"server_error.txt", "", "", false, false},
+		{"unknown.txt", "", "", false, false},
+		// 只有apt的TLS错误信息才按网络问题处理
+		{"unknown_tls.txt", "", "", false, false},
+	}
+	for _, d := range data {
+		stderr, err := os.ReadFile(filepath.Join("testdata", "update-source", d.fixture))
+		c.Assert(err, C.IsNil)
+		errType, reason, permanent, ok := classifyIndexError(string(stderr))
+		c.Check(errType, C.Equals, d.errType, C.Commentf("%s", d.fixture))
+		c.Check(strings.Contains(reason, d.reason), C.Equals, true, C.Commentf("%s: %s", d.fixture, reason))
+		c.Check(strings.Contains(reason, "\n"), C.Equals, false, C.Commentf("%s", d.fixture))
+		c.Check(permanent, C.Equals, d.permanent, C.Commentf("%s", d.fixture))
+		c.Check(ok, C.Equals, d.ok, C.Commentf("%s", d.fixture))
+	}
+}
+
+func (*testWrap) TestListSourceFiles(c *C.C) {
+	dir := c.MkDir()
+	for _, name := range []string{"b.list", "a.list", "c.sources.bak"} {
+		c.Assert(os.WriteFile(filepath.Join(dir, name), nil, 0644), C.IsNil)
+	}
+	list := filepath.Join(c.MkDir(), "sources.list")
+	c.Assert(os.WriteFile(list, nil, 0644), C.IsNil)
+	sources := listSourceFiles(map[string]string{
+		"Dir::Etc::SourceList":  list,
+		"Dir::Etc::SourceParts": dir,
+	})
+	c.Check(sources, C.DeepEquals, []string{list, filepath.Join(dir, "a.list"), filepath.Join(dir, "b.list")})
+	c.Check(listSourceFiles(map[string]string{"Dir::Etc::SourceList": "/dev/null", "Dir::Etc::SourceParts": "/dev/null"}), C.HasLen, 0)
+}
+
+func (*testWrap) TestMergeListsDirs(c *C.C) {
+	root := c.MkDir()
+	listsDir := filepath.Join(root, "lists")
+	c.Assert(os.MkdirAll(listsDir, 0755), C.IsNil)
+	for _, name := range []string{"a_InRelease", "b_InRelease", "lock"} {
+		c.Assert(os.WriteFile(filepath.Join(listsDir, name), []byte("old"), 0644), C.IsNil)
+	}
+	update := func(dir, name, content string) {
+		tmp := filepath.Join(dir, "partial", name)
+		c.Assert(os.WriteFile(tmp, []byte(content), 0644), C.IsNil)
+		c.Assert(os.Rename(tmp, filepath.Join(dir, name)), C.IsNil)
+	}
+	dirA := filepath.Join(root, "0")
+	dirB := filepath.Join(root, "1")
+	c.Assert(seedListsDir(listsDir, dirA), C.IsNil)
+	c.Assert(seedListsDir(listsDir, dirB), C.IsNil)
+	update(dirA, "a_InRelease", "a-new")
+	update(dirA, "shared_InRelease", "from-a")
+	update(dirB, "shared_InRelease", "from-b")
+	update(dirB, "b_InRelease", "b-new")
+
+	// 只合并成功的仓库,结果与执行顺序无关
+	c.Assert(mergeListsDirs(listsDir, []string{dirA}, false), C.IsNil)
+	for name, want := range map[string]string{"a_InRelease": "a-new", "b_InRelease": "old", "shared_InRelease": "from-a", "lock": "old"} {
+		content, err := os.ReadFile(filepath.Join(listsDir, name))
+		c.Assert(err, C.IsNil)
+		c.Check(string(content), C.Equals, want, C.Commentf("%s", name))
+	}
+
+	// 全部仓库成功时删除不属于任何仓库的索引,apt清理后各目录只剩自己仓库的索引
+	c.Assert(os.WriteFile(filepath.Join(listsDir, "removed_InRelease"), []byte("old"), 0644), C.IsNil)
+	dirC := filepath.Join(root, "2")
+	dirD := filepath.Join(root, "3")
+	c.Assert(os.MkdirAll(dirC, 0755), C.IsNil)
+	c.Assert(os.MkdirAll(dirD, 0755), C.IsNil)
+	c.Assert(os.Link(filepath.Join(listsDir, "a_InRelease"), filepath.Join(dirC, "a_InRelease")), C.IsNil)
+	c.Assert(os.WriteFile(filepath.Join(dirD, "b_InRelease"), []byte("b-new"), 0644), C.IsNil)
+	c.Assert(mergeListsDirsLocked(listsDir, []string{dirC, dirD}, true), C.IsNil)
+	entries, err := os.ReadDir(listsDir)
+	c.Assert(err, C.IsNil)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	c.Check(names, C.DeepEquals, []string{"a_InRelease", "b_InRelease", "lock"})
+	content, err := os.ReadFile(filepath.Join(listsDir, "b_InRelease"))
+	c.Assert(err, C.IsNil)
+	c.Check(string(content), C.Equals, "b-new")
+
+	summary := summarizeSourceResults([]SourceUpdateResult{
+		classifySourceUpdate("a.list", nil, ""),
+		classifySourceUpdate("b.list", nil, "W: Failed to fetch http://mirror/dists/eagle/InRelease  Temporary failure resolving 'mirror'\n"+
+			"W: Some index files failed to download. They have been ignored, or old ones used instead."),
+		classifySourceUpdate("c.list", errors.New("exit status 100"), "E: The repository 'http://mirror eagle Release' does not have a Release file."),
+	})
+	c.Check(summary.Succeeded, C.DeepEquals, []string{"a.list"})
+	c.Assert(summary.Failed, C.HasLen, 2)
+	c.Check(summary.Failed[0].Source, C.Equals, "b.list")
+	c.Check(summary.Failed[0].ErrType, C.Equals, system.ErrorIndexNetworkFailed)
+	c.Check(summary.Failed[1].ErrType, C.Equals, system.ErrorIndexNotFound)
+	c.Check(summary.Failed[1].Reason, C.Equals, "E: The repository 'http://mirror eagle Release' does not have a Release file.")
+}
+
+func (*testWrap) TestConfPathOverride(c *C.C) {
+	dir := c.MkDir()
+	confPath := filepath.Join(dir, "apt.conf")
+	logPath := filepath.Join(dir, "apt-get.log")
+	// 用记录参数的apt-get替换系统命令
+	script := "#!/bin/sh\necho \"$*\" >> " + logPath + "\nexit 1\n"
+	c.Assert(os.WriteFile(filepath.Join(dir, "apt-get"), []byte(script), 0755), C.IsNil)
+	oldPath := os.Getenv("PATH")
+	c.Assert(os.Setenv("PATH", dir+":"+oldPath), C.IsNil)
+	defer func() {
+		_ = os.Setenv("PATH", oldPath)
+	}()
+
+	_, _ = listInstallPackages(nil, confPath, []string{"pkg"})
+	_, _, _ = genOnlineUpdatePackagesByEmulateInstall(nil, confPath, []string{"pkg"}, nil)
+	_, _ = listDistUpgrade(nil, confPath, dir, nil)
+	content, err := os.ReadFile(logPath)
+	c.Assert(err, C.IsNil)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	c.Check(lines, C.HasLen, 3)
+	for _, line := range lines {
+		c.Check(strings.Contains(line, "-c "+confPath), C.Equals, true, C.Commentf("%s", line))
+	}
+
+	for _, cmdType := range []string{
+		system.InstallJobType,
+		system.PrepareDistUpgradeJobType,
+		system.DistUpgradeJobType,
+		system.RemoveJobType,
+		system.DownloadJobType,
+		system.AutoCleanJobType,
+	} {
+		cmd := createCommandLine(confPath, cmdType, nil)
+		c.Check(strings.Join(cmd.Args, " "), C.Matches, ".* -c "+confPath+" .*", C.Commentf("%s", cmdType))
+	}
+	for _, errType := range []string{string(system.ErrorDpkgInterrupted), string(system.ErrorDependenciesBroken)} {
+		cmd := createCommandLine(confPath, system.FixErrorJobType, []string{errType})
+		c.Check(strings.Join(cmd.Args, " "), C.Matches, ".* -c "+confPath+" .*", C.Commentf("%s", errType))
+	}
+
+	c.Assert(os.Setenv(ConfPathEnv, confPath), C.IsNil)
+	c.Check(DefaultConfPath(), C.Equals, confPath)
+	c.Assert(os.Unsetenv(ConfPathEnv), C.IsNil)
+	c.Check(DefaultConfPath(), C.Equals, system.LastoreAptV2CommonConfPath)
+}
+
+func (*testWrap) TestAptProxyEnviron(c *C.C) {
+	dir := c.MkDir()
+	logPath := filepath.Join(dir, "proxy.log")
+	argsPath := filepath.Join(dir, "args.log")
+	// 用记录代理变量和参数的apt-get和apt-cache替换系统命令
+	binDir := filepath.Join(dir, "bin")
+	c.Assert(os.Mkdir(binDir, 0755), C.IsNil)
+	script := "#!/bin/sh\necho \"$(basename \"$0\") $http_proxy\" >> " + logPath + "\necho \"$*\" >> " + argsPath + "\n"
+	for _, name := range []string{"apt-get", "apt-cache"} {
+		c.Assert(os.WriteFile(filepath.Join(binDir, name), []byte(script), 0755), C.IsNil)
+	}
+	oldPath := os.Getenv("PATH")
+	c.Assert(os.Setenv("PATH", binDir+":"+oldPath), C.IsNil)
+	sourceDir := filepath.Join(dir, "sources")
+	c.Assert(os.Mkdir(sourceDir, 0755), C.IsNil)
+	c.Assert(os.WriteFile(filepath.Join(sourceDir, "a.list"), []byte("deb http://mirror.example.com/deepin beige main\n"), 0644), C.IsNil)
+	oldSource := system.SystemUpdateSource
+	system.SystemUpdateSource = sourceDir
+	defer func() {
+		_ = os.Setenv("PATH", oldPath)
+		system.SystemUpdateSource = oldSource
+	}()
+
+	environ := map[string]string{"http_proxy": "http://127.0.0.1:8080", "DISPLAY": ":0"}
+	confPath := filepath.Join(dir, "apt.conf")
+	versions := map[string]string{"pkg": "1.0"}
+	calls := map[string]func(){
+		"CheckPkgSystemError": func() { _ = CheckPkgSystemError(environ, false) },
+		"simulateCommand":     func() { _ = simulateCommand(environ, []string{"apt-get", "install", "pkg"}).Run() },
+		"ValidateDistUpgrade": func() { _ = ValidateDistUpgrade(environ, confPath, system.SystemUpdate, nil, nil) },
+		"CheckSystemHealth":   func() { _ = CheckSystemHealth(environ, system.QuickCheckSystem, nil) },
+		"listInstallPackages": func() { _, _ = listInstallPackages(environ, confPath, []string{"pkg"}) },
+		"CheckVersionsInstallable": func() {
+			_ = CheckVersionsInstallable(environ, confPath, versions, nil)
+		},
+		"genOnlineUpdatePackagesByEmulateInstall": func() {
+			_, _, _ = genOnlineUpdatePackagesByEmulateInstall(environ, confPath, []string{"pkg"}, nil)
+		},
+		"listDistUpgrade":     func() { _, _ = listDistUpgrade(environ, confPath, sourceDir, nil) },
+		"QueryPackageOrigins": func() { _, _ = QueryPackageOrigins(environ, confPath, sourceDir, []string{"pkg"}) },
+		"CheckReinstallable":  func() { _ = CheckReinstallable(environ, confPath, versions, nil) },
+		"ListUnresolvableVersions": func() {
+			_, _ = ListUnresolvableVersions(environ, confPath, versions, nil)
+		},
+		"QueryChangelog": func() { _, _ = QueryChangelog(context.Background(), environ, confPath, "pkg") },
+		"DownloadPackages": func() {
+			path, _ := DownloadPackages([]string{"pkg"}, environ, confPath, nil)
+			if path != "" {
+				_ = os.RemoveAll(path)
+			}
+		},
+		"updateOneSource": func() {
+			_ = updateOneSource(filepath.Join(sourceDir, "a.list"), sourceDir, filepath.Join(dir, "work"), nil, environ, nil)
+		},
+	}
+	// 这些查询使用调用者传入的apt配置文件,而不是环境变量中的默认配置
+	withConfPath := make(map[string]bool)
+	for _, name := range []string{"ValidateDistUpgrade", "listInstallPackages", "CheckVersionsInstallable",
+		"genOnlineUpdatePackagesByEmulateInstall", "listDistUpgrade", "QueryPackageOrigins", "CheckReinstallable",
+		"ListUnresolvableVersions", "QueryChangelog", "DownloadPackages"} {
+		withConfPath[name] = true
+	}
+	for name, call := range calls {
+		_ = os.Remove(logPath)
+		_ = os.Remove(argsPath)
+		call()
+		content, err := os.ReadFile(logPath)
+		c.Assert(err, C.IsNil, C.Commentf("%s does not run apt", name))
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			c.Check(strings.HasSuffix(line, " http://127.0.0.1:8080"), C.Equals, true, C.Commentf("%s: %s", name, line))
+		}
+		if withConfPath[name] {
+			args, err := os.ReadFile(argsPath)
+			c.Assert(err, C.IsNil)
+			c.Check(strings.Contains(string(args), "-c "+confPath), C.Equals, true, C.Commentf("%s: %s", name, args))
+		}
+	}
+}
+
+func (*testWrap) TestPhasedDeferred(c *C.C) {
+	out := []byte(`Reading package lists...
+Calculating upgrade...
+The following upgrades have been deferred due to phasing:
+  libssl3 openssl
+The following packages will be upgraded:
+  dde-dock libssl3:amd64
+2 upgraded, 0 newly installed, 0 to remove and 1 not upgraded.
+`)
+	deferred := parsePhasedDeferred(out)
+	c.Check(deferred, C.HasLen, 2)
+	c.Check(filterPhasedDeferred([]string{"dde-dock", "libssl3"}, deferred), C.DeepEquals, []string{"dde-dock"})
+	c.Check(filterPhasedDeferred([]string{"dde-dock"}, parsePhasedDeferred(nil)), C.DeepEquals, []string{"dde-dock"})
+
+	c.Check(PhasedUpdateOption(true), C.DeepEquals, map[string]string{
+		"APT::Get::Always-Include-Phased-Updates": "true",
+	})
+	c.Check(PhasedUpdateOption(false)["APT::Get::Phase-Updates"], C.Equals, "true")
+}
+
+func (*testWrap) TestParseDistUpgradeOutput(c *C.C) {
+	out := []byte(`Reading package lists...
+Building dependency tree...
+Calculating upgrade...
+The following packages were automatically installed and are no longer required:
+  libfoo1
+Use 'sudo apt autoremove' to remove it.
+The following packages will be REMOVED:
+  deepin-old-tool* libbar2:amd64
+The following NEW packages will be installed:
+  libbar3
+The following packages will be upgraded:
+  dde-dock libssl3:amd64
+2 upgraded, 1 newly installed, 2 to remove and 0 not upgraded.
+After this operation, 1,024 kB disk space will be freed.
+Do you want to continue? [Y/n] Abort.
+`)
+	result, ok := parseDistUpgradeOutput(out)
+	c.Assert(ok, C.Equals, true)
+	c.Check(result.Packages, C.DeepEquals, []string{"dde-dock", "libssl3", "libbar3"})
+	c.Check(result.Removed, C.DeepEquals, []string{"deepin-old-tool", "libbar2"})
+	c.Check(result.SpaceKnown, C.Equals, true)
+	c.Check(result.SpaceDelta, C.Equals, int64(-1024000))
+
+	// 只有卸载时也是有效的结果
+	result, ok = parseDistUpgradeOutput([]byte(`The following packages will be REMOVED:
+  libbar2
+0 upgraded, 0 newly installed, 1 to remove and 0 not upgraded.
+`))
+	c.Assert(ok, C.Equals, true)
+	c.Check(result.Packages, C.HasLen, 0)
+	c.Check(result.Removed, C.DeepEquals, []string{"libbar2"})
+
+	_, ok = parseDistUpgradeOutput([]byte("0 upgraded, 0 newly installed, 0 to remove and 0 not upgraded.\n"))
+	c.Check(ok, C.Equals, false)
+}
+
+func (*testWrap) TestPackageOrigins(c *C.C) {
+	out := []byte(`dde-dock:
+  Installed: 5.5.0
+  Candidate: 5.6.0
+  Version table:
+     5.6.0 500
+        500 https://community-packages.deepin.com/beige beige/main amd64 Packages
+        500 file:/media/repo ./ Packages
+ *** 5.5.0 100
+        100 /var/lib/dpkg/status
+openssl:
+  Installed: 1.1.1n-9
+  Candidate: 1.1.1n-10
+  Version table:
+     1.1.1n-10 500
+        500 https://pro-packages.uniontech.com eagle/1070/main amd64 Packages
+ *** 1.1.1n-9 100
+        500 https://community-packages.deepin.com/beige beige/main amd64 Packages
+        100 /var/lib/dpkg/status
+missing:
+  Installed: (none)
+  Candidate: (none)
+  Version table:
+`)
+	origins := parsePolicyCandidateOrigins(out)
+	c.Check(origins["dde-dock"], C.HasLen, 2)
+	c.Check(origins["openssl"], C.DeepEquals, []policyOrigin{{URI: "https://pro-packages.uniontech.com", Dist: "eagle/1070/main"}})
+	c.Check(origins["missing"], C.HasLen, 0)
+
+	result := matchOriginFiles(origins, map[string][]system.SourceEntry{
+		"/etc/apt/sources.list.d/community.list": {{URI: "https://community-packages.deepin.com/beige/", Suite: "beige"}},
+		"/etc/apt/sources.list.d/local.list":     {{URI: "file:///media/repo", Suite: "./"}},
+		"/etc/apt/sources.list.d/pro.list":       {{URI: "https://pro-packages.uniontech.com/", Suite: "eagle/1070"}},
+		"/etc/apt/sources.list.d/other.list":     {{URI: "https://pro-packages.uniontech.com/", Suite: "eagle-security"}},
+	})
+	c.Check(result["dde-dock"], C.DeepEquals, []string{"/etc/apt/sources.list.d/community.list", "/etc/apt/sources.list.d/local.list"})
+	c.Check(result["openssl"], C.DeepEquals, []string{"/etc/apt/sources.list.d/pro.list"})
+}
+
+func (*testWrap) TestParseChangelog(c *C.C) {
+	out := []byte(`dde-dock (5.6.2) unstable; urgency=medium
+
+  * fix: tray icon flicker
+  * feat: support plugin order
+
+ -- Deepin Packages Builder <packages@deepin.com>  Tue, 02 May 2023 10:00:00 +0800
+
+dde-dock (5.6.1) unstable; urgency=medium
+
+  * fix: crash on startup
+
+ -- Deepin Packages Builder <packages@deepin.com>  Mon, 01 May 2023 10:00:00 +0800
+
+dde-dock (5.6.0) unstable; urgency=medium
+
+  * release 5.6.0
+
+ -- Deepin Packages Builder <packages@deepin.com>  Sun, 30 Apr 2023 10:00:00 +0800
+`)
+	entries := parseChangelog(out, "5.6.0")
+	c.Assert(entries, C.HasLen, 2)
+	c.Check(entries[0], C.DeepEquals, ChangelogEntry{
+		Version:      "5.6.2",
+		Distribution: "unstable",
+		Changes:      "* fix: tray icon flicker\n* feat: support plugin order",
+		Maintainer:   "Deepin Packages Builder <packages@deepin.com>",
+		Date:         "Tue, 02 May 2023 10:00:00 +0800",
+	})
+	c.Check(entries[1].Version, C.Equals, "5.6.1")
+
+	c.Check(parseChangelog(out, ""), C.HasLen, 3)
+	c.Check(parseChangelog(out, "5.6.2"), C.HasLen, 0)
+	c.Check(parseChangelog(nil, "5.6.0"), C.HasLen, 0)
+}
+
+func (*testWrap) TestCheckSimulateResult(c *C.C) {
+	out := []byte("Remv dde [5.6.3]\nInst libfoo1 (1.2-1 stable [amd64])")
+	jobErr := checkSimulateResult(nil, out, nil, nil)
+	c.Assert(jobErr, C.NotNil)
+	c.Check(jobErr.ErrType, C.Equals, system.ErrorDangerousRemoval)
+	c.Check(jobErr.Packages, C.DeepEquals, []string{"dde"})
+
+	c.Check(checkSimulateResult(nil, out, nil, []string{"dde"}), C.IsNil)
+	c.Check(checkSimulateResult(nil, []byte("Inst libfoo1 (1.2-1 stable [amd64])"), nil, nil), C.IsNil)
+
+	jobErr = checkSimulateResult(errors.New("exit status 100"), nil, []byte("E: Unable to correct problems, you have held broken packages."), nil)
+	c.Assert(jobErr, C.NotNil)
+	c.Check(jobErr.ErrType, C.Not(C.Equals), system.ErrorDangerousRemoval)
+}
+
+func (*testWrap) TestCheckDryRunResult(c *C.C) {
+	out := []byte(`Reading package lists...
+The following packages will be REMOVED:
+  dde* libbar1
+The following packages will be upgraded:
+  libfoo1
+1 upgraded, 0 newly installed, 2 to remove and 0 not upgraded.
+Need to get 1,024 B of archives.
+After this operation, 12.3 MB disk space will be freed.
+Do you want to continue? [Y/n] N
+Abort.
+`)
+	blockers := checkDryRunResult(DefaultConfPath(), errors.New("exit status 1"), out, nil)
+	c.Assert(blockers, C.HasLen, 1)
+	c.Check(blockers[0].ErrType, C.Equals, system.ErrorDangerousRemoval)
+	c.Check(blockers[0].Packages, C.DeepEquals, []string{"dde"})
+
+	c.Check(checkDryRunResult(DefaultConfPath(), nil, []byte("0 upgraded, 0 newly installed, 0 to remove and 0 not upgraded.\n"), nil), C.HasLen, 0)
+
+	blockers = checkDryRunResult(DefaultConfPath(), errors.New("exit status 100"), nil, []byte("E: Unable to correct problems, you have held broken packages."))
+	c.Assert(blockers, C.HasLen, 1)
+	c.Check(blockers[0].ErrType, C.Not(C.Equals), system.ErrorDangerousRemoval)
+}
+
+func (*testWrap) TestOptionToArgs(c *C.C) {
+	args, err := OptionToArgs(map[string]string{
+		"Dir::Etc::SourceParts":   "/dev/null",
+		"APT::Machine-ID":         "0123456789abcdef",
+		"DPkg::Options::":         "--script-ignore-error",
+		"Acquire::http::Dl-Limit": "1024",
+	})
+	c.Assert(err, C.IsNil)
+	c.Check(args, C.DeepEquals, []string{
+		"-o", "APT::Machine-ID=0123456789abcdef",
+		"-o", "Acquire::http::Dl-Limit=1024",
+		"-o", "DPkg::Options::=--script-ignore-error",
+		"-o", "Dir::Etc::SourceParts=/dev/null",
+	})
+
+	args, err = OptionToArgs(nil)
+	c.Check(err, C.IsNil)
+	c.Check(args, C.HasLen, 0)
+
+	for _, option := range []map[string]string{
+		{"": "1"},
+		{"Dir::Etc;rm": "1"},
+		{"-c": "/tmp/apt.conf"},
+		{"Dir::Etc::SourceList": "/dev/null; rm -rf /"},
+		{"Dir::Etc::SourceList": "$(id)"},
+		{"Dir::Etc::SourceList": "a\nb"},
+	} {
+		_, err := OptionToArgs(option)
+		c.Check(err, C.NotNil, C.Commentf("%v", option))
+	}
+}
+
+func (*testWrap) TestFindUnavailableFileSource(c *C.C) {
+	dir := c.MkDir()
+	unzipDirs := system.OfflineUnzipDirs
+	system.OfflineUnzipDirs = []string{dir}
+	defer func() {
+		system.OfflineUnzipDirs = unzipDirs
+	}()
+	repo := filepath.Join(dir, "repo")
+	c.Assert(os.MkdirAll(filepath.Join(repo, "dists", "eagle"), 0755), C.IsNil)
+
+	c.Check(fileSourceRoot(repo+"/dists/eagle/Release"), C.Equals, repo)
+	c.Check(fileSourceRoot(system.OfflineMountFsDir+"/abc/layer.1/dists/eagle/Release"), C.Equals,
+		system.OfflineMountFsDir+"/abc/layer.1")
+	c.Check(fileSourceRoot(system.OfflineMountFsDir+"/abc/dists/eagle/Release"), C.Equals,
+		system.OfflineMountFsDir+"/abc")
+
+	_, ok := findUnavailableFileSource("E: Failed to fetch file:" + repo + "/dists/eagle/InRelease  File not found")
+	c.Check(ok, C.Equals, false)
+
+	missing := filepath.Join(dir, "missing")
+	root, ok := findUnavailableFileSource("E: Failed to fetch file:" + missing + "/dists/eagle/InRelease  File not found")
+	c.Check(ok, C.Equals, true)
+	c.Check(root, C.Equals, missing)
+
+	root, ok = findUnavailableFileSource("E: The repository 'file:" + system.OfflineMountFsDir + "/0000/merged eagle Release' does not have a Release file.")
+	c.Check(ok, C.Equals, true)
+	c.Check(root, C.Equals, system.OfflineMountFsDir+"/0000/merged")
+
+	_, ok = findUnavailableFileSource("E: Failed to fetch http://packages.deepin.com/dists/eagle/InRelease")
+	c.Check(ok, C.Equals, false)
+	// 不在离线更新包目录中的file:仓库不处理
+	_, ok = findUnavailableFileSource("E: Failed to fetch file:" + c.MkDir() + "/missing/dists/eagle/InRelease  File not found")
+	c.Check(ok, C.Equals, false)
+
+	jobErr := parseJobError("E: Failed to fetch file:"+missing+"/dists/eagle/InRelease", "")
+	c.Check(jobErr.ErrType, C.Equals, system.ErrorOfflineRepoUnavailable)
+}
+
+func (*testWrap) TestDownloadConcurrencyOption(c *C.C) {
+	option, err := DownloadConcurrencyOption("", -1, nil)
+	c.Assert(err, C.IsNil)
+	c.Check(option, C.HasLen, 0)
+
+	option, err = DownloadConcurrencyOption("host", 0, []string{"mirrors.example.com = 5"})
+	c.Assert(err, C.IsNil)
+	c.Check(option, C.DeepEquals, map[string]string{
+		"Acquire::Queue-Mode":                                "host",
+		"Acquire::http::Pipeline-Depth":                      "0",
+		"Acquire::http::mirrors.example.com::Pipeline-Depth": "5",
+	})
+	_, err = OptionToArgs(option)
+	c.Check(err, C.IsNil)
+
+	for _, item := range []struct {
+		mode     string
+		depth    int
+		override []string
+	}{
+		{"parallel", -1, nil},
+		{"", MaxPipelineDepth + 1, nil},
+		{"", -1, []string{"mirrors.example.com"}},
+		{"", -1, []string{"mirrors.example.com=-1"}},
+		{"", -1, []string{"mirrors::example=1"}},
+		{"", -1, []string{"=1"}},
+	} {
+		_, err := DownloadConcurrencyOption(item.mode, item.depth, item.override)
+		c.Check(err, C.NotNil, C.Commentf("%v", item))
+	}
+}
+
+func (*testWrap) TestParseVersionNotFound(c *C.C) {
+	stderr := []byte("E: Version '1.0-1' for 'foo' was not found\nE: Version '2:3.4' for 'bar' was not found\n")
+	c.Check(parseVersionNotFound(stderr), C.DeepEquals, []string{"foo=1.0-1", "bar=2:3.4"})
+	c.Check(parseVersionNotFound([]byte("E: Unable to locate package foo\n")), C.IsNil)
+
+	c.Check(CheckVersionsInstallable(nil, DefaultConfPath(), nil, nil), C.NotNil)
+	c.Check(CheckVersionsInstallable(nil, DefaultConfPath(), map[string]string{"foo": "not a version"}, nil), C.NotNil)
+}
+
+func (*testWrap) TestParseDpkgFailedPackages(c *C.C) {
+	out := `Setting up foo (1.0-1) ...
+dpkg: error processing package foo (--configure):
+ installed foo package post-installation script subprocess returned error exit status 1
+dpkg: error processing archive /var/cache/apt/archives/bar_2.0_amd64.deb (--unpack):
+ trying to overwrite '/usr/bin/baz', which is also in package baz 1.0
+Errors were encountered while processing:
+ foo
+ /var/cache/apt/archives/bar_2.0_amd64.deb
+ qux
+E: Sub-process /usr/bin/dpkg returned an error code (1)
+`
+	c.Check(parseDpkgFailedPackages(out), C.DeepEquals, []string{"foo", "bar", "qux"})
+	c.Check(parseDpkgFailedPackages("E: Sub-process /usr/bin/dpkg returned an error code (1)"), C.IsNil)
+
+	jobErr := parseJobError("E: Sub-process /usr/bin/dpkg returned an error code (1)\n", out)
+	c.Check(jobErr.ErrType, C.Equals, system.ErrorDpkgError)
+	c.Check(jobErr.Packages, C.DeepEquals, []string{"foo", "bar", "qux"})
+}
+
+func (*testWrap) TestValidateLocalDeb(c *C.C) {
+	dir := c.MkDir()
+	fake := filepath.Join(dir, "fake.deb")
+	c.Assert(os.WriteFile(fake, []byte("not a deb"), 0644), C.IsNil)
+
+	for _, path := range []string{"fake.deb", filepath.Join(dir, "fake.txt"), filepath.Join(dir, "missing.deb"), dir + "/.deb", fake} {
+		_, _, err := ValidateLocalDeb(path)
+		c.Check(err, C.NotNil, C.Commentf("%v", path))
+	}
+}
+
+func (*testWrap) TestParseUnauthenticatedPackages(c *C.C) {
+	stdout := `Reading package lists...
+Building dependency tree...
+The following packages will be upgraded:
+  foo libbar1
+2 upgraded, 0 newly installed, 0 to remove and 0 not upgraded.
+Need to get 1,024 kB of archives.
+WARNING: The following packages cannot be authenticated!
+  foo libbar1
+`
+	stderr := "E: There were unauthenticated packages and -y was used without --allow-unauthenticated\n"
+	c.Check(parseUnauthenticatedPackages(stdout), C.DeepEquals, []string{"foo", "libbar1"})
+	c.Check(parseUnauthenticatedPackages("E: Unable to locate package foo\n"), C.IsNil)
+
+	jobErr := parseJobError(stderr, stdout)
+	c.Check(jobErr.ErrType, C.Equals, system.ErrorUnauthenticatedPackages)
+	c.Check(jobErr.Packages, C.DeepEquals, []string{"foo", "libbar1"})
+
+	err := parsePkgSystemError([]byte(stdout), []byte("E: Some packages could not be authenticated\n"))
+	var pkgErr *system.JobError
+	c.Assert(errors.As(err, &pkgErr), C.Equals, true)
+	c.Check(pkgErr.ErrType, C.Equals, system.ErrorUnauthenticatedPackages)
+	c.Check(pkgErr.Packages, C.DeepEquals, []string{"foo", "libbar1"})
+
+	c.Check(UnauthenticatedOption(false), C.IsNil)
+	c.Check(UnauthenticatedOption(true), C.DeepEquals, map[string]string{"APT::Get::AllowUnauthenticated": "true"})
+}
+
+func (*testWrap) TestDebDelta(c *C.C) {
+	args := map[string]string{"Debug::NoLocking": "1", system.DebDeltaKey: "true"}
+	options, _ := takeDebDeltaOption(args)
+	c.Check(options, C.DeepEquals, map[string]string{"Debug::NoLocking": "1"})
+	// 原参数不能被修改,重试时仍需要使用增量包
+	c.Check(args[system.DebDeltaKey], C.Equals, "true")
+	options, enabled := takeDebDeltaOption(map[string]string{"Debug::NoLocking": "1"})
+	c.Check(enabled, C.Equals, false)
+	c.Check(options, C.DeepEquals, map[string]string{"Debug::NoLocking": "1"})
+
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "old_1.0_amd64.deb"), make([]byte, 10), 0644), C.IsNil)
+	before := archiveDebSizes(dir)
+	c.Assert(os.WriteFile(filepath.Join(dir, "new_2.0_amd64.deb"), make([]byte, 100), 0644), C.IsNil)
+	c.Assert(os.WriteFile(filepath.Join(dir, "lock"), nil, 0644), C.IsNil)
+	c.Assert(os.Mkdir(filepath.Join(dir, "partial"), 0755), C.IsNil)
+	c.Check(debDeltaSavedBytes(before, archiveDebSizes(dir)), C.Equals, int64(100))
+
+	addDebDeltaSaved("job1", 100)
+	addDebDeltaSaved("job1", 20)
+	c.Check(TakeDebDeltaSaved("job1"), C.Equals, int64(120))
+	c.Check(TakeDebDeltaSaved("job1"), C.Equals, int64(0))
+}
+
+func (*testWrap) TestValidateExtraOption(c *C.C) {
+	c.Check(ValidateExtraOption("Acquire::http::Proxy", "http://proxy:3128"), C.IsNil)
+	c.Check(ValidateExtraOption("Acquire::Retries", "3"), C.IsNil)
+	c.Check(ValidateExtraOption("acquire::http::mirrors.example.com::Pipeline-Depth", "0"), C.IsNil)
+	c.Check(ValidateExtraOption("Dir::Etc::SourceList", "/tmp/sources.list"), C.NotNil)
+	c.Check(ValidateExtraOption("APT::Get::AllowUnauthenticated", "true"), C.NotNil)
+	c.Check(ValidateExtraOption("Acquire::AllowInsecureRepositories", "true"), C.NotNil)
+	c.Check(ValidateExtraOption("Acquire::https::mirrors.example.com::Verify-Peer", "false"), C.NotNil)
+	c.Check(ValidateExtraOption("ACQUIRE::CHECK-VALID-UNTIL", "false"), C.NotNil)
+	c.Check(ValidateExtraOption("Acquire::http::Proxy", "http://proxy;reboot"), C.NotNil)
+}
+
+func (*testWrap) TestCheckVersionsDownloadable(c *C.C) {
+	out := []byte(`dde-dock:
+  Installed: 5.5.0
+  Candidate: 5.6.0
+  Version table:
+     5.6.0 500
+        500 https://community-packages.deepin.com/beige beige/main amd64 Packages
+ *** 5.5.0 100
+        100 /var/lib/dpkg/status
+openssl:
+  Installed: 1.1.1n-9
+  Candidate: 1.1.1n-9
+  Version table:
+ *** 1.1.1n-9 500
+        500 https://community-packages.deepin.com/beige beige/main amd64 Packages
+        100 /var/lib/dpkg/status
+`)
+	versions := parsePolicyVersionOrigins(out)
+	c.Check(versions["dde-dock"], C.DeepEquals, map[string][]string{
+		"5.6.0": {"https://community-packages.deepin.com/beige"},
+		"5.5.0": nil,
+	})
+	c.Check(versions["openssl"]["1.1.1n-9"], C.DeepEquals, []string{"https://community-packages.deepin.com/beige"})
+
+	c.Check(checkVersionsDownloadable(map[string]string{"openssl": "1.1.1n-9"}, versions), C.IsNil)
+	err := checkVersionsDownloadable(map[string]string{"openssl": "1.1.1n-9", "dde-dock": "5.5.0", "missing": "1.0"}, versions)
+	var jobErr *system.JobError
+	c.Assert(errors.As(err, &jobErr), C.Equals, true)
+	c.Check(jobErr.ErrType, C.Equals, system.ErrorVersionNotFound)
+	c.Check(jobErr.Packages, C.DeepEquals, []string{"dde-dock=5.5.0", "missing=1.0"})
+}
+
+func (*testWrap) TestUnresolvableVersions(c *C.C) {
+	out := []byte(`dde-dock:
+  Installed: 5.5.0
+  Candidate: 5.6.0
+  Version table:
+     5.6.0 500
+        500 https://community-packages.deepin.com/beige beige/main amd64 Packages
+ *** 5.5.0 100
+        100 /var/lib/dpkg/status
+`)
+	versions := parsePolicyVersionOrigins(out)
+	c.Check(unresolvableVersions(map[string]string{"dde-dock": "5.6.0"}, versions), C.IsNil)
+	// 只在本地状态中的版本也可以解析
+	c.Check(unresolvableVersions(map[string]string{"dde-dock": "5.5.0"}, versions), C.IsNil)
+	c.Check(unresolvableVersions(map[string]string{"dde-dock": "5.7.0", "missing": "1.0"}, versions),
+		C.DeepEquals, []string{"dde-dock=5.7.0", "missing=1.0"})
+}
@@ -7,10 +7,14 @@ package apt
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
 
@@ -40,7 +44,7 @@ func (p *APTSystem) FindCMD(id string) *system.Command {
 	return p.CmdSet[id]
 }
 
-func createCommandLine(cmdType string, cmdArgs []string) *exec.Cmd {
+func createCommandLine(confPath string, cmdType string, cmdArgs []string) *exec.Cmd {
 	var args = []string{"-y"}
 
 	options := map[string]string{
@@ -57,33 +61,37 @@ func createCommandLine(cmdType string, cmdArgs []string) *exec.Cmd {
 	}
 	switch cmdType {
 	case system.InstallJobType:
-		args = append(args, "-c", system.LastoreAptV2CommonConfPath)
+		args = append(args, "-c", confPath)
 		args = append(args, "install")
 		args = append(args, cmdArgs...)
 	case system.PrepareDistUpgradeJobType:
-		args = append(args, "-c", system.LastoreAptV2CommonConfPath)
+		args = append(args, "-c", confPath)
 		args = append(args, "dist-upgrade", "-d", "--allow-change-held-packages")
 		args = append(args, cmdArgs...)
 	case system.DistUpgradeJobType:
-		args = append(args, "-c", system.LastoreAptV2CommonConfPath)
+		args = append(args, "-c", confPath)
 		args = append(args, "--allow-downgrades", "--allow-change-held-packages")
 		args = append(args, "dist-upgrade")
 		args = append(args, cmdArgs...)
 	case system.RemoveJobType:
-		args = append(args, "-c", system.LastoreAptV2CommonConfPath)
+		args = append(args, "-c", confPath)
 		args = append(args, "autoremove", "--allow-change-held-packages")
 		args = append(args, cmdArgs...)
 	case system.DownloadJobType:
-		args = append(args, "-c", system.LastoreAptV2CommonConfPath)
+		args = append(args, "-c", confPath)
 		args = append(args, "install", "-d", "--allow-change-held-packages")
 		args = append(args, cmdArgs...)
 	case system.UpdateSourceJobType:
 		args = append(args, cmdArgs...)
 		argString := strings.Join(args, " ")
 		sh := fmt.Sprintf("apt-get %s -o APT::Status-Fd=3 update --fix-missing && /var/lib/lastore/scripts/build_system_info -now", argString)
-		return exec.Command("/bin/sh", "-c", sh)
+		return system.AptCommand(nil, "/bin/sh", "-c", sh)
 	case system.CleanJobType:
-		return exec.Command("/usr/bin/lastore-apt-clean")
+		return system.AptCommand(nil, "/usr/bin/lastore-apt-clean")
+	case system.AutoCleanJobType:
+		args = append(args, "-c", confPath)
+		args = append(args, "autoclean")
+		args = append(args, cmdArgs...)
 
 	case system.FixErrorJobType:
 		var errType system.JobErrorType
@@ -100,10 +108,10 @@ func createCommandLine(cmdType string, cmdArgs []string) *exec.Cmd {
 		switch errType {
 		case system.ErrorDpkgInterrupted:
 			sh := "dpkg --force-confold --configure -a;" +
-				fmt.Sprintf("apt-get -y -c %s -f install %s;", system.LastoreAptV2CommonConfPath, aptOptionString)
-			return exec.Command("/bin/sh", "-c", sh) // #nosec G204
+				fmt.Sprintf("apt-get -y -c %s -f install %s;", confPath, aptOptionString)
+			return system.AptCommand(nil, "/bin/sh", "-c", sh) // #nosec G204
 		case system.ErrorDependenciesBroken:
-			args = append(args, "-c", system.LastoreAptV2CommonConfPath)
+			args = append(args, "-c", confPath)
 			args = append(args, "-f", "install")
 			args = append(args, aptOption...)
 		default:
@@ -111,31 +119,173 @@ func createCommandLine(cmdType string, cmdArgs []string) *exec.Cmd {
 		}
 	}
 
-	return exec.Command("apt-get", args...)
+	// 任务的环境变量和代理由Command.SetEnv设置
+	return system.AptCommand(nil, "apt-get", args...)
+}
+
+// DownloadJobMaxRuntime 和 UpgradeJobMaxRuntime 为下载和安装任务没有进度更新的最长时间,超时后任务失败,0表示不限制
+var (
+	DownloadJobMaxRuntime = 30 * time.Minute
+	UpgradeJobMaxRuntime  = 2 * time.Hour
+)
+
+func jobMaxRuntime(cmdType string) time.Duration {
+	switch cmdType {
+	case system.DownloadJobType, system.PrepareDistUpgradeJobType, system.UpdateSourceJobType:
+		return DownloadJobMaxRuntime
+	case system.InstallJobType, system.DistUpgradeJobType, system.RemoveJobType, system.FixErrorJobType:
+		return UpgradeJobMaxRuntime
+	}
+	return 0
 }
 
-func newAPTCommand(cmdSet system.CommandSet, jobId string, cmdType string, fn system.Indicator, cmdArgs []string) *system.Command {
-	cmd := createCommandLine(cmdType, cmdArgs)
+func newAPTCommand(cmdSet system.CommandSet, confPath string, jobId string, cmdType string, fn system.Indicator, cmdArgs []string) *system.Command {
+	cmd := createCommandLine(confPath, cmdType, cmdArgs)
 
 	// See aptCommand.Abort
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	items := newDownloadItemTracker()
 	r := &system.Command{
 		JobId:             jobId,
 		CmdSet:            cmdSet,
 		Indicator:         fn,
 		ParseJobError:     parseJobError,
-		ParseProgressInfo: parseProgressInfo,
+		ParseProgressInfo: items.parseProgressInfo,
 		Cmd:               cmd,
 		Cancelable:        true,
 	}
-	cmd.Stdout = &r.Stdout
+	switch cmdType {
+	case system.InstallJobType, system.DistUpgradeJobType, system.DownloadJobType, system.PrepareDistUpgradeJobType:
+		// 从光盘或U盘仓库获取包时apt会请求更换介质
+		r.AcceptMediaChange = true
+	}
+	r.MaxRuntime = jobMaxRuntime(cmdType)
+	cmd.Stdout = io.MultiWriter(&r.Stdout, items)
 	cmd.Stderr = &r.Stderr
 
 	cmdSet.AddCMD(r)
 	return r
 }
 
+var _fileSourceRegexp = regexp.MustCompile(`file:(/[^\s'"]+)`)
+
+// fileSourceRoot 返回apt输出中file:地址对应的仓库目录,离线更新包为挂载目录
+func fileSourceRoot(path string) string {
+	path = filepath.Clean("/" + strings.TrimLeft(path, "/"))
+	if rel, err := filepath.Rel(system.OfflineMountFsDir, path); err == nil && !strings.HasPrefix(rel, "..") && rel != "." {
+		// 挂载目录为 mountfs/<hash>、mountfs/<hash>/layer.N 或 mountfs/<hash>/merged
+		parts := strings.Split(rel, string(filepath.Separator))
+		root := filepath.Join(system.OfflineMountFsDir, parts[0])
+		if len(parts) > 1 && (parts[1] == "merged" || strings.HasPrefix(parts[1], "layer.")) {
+			root = filepath.Join(root, parts[1])
+		}
+		return root
+	}
+	if idx := strings.Index(path, "/dists/"); idx > 0 {
+		return path[:idx]
+	}
+	return path
+}
+
+// isOfflineRepoPath path是否在离线更新包的挂载或解压目录中
+func isOfflineRepoPath(path string) bool {
+	for _, dir := range append([]string{system.OfflineMountFsDir}, system.OfflineUnzipDirs...) {
+		if strings.HasPrefix(path, filepath.Clean(dir)+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// findUnavailableFileSource 从apt的错误输出中找出无法访问的离线更新包file:仓库,挂载目录已被卸载或解压的仓库目录不存在,
+// 其他file:仓库的错误不处理
+func findUnavailableFileSource(stdErrStr string) (string, bool) {
+	for _, match := range _fileSourceRegexp.FindAllStringSubmatch(stdErrStr, -1) {
+		root := fileSourceRoot(match[1])
+		if !isOfflineRepoPath(root) {
+			continue
+		}
+		if strings.HasPrefix(root, system.OfflineMountFsDir+"/") {
+			if !system.IsMountPoint(root) {
+				return root, true
+			}
+			continue
+		}
+		if _, err := os.Stat(root); os.IsNotExist(err) {
+			return root, true
+		}
+	}
+	return "", false
+}
+
+func offlineRepoUnavailableError(stdErrStr string) *system.JobError {
+	root, ok := findUnavailableFileSource(stdErrStr)
+	if !ok {
+		return nil
+	}
+	return &system.JobError{
+		ErrType:   system.ErrorOfflineRepoUnavailable,
+		ErrDetail: fmt.Sprintf("offline repository %s is unavailable\n%s", root, stdErrStr),
+	}
+}
+
+var _dpkgErrorProcessingRegexp = regexp.MustCompile(`dpkg: error processing (?:package|archive) (\S+)`)
+
+// parseDpkgFailedPackages 返回dpkg输出中处理失败的包,顺序为出错的顺序
+func parseDpkgFailedPackages(out string) []string {
+	var pkgs []string
+	seen := make(map[string]bool)
+	add := func(pkg string) {
+		// 归档文件路径只保留包名
+		pkg = strings.SplitN(filepath.Base(pkg), "_", 2)[0]
+		if pkg != "" && !seen[pkg] {
+			seen[pkg] = true
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	for _, match := range _dpkgErrorProcessingRegexp.FindAllStringSubmatch(out, -1) {
+		add(match[1])
+	}
+	const processing = "Errors were encountered while processing:\n"
+	if idx := strings.Index(out, processing); idx >= 0 {
+		for _, line := range strings.Split(out[idx+len(processing):], "\n") {
+			if !strings.HasPrefix(line, " ") || strings.TrimSpace(line) == "" {
+				break
+			}
+			add(strings.TrimSpace(line))
+		}
+	}
+	return pkgs
+}
+
+const unauthenticatedWarning = "WARNING: The following packages cannot be authenticated!"
+
+// parseUnauthenticatedPackages 返回apt输出中无法验证签名的包,包名在警告后缩进的行中
+func parseUnauthenticatedPackages(out string) []string {
+	idx := strings.Index(out, unauthenticatedWarning)
+	if idx < 0 {
+		return nil
+	}
+	var pkgs []string
+	for _, line := range strings.Split(out[idx+len(unauthenticatedWarning):], "\n")[1:] {
+		if !strings.HasPrefix(line, " ") || strings.TrimSpace(line) == "" {
+			break
+		}
+		pkgs = append(pkgs, strings.Fields(line)...)
+	}
+	return pkgs
+}
+
+// isUnauthenticatedError 非交互执行时apt拒绝安装无法验证签名的包
+func isUnauthenticatedError(stdErrStr string) bool {
+	return strings.Contains(stdErrStr, "There were unauthenticated packages") ||
+		strings.Contains(stdErrStr, "Some packages could not be authenticated")
+}
+
 func parseJobError(stdErrStr string, stdOutStr string) *system.JobError {
+	if jobErr := offlineRepoUnavailableError(stdErrStr); jobErr != nil {
+		return jobErr
+	}
 	switch {
 	case strings.Contains(stdErrStr, "Failed to fetch"):
 		if strings.Contains(stdErrStr, "rename failed, Operation not permitted") {
@@ -169,6 +319,7 @@ func parseJobError(stdErrStr string, stdOutStr string) *system.JobError {
 		return &system.JobError{
 			ErrType:   system.ErrorDpkgError,
 			ErrDetail: detail,
+			Packages:  parseDpkgFailedPackages(stdOutStr + "\n" + stdErrStr),
 		}
 
 	case strings.Contains(stdErrStr, "Unable to locate package"):
@@ -205,10 +356,11 @@ func parseJobError(stdErrStr string, stdOutStr string) *system.JobError {
 			ErrDetail: stdErrStr,
 		}
 
-	case strings.Contains(stdErrStr, "There were unauthenticated packages"):
+	case isUnauthenticatedError(stdErrStr):
 		return &system.JobError{
 			ErrType:   system.ErrorUnauthenticatedPackages,
 			ErrDetail: stdErrStr,
+			Packages:  parseUnauthenticatedPackages(stdOutStr + "\n" + stdErrStr),
 		}
 
 	case strings.Contains(stdErrStr, "I/O error"):
@@ -256,17 +408,17 @@ func parseJobError(stdErrStr string, stdOutStr string) *system.JobError {
 	}
 }
 
-func DownloadPackages(packages []string, environ map[string]string, options map[string]string) (string, error) {
+func DownloadPackages(packages []string, environ map[string]string, confPath string, options map[string]string) (string, error) {
 	var args = []string{}
 	for k, v := range options {
 		args = append(args, "-o", k+"="+v)
 	}
 
-	args = append(args, "-c", system.LastoreAptV2CommonConfPath)
+	args = append(args, "-c", confPath)
 	args = append(args, "download")
 	args = append(args, packages...)
 	logger.Debug("downlaod package with args:", args)
-	cmd := exec.Command("apt-get", args...)
+	cmd := system.AptCommand(environ, "apt-get", args...)
 	tmpPath, err := os.MkdirTemp("/tmp", "apt-download-")
 	if err != nil {
 		return "", err
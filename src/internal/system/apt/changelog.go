@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+)
+
+// ChangelogEntry debian/changelog中的一个版本
+type ChangelogEntry struct {
+	Version      string
+	Distribution string
+	Changes      string
+	Maintainer   string
+	Date         string
+}
+
+// PackageChangelog 已安装版本到候选版本之间的更新说明,没有更新说明时Entries为空
+type PackageChangelog struct {
+	InstalledVersion string
+	Entries          []ChangelogEntry
+}
+
+// 版本头: dde-dock (5.6.1) unstable; urgency=medium
+var _changelogHeaderRegexp = regexp.MustCompile(`^\S+ \(([^)]+)\) ([^;]*);`)
+
+// parseChangelog 解析apt-get changelog的输出,返回比installed新的版本,installed为空时返回全部
+func parseChangelog(out []byte, installed string) []ChangelogEntry {
+	var entries []ChangelogEntry
+	var current *ChangelogEntry
+	var changes []string
+	finish := func() {
+		if current == nil {
+			return
+		}
+		current.Changes = strings.Trim(strings.Join(changes, "\n"), "\n")
+		entries = append(entries, *current)
+		current = nil
+		changes = nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := _changelogHeaderRegexp.FindStringSubmatch(line); match != nil {
+			finish()
+			if installed != "" {
+				result, err := system.CompareVersions(match[1], installed)
+				if err != nil || result <= 0 {
+					// changelog按版本从新到旧排列
+					break
+				}
+			}
+			current = &ChangelogEntry{Version: match[1], Distribution: strings.TrimSpace(match[2])}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if strings.HasPrefix(line, " -- ") {
+			// 结尾: " -- Maintainer <mail>  Mon, 01 May 2023 10:00:00 +0800"
+			trailer := strings.TrimPrefix(line, " -- ")
+			if i := strings.Index(trailer, ">  "); i >= 0 {
+				current.Maintainer = trailer[:i+1]
+				current.Date = strings.TrimSpace(trailer[i+3:])
+			} else {
+				current.Maintainer = strings.TrimSpace(trailer)
+			}
+			finish()
+			continue
+		}
+		changes = append(changes, strings.TrimPrefix(line, "  "))
+	}
+	finish()
+	return entries
+}
+
+// QueryChangelog 通过apt-get changelog获取pkg已安装版本之后的更新说明,ctx结束时终止查询.
+// 获取失败(如仓库未提供changelog或超时)时返回空的Entries和错误
+func QueryChangelog(ctx context.Context, environ map[string]string, confPath string, pkg string) (PackageChangelog, error) {
+	result := PackageChangelog{
+		InstalledVersion: system.QueryInstalledVersions([]string{pkg})[pkg],
+	}
+	var errBuf bytes.Buffer
+	cmd := system.AptCommandContext(ctx, environ, "apt-get", "-c", confPath, "changelog", "--", pkg) // #nosec G204
+	cmd.Stderr = &errBuf
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("get changelog of %s: %w", pkg, ctx.Err())
+	}
+	if err != nil {
+		return result, fmt.Errorf("get changelog of %s failed: %v %s", pkg, err, strings.TrimSpace(errBuf.String()))
+	}
+	result.Entries = parseChangelog(out, result.InstalledVersion)
+	return result, nil
+}
@@ -0,0 +1,127 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package apt
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+)
+
+// DebDeltaBin debdelta-upgrade根据已安装的版本下载增量包并在本地重建deb,重建后会校验deb的签名和摘要
+const DebDeltaBin = "/usr/bin/debdelta-upgrade"
+
+var (
+	debDeltaSavedMu sync.Mutex
+	debDeltaSaved   = make(map[string]int64) // key 是 jobId,value 是通过增量包重建而无需完整下载的字节数
+)
+
+// DebDeltaAvailable 判断系统是否安装了debdelta
+func DebDeltaAvailable() bool {
+	info, err := os.Stat(DebDeltaBin)
+	return err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+}
+
+// TakeDebDeltaSaved 取出并清除jobId通过增量包节省的下载字节数
+func TakeDebDeltaSaved(jobId string) int64 {
+	debDeltaSavedMu.Lock()
+	defer debDeltaSavedMu.Unlock()
+	saved := debDeltaSaved[jobId]
+	delete(debDeltaSaved, jobId)
+	return saved
+}
+
+func addDebDeltaSaved(jobId string, saved int64) {
+	debDeltaSavedMu.Lock()
+	defer debDeltaSavedMu.Unlock()
+	debDeltaSaved[jobId] += saved
+}
+
+// takeDebDeltaOption 返回去掉DebDeltaKey后的apt参数,以及是否需要使用增量包
+func takeDebDeltaOption(args map[string]string) (map[string]string, bool) {
+	if _, ok := args[system.DebDeltaKey]; !ok {
+		return args, false
+	}
+	options := make(map[string]string, len(args))
+	for key, value := range args {
+		if key != system.DebDeltaKey {
+			options[key] = value
+		}
+	}
+	return options, DebDeltaAvailable()
+}
+
+// archiveDebSizes 返回dir中deb文件的大小
+func archiveDebSizes(dir string) map[string]int64 {
+	sizes := make(map[string]int64)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return sizes
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), ".deb") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		sizes[entry.Name()] = info.Size()
+	}
+	return sizes
+}
+
+// debDeltaSavedBytes 返回after中新增的deb的大小之和,即由增量包重建而无需完整下载的字节数,不包含增量包本身的大小
+func debDeltaSavedBytes(before, after map[string]int64) int64 {
+	var saved int64
+	for name, size := range after {
+		if _, ok := before[name]; !ok {
+			saved += size
+		}
+	}
+	return saved
+}
+
+// startWithDebDelta 先执行debdelta-upgrade在缓存目录重建packages的deb,packages为空时处理所有可升级的包,再执行apt下载.
+// 没有增量包、重建或校验失败的包不会放入缓存目录,由apt完整下载,因此debdelta失败时不影响任务结果.
+// debdelta-upgrade使用系统的apt配置,不在系统仓库中的包也会由apt完整下载
+func startWithDebDelta(c *system.Command, confPath string, packages []string) error {
+	archivesDir, err := system.GetArchivesDir(confPath)
+	if err != nil {
+		logger.Warning("debdelta disabled:", err)
+		return c.Start()
+	}
+	before := archiveDebSizes(archivesDir)
+	args := append([]string{"--dir", archivesDir, "--"}, packages...)
+	cmd := exec.Command(DebDeltaBin, args...) // #nosec G204
+	cmd.Env = c.Cmd.Env
+	err = c.StartPrepare(cmd)
+	if err != nil {
+		logger.Warning("failed to start debdelta, fall back to full download:", err)
+		return c.Start()
+	}
+	go func() {
+		proceed, err := c.WaitPrepare()
+		if !proceed {
+			return
+		}
+		if err != nil {
+			logger.Warningf("debdelta of job %s failed, fall back to full download: %v", c.JobId, err)
+		}
+		saved := debDeltaSavedBytes(before, archiveDebSizes(archivesDir))
+		logger.Infof("job %s rebuilt %d bytes of packages from deltas", c.JobId, saved)
+		addDebDeltaSaved(c.JobId, saved)
+
+		err = c.Start()
+		if err != nil {
+			c.IndicateFailed(system.ErrorUnknown,
+				"apt-get start failed: "+err.Error(), false)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,82 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package apt
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+)
+
+// takeMirrorFetchOption 返回去掉MirrorSourcePartsKey后的apt参数,以及需要下载索引的镜像仓库目录
+func takeMirrorFetchOption(args map[string]string) (map[string]string, string) {
+	mirrorSourceDir, ok := args[system.MirrorSourcePartsKey]
+	if !ok {
+		return args, ""
+	}
+	options := make(map[string]string, len(args))
+	for key, value := range args {
+		if key != system.MirrorSourcePartsKey {
+			options[key] = value
+		}
+	}
+	return options, mirrorSourceDir
+}
+
+// newMirrorFetchCommand 只更新mirrorSourceDir中的镜像仓库,索引写入listsDir,保留其他仓库的索引.
+// 不输出进度,任务进度从任务命令开始计算
+func newMirrorFetchCommand(cmdSet system.CommandSet, confPath string, jobId string, fn system.Indicator, mirrorSourceDir, listsDir string) *system.Command {
+	cmd := system.AptCommand(nil, "apt-get", "-c", confPath, "update",
+		"-o", "Dir::Etc::SourceList=/dev/null",
+		"-o", "Dir::Etc::SourceParts="+mirrorSourceDir,
+		"-o", "Dir::State::lists="+listsDir,
+		"-o", "APT::Get::List-Cleanup=false") // #nosec G204
+	// See aptCommand.Abort
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	r := &system.Command{
+		JobId:             jobId,
+		CmdSet:            cmdSet,
+		Indicator:         fn,
+		ParseJobError:     parseJobError,
+		ParseProgressInfo: parseProgressInfo,
+		Cmd:               cmd,
+		Cancelable:        true,
+	}
+	cmd.Stdout = &r.Stdout
+	cmd.Stderr = &r.Stderr
+	cmdSet.AddCMD(r)
+	return r
+}
+
+// startAfterMirrorFetch 先从镜像下载索引,成功后调用start执行任务本身的检查和命令.
+// 下载索引作为任务的一部分执行,Abort可以终止,失败时按apt-get update的错误结束任务
+func (p *APTSystem) startAfterMirrorFetch(jobId string, environ map[string]string, mirrorSourceDir, listsDir string, start func() error) error {
+	c := newMirrorFetchCommand(p, system.LastoreAptV2ConfPath, jobId, p.Indicator, mirrorSourceDir, listsDir)
+	c.SetEnv(environ)
+	c.AtExitFn = func() bool {
+		if c.ExitCode != system.ExitSuccess {
+			return false
+		}
+		err := start()
+		if err != nil {
+			var jobErr *system.JobError
+			if errors.As(err, &jobErr) {
+				c.IndicateJobError(jobErr, true)
+			} else {
+				c.IndicateFailed(system.ErrorUnknown, "failed to start system job: "+err.Error(), false)
+			}
+		}
+		return true
+	}
+	c.Indicator(system.JobProgressInfo{
+		JobId:       jobId,
+		Status:      system.RunningStatus,
+		Progress:    0,
+		Description: "preparing",
+		Cancelable:  true,
+	})
+	return c.Start()
+}
@@ -0,0 +1,282 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+)
+
+// policyOrigin apt-cache policy版本表中的一个仓库,Dist为suite/component,flat仓库为suite本身
+type policyOrigin struct {
+	URI  string
+	Dist string
+}
+
+// parsePolicyCandidateOrigins 解析apt-cache policy的输出,返回每个包候选版本所在的仓库,本地状态(/var/lib/dpkg/status)不计入
+func parsePolicyCandidateOrigins(out []byte) map[string][]policyOrigin {
+	origins := make(map[string][]policyOrigin)
+	var name, candidate string
+	var inCandidate bool
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case !strings.HasPrefix(line, " "):
+			name = strings.TrimSuffix(trimmed, ":")
+			candidate = ""
+			inCandidate = false
+		case strings.HasPrefix(trimmed, "Candidate:"):
+			candidate = strings.TrimSpace(strings.TrimPrefix(trimmed, "Candidate:"))
+		case strings.HasPrefix(line, "        "):
+			// 仓库行: 500 http://mirror/deepin beige/main amd64 Packages
+			fields := strings.Fields(trimmed)
+			if inCandidate && len(fields) >= 4 {
+				origins[name] = append(origins[name], policyOrigin{URI: fields[1], Dist: fields[2]})
+			}
+		default:
+			// 版本行: " *** 5.5.0 100" 或 "     5.6.0 500"
+			fields := strings.Fields(strings.TrimPrefix(trimmed, "***"))
+			inCandidate = len(fields) > 0 && candidate != "" && candidate != "(none)" && fields[0] == candidate
+		}
+	}
+	return origins
+}
+
+// normalizeSourceURI apt-cache policy输出的file:地址只有一个/,且不带结尾的/
+func normalizeSourceURI(uri string) string {
+	uri = strings.TrimSuffix(uri, "/")
+	if strings.HasPrefix(uri, "file:") {
+		uri = "file:/" + strings.TrimLeft(strings.TrimPrefix(uri, "file:"), "/")
+	}
+	return uri
+}
+
+func (o policyOrigin) match(entry system.SourceEntry) bool {
+	if normalizeSourceURI(o.URI) != normalizeSourceURI(entry.URI) {
+		return false
+	}
+	if strings.HasSuffix(entry.Suite, "/") {
+		return strings.TrimSuffix(o.Dist, "/") == strings.TrimSuffix(entry.Suite, "/")
+	}
+	return strings.HasPrefix(o.Dist, entry.Suite+"/")
+}
+
+// sourceFiles sourcePath为目录时返回其中的*.list文件
+func sourceFiles(sourcePath string) ([]string, error) {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{sourcePath}, nil
+	}
+	files, err := filepath.Glob(filepath.Join(sourcePath, "*.list"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// matchOriginFiles 根据仓库地址找到包候选版本来自哪些仓库文件
+func matchOriginFiles(origins map[string][]policyOrigin, fileEntries map[string][]system.SourceEntry) map[string][]string {
+	files := make([]string, 0, len(fileEntries))
+	for file := range fileEntries {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	result := make(map[string][]string)
+	for name, pkgOrigins := range origins {
+		for _, file := range files {
+			matched := false
+			for _, entry := range fileEntries[file] {
+				for _, origin := range pkgOrigins {
+					if origin.match(entry) {
+						matched = true
+						break
+					}
+				}
+				if matched {
+					break
+				}
+			}
+			if matched {
+				result[name] = append(result[name], file)
+			}
+		}
+	}
+	return result
+}
+
+// QueryPackageOrigins 返回packages的候选版本来自sourcePath中的哪些仓库文件,sourcePath可以是文件或目录
+func QueryPackageOrigins(environ map[string]string, confPath string, sourcePath string, packages []string) (map[string][]string, error) {
+	if len(packages) == 0 {
+		return map[string][]string{}, nil
+	}
+	files, err := sourceFiles(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	fileEntries := make(map[string][]system.SourceEntry)
+	for _, file := range files {
+		entries, err := system.LoadSourceEntries(file)
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+		fileEntries[file] = entries
+	}
+	args := []string{"-c", confPath}
+	if len(files) == 1 && files[0] == sourcePath {
+		args = append(args, "-o", "Dir::Etc::SourceList="+sourcePath, "-o", "Dir::Etc::SourceParts=/dev/null")
+	} else {
+		args = append(args, "-o", "Dir::Etc::SourceList=/dev/null", "-o", "Dir::Etc::SourceParts="+sourcePath)
+	}
+	args = append(args, "policy", "--")
+	args = append(args, packages...)
+	var errBuf bytes.Buffer
+	cmd := system.AptCommand(environ, "apt-cache", args...) // #nosec G204
+	cmd.Stderr = &errBuf
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("run:%v failed-->%v %s", cmd.Args, err, errBuf.String())
+	}
+	return matchOriginFiles(parsePolicyCandidateOrigins(out), fileEntries), nil
+}
+
+// dpkgStatusFile apt-cache policy版本表中表示已安装的本地状态,不能从这里下载
+const dpkgStatusFile = "/var/lib/dpkg/status"
+
+// parsePolicyVersionOrigins 解析apt-cache policy的输出,返回每个包各版本所在的仓库地址,本地状态不计入;
+// 版本只存在于本地状态时该版本对应空列表
+func parsePolicyVersionOrigins(out []byte) map[string]map[string][]string {
+	versions := make(map[string]map[string][]string)
+	var name, version string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case !strings.HasPrefix(line, " "):
+			name = strings.TrimSuffix(trimmed, ":")
+			version = ""
+			versions[name] = make(map[string][]string)
+		case strings.HasPrefix(line, "        "):
+			// 仓库行: 500 http://mirror/deepin beige/main amd64 Packages
+			fields := strings.Fields(trimmed)
+			if version != "" && len(fields) >= 2 && fields[1] != dpkgStatusFile {
+				versions[name][version] = append(versions[name][version], fields[1])
+			}
+		case strings.HasPrefix(line, " *** ") || strings.HasPrefix(line, "     "):
+			// 版本行: " *** 5.5.0 100" 或 "     5.6.0 500"
+			fields := strings.Fields(strings.TrimPrefix(trimmed, "***"))
+			version = ""
+			if len(fields) > 0 && name != "" {
+				version = fields[0]
+				if _, ok := versions[name][version]; !ok {
+					versions[name][version] = nil
+				}
+			}
+		default:
+			// Installed、Candidate、Version table等
+			version = ""
+		}
+	}
+	return versions
+}
+
+// CheckReinstallable 检查pkgs(包名->已安装版本)的版本是否仍能从option配置的仓库下载,重新安装需要下载相同的版本.
+// 仓库中已经没有这些版本时返回ErrorVersionNotFound
+func CheckReinstallable(environ map[string]string, confPath string, pkgs map[string]string, option map[string]string) error {
+	if len(pkgs) == 0 {
+		return errors.New("empty packages")
+	}
+	optionArgs, err := OptionToArgs(option)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := append([]string{"-c", confPath}, optionArgs...)
+	args = append(args, "policy", "--")
+	args = append(args, names...)
+	var errBuf bytes.Buffer
+	cmd := system.AptCommand(environ, "apt-cache", args...) // #nosec G204
+	cmd.Stderr = &errBuf
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("run:%v failed-->%v %s", cmd.Args, err, errBuf.String())
+	}
+	return checkVersionsDownloadable(pkgs, parsePolicyVersionOrigins(out))
+}
+
+// checkVersionsDownloadable 返回pkgs中没有可下载来源的版本,versions为parsePolicyVersionOrigins的结果
+func checkVersionsDownloadable(pkgs map[string]string, versions map[string]map[string][]string) error {
+	var missing []string
+	for name, version := range pkgs {
+		if len(versions[name][version]) == 0 {
+			missing = append(missing, name+"="+version)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return &system.JobError{
+		ErrType:   system.ErrorVersionNotFound,
+		ErrDetail: "installed versions are no longer available in any repository: " + strings.Join(missing, " "),
+		Packages:  missing,
+	}
+}
+
+// ListUnresolvableVersions 返回pkgs(包名->版本)中在options配置的仓库和本地状态中都不存在的版本,格式为name=version
+func ListUnresolvableVersions(environ map[string]string, confPath string, pkgs map[string]string, options []string) ([]string, error) {
+	if len(pkgs) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := append([]string{"-c", confPath}, options...)
+	args = append(args, "policy", "--")
+	args = append(args, names...)
+	var errBuf bytes.Buffer
+	cmd := system.AptCommand(environ, "apt-cache", args...) // #nosec G204
+	cmd.Stderr = &errBuf
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("run:%v failed-->%v %s", cmd.Args, err, errBuf.String())
+	}
+	return unresolvableVersions(pkgs, parsePolicyVersionOrigins(out)), nil
+}
+
+// unresolvableVersions versions为parsePolicyVersionOrigins的结果,只在本地状态中的版本也可以解析
+func unresolvableVersions(pkgs map[string]string, versions map[string]map[string][]string) []string {
+	var missing []string
+	for name, version := range pkgs {
+		if _, ok := versions[name][version]; !ok {
+			missing = append(missing, name+"="+version)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
@@ -0,0 +1,423 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package apt
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+)
+
+// parallelUpdateSourceLimit 并行检查更新时同时执行的apt-get update数量
+const parallelUpdateSourceLimit = 4
+
+const buildSystemInfoScript = "/var/lib/lastore/scripts/build_system_info"
+
+// SourceUpdateResult 单个仓库文件检查更新的结果
+type SourceUpdateResult struct {
+	Source  string
+	ErrType system.JobErrorType `json:",omitempty"`
+	Reason  string              `json:",omitempty"` // 同JobError.ErrReason
+	Detail  string              `json:",omitempty"`
+
+	permanent bool
+}
+
+// ParallelUpdateResult 并行检查更新的汇总结果,部分仓库失败时作为成功任务的Description
+type ParallelUpdateResult struct {
+	Succeeded []string
+	Failed    []SourceUpdateResult `json:",omitempty"`
+}
+
+// parallelJobs 正在并行检查更新的任务,用于取消
+type parallelJobs struct {
+	mu      sync.Mutex
+	cancels map[string]func(withFailed bool)
+}
+
+func newParallelJobs() *parallelJobs {
+	return &parallelJobs{cancels: make(map[string]func(withFailed bool))}
+}
+
+func (p *parallelJobs) add(jobId string, cancel func(withFailed bool)) {
+	p.mu.Lock()
+	p.cancels[jobId] = cancel
+	p.mu.Unlock()
+}
+
+func (p *parallelJobs) remove(jobId string) {
+	p.mu.Lock()
+	delete(p.cancels, jobId)
+	p.mu.Unlock()
+}
+
+func (p *parallelJobs) cancel(jobId string, withFailed bool) bool {
+	p.mu.Lock()
+	cancel, ok := p.cancels[jobId]
+	p.mu.Unlock()
+	if ok {
+		cancel(withFailed)
+	}
+	return ok
+}
+
+// listSourceFiles 返回apt参数中配置的所有仓库文件,按路径排序
+func listSourceFiles(args map[string]string) []string {
+	var sources []string
+	if list := args["Dir::Etc::SourceList"]; list != "" && list != "/dev/null" {
+		if _, err := os.Stat(list); err == nil {
+			sources = append(sources, list)
+		}
+	}
+	if parts := args["Dir::Etc::SourceParts"]; parts != "" && parts != "/dev/null" {
+		entries, err := os.ReadDir(parts)
+		if err != nil {
+			logger.Warning(err)
+		}
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), ".list") {
+				sources = append(sources, filepath.Join(parts, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// seedListsDir 将现有索引硬链接到dir,apt-get update可以据此跳过未变化的索引
+func seedListsDir(listsDir, dir string) error {
+	err := os.MkdirAll(filepath.Join(dir, "partial"), 0755)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(listsDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || entry.Name() == "lock" {
+			continue
+		}
+		err = os.Link(filepath.Join(listsDir, entry.Name()), filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeListsDirs 按dirs的顺序将更新过的索引移动到listsDir,多个仓库更新了同一个文件时使用第一个.
+// removeStale为true时dirs包含全部仓库,同时删除listsDir中不属于任何仓库的索引,如已删除的仓库的索引
+func mergeListsDirs(listsDir string, dirs []string, removeStale bool) error {
+	merged := make(map[string]bool)
+	referenced := make(map[string]bool)
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.Type().IsRegular() || name == "lock" {
+				continue
+			}
+			referenced[name] = true
+			if merged[name] {
+				continue
+			}
+			src := filepath.Join(dir, name)
+			dst := filepath.Join(listsDir, name)
+			srcInfo, err := os.Stat(src)
+			if err != nil {
+				return err
+			}
+			// 仍是种子文件的硬链接,说明没有更新
+			if dstInfo, err := os.Stat(dst); err == nil && os.SameFile(srcInfo, dstInfo) {
+				continue
+			}
+			err = os.Rename(src, dst)
+			if err != nil {
+				return err
+			}
+			merged[name] = true
+		}
+	}
+	if !removeStale {
+		return nil
+	}
+	entries, err := os.ReadDir(listsDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || name == "lock" || referenced[name] {
+			continue
+		}
+		logger.Info("remove stale list:", name)
+		err = os.Remove(filepath.Join(listsDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// listsLockTimeout 合并索引前等待其他进程释放lists锁的最长时间
+var listsLockTimeout = 5 * time.Minute
+
+func mergeListsDirsLocked(listsDir string, dirs []string, removeStale bool) error {
+	unlock, err := system.LockFile(filepath.Join(listsDir, "lock"), listsLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return mergeListsDirs(listsDir, dirs, removeStale)
+}
+
+// summarizeSourceResults results需要与仓库文件顺序一致,保证汇总结果稳定
+func summarizeSourceResults(results []SourceUpdateResult) ParallelUpdateResult {
+	var summary ParallelUpdateResult
+	for _, r := range results {
+		if r.ErrType == "" {
+			summary.Succeeded = append(summary.Succeeded, r.Source)
+		} else {
+			summary.Failed = append(summary.Failed, r)
+		}
+	}
+	return summary
+}
+
+// classifySourceUpdate 根据apt-get update的结果判断单个仓库是否更新成功
+func classifySourceUpdate(source string, runErr error, stderr string) SourceUpdateResult {
+	result := SourceUpdateResult{Source: source}
+	if runErr == nil && !strings.Contains(stderr, "Some index files failed to download") &&
+		!strings.Contains(stderr, "Failed to fetch") {
+		return result
+	}
+	errType, reason, permanent, ok := classifyIndexError(stderr)
+	if !ok {
+		errType = system.ErrorIndexDownloadFailed
+		if strings.Contains(stderr, "No space left on device") {
+			errType = system.ErrorInsufficientSpace
+		}
+	}
+	result.ErrType = errType
+	result.Reason = reason
+	result.permanent = permanent
+	result.Detail = strings.TrimSpace(stderr)
+	if result.Detail == "" && runErr != nil {
+		result.Detail = runErr.Error()
+	}
+	return result
+}
+
+func updateOneSource(source, listsDir, workDir string, extraArgs []string, environ map[string]string, stop <-chan struct{}) SourceUpdateResult {
+	err := seedListsDir(listsDir, workDir)
+	if err != nil {
+		return SourceUpdateResult{Source: source, ErrType: system.ErrorUnknown, Detail: err.Error()}
+	}
+	args := append([]string{"-y"}, extraArgs...)
+	args = append(args,
+		"-o", "Dir::Etc::SourceList="+source,
+		"-o", "Dir::Etc::SourceParts=/dev/null",
+		"-o", "Dir::State::lists="+workDir,
+		// 清理后workDir中只剩当前仓库的索引,合并时据此删除已不属于任何仓库的索引;有文件下载失败时apt不会清理
+		"-o", "APT::Get::List-Cleanup=true",
+		// 多个进程同时生成缓存会互相覆盖,合并索引后由下一次apt调用生成
+		"-o", "Dir::Cache::pkgcache=",
+		"-o", "Dir::Cache::srcpkgcache=",
+		"update", "--fix-missing")
+	cmd := system.AptCommand(environ, "apt-get", args...) // #nosec G204
+	for key, value := range environ {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Start()
+	if err != nil {
+		return SourceUpdateResult{Source: source, ErrType: system.ErrorUnknown, Detail: err.Error()}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	result := classifySourceUpdate(source, err, stderr.String())
+	if result.ErrType != "" {
+		logger.Warningf("update source %s failed: %s", source, result.Detail)
+	}
+	return result
+}
+
+// updateSourceParallel 每个仓库文件使用单独的lists目录并行执行apt-get update,全部结束后合并成功仓库的索引.
+// 部分仓库失败时任务仍然成功,Description中记录失败的仓库;全部失败时任务失败
+func (p *APTSystem) updateSourceParallel(jobId string, environ map[string]string, args map[string]string, sources []string) error {
+	listsDir := args["Dir::State::lists"]
+	if listsDir == "" {
+		listsDir = system.OnlineListPath
+	}
+	extra := make(map[string]string)
+	for key, value := range args {
+		switch key {
+		case "Dir::Etc::SourceList", "Dir::Etc::SourceParts", "Dir::State::lists":
+		default:
+			extra[key] = value
+		}
+	}
+	extraArgs, err := OptionToArgs(extra)
+	if err != nil {
+		return err
+	}
+	workRoot := filepath.Join(filepath.Dir(listsDir), "."+filepath.Base(listsDir)+".parallel")
+	err = os.RemoveAll(workRoot)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var abortWithFailed bool
+	p.parallel.add(jobId, func(withFailed bool) {
+		stopOnce.Do(func() {
+			abortWithFailed = withFailed
+			close(stop)
+		})
+	})
+	indicate := func(info system.JobProgressInfo) {
+		info.JobId = jobId
+		p.Indicator(info)
+	}
+	indicate(system.JobProgressInfo{Status: system.RunningStatus, Cancelable: true})
+
+	go func() {
+		defer func() {
+			p.parallel.remove(jobId)
+			err := os.RemoveAll(workRoot)
+			if err != nil {
+				logger.Warning(err)
+			}
+		}()
+		results := make([]SourceUpdateResult, len(sources))
+		workDirs := make([]string, len(sources))
+		sem := make(chan struct{}, parallelUpdateSourceLimit)
+		var wg sync.WaitGroup
+		var finishedMu sync.Mutex
+		var finished int
+		for i, source := range sources {
+			workDirs[i] = filepath.Join(workRoot, strconv.Itoa(i))
+			wg.Add(1)
+			go func(i int, source string) {
+				defer wg.Done()
+				select {
+				case sem <- struct{}{}:
+				case <-stop:
+					results[i] = SourceUpdateResult{Source: source, ErrType: system.ErrorUnknown, Detail: "aborted"}
+					return
+				}
+				results[i] = updateOneSource(source, listsDir, workDirs[i], extraArgs, environ, stop)
+				<-sem
+				finishedMu.Lock()
+				finished++
+				progress := float64(finished) / float64(len(sources))
+				finishedMu.Unlock()
+				indicate(system.JobProgressInfo{
+					Status:      system.RunningStatus,
+					Progress:    progress * 0.99,
+					Description: source,
+					Cancelable:  true,
+				})
+			}(i, source)
+		}
+		wg.Wait()
+
+		select {
+		case <-stop:
+			status := system.PausedStatus
+			if abortWithFailed {
+				status = system.FailedStatus
+			}
+			indicate(system.JobProgressInfo{Status: status, Progress: -1, Cancelable: true})
+			return
+		default:
+		}
+
+		summary := summarizeSourceResults(results)
+		var succeededDirs []string
+		for i, r := range results {
+			if r.ErrType == "" {
+				succeededDirs = append(succeededDirs, workDirs[i])
+			}
+		}
+		content, _ := json.Marshal(summary)
+		if len(summary.Succeeded) == 0 {
+			permanent := true
+			for _, r := range summary.Failed {
+				permanent = permanent && r.permanent
+			}
+			indicate(system.JobProgressInfo{
+				Status:     system.FailedStatus,
+				Progress:   -1,
+				Cancelable: true,
+				Error: &system.JobError{
+					ErrType:   summary.Failed[0].ErrType,
+					ErrDetail: string(content),
+					ErrReason: summary.Failed[0].Reason,
+				},
+				FatalError: permanent,
+			})
+			return
+		}
+		// 与apt-get update互斥,避免其他apt进程读到合并了一半的索引;仓库全部成功时才能确定哪些索引已不再使用
+		err := mergeListsDirsLocked(listsDir, succeededDirs, len(summary.Failed) == 0)
+		if err != nil {
+			indicate(system.JobProgressInfo{
+				Status:     system.FailedStatus,
+				Progress:   -1,
+				Cancelable: true,
+				Error: &system.JobError{
+					ErrType:   system.ErrorUnknown,
+					ErrDetail: "failed to merge lists: " + err.Error(),
+				},
+			})
+			return
+		}
+		out, err := exec.Command(buildSystemInfoScript, "-now").CombinedOutput() // #nosec G204
+		if err != nil {
+			logger.Warningf("%s failed: %v %s", buildSystemInfoScript, err, out)
+		}
+		var description string
+		if len(summary.Failed) > 0 {
+			var failed []string
+			for _, r := range summary.Failed {
+				failed = append(failed, r.Source)
+			}
+			logger.Warningf("update source partially succeeded, failed sources: %v", failed)
+			description = string(content)
+		}
+		indicate(system.JobProgressInfo{
+			Status:      system.SucceedStatus,
+			Progress:    1.0,
+			Description: description,
+		})
+	}()
+	return nil
+}
@@ -7,21 +7,49 @@ package apt
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
 	"io"
+	"math"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/linuxdeepin/go-lib/strv"
+	debVersion "pault.ag/go/debian/version"
 )
 
 type APTSystem struct {
 	CmdSet    map[string]*system.Command
 	Indicator system.Indicator
+
+	parallel *parallelJobs // 并行检查更新的任务,不对应单个Command
+	confPath string        // apt-get -c 使用的配置文件
+}
+
+// ConfPathEnv 设置该环境变量可以替换默认的apt配置文件,用于测试和定制
+const ConfPathEnv = "LASTORE_APT_CONF_PATH"
+
+// DefaultConfPath 返回lastore调用apt时使用的配置文件路径
+func DefaultConfPath() string {
+	if confPath := os.Getenv(ConfPathEnv); confPath != "" {
+		return confPath
+	}
+	return system.LastoreAptV2CommonConfPath
+}
+
+// ConfPath 返回任务使用的apt配置文件,查询可更新包、模拟执行等操作需要使用相同的配置
+func (p *APTSystem) ConfPath() string {
+	return p.confPath
 }
 
 func NewSystem(nonUnknownList []string, otherList []string) system.System {
@@ -31,10 +59,12 @@ func NewSystem(nonUnknownList []string, otherList []string) system.System {
 
 func New(nonUnknownList []string, otherList []string) APTSystem {
 	p := APTSystem{
-		CmdSet: make(map[string]*system.Command),
+		CmdSet:   make(map[string]*system.Command),
+		parallel: newParallelJobs(),
+		confPath: DefaultConfPath(),
 	}
 	//WaitDpkgLockRelease()
-	//_ = exec.Command("/var/lib/lastore/scripts/build_safecache.sh").Run() // TODO
+	buildSafecache()
 	p.initSource(nonUnknownList, otherList)
 	return p
 }
@@ -53,7 +83,33 @@ func parseProgressInfo(id, line string) (system.JobProgressInfo, error) {
 		return system.JobProgressInfo{JobId: id}, fmt.Errorf("Invlaid Progress line:%q", line)
 	}
 
+	// media-change:medium:drive:human-readable string
+	if fs[0] == "media-change" {
+		message := strings.TrimSpace(fs[3])
+		return system.JobProgressInfo{
+			JobId:       id,
+			Progress:    -1,
+			Description: message,
+			Status:      system.RunningStatus,
+			Cancelable:  true,
+			MediaChange: &system.MediaChange{
+				Medium:  strings.TrimSpace(fs[1]),
+				Drive:   strings.TrimSpace(fs[2]),
+				Message: message,
+			},
+		}, nil
+	}
+
 	progress, err := parseProgressField(fs[2])
+	if err != nil && (fs[0] == "pmstatus" || fs[0] == "pmerror") {
+		// 多架构的包名带有架构,如 pmstatus:libc6:amd64:20.0000:Installing libc6 (amd64)
+		if more := strings.SplitN(line, ":", 5); len(more) == 5 {
+			if p, perr := parseProgressField(more[3]); perr == nil {
+				progress, err = p, nil
+				fs = []string{more[0], more[1] + ":" + more[2], more[3], more[4]}
+			}
+		}
+	}
 	if err != nil {
 		return system.JobProgressInfo{JobId: id}, err
 	}
@@ -61,6 +117,9 @@ func parseProgressInfo(id, line string) (system.JobProgressInfo, error) {
 
 	var status system.Status
 	var cancelable = true
+	var currentItem *system.DownloadItem
+	var downloaded int
+	var pkg string
 
 	infoType := fs[0]
 
@@ -70,10 +129,13 @@ func parseProgressInfo(id, line string) (system.JobProgressInfo, error) {
 	case "dlstatus":
 		progress = progress / 100.0
 		status = system.RunningStatus
+		currentItem = parseDownloadItem(description)
+		downloaded, _ = strconv.Atoi(fs[1])
 	case "pmstatus":
 		progress = progress / 100.0
 		status = system.RunningStatus
 		cancelable = false
+		pkg = strings.SplitN(fs[1], ":", 2)[0]
 	case "pmerror":
 		progress = -1
 		if id != system.DistUpgradeJobType {
@@ -81,7 +143,7 @@ func parseProgressInfo(id, line string) (system.JobProgressInfo, error) {
 		}
 
 	default:
-		//	case "pmconffile", "media-change":
+		//	case "pmconffile":
 		return system.JobProgressInfo{JobId: id},
 			fmt.Errorf("W: unknow status:%q", line)
 
@@ -93,9 +155,125 @@ func parseProgressInfo(id, line string) (system.JobProgressInfo, error) {
 		Description: description,
 		Status:      status,
 		Cancelable:  cancelable,
+		CurrentItem: currentItem,
+		Downloaded:  downloaded,
+		Package:     pkg,
 	}, nil
 }
 
+// apt在APT::Status-Fd中只输出下载到第几个文件和剩余时间,不包含文件名和大小,如:
+//
+//	dlstatus:1:0.0000:Retrieving file 1 of 3
+//	dlstatus:2:31.4541:Retrieving file 2 of 12 (1min 12s remaining)
+var _dlFileIndexRegex = regexp.MustCompile(`^Retrieving file (\d+) of (\d+)(?: \((.+) remaining\))?$`)
+
+// parseDownloadItem 从dlstatus的描述中解析下载进度,无法识别时返回nil.文件名和大小由downloadItemTracker从标准输出中补充
+func parseDownloadItem(description string) *system.DownloadItem {
+	m := _dlFileIndexRegex.FindStringSubmatch(description)
+	if m == nil {
+		return nil
+	}
+	index, _ := strconv.Atoi(m[1])
+	total, _ := strconv.Atoi(m[2])
+	return &system.DownloadItem{
+		Index:     index,
+		Total:     total,
+		Remaining: m[3],
+	}
+}
+
+// apt开始下载每个文件时在标准输出中打印序号、地址、包名和大小,如:
+//
+//	Get:3 http://mirror/deepin apricot/main amd64 libfoo amd64 1.2-1 [3,248 kB]
+//	Get:1 http://mirror/deepin apricot/main libbar amd64 2.0 [512 B]
+var _dlGetRegex = regexp.MustCompile(`^Get:(\d+) (\S+) \S+ ((?:\S+ )+)\[([\d.,]+) (B|kB|KB|MB|GB|TB)\]`)
+
+func parseDownloadSize(num, unit string) int64 {
+	n, err := parseLocaleNumber(num)
+	if err != nil {
+		logger.Warning(err)
+		return 0
+	}
+	return int64(math.Round(n * _spaceUnits[unit]))
+}
+
+// parseGetLine 解析标准输出中的Get:N行,不是Get行时返回nil
+func parseGetLine(line string) *system.DownloadItem {
+	m := _dlGetRegex.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	index, _ := strconv.Atoi(m[1])
+	// 新版apt在包名前带有仓库的架构: [arch] package arch version
+	fields := strings.Fields(m[3])
+	name := fields[0]
+	if len(fields) == 4 {
+		name = fields[1]
+	}
+	return &system.DownloadItem{
+		URI:   m[2],
+		Name:  name,
+		Size:  parseDownloadSize(m[4], m[5]),
+		Index: index,
+	}
+}
+
+// downloadItemTracker 记录标准输出中Get:N行的文件信息,按序号补充到dlstatus解析出的下载进度中
+type downloadItemTracker struct {
+	mu    sync.Mutex
+	items map[int]*system.DownloadItem
+	line  []byte // 未读到换行的部分
+}
+
+func newDownloadItemTracker() *downloadItemTracker {
+	return &downloadItemTracker{
+		items: make(map[int]*system.DownloadItem),
+	}
+}
+
+// Write 作为apt标准输出的一部分写入,只解析完整的行
+func (t *downloadItemTracker) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.line = append(t.line, p...)
+	for {
+		i := bytes.IndexByte(t.line, '\n')
+		if i < 0 {
+			break
+		}
+		if item := parseGetLine(string(bytes.TrimSpace(t.line[:i]))); item != nil {
+			t.items[item.Index] = item
+		}
+		t.line = t.line[i+1:]
+	}
+	return len(p), nil
+}
+
+// fill 补充item对应序号的地址、包名和大小,没有对应的Get行时不修改
+func (t *downloadItemTracker) fill(item *system.DownloadItem) {
+	if item == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	got, ok := t.items[item.Index]
+	if !ok {
+		return
+	}
+	item.URI = got.URI
+	item.Name = got.Name
+	item.Size = got.Size
+}
+
+// parseProgressInfo 在parseProgressInfo的基础上补充正在下载的文件信息
+func (t *downloadItemTracker) parseProgressInfo(id, line string) (system.JobProgressInfo, error) {
+	info, err := parseProgressInfo(id, line)
+	if err == nil {
+		t.fill(info.CurrentItem)
+	}
+	return info, err
+}
+
 func (p *APTSystem) AttachIndicator(f system.Indicator) {
 	p.Indicator = f
 }
@@ -126,6 +304,9 @@ func parsePkgSystemError(out, err []byte) error {
 	if len(err) == 0 {
 		return nil
 	}
+	if jobErr := offlineRepoUnavailableError(string(err)); jobErr != nil {
+		return jobErr
+	}
 	switch {
 	case bytes.Contains(err, []byte("dpkg was interrupted")):
 		return &system.JobError{
@@ -156,6 +337,13 @@ func parsePkgSystemError(out, err []byte) error {
 			ErrDetail: detail,
 		}
 
+	case isUnauthenticatedError(string(err)):
+		return &system.JobError{
+			ErrType:   system.ErrorUnauthenticatedPackages,
+			ErrDetail: string(err),
+			Packages:  parseUnauthenticatedPackages(string(out) + "\n" + string(err)),
+		}
+
 	default:
 		detail := string(append(out, err...))
 		return &system.JobError{
@@ -165,14 +353,14 @@ func parsePkgSystemError(out, err []byte) error {
 	}
 }
 
-func CheckPkgSystemError(lock bool) error {
+func CheckPkgSystemError(environ map[string]string, lock bool) error {
 	args := []string{"check"}
 	if !lock {
 		// without locking, it can only check for dependencies broken
 		args = append(args, "-o", "Debug::NoLocking=1")
 	}
 
-	cmd := exec.Command("apt-get", args...)
+	cmd := system.AptCommand(environ, "apt-get", args...)
 	var outBuf bytes.Buffer
 	cmd.Stdout = &outBuf
 	var errBuf bytes.Buffer
@@ -184,11 +372,32 @@ func CheckPkgSystemError(lock bool) error {
 	return parsePkgSystemError(outBuf.Bytes(), errBuf.Bytes())
 }
 
-func safeStart(c *system.Command) error {
-	args := c.Cmd.Args
-	// add -s option
-	args = append([]string{"-s"}, args[1:]...)
-	cmd := exec.Command("apt-get", args...) // #nosec G204
+// simulateCommand 返回apt-get命令行对应的-s模拟执行命令
+func simulateCommand(environ map[string]string, cmdArgs []string) *exec.Cmd {
+	args := append([]string{"-s"}, cmdArgs[1:]...)
+	return system.AptCommand(environ, "apt-get", args...) // #nosec G204
+}
+
+// checkSimulateResult 检查模拟执行的结果,返回阻止真正执行的错误,allowed为允许卸载的受保护的包
+func checkSimulateResult(runErr error, stdout, stderr []byte, allowed []string) *system.JobError {
+	if runErr != nil {
+		return parseJobError(string(stderr), string(stdout))
+	}
+	// 需要卸载受保护的包时终止任务
+	removed := filterAllowedRemoval(parseProtectedRemoval(stdout, GetProtectedPackages()), allowed)
+	if len(removed) > 0 {
+		return &system.JobError{
+			ErrType:   system.ErrorDangerousRemoval,
+			ErrDetail: "protected packages would be removed: " + strings.Join(removed, " "),
+			Packages:  removed,
+		}
+	}
+	return nil
+}
+
+// safeStart 先使用environ模拟执行c,检查通过后再真正执行
+func safeStart(c *system.Command, environ map[string]string) error {
+	cmd := simulateCommand(environ, c.Cmd.Args)
 
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
@@ -196,22 +405,22 @@ func safeStart(c *system.Command) error {
 	cmd.Stderr = &stderr
 
 	// perform apt-get action simulate
-	err := cmd.Start()
+	err := c.StartPrepare(cmd)
 	if err != nil {
 		return err
 	}
 	go func() {
-		err := cmd.Wait()
-		if err != nil {
-			jobErr := parseJobError(stderr.String(), stdout.String())
-			c.IndicateFailed(jobErr.ErrType, jobErr.ErrDetail, false)
+		proceed, err := c.WaitPrepare()
+		if !proceed {
 			return
 		}
-
-		// cmd run ok
-		// check rm dde?
-		if bytes.Contains(stdout.Bytes(), []byte("Remv dde ")) {
-			c.IndicateFailed("removeDDE", "", true)
+		jobErr := checkSimulateResult(err, stdout.Bytes(), stderr.Bytes(), takeAllowedRemoval(c.JobId))
+		if jobErr != nil {
+			if err != nil {
+				c.IndicateFailed(jobErr.ErrType, jobErr.ErrDetail, false)
+			} else {
+				c.IndicateJobError(jobErr, true)
+			}
 			return
 		}
 
@@ -225,65 +434,381 @@ func safeStart(c *system.Command) error {
 	return nil
 }
 
-func OptionToArgs(options map[string]string) []string {
+// ValidateDistUpgrade 对mode中的每个分类执行一次dist-upgrade --assume-no,不下载也不安装任何包,
+// 返回下载空间不足、需要卸载受保护的包和依赖无法满足等阻止更新的错误.
+// option为更新任务使用的apt配置(不含仓库参数),coreList为系统更新时额外安装的必装清单
+func ValidateDistUpgrade(environ map[string]string, confPath string, mode system.UpdateType, coreList []string, option map[string]string) []*system.JobError {
+	var blockers []*system.JobError
+	for _, typ := range system.AllInstallUpdateType() {
+		if typ&mode == 0 {
+			continue
+		}
+		sourcePath := system.GetCategorySourceMap()[typ]
+		info, err := os.Stat(sourcePath)
+		if err != nil {
+			continue
+		}
+		categoryOption := map[string]string{
+			"Debug::NoLocking": "1",
+		}
+		for k, v := range option {
+			categoryOption[k] = v
+		}
+		if info.IsDir() {
+			categoryOption["Dir::Etc::SourceList"] = "/dev/null"
+			categoryOption["Dir::Etc::SourceParts"] = sourcePath
+		} else {
+			categoryOption["Dir::Etc::SourceList"] = sourcePath
+			categoryOption["Dir::Etc::SourceParts"] = "/dev/null"
+		}
+		optionArgs, err := OptionToArgs(categoryOption)
+		if err != nil {
+			blockers = append(blockers, &system.JobError{ErrType: system.ErrorUnknown, ErrDetail: err.Error()})
+			continue
+		}
+		var packages []string
+		if typ == system.SystemUpdate {
+			packages = coreList
+		}
+		// 与更新任务的参数一致
+		args := append([]string{"-c", confPath, "--assume-no"}, optionArgs...)
+		args = append(args, "--allow-downgrades", "--allow-change-held-packages", "dist-upgrade")
+		cmd := system.AptCommand(environ, "apt-get", append(args, packages...)...) // #nosec G204
+		var stdout bytes.Buffer
+		var stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		runErr := cmd.Run()
+		blockers = append(blockers, checkDryRunResult(confPath, runErr, stdout.Bytes(), stderr.Bytes())...)
+	}
+	return blockers
+}
+
+// checkDryRunResult 检查dist-upgrade --assume-no的结果.有变化时--assume-no的退出码也为1,只有无法解析出变化时才按执行失败处理
+func checkDryRunResult(confPath string, runErr error, stdout, stderr []byte) []*system.JobError {
+	result, ok := parseDistUpgradeOutput(stdout)
+	if !ok {
+		if runErr != nil {
+			return []*system.JobError{parseJobError(string(stderr), string(stdout))}
+		}
+		return nil
+	}
+	var blockers []*system.JobError
+	protected := strv.Strv(GetProtectedPackages())
+	var removed []string
+	for _, pkg := range result.Removed {
+		if protected.Contains(pkg) {
+			removed = append(removed, pkg)
+		}
+	}
+	if len(removed) > 0 {
+		blockers = append(blockers, &system.JobError{
+			ErrType:   system.ErrorDangerousRemoval,
+			ErrDetail: "protected packages would be removed: " + strings.Join(removed, " "),
+			Packages:  removed,
+		})
+	}
+	shortfall, err := system.DownloadSpaceShortfall(confPath, stdout)
+	if err != nil {
+		// 无法确定下载量时不阻止更新,由apt处理
+		logger.Warning(err)
+	} else if shortfall != nil {
+		blockers = append(blockers, &system.JobError{
+			ErrType:   system.ErrorInsufficientSpace,
+			ErrDetail: shortfall.Error(),
+		})
+	}
+	return blockers
+}
+
+var (
+	protectedPackagesMu sync.RWMutex
+	// 缺省保护桌面环境的元包和核心组件
+	protectedPackages = []string{
+		"dde", "dde-session-shell", "dde-session-ui", "startdde", "dde-desktop",
+		"dde-dock", "dde-launcher", "dde-control-center", "deepin-desktop-base", "lastore-daemon",
+	}
+	allowedRemovals = make(map[string][]string) // key 是 jobId,value 是管理员允许该job卸载的受保护的包
+)
+
+// SetProtectedPackages 设置受保护的包,模拟执行发现需要卸载这些包时任务会被终止
+func SetProtectedPackages(packages []string) {
+	protectedPackagesMu.Lock()
+	defer protectedPackagesMu.Unlock()
+	protectedPackages = packages
+}
+
+func GetProtectedPackages() []string {
+	protectedPackagesMu.RLock()
+	defer protectedPackagesMu.RUnlock()
+	return protectedPackages
+}
+
+// AllowProtectedRemoval 允许jobId对应的任务下一次执行时卸载指定的受保护的包
+func AllowProtectedRemoval(jobId string, packages []string) {
+	protectedPackagesMu.Lock()
+	defer protectedPackagesMu.Unlock()
+	allowedRemovals[jobId] = packages
+}
+
+// takeAllowedRemoval 取出并清除jobId的授权,授权只生效一次
+func takeAllowedRemoval(jobId string) []string {
+	protectedPackagesMu.Lock()
+	defer protectedPackagesMu.Unlock()
+	packages := allowedRemovals[jobId]
+	delete(allowedRemovals, jobId)
+	return packages
+}
+
+// filterAllowedRemoval 去掉已被允许卸载的包
+func filterAllowedRemoval(removed []string, allowed []string) []string {
+	var result []string
+	for _, pkg := range removed {
+		if !strv.Strv(allowed).Contains(pkg) {
+			result = append(result, pkg)
+		}
+	}
+	return result
+}
+
+// parseProtectedRemoval 解析apt-get -s输出中的Remv行,返回其中受保护的包
+func parseProtectedRemoval(out []byte, protected []string) []string {
+	if len(protected) == 0 {
+		return nil
+	}
+	protectedMap := make(map[string]bool, len(protected))
+	for _, pkg := range protected {
+		protectedMap[pkg] = true
+	}
+	var removed []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "Remv" {
+			continue
+		}
+		// 多架构时包名带有架构后缀,如 dde:amd64
+		name := strings.SplitN(fields[1], ":", 2)[0]
+		if protectedMap[name] {
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
+
+var _aptOptionKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.+-]*(::[A-Za-z0-9_.+-]*)*$`)
+
+// 检查更新时参数会拼接到sh -c中执行,值中不允许出现shell特殊字符
+const _unsafeOptionValueChars = " \t\r\n\x00;&|$`'\"<>()\\*?"
+
+// OptionToArgs 将apt配置项按key排序转换为-o参数,key格式错误或value含有shell特殊字符时返回错误
+func OptionToArgs(options map[string]string) ([]string, error) {
+	keys := make([]string, 0, len(options))
+	for key, value := range options {
+		if !_aptOptionKeyRegexp.MatchString(key) {
+			return nil, fmt.Errorf("invalid apt option key %q", key)
+		}
+		if strings.ContainsAny(value, _unsafeOptionValueChars) {
+			return nil, fmt.Errorf("invalid apt option value %q for %s", value, key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 	var args []string
-	for key, value := range options { // apt 命令执行参数
+	for _, key := range keys { // apt 命令执行参数
 		args = append(args, "-o")
-		args = append(args, fmt.Sprintf("%v=%v", key, value))
+		args = append(args, fmt.Sprintf("%v=%v", key, options[key]))
 	}
-	return args
+	return args, nil
+}
+
+// 管理员可以通过配置文件为任务添加的apt配置项的前缀
+var _extraOptionAllowedPrefixes = []string{"acquire::"}
+
+// 即使前缀允许也不能设置的配置项,这些配置会降低仓库和传输的安全校验
+var _extraOptionDeniedSuffixes = []string{
+	"::allowinsecurerepositories",
+	"::allowdowngradetoinsecurerepositories",
+	"::allowweakrepositories",
+	"::check-valid-until",
+	"::verify-peer",
+	"::verify-host",
+	"::cainfo",
+	"::capath",
+}
+
+// ValidateExtraOption 检查管理员配置的额外apt参数是否允许设置,apt的配置项不区分大小写
+func ValidateExtraOption(key, value string) error {
+	_, err := OptionToArgs(map[string]string{key: value})
+	if err != nil {
+		return err
+	}
+	lowerKey := strings.ToLower(key)
+	allowed := false
+	for _, prefix := range _extraOptionAllowedPrefixes {
+		if strings.HasPrefix(lowerKey, prefix) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("apt option %s is not allowed", key)
+	}
+	for _, suffix := range _extraOptionDeniedSuffixes {
+		if strings.HasSuffix(lowerKey, suffix) {
+			return fmt.Errorf("apt option %s is not allowed", key)
+		}
+	}
+	return nil
 }
 
 func (p *APTSystem) DownloadPackages(jobId string, packages []string, environ map[string]string, args map[string]string) error {
-	err := CheckPkgSystemError(false)
+	if options, mirrorSourceDir := takeMirrorFetchOption(args); mirrorSourceDir != "" {
+		return p.startAfterMirrorFetch(jobId, environ, mirrorSourceDir, options["Dir::State::lists"], func() error {
+			return p.DownloadPackages(jobId, packages, environ, options)
+		})
+	}
+	err := CheckPkgSystemError(environ, false)
+	if err != nil {
+		return err
+	}
+	args, debDelta := takeDebDeltaOption(args)
+	optionArgs, err := OptionToArgs(args)
 	if err != nil {
 		return err
 	}
-	c := newAPTCommand(p, jobId, system.DownloadJobType, p.Indicator, append(packages, OptionToArgs(args)...))
+	err = checkDownloadSpace(environ, append(append(optionArgs, "install", "-d", "--allow-change-held-packages", "--"), packages...))
+	if err != nil {
+		return err
+	}
+	c := newAPTCommand(p, p.confPath, jobId, system.DownloadJobType, p.Indicator, append(packages, optionArgs...))
 	c.SetEnv(environ)
+	if debDelta {
+		return startWithDebDelta(c, p.confPath, packages)
+	}
 	return c.Start()
 }
 
 func (p *APTSystem) DownloadSource(jobId string, packages []string, environ map[string]string, args map[string]string) error {
+	if options, mirrorSourceDir := takeMirrorFetchOption(args); mirrorSourceDir != "" {
+		return p.startAfterMirrorFetch(jobId, environ, mirrorSourceDir, options["Dir::State::lists"], func() error {
+			return p.DownloadSource(jobId, packages, environ, options)
+		})
+	}
 	// 无需检查依赖错误
 	/*
-		err := CheckPkgSystemError(false)
+		err := CheckPkgSystemError(environ, false)
 		if err != nil {
 			return err
 		}
 	*/
 
-	c := newAPTCommand(p, jobId, system.PrepareDistUpgradeJobType, p.Indicator, append(packages, OptionToArgs(args)...))
+	args, debDelta := takeDebDeltaOption(args)
+	optionArgs, err := OptionToArgs(args)
+	if err != nil {
+		return err
+	}
+	err = checkDownloadSpace(environ, append(append(optionArgs, "dist-upgrade", "-d", "--allow-change-held-packages"), packages...))
+	if err != nil {
+		return err
+	}
+	c := newAPTCommand(p, p.confPath, jobId, system.PrepareDistUpgradeJobType, p.Indicator, append(packages, optionArgs...))
 	c.SetEnv(environ)
+	if debDelta {
+		// dist-upgrade会升级所有包,不限制debdelta处理的包
+		return startWithDebDelta(c, p.confPath, nil)
+	}
 	return c.Start()
 }
 
+// checkDownloadSpace 下载前检查缓存分区空间,避免下载一半后才因空间不足失败
+func checkDownloadSpace(environ map[string]string, args []string) error {
+	shortfall, err := system.QueryDownloadSpaceShortfall(environ, args)
+	if err != nil {
+		// 无法确定下载量时不阻止下载,由apt处理
+		logger.Warning(err)
+		return nil
+	}
+	if shortfall != nil {
+		return &system.JobError{
+			ErrType:   system.ErrorInsufficientSpace,
+			ErrDetail: shortfall.Error(),
+		}
+	}
+	return nil
+}
+
 func (p *APTSystem) Remove(jobId string, packages []string, environ map[string]string) error {
 	WaitDpkgLockRelease()
-	err := CheckPkgSystemError(true)
+	err := CheckPkgSystemError(environ, true)
 	if err != nil {
 		return err
 	}
 
-	c := newAPTCommand(p, jobId, system.RemoveJobType, p.Indicator, packages)
+	c := newAPTCommand(p, p.confPath, jobId, system.RemoveJobType, p.Indicator, packages)
 	c.SetEnv(environ)
-	return safeStart(c)
+	return safeStart(c, environ)
 }
 
 func (p *APTSystem) Install(jobId string, packages []string, environ map[string]string, args map[string]string) error {
+	if options, mirrorSourceDir := takeMirrorFetchOption(args); mirrorSourceDir != "" {
+		return p.startAfterMirrorFetch(jobId, environ, mirrorSourceDir, options["Dir::State::lists"], func() error {
+			return p.Install(jobId, packages, environ, options)
+		})
+	}
 	WaitDpkgLockRelease()
-	err := CheckPkgSystemError(true)
+	err := CheckPkgSystemError(environ, true)
 	if err != nil {
 		return err
 	}
-	c := newAPTCommand(p, jobId, system.InstallJobType, p.Indicator, append(OptionToArgs(args), packages...))
+	optionArgs, err := OptionToArgs(args)
+	if err != nil {
+		return err
+	}
+	c := newAPTCommand(p, p.confPath, jobId, system.InstallJobType, p.Indicator, append(optionArgs, packages...))
 	c.SetEnv(environ)
-	return safeStart(c)
+	return safeStart(c, environ)
+}
+
+// ValidateLocalDeb 检查本地deb文件是否存在且是有效的deb包,返回包名.
+// 返回的路径为绝对路径,apt-get install需要通过路径区分本地文件和仓库中的包
+func ValidateLocalDeb(path string) (absPath string, pkgName string, err error) {
+	if !filepath.IsAbs(path) || !strings.HasSuffix(path, ".deb") {
+		return "", "", fmt.Errorf("invalid deb path %q", path)
+	}
+	absPath = filepath.Clean(path)
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return "", "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", "", fmt.Errorf("%q is not a regular file", absPath)
+	}
+	var errBuf bytes.Buffer
+	cmd := exec.Command("dpkg-deb", "--info", absPath) // #nosec G204
+	cmd.Stderr = &errBuf
+	err = cmd.Run()
+	if err != nil {
+		return "", "", fmt.Errorf("%q is not a valid deb: %v %v", absPath, err, strings.TrimSpace(errBuf.String()))
+	}
+	out, err := exec.Command("dpkg-deb", "--field", absPath, "Package").Output() // #nosec G204
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read package name of %q: %v", absPath, err)
+	}
+	pkgName = strings.TrimSpace(string(out))
+	if pkgName == "" {
+		return "", "", fmt.Errorf("%q has no package name", absPath)
+	}
+	return absPath, pkgName, nil
 }
 
 func (p *APTSystem) DistUpgrade(jobId string, packages []string, environ map[string]string, args map[string]string) error {
+	if options, mirrorSourceDir := takeMirrorFetchOption(args); mirrorSourceDir != "" {
+		return p.startAfterMirrorFetch(jobId, environ, mirrorSourceDir, options["Dir::State::lists"], func() error {
+			return p.DistUpgrade(jobId, packages, environ, options)
+		})
+	}
 	WaitDpkgLockRelease()
-	err := CheckPkgSystemError(true)
+	err := CheckPkgSystemError(environ, true)
 	if err != nil {
 		// 无需处理依赖错误,在获取可更新包时,使用dist-upgrade -d命令获取,就会报错了
 		var e *system.JobError
@@ -292,38 +817,313 @@ func (p *APTSystem) DistUpgrade(jobId string, packages []string, environ map[str
 			return err
 		}
 	}
-	c := newAPTCommand(p, jobId, system.DistUpgradeJobType, p.Indicator, append(OptionToArgs(args), packages...))
+	optionArgs, err := OptionToArgs(args)
+	if err != nil {
+		return err
+	}
+	c := newAPTCommand(p, p.confPath, jobId, system.DistUpgradeJobType, p.Indicator, append(optionArgs, packages...))
 	c.SetEnv(environ)
-	return safeStart(c)
+	return safeStart(c, environ)
 }
 
 func (p *APTSystem) UpdateSource(jobId string, environ map[string]string, args map[string]string) error {
-	c := newAPTCommand(p, jobId, system.UpdateSourceJobType, p.Indicator, OptionToArgs(args))
+	if _, ok := args[system.ParallelUpdateSourceKey]; ok {
+		options := make(map[string]string, len(args))
+		for key, value := range args {
+			if key != system.ParallelUpdateSourceKey {
+				options[key] = value
+			}
+		}
+		args = options
+		// 只有一个仓库文件时与普通方式相同
+		if sources := listSourceFiles(args); len(sources) > 1 {
+			return p.updateSourceParallel(jobId, environ, args, sources)
+		}
+	}
+	optionArgs, err := OptionToArgs(args)
+	if err != nil {
+		return err
+	}
+	c := newAPTCommand(p, p.confPath, jobId, system.UpdateSourceJobType, p.Indicator, optionArgs)
+	listsDir := args["Dir::State::lists"]
+	if listsDir == "" {
+		listsDir = system.OnlineListPath
+	}
+	// 取消检查更新时恢复之前的索引,避免不完整的InRelease等文件影响下一次检查
+	snapshot, err := system.SnapshotLists(listsDir)
+	if err != nil {
+		logger.Warning("failed to snapshot lists:", err)
+	}
 	c.AtExitFn = func() bool {
+		aborted := c.Aborted()
+		if snapshot != nil {
+			if aborted {
+				err := snapshot.Restore()
+				if err != nil {
+					logger.Warning("failed to restore lists:", err)
+				}
+			} else {
+				snapshot.Discard()
+			}
+		}
+		if aborted {
+			return false
+		}
 		// 无网络时检查更新失败,exitCode为0,空间不足(不确定exit code)导致需要特殊处理
 		if c.ExitCode == system.ExitSuccess && bytes.Contains(c.Stderr.Bytes(), []byte("Some index files failed to download")) {
 			if bytes.Contains(c.Stderr.Bytes(), []byte("No space left on device")) {
 				c.IndicateFailed(system.ErrorInsufficientSpace, c.Stderr.String(), false)
-			} else {
-				c.IndicateFailed(system.ErrorIndexDownloadFailed, c.Stderr.String(), false)
+				return true
+			}
+			errType, reason, permanent, ok := classifyIndexError(c.Stderr.String())
+			if !ok {
+				errType = system.ErrorIndexDownloadFailed
 			}
+			c.IndicateJobError(&system.JobError{
+				ErrType:   errType,
+				ErrDetail: c.Stderr.String(),
+				ErrReason: reason,
+			}, permanent)
 			return true
 		}
+		if c.ExitCode == system.ExitFailure {
+			if errType, reason, permanent, ok := classifyIndexError(c.Stderr.String()); ok {
+				c.IndicateJobError(&system.JobError{
+					ErrType:   errType,
+					ErrDetail: c.Stderr.String(),
+					ErrReason: reason,
+				}, permanent)
+				return true
+			}
+		}
 		return false
 	}
 	c.SetEnv(environ)
-	return c.Start()
+	err = c.Start()
+	if err != nil && snapshot != nil {
+		snapshot.Discard()
+	}
+	return err
+}
+
+var (
+	_indexNotFoundRegex     = regexp.MustCompile(`\b404\s+Not Found|does not have a Release file`)
+	_releaseExpiredRegex    = regexp.MustCompile(`Release file for \S+ is expired`)
+	_indexNetworkErrorRegex = regexp.MustCompile(`Temporary failure resolving|Could not resolve|Connection timed out|` +
+		`Could not connect to|Connection failed|Network is unreachable|Connection refused|Connection reset|` +
+		`Certificate verification failed|Could not handshake: |gnutls_handshake\(\) failed|SSL connection failed|Hash Sum mismatch`)
+)
+
+// classifyIndexError 按apt-get update的stderr区分失败原因,reason为确定原因的那一行输出.
+// 仓库配置问题(permanent为true)重试也不会成功,同时存在两类错误时按配置问题处理;ok为false表示无法识别
+func classifyIndexError(stderr string) (errType system.JobErrorType, reason string, permanent bool, ok bool) {
+	if _, unavailable := findUnavailableFileSource(stderr); unavailable {
+		return system.ErrorOfflineRepoUnavailable, "", true, true
+	}
+	for _, c := range []struct {
+		regex     *regexp.Regexp
+		errType   system.JobErrorType
+		permanent bool
+	}{
+		{_releaseExpiredRegex, system.ErrorReleaseExpired, true},
+		{_indexNotFoundRegex, system.ErrorIndexNotFound, true},
+		{_indexNetworkErrorRegex, system.ErrorIndexNetworkFailed, false},
+	} {
+		if line := matchedLine(c.regex, stderr); line != "" {
+			return c.errType, line, c.permanent, true
+		}
+	}
+	return "", "", false, false
+}
+
+// matchedLine 返回output中第一个匹配regex的行,没有匹配时返回空
+func matchedLine(regex *regexp.Regexp, output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if regex.MatchString(line) {
+			return strings.TrimSpace(line)
+		}
+	}
+	return ""
 }
 
 func (p *APTSystem) Clean(jobId string) error {
-	c := newAPTCommand(p, jobId, system.CleanJobType, p.Indicator, nil)
+	c := newAPTCommand(p, p.confPath, jobId, system.CleanJobType, p.Indicator, nil)
 	return c.Start()
 }
 
+// AutoCleanResult 清理缓存任务成功后Description中的内容
+type AutoCleanResult struct {
+	ReclaimedBytes int64
+}
+
+// AutoCleanMaxSizeOption AutoClean任务option中的缓存大小上限(字节),设置后只删除最旧的包直到不超过上限
+const AutoCleanMaxSizeOption = "MaxCacheSize"
+
+// AutoClean 执行apt-get autoclean清理无法再下载的包,并删除不在keepPackages中的包,已下载的待更新包不会被删除
+func (p *APTSystem) AutoClean(jobId string, keepPackages []string, cmdArgs map[string]string) error {
+	archivesDir, err := system.GetArchivesDir(p.confPath)
+	if err != nil {
+		return err
+	}
+	var maxSize int64
+	if v, ok := cmdArgs[AutoCleanMaxSizeOption]; ok {
+		maxSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	before := archivesSize(archivesDir)
+	c := newAPTCommand(p, p.confPath, jobId, system.AutoCleanJobType, p.Indicator, nil)
+	c.AtExitFn = func() bool {
+		if c.ExitCode != system.ExitSuccess {
+			return false
+		}
+		if maxSize > 0 {
+			trimArchives(archivesDir, maxSize, keepPackages)
+		} else {
+			removeUnreferencedDebs(archivesDir, keepPackages)
+		}
+		result, _ := json.Marshal(AutoCleanResult{ReclaimedBytes: before - archivesSize(archivesDir)})
+		c.Indicator(system.JobProgressInfo{
+			JobId:       c.JobId,
+			Status:      system.SucceedStatus,
+			Progress:    1.0,
+			Description: string(result),
+		})
+		return true
+	}
+	return c.Start()
+}
+
+// CacheSize 返回lastore缓存中deb的总大小(字节),系统apt的缓存不由lastore管理,不计算在内
+func CacheSize(confPath string) (int64, error) {
+	archivesDir, err := system.GetArchivesDir(confPath)
+	if err != nil {
+		return 0, err
+	}
+	return archivesSize(archivesDir), nil
+}
+
+func archivesSize(dirs ...string) int64 {
+	var size int64
+	for _, dir := range dirs {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.deb"))
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err == nil {
+				size += info.Size()
+			}
+		}
+	}
+	return size
+}
+
+// keepDebs 清理缓存时需要保留的deb,keepPackages的格式为 包名[:架构][=版本],没有指定版本时保留该包的所有版本
+type keepDebs map[string]map[string]bool
+
+func newKeepDebs(keepPackages []string) keepDebs {
+	keep := make(keepDebs, len(keepPackages))
+	for _, pkg := range keepPackages {
+		nameArch, version, hasVersion := strings.Cut(pkg, "=")
+		name := strings.SplitN(nameArch, ":", 2)[0]
+		versions, ok := keep[name]
+		if ok && versions == nil {
+			continue
+		}
+		if !hasVersion {
+			keep[name] = nil
+			continue
+		}
+		if versions == nil {
+			versions = make(map[string]bool)
+			keep[name] = versions
+		}
+		versions[version] = true
+	}
+	return keep
+}
+
+// contains deb文件名格式为 包名_版本_架构.deb,版本中的':'被转义为%3a
+func (k keepDebs) contains(file string) bool {
+	parts := strings.SplitN(strings.TrimSuffix(filepath.Base(file), ".deb"), "_", 3)
+	versions, ok := k[parts[0]]
+	if !ok {
+		return false
+	}
+	if versions == nil {
+		return true
+	}
+	if len(parts) < 2 {
+		return false
+	}
+	version, err := url.PathUnescape(parts[1])
+	if err != nil {
+		version = parts[1]
+	}
+	return versions[version]
+}
+
+// trimArchives 从最旧的deb开始删除,直到dir中deb的总大小不超过maxSize,keepPackages中的包不会被删除.
+// 只处理lastore的缓存目录,系统apt的缓存不由lastore管理
+func trimArchives(dir string, maxSize int64, keepPackages []string) {
+	keep := newKeepDebs(keepPackages)
+	type debFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var debs []debFile
+	var total int64
+	files, _ := filepath.Glob(filepath.Join(dir, "*.deb"))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		total += info.Size()
+		if keep.contains(file) {
+			continue
+		}
+		debs = append(debs, debFile{path: file, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(debs, func(i, j int) bool {
+		return debs[i].modTime.Before(debs[j].modTime)
+	})
+	for _, deb := range debs {
+		if total <= maxSize {
+			return
+		}
+		err := os.Remove(deb.path)
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+		total -= deb.size
+	}
+}
+
+// removeUnreferencedDebs 删除不在keepPackages中的deb
+func removeUnreferencedDebs(dir string, keepPackages []string) {
+	keep := newKeepDebs(keepPackages)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.deb"))
+	for _, file := range files {
+		if keep.contains(file) {
+			continue
+		}
+		err := os.Remove(file)
+		if err != nil {
+			logger.Warning(err)
+		}
+	}
+}
+
 func (p *APTSystem) Abort(jobId string) error {
 	if c := p.FindCMD(jobId); c != nil {
 		return c.Abort()
 	}
+	if p.parallel.cancel(jobId, false) {
+		return nil
+	}
 	return system.NotFoundError("abort " + jobId)
 }
 
@@ -331,23 +1131,140 @@ func (p *APTSystem) AbortWithFailed(jobId string) error {
 	if c := p.FindCMD(jobId); c != nil {
 		return c.AbortWithFailed()
 	}
+	if p.parallel.cancel(jobId, true) {
+		return nil
+	}
 	return system.NotFoundError("abort " + jobId)
 }
 
+func (p *APTSystem) PauseAtFileBoundary(jobId string, timeout time.Duration) error {
+	if c := p.FindCMD(jobId); c != nil {
+		return c.PauseAtFileBoundary(timeout)
+	}
+	return system.NotFoundError("pause " + jobId)
+}
+
+func (p *APTSystem) ConfirmMediaChange(jobId string) error {
+	if c := p.FindCMD(jobId); c != nil {
+		return c.ConfirmMediaChange()
+	}
+	return system.NotFoundError("confirm media change " + jobId)
+}
+
 func (p *APTSystem) FixError(jobId string, errType string, environ map[string]string, args map[string]string) error {
 	WaitDpkgLockRelease()
-	c := newAPTCommand(p, jobId, system.FixErrorJobType, p.Indicator, append([]string{errType}, OptionToArgs(args)...))
+	optionArgs, err := OptionToArgs(args)
+	if err != nil {
+		return err
+	}
+	c := newAPTCommand(p, p.confPath, jobId, system.FixErrorJobType, p.Indicator, append([]string{errType}, optionArgs...))
 	c.SetEnv(environ)
 	if system.JobErrorType(errType) == system.ErrorDependenciesBroken { // 修复依赖错误的时候，会有需要卸载dde的情况，因此需要用safeStart来进行处理
-		return safeStart(c)
+		return safeStart(c, environ)
 	}
 	return c.Start()
 }
 
 func (p *APTSystem) CheckSystem(jobId string, checkType string, environ map[string]string, cmdArgs map[string]string) error {
+	go func() {
+		indicate := func(progress float64, status system.Status) {
+			p.Indicator(system.JobProgressInfo{
+				JobId:    jobId,
+				Progress: progress,
+				Status:   status,
+			})
+		}
+		indicate(0, system.RunningStatus)
+		err := CheckSystemHealth(environ, checkType, func(progress float64) {
+			indicate(progress, system.RunningStatus)
+		})
+		if err != nil {
+			var jobErr *system.JobError
+			if !errors.As(err, &jobErr) {
+				jobErr = &system.JobError{
+					ErrType:   system.ErrorUnknown,
+					ErrDetail: err.Error(),
+				}
+			}
+			p.Indicator(system.JobProgressInfo{
+				JobId:      jobId,
+				Progress:   -1.0,
+				Status:     system.FailedStatus,
+				Cancelable: true,
+				Error:      jobErr,
+			})
+			return
+		}
+		indicate(1.0, system.SucceedStatus)
+	}()
 	return nil
 }
 
+// CheckSystemHealth 检查包管理系统是否处于可以更新的状态,checkType为system.ThoroughCheckSystem时
+// 除apt-get check外还会检查未配置完成的包和需要apt-get -f修复的包
+func CheckSystemHealth(environ map[string]string, checkType string, progress func(float64)) error {
+	report := func(v float64) {
+		if progress != nil {
+			progress(v)
+		}
+	}
+	report(0)
+	err := CheckPkgSystemError(environ, false)
+	if err != nil {
+		return err
+	}
+	if checkType != system.ThoroughCheckSystem {
+		report(1.0)
+		return nil
+	}
+	report(0.4)
+	// #nosec G204
+	out, err := exec.Command("dpkg", "--audit").CombinedOutput()
+	if len(bytes.TrimSpace(out)) != 0 {
+		return &system.JobError{
+			ErrType:   system.ErrorDpkgInterrupted,
+			ErrDetail: string(out),
+		}
+	}
+	if err != nil {
+		return err
+	}
+	report(0.7)
+	// #nosec G204
+	out, err = system.AptCommand(environ, "apt-get", "-s", "-f", "install", "-o", "Debug::NoLocking=1").CombinedOutput()
+	if err != nil {
+		return parsePkgSystemError(out, []byte(err.Error()))
+	}
+	if brokenPkgs := parseFixBrokenSimulate(out); len(brokenPkgs) != 0 {
+		return &system.JobError{
+			ErrType:   system.ErrorDependenciesBroken,
+			ErrDetail: "packages need to be fixed: " + strings.Join(brokenPkgs, " "),
+		}
+	}
+	report(1.0)
+	return nil
+}
+
+// parseFixBrokenSimulate 解析apt-get -s -f install的输出,返回需要修复的包
+func parseFixBrokenSimulate(out []byte) []string {
+	var pkgs []string
+	found := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "Inst", "Remv", "Conf":
+			if !found[fields[1]] {
+				found[fields[1]] = true
+				pkgs = append(pkgs, fields[1])
+			}
+		}
+	}
+	return pkgs
+}
+
 func (p *APTSystem) initSource(nonUnknownList []string, otherList []string) {
 	err := system.UpdateUnknownSourceDir(nonUnknownList)
 	if err != nil {
@@ -359,14 +1276,18 @@ func (p *APTSystem) initSource(nonUnknownList []string, otherList []string) {
 	}
 }
 
-func ListInstallPackages(packages []string) ([]string, error) {
+func ListInstallPackages(environ map[string]string, confPath string, packages []string) ([]string, error) {
+	return listInstallPackages(environ, confPath, packages)
+}
+
+func listInstallPackages(environ map[string]string, confPath string, packages []string) ([]string, error) {
 	args := []string{
-		"-c", system.LastoreAptV2CommonConfPath,
+		"-c", confPath,
 		"install", "-s",
 		"-o", "Debug::NoLocking=1",
 	}
 	args = append(args, packages...)
-	cmd := exec.Command("apt-get", args...) // #nosec G204
+	cmd := system.AptCommand(environ, "apt-get", args...) // #nosec G204
 	var outBuf bytes.Buffer
 	cmd.Stdout = &outBuf
 	var errBuf bytes.Buffer
@@ -384,24 +1305,163 @@ func ListInstallPackages(packages []string) ([]string, error) {
 	return nil, err
 }
 
+var _versionNotFoundRegexp = regexp.MustCompile(`Version '([^']+)' for '([^']+)' was not found`)
+
+// parseVersionNotFound 返回apt输出中找不到指定版本的包,格式为pkg=version
+func parseVersionNotFound(stderr []byte) []string {
+	var pkgs []string
+	for _, match := range _versionNotFoundRegexp.FindAllSubmatch(stderr, -1) {
+		pkgs = append(pkgs, string(match[2])+"="+string(match[1]))
+	}
+	return pkgs
+}
+
+// CheckVersionsInstallable 校验pkgs(包名->版本)的版本格式并使用option模拟安装,option需要与安装任务的参数一致,包括仓库参数.
+// 仓库中没有指定版本时返回ErrorVersionNotFound
+func CheckVersionsInstallable(environ map[string]string, confPath string, pkgs map[string]string, option map[string]string) error {
+	if len(pkgs) == 0 {
+		return errors.New("empty packages")
+	}
+	optionArgs, err := OptionToArgs(option)
+	if err != nil {
+		return err
+	}
+	var args []string
+	for name, version := range pkgs {
+		_, err := debVersion.Parse(version)
+		if err != nil || version != strings.TrimSpace(version) {
+			return fmt.Errorf("invalid version %q of %q: %v", version, name, err)
+		}
+		args = append(args, name+"="+version)
+	}
+	sort.Strings(args)
+	cmdArgs := append([]string{"-c", confPath, "install", "-s", "-o", "Debug::NoLocking=1"}, optionArgs...)
+	cmd := system.AptCommand(environ, "apt-get", append(cmdArgs, args...)...) // #nosec G204
+	var outBuf bytes.Buffer
+	cmd.Stdout = &outBuf
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	err = cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if missing := parseVersionNotFound(errBuf.Bytes()); len(missing) > 0 {
+		return &system.JobError{
+			ErrType:   system.ErrorVersionNotFound,
+			ErrDetail: "versions not found: " + strings.Join(missing, " "),
+			Packages:  missing,
+		}
+	}
+	if jobErr := parsePkgSystemError(outBuf.Bytes(), errBuf.Bytes()); jobErr != nil {
+		return jobErr
+	}
+	return err
+}
+
 var _installRegex = regexp.MustCompile(`Inst (.*) \[.*] \(([^ ]+) .*\)`)
 var _installRegex2 = regexp.MustCompile(`Inst (.*) \(([^ ]+) .*\)`)
 var _removeRegex = regexp.MustCompile(`Remv (\S+)\s\[([^]]+)]`)
 
+const (
+	// emulateInstallBatchSize 模拟安装时每批的包数量,包数量不超过该值时不分批
+	emulateInstallBatchSize = 200
+	// emulateInstallParallel 同时执行模拟安装的批数
+	emulateInstallParallel = 4
+)
+
 // GenOnlineUpdatePackagesByEmulateInstall option 需要带上仓库参数 // TODO 存在正则范围不够的情况，导致风险，需要替换成ListDistUpgradePackages
-func GenOnlineUpdatePackagesByEmulateInstall(packages []string, option []string) (map[string]system.PackageInfo, map[string]system.PackageInfo, error) {
+// 包数量较多时分批并行模拟安装后合并结果,如果各批结果存在冲突(批之间存在依赖关系导致),则使用全部包重新模拟安装
+func GenOnlineUpdatePackagesByEmulateInstall(environ map[string]string, confPath string, packages []string, option []string) (map[string]system.PackageInfo, map[string]system.PackageInfo, error) {
+	return genOnlineUpdatePackagesByEmulateInstallBatch(environ, confPath, packages, option)
+}
+
+func genOnlineUpdatePackagesByEmulateInstallBatch(environ map[string]string, confPath string, packages []string, option []string) (map[string]system.PackageInfo, map[string]system.PackageInfo, error) {
+	if len(packages) <= emulateInstallBatchSize {
+		return genOnlineUpdatePackagesByEmulateInstall(environ, confPath, packages, option)
+	}
+	var batches [][]string
+	for begin := 0; begin < len(packages); begin += emulateInstallBatchSize {
+		end := begin + emulateInstallBatchSize
+		if end > len(packages) {
+			end = len(packages)
+		}
+		batches = append(batches, packages[begin:end])
+	}
+	type batchResult struct {
+		install map[string]system.PackageInfo
+		remove  map[string]system.PackageInfo
+		err     error
+	}
+	results := make([]batchResult, len(batches))
+	sem := make(chan struct{}, emulateInstallParallel)
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, batch []string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			install, remove, err := genOnlineUpdatePackagesByEmulateInstall(environ, confPath, batch, option)
+			results[i] = batchResult{install: install, remove: remove, err: err}
+		}(i, batch)
+	}
+	wg.Wait()
+
+	allInstallPackages := make(map[string]system.PackageInfo)
+	removePackages := make(map[string]system.PackageInfo)
+	conflict := false
+	for _, result := range results {
+		if result.err != nil {
+			logger.Warning("emulate install by batch failed, retry with all packages:", result.err)
+			conflict = true
+			break
+		}
+		if mergePackageInfoMap(allInstallPackages, result.install) || mergePackageInfoMap(removePackages, result.remove) {
+			conflict = true
+			break
+		}
+	}
+	if !conflict {
+		for name := range allInstallPackages {
+			if _, ok := removePackages[name]; ok {
+				conflict = true
+				break
+			}
+		}
+	}
+	if conflict {
+		logger.Info("emulate install batch results disagree, retry with all packages")
+		return genOnlineUpdatePackagesByEmulateInstall(environ, confPath, packages, option)
+	}
+	return allInstallPackages, removePackages, nil
+}
+
+// mergePackageInfoMap 将src合并到dst,同名包版本不一致时返回true
+func mergePackageInfoMap(dst, src map[string]system.PackageInfo) bool {
+	for name, info := range src {
+		if origin, ok := dst[name]; ok && origin.Version != info.Version {
+			return true
+		}
+		dst[name] = info
+	}
+	return false
+}
+
+func genOnlineUpdatePackagesByEmulateInstall(environ map[string]string, confPath string, packages []string, option []string) (map[string]system.PackageInfo, map[string]system.PackageInfo, error) {
 	allInstallPackages := make(map[string]system.PackageInfo)
 	removePackages := make(map[string]system.PackageInfo)
 	args := []string{
 		"dist-upgrade", "-s",
-		"-c", system.LastoreAptV2CommonConfPath,
+		"-c", confPath,
 		"-o", "Debug::NoLocking=1",
 	}
 	args = append(args, option...)
 	if len(packages) > 0 {
 		args = append(args, packages...)
 	}
-	cmd := exec.Command("apt-get", args...) // #nosec G204
+	cmd := system.AptCommand(environ, "apt-get", args...) // #nosec G204
 	var outBuf bytes.Buffer
 	cmd.Stdout = &outBuf
 	var errBuf bytes.Buffer
@@ -414,6 +1474,7 @@ func GenOnlineUpdatePackagesByEmulateInstall(packages []string, option []string)
 	const upgraded = "The following packages will be upgraded:"
 	const newInstalled = "The following NEW packages will be installed:"
 	const removed = "The following packages will be REMOVED:"
+	deferred := parsePhasedDeferred(outBuf.Bytes())
 	if bytes.Contains(outBuf.Bytes(), []byte(upgraded)) ||
 		bytes.Contains(outBuf.Bytes(), []byte(newInstalled)) ||
 		bytes.Contains(outBuf.Bytes(), []byte(removed)) {
@@ -425,6 +1486,9 @@ func GenOnlineUpdatePackagesByEmulateInstall(packages []string, option []string)
 				matches = _installRegex2.FindStringSubmatch(line)
 			}
 			if len(matches) >= 3 {
+				if _, ok := deferred[matches[1]]; ok {
+					continue
+				}
 				allInstallPackages[matches[1]] = system.PackageInfo{
 					Name:    matches[1],
 					Version: matches[2],
@@ -447,25 +1511,67 @@ func GenOnlineUpdatePackagesByEmulateInstall(packages []string, option []string)
 
 // ListDistUpgradePackages return the pkgs from apt dist-upgrade
 // NOTE: the result strim the arch suffix
-func ListDistUpgradePackages(sourcePath string, option []string) ([]string, error) {
+func ListDistUpgradePackages(environ map[string]string, confPath string, sourcePath string, option []string) ([]string, error) {
+	result, err := listDistUpgrade(environ, confPath, sourcePath, option)
+	return result.Packages, err
+}
+
+// ListDistUpgrade 同ListDistUpgradePackages,并返回更新时会被卸载的包和更新后磁盘空间的变化
+func ListDistUpgrade(environ map[string]string, confPath string, sourcePath string, option []string) (DistUpgradeResult, error) {
+	return listDistUpgrade(environ, confPath, sourcePath, option)
+}
+
+// DistUpgradeResult apt dist-upgrade --assume-no 输出的解析结果
+type DistUpgradeResult struct {
+	Packages   []string // 升级和新安装的包
+	Removed    []string // 会被卸载的包
+	SpaceDelta int64    // 更新后磁盘空间的变化(字节),正数为额外占用,负数为释放
+	SpaceKnown bool     // 输出中没有空间信息时为false
+}
+
+// sourcePathArgs 只使用sourcePath中仓库的apt参数,sourcePath可以是目录或list文件
+func sourcePathArgs(sourcePath string) ([]string, error) {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return []string{"-o", "Dir::Etc::SourceList=/dev/null", "-o", "Dir::Etc::SourceParts=" + sourcePath}, nil
+	}
+	return []string{"-o", "Dir::Etc::SourceList=" + sourcePath, "-o", "Dir::Etc::SourceParts=/dev/null"}, nil
+}
+
+// ListDistUpgradeVersions 返回模拟全量更新时会升级和新安装的包,格式为 包名=目标版本
+func ListDistUpgradeVersions(environ map[string]string, confPath string, sourcePath string, option []string) ([]string, error) {
+	sourceArgs, err := sourcePathArgs(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	install, _, err := genOnlineUpdatePackagesByEmulateInstall(environ, confPath, nil, append(sourceArgs, option...))
+	if err != nil {
+		return nil, err
+	}
+	packages := make([]string, 0, len(install))
+	for name, info := range install {
+		packages = append(packages, name+"="+info.Version)
+	}
+	sort.Strings(packages)
+	return packages, nil
+}
+
+func listDistUpgrade(environ map[string]string, confPath string, sourcePath string, option []string) (DistUpgradeResult, error) {
 	args := []string{
-		"-c", system.LastoreAptV2CommonConfPath,
+		"-c", confPath,
 		"dist-upgrade", "--assume-no",
 		"-o", "Debug::NoLocking=1",
 	}
-	if info, err := os.Stat(sourcePath); err == nil {
-		if info.IsDir() {
-			args = append(args, "-o", "Dir::Etc::SourceList=/dev/null")
-			args = append(args, "-o", "Dir::Etc::SourceParts="+sourcePath)
-		} else {
-			args = append(args, "-o", "Dir::Etc::SourceList="+sourcePath)
-			args = append(args, "-o", "Dir::Etc::SourceParts=/dev/null")
-		}
-	} else {
-		return nil, err
+	sourceArgs, err := sourcePathArgs(sourcePath)
+	if err != nil {
+		return DistUpgradeResult{}, err
 	}
+	args = append(args, sourceArgs...)
 	args = append(args, option...)
-	cmd := exec.Command("apt-get", args...) // #nosec G204
+	cmd := system.AptCommand(environ, "apt-get", args...) // #nosec G204
 	var outBuf bytes.Buffer
 	cmd.Stdout = &outBuf
 	var errBuf bytes.Buffer
@@ -473,18 +1579,213 @@ func ListDistUpgradePackages(sourcePath string, option []string) ([]string, erro
 	// NOTE: 这里不能使用命令的退出码来判断，因为 --assume-no 会让命令的退出码为 1
 	_ = cmd.Run()
 	logger.Debug("cmd is ", cmd.String())
+	result, ok := parseDistUpgradeOutput(outBuf.Bytes())
+	if ok {
+		return result, nil
+	}
+	return DistUpgradeResult{}, parsePkgSystemError(outBuf.Bytes(), errBuf.Bytes())
+}
+
+// parseDistUpgradeOutput 解析dist-upgrade的输出,没有升级、新安装和卸载的包时ok为false
+func parseDistUpgradeOutput(out []byte) (result DistUpgradeResult, ok bool) {
 	const upgraded = "The following packages will be upgraded:"
 	const newInstalled = "The following NEW packages will be installed:"
-	if bytes.Contains(outBuf.Bytes(), []byte(upgraded)) ||
-		bytes.Contains(outBuf.Bytes(), []byte(newInstalled)) {
+	const removed = "The following packages will be REMOVED:"
+	if !bytes.Contains(out, []byte(upgraded)) &&
+		!bytes.Contains(out, []byte(newInstalled)) &&
+		!bytes.Contains(out, []byte(removed)) {
+		return result, false
+	}
+	p := parseAptShowList(bytes.NewReader(out), upgraded)
+	p = append(p, parseAptShowList(bytes.NewReader(out), newInstalled)...)
+	result.Packages = filterPhasedDeferred(p, parsePhasedDeferred(out))
+	for _, name := range parseAptShowList(bytes.NewReader(out), removed) {
+		// 同时清除配置文件的包以*结尾
+		result.Removed = append(result.Removed, strings.TrimSuffix(name, "*"))
+	}
+	result.SpaceDelta, result.SpaceKnown = parseSpaceDelta(out)
+	return result, true
+}
 
-		p := parseAptShowList(bytes.NewReader(outBuf.Bytes()), upgraded)
-		p = append(p, parseAptShowList(bytes.NewReader(outBuf.Bytes()), newInstalled)...)
-		return p, nil
+var _spaceDeltaRegex = regexp.MustCompile(`([0-9][0-9.,]*)\s*(B|kB|KB|MB|GB|TB)\b`)
+
+var _spaceUnits = map[string]float64{
+	"B":  1,
+	"kB": 1000,
+	"KB": 1000,
+	"MB": 1000 * 1000,
+	"GB": 1000 * 1000 * 1000,
+	"TB": 1000 * 1000 * 1000 * 1000,
+}
+
+// parseSpaceDelta 解析apt输出的空间变化,返回有符号的字节数,释放空间时为负数.支持的输出如:
+//
+//	After this operation, 12.3 MB of additional disk space will be used.
+//	After this operation, 1,024 kB disk space will be freed.
+//	解压缩后会消耗 12.3 MB 的额外空间。
+//	解压缩后将会空出 1,024 kB 的空间。
+func parseSpaceDelta(out []byte) (int64, bool) {
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.HasPrefix(line, "After this operation") && !strings.HasPrefix(line, "解压缩后") {
+			continue
+		}
+		matches := _spaceDeltaRegex.FindStringSubmatch(line)
+		if len(matches) < 3 {
+			continue
+		}
+		num, err := parseLocaleNumber(matches[1])
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+		size := int64(math.Round(num * _spaceUnits[matches[2]]))
+		if strings.Contains(line, "freed") || strings.Contains(line, "空出") {
+			size = -size
+		}
+		return size, true
 	}
+	return 0, false
+}
 
-	err := parsePkgSystemError(outBuf.Bytes(), errBuf.Bytes())
-	return nil, err
+// parseLocaleNumber 解析带分隔符的数字,如 1,024 12.3 1.234,5 12,3.
+// 同时存在两种分隔符时最后出现的为小数点;只有一种且其后恰好3位数字时视为千位分隔符
+func parseLocaleNumber(s string) (float64, error) {
+	lastDot := strings.LastIndex(s, ".")
+	lastComma := strings.LastIndex(s, ",")
+	decimalSep := ""
+	switch {
+	case lastDot >= 0 && lastComma >= 0:
+		if lastDot > lastComma {
+			decimalSep = "."
+		} else {
+			decimalSep = ","
+		}
+	case lastDot >= 0 || lastComma >= 0:
+		sep := "."
+		idx := lastDot
+		if lastComma >= 0 {
+			sep = ","
+			idx = lastComma
+		}
+		if strings.Count(s, sep) == 1 && len(s)-idx-1 != 3 {
+			decimalSep = sep
+		}
+	}
+	var intPart, fracPart string
+	if decimalSep != "" {
+		idx := strings.LastIndex(s, decimalSep)
+		intPart, fracPart = s[:idx], s[idx+1:]
+	} else {
+		intPart = s
+	}
+	intPart = strings.NewReplacer(",", "", ".", "").Replace(intPart)
+	if fracPart != "" {
+		intPart += "." + fracPart
+	}
+	return strconv.ParseFloat(intPart, 64)
+}
+
+const phasedDeferredTitle = "The following upgrades have been deferred due to phasing:"
+
+// parsePhasedDeferred 返回因分阶段更新(Phased-Update-Percentage)被推迟的包
+func parsePhasedDeferred(out []byte) map[string]struct{} {
+	deferred := make(map[string]struct{})
+	for _, name := range parseAptShowList(bytes.NewReader(out), phasedDeferredTitle) {
+		deferred[name] = struct{}{}
+	}
+	return deferred
+}
+
+// filterPhasedDeferred coreList等显式指定的包不受分阶段更新限制,需要从可更新列表中去掉被推迟的包
+func filterPhasedDeferred(packages []string, deferred map[string]struct{}) []string {
+	if len(deferred) == 0 {
+		return packages
+	}
+	var result []string
+	for _, name := range packages {
+		if _, ok := deferred[name]; !ok {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+const machineIDFile = "/etc/machine-id"
+
+var _machineIDRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// UnauthenticatedOption 返回允许安装无法验证签名的包的apt配置,allow为false时返回nil,apt会拒绝安装这些包
+func UnauthenticatedOption(allow bool) map[string]string {
+	if !allow {
+		return nil
+	}
+	return map[string]string{
+		"APT::Get::AllowUnauthenticated": "true",
+	}
+}
+
+// PhasedUpdateOption 返回分阶段更新的apt配置.apt默认在chroot和容器中不分阶段,这里固定开启,
+// 并使用machine-id作为种子,保证同一台机器每次检查的结果一致;ignore为true时包含所有分阶段的更新
+func PhasedUpdateOption(ignore bool) map[string]string {
+	if ignore {
+		return map[string]string{
+			"APT::Get::Always-Include-Phased-Updates": "true",
+		}
+	}
+	option := map[string]string{
+		"APT::Get::Phase-Updates": "true",
+	}
+	content, err := os.ReadFile(machineIDFile)
+	if err != nil {
+		logger.Warning(err)
+		return option
+	}
+	if machineID := strings.TrimSpace(string(content)); _machineIDRegex.MatchString(machineID) {
+		option["APT::Machine-ID"] = machineID
+	}
+	return option
+}
+
+// Pipeline-Depth的取值范围,为0时关闭http流水线
+const (
+	MinPipelineDepth = 0
+	MaxPipelineDepth = 32
+)
+
+var _pipelineHostRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+
+// DownloadConcurrencyOption 返回控制apt下载并发的配置:queueMode为host时每个主机一个下载队列,为access时每种下载方式一个队列;
+// pipelineDepth为http流水线深度,小于0时不设置.未设置的项保持apt的默认行为.
+// 部分镜像不能正确处理流水线请求,可以通过hostPipelineDepth按"主机=深度"单独指定,如"mirrors.example.com=0"
+func DownloadConcurrencyOption(queueMode string, pipelineDepth int, hostPipelineDepth []string) (map[string]string, error) {
+	option := make(map[string]string)
+	switch queueMode {
+	case "":
+	case "host", "access":
+		option["Acquire::Queue-Mode"] = queueMode
+	default:
+		return nil, fmt.Errorf("invalid queue mode %q", queueMode)
+	}
+	if pipelineDepth > MaxPipelineDepth {
+		return nil, fmt.Errorf("pipeline depth %d out of range [%d, %d]", pipelineDepth, MinPipelineDepth, MaxPipelineDepth)
+	}
+	if pipelineDepth >= MinPipelineDepth {
+		option["Acquire::http::Pipeline-Depth"] = strconv.Itoa(pipelineDepth)
+	}
+	for _, item := range hostPipelineDepth {
+		host, value, ok := strings.Cut(item, "=")
+		host = strings.TrimSpace(host)
+		if !ok || !_pipelineHostRegexp.MatchString(host) {
+			return nil, fmt.Errorf("invalid pipeline depth override %q", item)
+		}
+		depth, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || depth < MinPipelineDepth || depth > MaxPipelineDepth {
+			return nil, fmt.Errorf("invalid pipeline depth override %q", item)
+		}
+		// apt的http方法优先读取 Acquire::http::<host>::<配置>
+		option[fmt.Sprintf("Acquire::http::%s::Pipeline-Depth", host)] = strconv.Itoa(depth)
+	}
+	return option, nil
 }
 
 func parseAptShowList(r io.Reader, title string) []string {
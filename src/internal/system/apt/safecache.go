@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package apt
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	safecacheScript  = "/var/lib/lastore/scripts/build_safecache.sh"
+	safecacheTimeout = 2 * time.Minute
+)
+
+var safecache = struct {
+	once  sync.Once
+	done  chan struct{}
+	ready bool
+}{
+	done: make(chan struct{}),
+}
+
+// buildSafecache 在后台执行build_safecache.sh,不阻塞守护进程启动,多次调用只会执行一次
+func buildSafecache() {
+	safecache.once.Do(func() {
+		go func() {
+			safecache.ready = runSafecacheScript(safecacheScript, safecacheTimeout)
+			close(safecache.done)
+		}()
+	})
+}
+
+// runSafecacheScript 脚本不存在时视为未就绪,但不影响守护进程的其他功能
+func runSafecacheScript(script string, timeout time.Duration) bool {
+	if _, err := os.Stat(script); err != nil {
+		logger.Infof("skip building safecache: %v", err)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	out, err := exec.CommandContext(ctx, script).CombinedOutput() // #nosec G204
+	output := strings.TrimSpace(string(out))
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.Warningf("%s timed out after %v, output: %s", script, timeout, output)
+		return false
+	}
+	if err != nil {
+		logger.Warningf("%s failed: %v, output: %s", script, err, output)
+		return false
+	}
+	logger.Infof("%s finished in %v", script, time.Since(start))
+	return true
+}
+
+// WaitSafecache 等待safecache构建结束,返回是否构建成功.timeout<=0时一直等待
+func WaitSafecache(timeout time.Duration) bool {
+	buildSafecache()
+	if timeout <= 0 {
+		<-safecache.done
+		return safecache.ready
+	}
+	select {
+	case <-safecache.done:
+		return safecache.ready
+	case <-time.After(timeout):
+		return false
+	}
+}
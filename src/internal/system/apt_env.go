@@ -0,0 +1,62 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package system
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// proxyEnvKeys apt会读取的代理相关环境变量
+var proxyEnvKeys = []string{
+	"http_proxy", "https_proxy", "ftp_proxy", "all_proxy", "no_proxy",
+	"HTTP_PROXY", "HTTPS_PROXY", "FTP_PROXY", "ALL_PROXY", "NO_PROXY",
+}
+
+// ProxyEnviron 以 key=value 的形式返回environ中apt会读取的代理变量,其他变量会被忽略
+func ProxyEnviron(environ map[string]string) []string {
+	var env []string
+	for _, key := range proxyEnvKeys {
+		if value := environ[key]; value != "" {
+			env = append(env, key+"="+value)
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+// mergeEnviron 使用extra覆盖base中的同名变量
+func mergeEnviron(base []string, extra ...string) []string {
+	keys := make(map[string]bool)
+	for _, kv := range extra {
+		keys[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+	env := make([]string, 0, len(base)+len(extra))
+	for _, kv := range base {
+		if keys[strings.SplitN(kv, "=", 2)[0]] {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return append(env, extra...)
+}
+
+// AptCommand 创建apt相关的命令,所有apt、apt-get、apt-cache的调用都应通过该函数.
+// environ为发起调用的任务或请求的环境变量,其中的代理变量覆盖守护进程自身的同名变量,为nil时只使用守护进程的环境变量
+func AptCommand(environ map[string]string, name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...) // #nosec G204
+	cmd.Env = mergeEnviron(os.Environ(), ProxyEnviron(environ)...)
+	return cmd
+}
+
+// AptCommandContext 同AptCommand,ctx结束时终止命令
+func AptCommandContext(ctx context.Context, environ map[string]string, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...) // #nosec G204
+	cmd.Env = mergeEnviron(os.Environ(), ProxyEnviron(environ)...)
+	return cmd
+}
@@ -5,11 +5,13 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type CommandSet interface {
@@ -27,6 +29,8 @@ type Command struct {
 	Cmd      *exec.Cmd
 	cmdMu    sync.Mutex
 	ExitCode int
+	aborted  bool      // 是否由Abort或AbortWithFailed结束
+	prepare  *exec.Cmd // 真正执行前的准备命令,如apt-get -s模拟执行
 
 	pipe *os.File
 
@@ -37,8 +41,32 @@ type Command struct {
 	Stdout   bytes.Buffer
 	Stderr   bytes.Buffer
 	AtExitFn func() bool
+
+	boundaryMu      sync.Mutex
+	downloaded      int  // dlstatus中已下载完成的文件数
+	pauseOnBoundary bool // 下一个文件下载完成后暂停
+	pauseBaseline   int  // 请求暂停时已下载完成的文件数
+
+	// AcceptMediaChange 为true时通过stdin响应apt的media-change请求,需要在Start之前设置
+	AcceptMediaChange bool
+	mediaMu           sync.Mutex
+	mediaInput        *os.File // apt等待更换介质时从stdin读取回车
+	mediaWaiting      bool
+	mediaTimer        *time.Timer
+	mediaTimedOut     bool
+
+	// MaxRuntime 没有进度更新的最长时间,超时后强制结束任务,0表示不限制.需要在Start之前设置
+	MaxRuntime        time.Duration
+	runtimeMu         sync.Mutex
+	runtimeTimer      *time.Timer
+	runtimeProgress   float64
+	runtimeDownloaded int
+	runtimeTimedOut   bool
 }
 
+// MediaChangeTimeout 等待确认介质已插入的时间,超时后任务失败
+var MediaChangeTimeout = 10 * time.Minute
+
 func (c *Command) String() string {
 	return fmt.Sprintf("AptCommand{id:%q, Cancelable:%v, CMD:%q}",
 		c.JobId, c.Cancelable, strings.Join(c.Cmd.Args, " "))
@@ -49,11 +77,15 @@ func (c *Command) SetEnv(envVarMap map[string]string) {
 		return
 	}
 
-	envVarSlice := os.Environ()
+	envVarSlice := c.Cmd.Env
+	if envVarSlice == nil {
+		envVarSlice = os.Environ()
+	}
+	var extra []string
 	for key, value := range envVarMap {
-		envVarSlice = append(envVarSlice, key+"="+value)
+		extra = append(extra, key+"="+value)
 	}
-	c.Cmd.Env = envVarSlice
+	c.Cmd.Env = mergeEnviron(envVarSlice, extra...)
 }
 
 func (c *Command) Start() error {
@@ -69,16 +101,31 @@ func (c *Command) Start() error {
 
 	c.Cmd.ExtraFiles = append(c.Cmd.ExtraFiles, ww)
 
+	if c.AcceptMediaChange && c.Cmd.Stdin == nil {
+		mr, mw, err := os.Pipe()
+		if err != nil {
+			_ = rr.Close()
+			return fmt.Errorf("aptCommand.Start stdin pipe : %v", err)
+		}
+		defer func() {
+			_ = mr.Close()
+		}()
+		c.Cmd.Stdin = mr
+		c.mediaInput = mw
+	}
+
 	c.cmdMu.Lock()
 	err = c.Cmd.Start()
 	c.cmdMu.Unlock()
 	if err != nil {
 		_ = rr.Close()
+		c.closeMediaInput()
 		return err
 	}
 
 	c.pipe = rr
 
+	c.startRuntimeWatchdog()
 	go c.updateProgress()
 
 	go func() {
@@ -102,6 +149,30 @@ func (c *Command) Wait() (err error) {
 	return err
 }
 
+// 每个job保留的输出大小
+const jobLogMaxSize = 32 * 1024
+
+func tailBytes(b []byte, size int) []byte {
+	if len(b) <= size {
+		return b
+	}
+	b = b[len(b)-size:]
+	// 从完整的行开始
+	if idx := bytes.IndexByte(b, '\n'); idx >= 0 {
+		b = b[idx+1:]
+	}
+	return b
+}
+
+func (c *Command) tailLog() string {
+	var buf bytes.Buffer
+	buf.WriteString("stdout:\n")
+	buf.Write(tailBytes(c.Stdout.Bytes(), jobLogMaxSize/2))
+	buf.WriteString("\nstderr:\n")
+	buf.Write(tailBytes(c.Stderr.Bytes(), jobLogMaxSize/2))
+	return buf.String()
+}
+
 const (
 	ExitSuccess = 0
 	ExitFailure = 1
@@ -113,12 +184,21 @@ func (c *Command) atExit() {
 	if err != nil {
 		logger.Warning("failed to close pipe:", err)
 	}
+	c.closeMediaInput()
+	c.stopRuntimeWatchdog()
 
 	logger.Infof("job %s Stdout: %s", c.JobId, c.Stdout.Bytes())
 	logger.Infof("job %s Stderr: %s", c.JobId, c.Stderr.Bytes())
 
 	c.CmdSet.RemoveCMD(c.JobId)
 
+	log := c.tailLog()
+	indicator := c.Indicator
+	c.Indicator = func(info JobProgressInfo) {
+		info.Log = log
+		indicator(info)
+	}
+
 	if c.AtExitFn != nil {
 		shouldReturn := c.AtExitFn()
 		if shouldReturn {
@@ -126,6 +206,34 @@ func (c *Command) atExit() {
 		}
 	}
 
+	if c.ExitCode == ExitFailure && c.runtimeExceeded() {
+		c.Indicator(JobProgressInfo{
+			JobId:      c.JobId,
+			Status:     FailedStatus,
+			Progress:   -1.0,
+			Cancelable: true,
+			Error: &JobError{
+				ErrType:   ErrorJobTimeout,
+				ErrDetail: fmt.Sprintf("no progress in %v", c.MaxRuntime),
+			},
+		})
+		return
+	}
+
+	if c.ExitCode == ExitFailure && c.mediaChangeTimedOut() {
+		c.Indicator(JobProgressInfo{
+			JobId:      c.JobId,
+			Status:     FailedStatus,
+			Progress:   -1.0,
+			Cancelable: true,
+			Error: &JobError{
+				ErrType:   ErrorMediaChangeTimeout,
+				ErrDetail: fmt.Sprintf("no media inserted in %v", MediaChangeTimeout),
+			},
+		})
+		return
+	}
+
 	switch c.ExitCode {
 	case ExitSuccess:
 		c.Indicator(JobProgressInfo{
@@ -166,22 +274,34 @@ func (c *Command) atExit() {
 }
 
 func (c *Command) IndicateFailed(errType JobErrorType, errDetail string, isFatalErr bool) {
-	logger.Warningf("IndicateFailed: type: %s, detail: %s", errType, errDetail)
+	c.IndicateJobError(&JobError{
+		ErrType:   errType,
+		ErrDetail: errDetail,
+	}, isFatalErr)
+}
+
+// IndicateJobError 以完整的JobError结束任务,用于需要携带额外信息(如相关的包)的错误
+func (c *Command) IndicateJobError(jobErr *JobError, isFatalErr bool) {
+	logger.Warningf("IndicateFailed: type: %s, detail: %s", jobErr.ErrType, jobErr.ErrDetail)
 	progressInfo := JobProgressInfo{
 		JobId:      c.JobId,
 		Progress:   -1.0,
 		Status:     FailedStatus,
 		Cancelable: true,
-		Error: &JobError{
-			ErrType:   errType,
-			ErrDetail: errDetail,
-		},
+		Error:      jobErr,
 		FatalError: isFatalErr,
 	}
 	c.CmdSet.RemoveCMD(c.JobId)
 	c.Indicator(progressInfo)
 }
 
+// Aborted 命令是否被主动终止,用于在AtExitFn中区分取消和命令本身失败
+func (c *Command) Aborted() bool {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	return c.aborted
+}
+
 func (c *Command) Abort() error {
 	return c.abort(false)
 }
@@ -191,14 +311,30 @@ func (c *Command) AbortWithFailed() error {
 }
 
 func (c *Command) abort(withFailed bool) error {
-	if c.Cancelable {
+	return c.kill(withFailed, false)
+}
+
+// kill 终止命令,force为true时不检查Cancelable
+func (c *Command) kill(withFailed bool, force bool) error {
+	if c.Cancelable || force {
 		c.cmdMu.Lock()
 		defer c.cmdMu.Unlock()
+		if c.Cmd.Process == nil && c.prepare != nil && c.prepare.Process != nil {
+			logger.Debugf("Abort prepare of Command: %v\n", c)
+			c.aborted = true
+			if withFailed {
+				c.ExitCode = ExitFailure
+			} else {
+				c.ExitCode = ExitPause
+			}
+			return c.prepare.Process.Kill()
+		}
 		if c.Cmd.Process == nil {
 			return errors.New("the process has not yet started")
 		}
 
 		logger.Debugf("Abort Command: %v\n", c)
+		c.aborted = true
 		if withFailed {
 			c.ExitCode = ExitFailure
 		} else {
@@ -214,21 +350,247 @@ func (c *Command) abort(withFailed bool) error {
 	return NotSupportError
 }
 
+// StartPrepare 启动真正执行前的准备命令,期间任务处于准备状态,Abort会终止准备命令
+func (c *Command) StartPrepare(prepare *exec.Cmd) error {
+	c.Indicator(JobProgressInfo{
+		JobId:       c.JobId,
+		Status:      RunningStatus,
+		Progress:    0,
+		Description: "preparing",
+		Cancelable:  c.Cancelable,
+	})
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+	c.prepare = prepare
+	return prepare.Start()
+}
+
+// WaitPrepare 等待准备命令结束,err为准备命令的执行结果.
+// 准备期间被终止时已通知任务结果,proceed为false,不应再执行Start
+func (c *Command) WaitPrepare() (proceed bool, err error) {
+	err = c.prepare.Wait()
+	c.cmdMu.Lock()
+	c.prepare = nil
+	aborted := c.aborted
+	c.cmdMu.Unlock()
+	if aborted {
+		c.indicateAborted()
+		return false, err
+	}
+	return true, err
+}
+
+// indicateAborted 在真正的命令启动前被终止时结束任务
+func (c *Command) indicateAborted() {
+	c.CmdSet.RemoveCMD(c.JobId)
+	info := JobProgressInfo{
+		JobId:      c.JobId,
+		Status:     PausedStatus,
+		Progress:   -1.0,
+		Cancelable: true,
+	}
+	if c.ExitCode == ExitFailure {
+		info.Status = FailedStatus
+		info.Error = &JobError{
+			ErrType:   ErrorUnknown,
+			ErrDetail: "aborted while preparing",
+		}
+	}
+	c.Indicator(info)
+}
+
+// PauseAtFileBoundary 在正在下载的文件完成后暂停任务,已下载的文件保留在缓存中,之后可以继续使用.
+// timeout内没有文件下载完成时直接暂停,未完成的文件由apt在下次下载时续传.
+func (c *Command) PauseAtFileBoundary(timeout time.Duration) error {
+	if !c.Cancelable {
+		return NotSupportError
+	}
+	c.boundaryMu.Lock()
+	c.pauseOnBoundary = true
+	c.pauseBaseline = c.downloaded
+	c.boundaryMu.Unlock()
+	time.AfterFunc(timeout, func() {
+		if c.takePauseOnBoundary(-1) {
+			logger.Infof("job %s did not reach a file boundary in %v, pause now", c.JobId, timeout)
+			err := c.Abort()
+			if err != nil {
+				logger.Warning(err)
+			}
+		}
+	})
+	return nil
+}
+
+// takePauseOnBoundary 判断是否需要在此时暂停,downloaded<0表示不检查文件边界.每次请求只会返回一次true
+func (c *Command) takePauseOnBoundary(downloaded int) bool {
+	c.boundaryMu.Lock()
+	defer c.boundaryMu.Unlock()
+	if downloaded > c.downloaded {
+		c.downloaded = downloaded
+	}
+	if !c.pauseOnBoundary || (downloaded >= 0 && c.downloaded <= c.pauseBaseline) {
+		return false
+	}
+	c.pauseOnBoundary = false
+	return true
+}
+
+// ConfirmMediaChange 用户插入apt请求的介质后调用,向apt的stdin写入回车使其继续
+func (c *Command) ConfirmMediaChange() error {
+	c.mediaMu.Lock()
+	defer c.mediaMu.Unlock()
+	if !c.mediaWaiting || c.mediaInput == nil {
+		return errors.New("the job is not waiting for media change")
+	}
+	c.mediaWaiting = false
+	c.mediaTimer.Stop()
+	_, err := c.mediaInput.Write([]byte("\n"))
+	return err
+}
+
+// waitMediaChange 开始等待用户确认,timeout内没有确认时任务失败.apt检查介质不正确时会再次请求,重新计时
+func (c *Command) waitMediaChange(timeout time.Duration) {
+	c.mediaMu.Lock()
+	defer c.mediaMu.Unlock()
+	if c.mediaInput == nil {
+		logger.Warningf("job %s can not respond to media change", c.JobId)
+		return
+	}
+	if c.mediaTimer != nil {
+		c.mediaTimer.Stop()
+	}
+	c.mediaWaiting = true
+	c.mediaTimer = time.AfterFunc(timeout, func() {
+		c.mediaMu.Lock()
+		if !c.mediaWaiting {
+			c.mediaMu.Unlock()
+			return
+		}
+		c.mediaWaiting = false
+		c.mediaTimedOut = true
+		c.mediaMu.Unlock()
+		logger.Warningf("job %s wait media change timeout", c.JobId)
+		err := c.AbortWithFailed()
+		if err != nil {
+			logger.Warning(err)
+		}
+	})
+}
+
+func (c *Command) mediaChangeTimedOut() bool {
+	c.mediaMu.Lock()
+	defer c.mediaMu.Unlock()
+	return c.mediaTimedOut
+}
+
+func (c *Command) closeMediaInput() {
+	c.mediaMu.Lock()
+	defer c.mediaMu.Unlock()
+	if c.mediaTimer != nil {
+		c.mediaTimer.Stop()
+	}
+	c.mediaWaiting = false
+	if c.mediaInput != nil {
+		_ = c.mediaInput.Close()
+		c.mediaInput = nil
+	}
+}
+
+// startRuntimeWatchdog 开始计时,MaxRuntime内没有进度更新时强制结束命令,任务以ErrorJobTimeout失败
+func (c *Command) startRuntimeWatchdog() {
+	if c.MaxRuntime <= 0 {
+		return
+	}
+	c.runtimeMu.Lock()
+	defer c.runtimeMu.Unlock()
+	c.runtimeTimer = time.AfterFunc(c.MaxRuntime, func() {
+		c.runtimeMu.Lock()
+		if c.runtimeTimer == nil {
+			c.runtimeMu.Unlock()
+			return
+		}
+		c.runtimeTimedOut = true
+		c.runtimeMu.Unlock()
+		logger.Warningf("job %s has no progress in %v, kill it", c.JobId, c.MaxRuntime)
+		// 超时说明apt已经卡住,不可取消的阶段也需要结束,dpkg中断由任务失败后的修复流程处理
+		err := c.kill(true, true)
+		if err != nil {
+			logger.Warning(err)
+		}
+	})
+}
+
+// resetRuntimeWatchdog 进度变化或有新的文件下载完成时重新计时,进度没有变化的输出不重新计时
+func (c *Command) resetRuntimeWatchdog(info JobProgressInfo) {
+	c.runtimeMu.Lock()
+	defer c.runtimeMu.Unlock()
+	if c.runtimeTimer == nil || c.runtimeTimedOut {
+		return
+	}
+	if info.Progress == c.runtimeProgress && info.Downloaded <= c.runtimeDownloaded {
+		return
+	}
+	c.runtimeProgress = info.Progress
+	if info.Downloaded > c.runtimeDownloaded {
+		c.runtimeDownloaded = info.Downloaded
+	}
+	c.runtimeTimer.Reset(c.MaxRuntime)
+}
+
+func (c *Command) stopRuntimeWatchdog() {
+	c.runtimeMu.Lock()
+	defer c.runtimeMu.Unlock()
+	if c.runtimeTimer != nil {
+		c.runtimeTimer.Stop()
+		c.runtimeTimer = nil
+	}
+}
+
+func (c *Command) runtimeExceeded() bool {
+	c.runtimeMu.Lock()
+	defer c.runtimeMu.Unlock()
+	return c.runtimeTimedOut
+}
+
 func (c *Command) updateProgress() {
-	b := bufio.NewReader(c.pipe)
+	ScanProgressInfo(c.pipe, c.JobId, c.ParseProgressInfo, func(info JobProgressInfo) {
+		c.Cancelable = info.Cancelable
+		c.resetRuntimeWatchdog(info)
+		if info.MediaChange != nil {
+			c.waitMediaChange(MediaChangeTimeout)
+		}
+		c.Indicator(info)
+		if c.takePauseOnBoundary(info.Downloaded) {
+			logger.Infof("job %s reached a file boundary, pause now", c.JobId)
+			err := c.Abort()
+			if err != nil {
+				logger.Warning(err)
+			}
+		}
+	})
+}
+
+// ScanProgressInfo 从r中读取进度信息,只解析以换行结尾的完整记录,被拆分读取的记录会缓存到读到换行为止.
+// 无法解析的记录直接跳过,结尾处不完整的记录会被丢弃.
+func ScanProgressInfo(r io.Reader, jobId string, parse ParseProgressInfo, fn func(JobProgressInfo)) {
+	b := bufio.NewReader(r)
 	for {
 		line, err := b.ReadString('\n')
 		if err != nil {
+			if strings.TrimSpace(line) != "" {
+				logger.Debugf("job %s drop incomplete progress line: %q", jobId, line)
+			}
 			return
 		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
 
-		info, err := c.ParseProgressInfo(c.JobId, line)
+		info, err := parse(jobId, line)
 		if err != nil {
-			logger.Errorf("aptCommand.updateProgress %v -> %v\n", info, err)
+			logger.Debugf("job %s skip progress line %q: %v", jobId, line, err)
 			continue
 		}
-
-		c.Cancelable = info.Cancelable
-		c.Indicator(info)
+		fn(info)
 	}
 }
@@ -7,12 +7,13 @@ package system
 import (
 	"bufio"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"regexp"
 	"strings"
 	"syscall"
+	"time"
 	"unicode"
 
 	grub2 "github.com/linuxdeepin/go-dbus-factory/com.deepin.daemon.grub2"
@@ -113,11 +114,21 @@ const (
 	ErrorUnauthenticatedPackages JobErrorType = "unauthenticatedPackages"
 	ErrorOperationNotPermitted   JobErrorType = "operationNotPermitted"
 	ErrorIndexDownloadFailed     JobErrorType = "IndexDownloadFailed"
+	ErrorIndexNetworkFailed      JobErrorType = "indexNetworkFailed" // 域名解析、连接、TLS握手等网络问题导致索引下载失败,可以重试
+	ErrorIndexNotFound           JobErrorType = "indexNotFound"      // 仓库中不存在对应的索引(404、没有Release文件),通常是仓库配置错误,重试无效
+	ErrorReleaseExpired          JobErrorType = "releaseExpired"     // 仓库的Release文件已过期,重试无效
 	ErrorIO                      JobErrorType = "ioError"
 	ErrorDamagePackage           JobErrorType = "damagePackage" // 包损坏,需要删除后重新下载或者安装
 	ErrorInvalidSourcesList      JobErrorType = "invalidSourceList"
 	ErrorPlatformUnreachable     JobErrorType = "platformUnreachable"
 	ErrorOfflineCheck            JobErrorType = "offlineCheckError"
+	ErrorDangerousRemoval        JobErrorType = "removeDDE"              // 操作会卸载受保护的包,JobError.Packages为这些包;沿用removeDDE兼容已有客户端
+	ErrorMediaChangeTimeout      JobErrorType = "mediaChangeTimeout"     // 等待插入光盘或U盘超时
+	ErrorOfflineRepoUnavailable  JobErrorType = "offlineRepoUnavailable" // file:仓库目录不存在或离线更新包已被卸载,需要重新导入离线更新包
+	ErrorOupSystemTypeMismatch   JobErrorType = "oupSystemTypeMismatch"  // 离线更新包适用于其他系统版本
+	ErrorOupArchMismatch         JobErrorType = "oupArchMismatch"        // 离线更新包适用于其他架构
+	ErrorVersionNotFound         JobErrorType = "versionNotFound"        // 仓库中没有指定的版本,JobError.Packages为这些包
+	ErrorJobTimeout              JobErrorType = "jobTimeout"             // 任务长时间没有进度,被强制结束
 
 	ErrorMissCoreFile  JobErrorType = "missCoreFile"
 	ErrorScript        JobErrorType = "scriptError"
@@ -222,7 +233,7 @@ func HandleDelayPackage(hold bool, packages []string) {
 		action,
 	}
 	args = append(args, packages...)
-	err := exec.Command("apt-mark", args...).Run()
+	err := AptCommand(nil, "apt-mark", args...).Run()
 	if err != nil {
 		logger.Warning(err)
 	}
@@ -335,3 +346,101 @@ func CheckLock(p string) (string, bool) {
 
 	return "", false
 }
+
+// PackageSystemLockFiles dpkg和apt使用的锁文件,按apt加锁的顺序排列
+var PackageSystemLockFiles = []string{
+	"/var/lib/dpkg/lock-frontend",
+	"/var/lib/dpkg/lock",
+	"/var/cache/apt/archives/lock",
+	"/var/lib/apt/lists/lock",
+}
+
+// lockHolder 返回文件是否被其他进程加锁及持有锁的进程号,进程号无法获取时为0
+func lockHolder(p string) (locked bool, pid int) {
+	// #nosec G304
+	file, err := os.Open(p)
+	if err != nil {
+		return false, 0
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	flockT := syscall.Flock_t{
+		Type:   syscall.F_WRLCK,
+		Whence: io.SeekStart,
+	}
+	err = syscall.FcntlFlock(file.Fd(), syscall.F_GETLK, &flockT)
+	if err != nil {
+		logger.Warningf("unable to check file %q lock status: %s", p, err)
+		return false, 0
+	}
+	if flockT.Type == syscall.F_UNLCK {
+		return false, 0
+	}
+	// 持有者在其他pid命名空间或使用OFD锁时没有有效的进程号
+	if flockT.Pid <= 0 {
+		return true, 0
+	}
+	return true, int(flockT.Pid)
+}
+
+// LockFile 与apt相同,对path加fcntl写锁,被其他进程占用时每秒重试一次,超过timeout返回错误.
+// 返回的unlock用于释放锁
+func LockFile(path string, timeout time.Duration) (unlock func(), err error) {
+	// #nosec G304
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	flockT := syscall.Flock_t{
+		Type:   syscall.F_WRLCK,
+		Whence: io.SeekStart,
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &flockT)
+		if err == nil {
+			break
+		}
+		if (err != syscall.EAGAIN && err != syscall.EACCES) || time.Now().After(deadline) {
+			_ = file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+		}
+		time.Sleep(time.Second)
+	}
+	return func() {
+		_ = file.Close()
+	}, nil
+}
+
+// processName 返回进程名,进程已经退出时返回错误
+func processName(pid int) (string, error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// PackageSystemBusy 返回dpkg或apt是否被其他进程锁定,以及持有锁的进程号和进程名.
+// 无法获取持有者时pid为0、name为空;查询期间持有者退出并释放了锁时继续检查其他锁文件
+func PackageSystemBusy() (busy bool, pid int, name string) {
+	for _, p := range PackageSystemLockFiles {
+		locked, holder := lockHolder(p)
+		if !locked {
+			continue
+		}
+		if holder == 0 {
+			return true, 0, ""
+		}
+		name, err := processName(holder)
+		if err != nil {
+			if locked, _ := lockHolder(p); !locked {
+				continue
+			}
+			return true, holder, ""
+		}
+		return true, holder, name
+	}
+	return false, 0, ""
+}
@@ -3,6 +3,7 @@ package dut
 import (
 	"encoding/json"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -31,17 +32,22 @@ func NewSystem(nonUnknownList []string, otherList []string) system.System {
 }
 
 func OptionToArgs(options map[string]string) []string {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 	var args []string
-	for key, value := range options { // dut 命令执行参数
+	for _, key := range keys { // dut 命令执行参数
 		args = append(args, key)
-		args = append(args, value)
+		args = append(args, options[key])
 	}
 	return args
 }
 
 func (p *DutSystem) UpdateSource(jobId string, environ map[string]string, args map[string]string) error {
 	// 依赖错误放到后面检查
-	// err := checkSystemDependsError()
+	// err := checkSystemDependsError(environ)
 	// if err != nil {
 	// 	return err
 	// }
@@ -49,7 +55,7 @@ func (p *DutSystem) UpdateSource(jobId string, environ map[string]string, args m
 }
 
 func (p *DutSystem) DistUpgrade(jobId string, packages []string, environ map[string]string, args map[string]string) error {
-	err := checkSystemDependsError()
+	err := checkSystemDependsError(environ)
 	if err != nil {
 		return err
 	}
@@ -66,8 +72,8 @@ func (p *DutSystem) CheckSystem(jobId string, checkType string, environ map[stri
 	return c.Start()
 }
 
-func checkSystemDependsError() error {
-	err := apt.CheckPkgSystemError(false)
+func checkSystemDependsError(environ map[string]string) error {
+	err := apt.CheckPkgSystemError(environ, false)
 	if err != nil {
 		logger.Warningf("apt-get check failed:%v", err)
 		return err
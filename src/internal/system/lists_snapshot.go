@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package system
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// AbortedPartialDir 检查更新被取消时,partial目录中未完成的文件会移动到该目录,下次检查更新前清理
+func AbortedPartialDir(partialDir string) string {
+	return partialDir + ".aborted"
+}
+
+// ListsSnapshot apt-get update前lists目录的快照.apt更新索引时通过rename替换文件,不会原地修改,
+// 因此使用硬链接保存即可,不需要复制文件内容.
+type ListsSnapshot struct {
+	dir    string
+	backup string
+}
+
+// SnapshotLists 为dir中的索引文件创建快照.每次使用单独的临时目录,与dir在同一个文件系统中才能创建硬链接,
+// 任务结束时需要调用Restore或Discard删除
+func SnapshotLists(dir string) (*ListsSnapshot, error) {
+	backup, err := os.MkdirTemp(filepath.Dir(dir), "."+filepath.Base(dir)+".snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	s := &ListsSnapshot{
+		dir:    dir,
+		backup: backup,
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		_ = os.RemoveAll(s.backup)
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		err = os.Link(filepath.Join(dir, entry.Name()), filepath.Join(s.backup, entry.Name()))
+		if err != nil {
+			_ = os.RemoveAll(s.backup)
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Restore 将lists目录恢复到快照时的状态,并把partial中未完成的文件移到AbortedPartialDir,防止下次断点续传时使用不完整的文件.
+// 无论是否恢复成功都会删除快照
+func (s *ListsSnapshot) Restore() error {
+	defer s.Discard()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		// lock由apt管理,不需要恢复
+		if !entry.Type().IsRegular() || entry.Name() == "lock" {
+			continue
+		}
+		err = os.Remove(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	backups, err := os.ReadDir(s.backup)
+	if err != nil {
+		return err
+	}
+	for _, entry := range backups {
+		if entry.Name() == "lock" {
+			continue
+		}
+		err = os.Link(filepath.Join(s.backup, entry.Name()), filepath.Join(s.dir, entry.Name()))
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	err = movePartialAside(filepath.Join(s.dir, "partial"))
+	if err != nil {
+		logger.Warning(err)
+	}
+	return nil
+}
+
+// Discard 删除快照,检查更新正常结束或无法启动时调用
+func (s *ListsSnapshot) Discard() {
+	err := os.RemoveAll(s.backup)
+	if err != nil {
+		logger.Warning(err)
+	}
+}
+
+func movePartialAside(partialDir string) error {
+	entries, err := os.ReadDir(partialDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	aborted := AbortedPartialDir(partialDir)
+	err = os.MkdirAll(aborted, 0755)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = os.Rename(filepath.Join(partialDir, entry.Name()), filepath.Join(aborted, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
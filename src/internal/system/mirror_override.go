@@ -0,0 +1,242 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MirrorOverrideDir 单次任务临时替换镜像时生成的仓库配置和索引目录
+var MirrorOverrideDir = "/var/lib/lastore/mirror-override"
+
+// MirrorSourcePartsKey 任务的参数中包含该项时,任务命令执行前先从该目录中的镜像仓库下载索引,不会传给apt
+const MirrorSourcePartsKey = "Lastore::MirrorSourceParts"
+
+// NormalizeMirrorURL 校验镜像地址,只允许http和https,返回以/结尾的地址
+func NormalizeMirrorURL(mirror string) (string, error) {
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return "", fmt.Errorf("invalid mirror %q: %v", mirror, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil ||
+		u.RawQuery != "" || u.Fragment != "" || strings.ContainsAny(mirror, " \t\r\n[]#\"'\\") {
+		return "", fmt.Errorf("invalid mirror %q", mirror)
+	}
+	return strings.TrimSuffix(u.String(), "/") + "/", nil
+}
+
+// uriToListPrefix 与apt的URItoFileName一致,返回仓库地址对应的索引文件名前缀
+func uriToListPrefix(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	s := u.Host + u.Path
+	if u.Host != "" && !strings.HasPrefix(u.Path, "/") {
+		s = u.Host + "/" + u.Path
+	}
+	if !strings.HasSuffix(s, "/") {
+		s += "/"
+	}
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= 0x20 || c >= 0x7f || strings.IndexByte("\\|{}[]<>\"^~_=!@#$%^*", c) >= 0 {
+			fmt.Fprintf(&buf, "%%%02x", c)
+			continue
+		}
+		if c == '/' {
+			c = '_'
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
+
+// rewriteSourceURIs 将单行格式sources.list中所有仓库地址替换为mirror,其余内容和注释保持不变,返回新内容和被替换的地址
+func rewriteSourceURIs(content []byte, mirror string) ([]byte, []string) {
+	var out bytes.Buffer
+	var uris []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		code := line
+		if idx := strings.Index(code, "#"); idx >= 0 {
+			code = code[:idx]
+		}
+		fields := fieldRanges(code)
+		if len(fields) >= 3 && (code[fields[0][0]:fields[0][1]] == "deb" || code[fields[0][0]:fields[0][1]] == "deb-src") {
+			i := 1
+			if strings.HasPrefix(code[fields[i][0]:fields[i][1]], "[") {
+				for i < len(fields) && !strings.HasSuffix(code[fields[i][0]:fields[i][1]], "]") {
+					i++
+				}
+				i++
+			}
+			if i < len(fields) {
+				start, end := fields[i][0], fields[i][1]
+				uris = append(uris, line[start:end])
+				line = line[:start] + mirror + line[end:]
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), uris
+}
+
+// fieldRanges 与strings.Fields相同按空白切分,返回每个字段在s中的起止位置
+func fieldRanges(s string) [][2]int {
+	var ranges [][2]int
+	start := -1
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			if start >= 0 {
+				ranges = append(ranges, [2]int{start, i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		ranges = append(ranges, [2]int{start, len(s)})
+	}
+	return ranges
+}
+
+func sourceFilesOf(path string) []string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if !info.IsDir() {
+		return []string{path}
+	}
+	files, _ := filepath.Glob(filepath.Join(path, "*.list"))
+	return files
+}
+
+func realPath(path string) string {
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		return p
+	}
+	return path
+}
+
+// ApplyMirrorOverride 只对本次任务把option中属于systemSource的仓库地址替换为mirror,不修改系统的仓库配置.
+// 其他仓库沿用系统的索引,镜像的索引由apt后端在任务命令执行前下载(见MirrorSourcePartsKey);cleanup在任务结束后删除临时文件,
+// option中没有systemSource时返回nil
+func ApplyMirrorOverride(option map[string]string, systemSource, mirror string) (cleanup func(), err error) {
+	mirror, err = NormalizeMirrorURL(mirror)
+	if err != nil {
+		return nil, err
+	}
+	var sources []string
+	if list := option["Dir::Etc::SourceList"]; list != "" && list != "/dev/null" {
+		sources = append(sources, list)
+	}
+	if parts := option["Dir::Etc::SourceParts"]; parts != "" && parts != "/dev/null" {
+		sources = append(sources, sourceFilesOf(parts)...)
+	}
+	systemFiles := make(map[string]bool)
+	for _, file := range sourceFilesOf(systemSource) {
+		systemFiles[realPath(file)] = true
+	}
+	hasSystemSource := false
+	for _, source := range sources {
+		hasSystemSource = hasSystemSource || systemFiles[realPath(source)]
+	}
+	if !hasSystemSource {
+		return nil, nil
+	}
+
+	err = os.MkdirAll(MirrorOverrideDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(MirrorOverrideDir, "job-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup = func() {
+		_ = os.RemoveAll(dir)
+	}
+	sourceDir := filepath.Join(dir, "sources.list.d")
+	mirrorSourceDir := filepath.Join(dir, "mirror.list.d") // 只包含替换后的系统仓库,用于下载镜像的索引
+	listsDir := filepath.Join(dir, "lists")
+	for _, d := range []string{sourceDir, mirrorSourceDir, filepath.Join(listsDir, "partial")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	var systemPrefixes []string // 被替换的原地址的索引前缀
+	for i, source := range sources {
+		content, err := os.ReadFile(source)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		name := fmt.Sprintf("%02d-%s", i, strings.TrimSuffix(filepath.Base(source), ".list")+".list")
+		if systemFiles[realPath(source)] {
+			var uris []string
+			content, uris = rewriteSourceURIs(content, mirror)
+			for _, uri := range uris {
+				systemPrefixes = append(systemPrefixes, uriToListPrefix(uri))
+			}
+			if err := os.WriteFile(filepath.Join(mirrorSourceDir, name), content, 0644); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+		if err := os.WriteFile(filepath.Join(sourceDir, name), content, 0644); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	originLists := option["Dir::State::lists"]
+	if originLists == "" {
+		originLists = OnlineListPath
+	}
+	entries, err := os.ReadDir(originLists)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == "lock" || hasAnyPrefix(entry.Name(), systemPrefixes) {
+			continue
+		}
+		err := os.Symlink(filepath.Join(originLists, entry.Name()), filepath.Join(listsDir, entry.Name()))
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	option["Dir::Etc::SourceList"] = "/dev/null"
+	option["Dir::Etc::SourceParts"] = sourceDir
+	option["Dir::State::lists"] = listsDir
+	option[MirrorSourcePartsKey] = mirrorSourceDir
+	return cleanup, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// TrustedKeyDir apt信任的仓库公钥目录
+var TrustedKeyDir = "/etc/apt/trusted.gpg.d"
+
+const (
+	sourceKeyPrefix  = "lastore-"
+	armoredKeyHeader = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	maxSourceKeySize = 1024 * 1024
+)
+
+var _fingerprintRegex = regexp.MustCompile(`^[0-9A-F]{40}$`)
+
+// parseKeyFingerprints 解析gpg --with-colons的输出,返回主密钥的指纹;包含私钥时返回错误
+func parseKeyFingerprints(out []byte) ([]string, error) {
+	var fingerprints []string
+	var inPub bool
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		switch fields[0] {
+		case "sec", "ssb":
+			return nil, errors.New("key data contains secret key")
+		case "pub":
+			inPub = true
+		case "sub", "uid":
+			inPub = false
+		case "fpr":
+			// 只取紧跟在pub后的指纹,子密钥的指纹忽略
+			if inPub && len(fields) > 9 && _fingerprintRegex.MatchString(fields[9]) {
+				fingerprints = append(fingerprints, fields[9])
+			}
+			inPub = false
+		}
+	}
+	if len(fingerprints) == 0 {
+		return nil, errors.New("no public key found in key data")
+	}
+	return fingerprints, nil
+}
+
+func sourceKeyPath(fingerprint string, armored bool) string {
+	ext := ".gpg"
+	if armored {
+		ext = ".asc"
+	}
+	return filepath.Join(TrustedKeyDir, sourceKeyPrefix+fingerprint+ext)
+}
+
+// ImportSourceKey 校验公钥后写入TrustedKeyDir,返回公钥指纹.keyData支持二进制和ascii armor两种格式,只允许包含一个公钥
+func ImportSourceKey(keyData []byte) (string, error) {
+	if len(keyData) == 0 || len(keyData) > maxSourceKeySize {
+		return "", fmt.Errorf("invalid key size: %d", len(keyData))
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("gpg", "--batch", "--no-tty", "--no-options", "--with-colons", "--show-keys")
+	cmd.Stdin = bytes.NewReader(keyData)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("malformed key: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	fingerprints, err := parseKeyFingerprints(out)
+	if err != nil {
+		return "", err
+	}
+	if len(fingerprints) != 1 {
+		return "", fmt.Errorf("key data contains %d public keys, expect 1", len(fingerprints))
+	}
+	fingerprint := fingerprints[0]
+	armored := bytes.HasPrefix(bytes.TrimSpace(keyData), []byte(armoredKeyHeader))
+	err = os.MkdirAll(TrustedKeyDir, 0755)
+	if err != nil {
+		return "", err
+	}
+	// 先写临时文件再rename,防止apt读取到不完整的公钥
+	tmp, err := os.CreateTemp(TrustedKeyDir, "."+sourceKeyPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	_, err = tmp.Write(keyData)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(tmp.Name(), sourceKeyPath(fingerprint, armored))
+	if err != nil {
+		return "", err
+	}
+	logger.Infof("import source key %s", fingerprint)
+	return fingerprint, nil
+}
+
+// RemoveSourceKey 删除通过ImportSourceKey导入的公钥,其他途径安装的公钥不处理
+func RemoveSourceKey(fingerprint string) error {
+	fingerprint = strings.ToUpper(strings.ReplaceAll(fingerprint, " ", ""))
+	if !_fingerprintRegex.MatchString(fingerprint) {
+		return fmt.Errorf("invalid fingerprint: %q", fingerprint)
+	}
+	var removed bool
+	for _, armored := range []bool{false, true} {
+		err := os.Remove(sourceKeyPath(fingerprint, armored))
+		if err == nil {
+			removed = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !removed {
+		return NotFoundError("source key " + fingerprint)
+	}
+	logger.Infof("remove source key %s", fingerprint)
+	return nil
+}
@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package system
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SourceEntry sources.list中的一条仓库记录
+type SourceEntry struct {
+	URI   string
+	Suite string
+}
+
+// InReleaseURL 仓库InRelease文件的地址,suite以/结尾的是flat仓库,InRelease直接位于suite目录下
+func (e SourceEntry) InReleaseURL() string {
+	uri := strings.TrimSuffix(e.URI, "/")
+	if strings.HasSuffix(e.Suite, "/") {
+		suite := strings.TrimPrefix(e.Suite, "./")
+		if suite == "" || suite == "/" {
+			return uri + "/InRelease"
+		}
+		return uri + "/" + strings.TrimSuffix(suite, "/") + "/InRelease"
+	}
+	return uri + "/dists/" + e.Suite + "/InRelease"
+}
+
+// ParseSourceEntries 解析单行格式的sources.list,相同的仓库只保留一条
+func ParseSourceEntries(r io.Reader) []SourceEntry {
+	var entries []SourceEntry
+	seen := make(map[SourceEntry]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 || (fields[0] != "deb" && fields[0] != "deb-src") {
+			continue
+		}
+		fields = fields[1:]
+		// 跳过 [arch=amd64 trusted=yes] 形式的选项
+		if strings.HasPrefix(fields[0], "[") {
+			for len(fields) > 0 && !strings.HasSuffix(fields[0], "]") {
+				fields = fields[1:]
+			}
+			if len(fields) > 0 {
+				fields = fields[1:]
+			}
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		entry := SourceEntry{URI: fields[0], Suite: fields[1]}
+		if seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// LoadSourceEntries 读取仓库配置,path可以是文件或者包含*.list文件的目录
+func LoadSourceEntries(path string) ([]SourceEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*.list"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	var entries []SourceEntry
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+		entries = append(entries, ParseSourceEntries(f)...)
+		_ = f.Close()
+	}
+	return entries, nil
+}
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 )
 
 const VarLibDir = "/var/lib/lastore"
@@ -34,6 +35,7 @@ const (
 	PrepareDistUpgradeJobType = "prepare_dist_upgrade"
 	UpdateSourceJobType       = "update_source"
 	CleanJobType              = "clean"
+	AutoCleanJobType          = "auto_clean" // 只清理过期的缓存包,保留待更新的包
 	FixErrorJobType           = "fix_error"
 	CheckSystemJobType        = "check_system"
 	OfflineUpdateJobType      = "offline_update"
@@ -52,6 +54,12 @@ const (
 	AppendUpgradeJobTye           = "append_upgrade"
 )
 
+// CheckSystem的检查类型
+const (
+	QuickCheckSystem    = "quick"    // 只检查依赖关系
+	ThoroughCheckSystem = "thorough" // 额外检查未配置完成和需要修复的包
+)
+
 const (
 	NotifyExpireTimeoutDefault = -1
 	NotifyExpireTimeoutNoHide  = 0
@@ -65,6 +73,29 @@ type JobProgressInfo struct {
 	Cancelable  bool
 	Error       *JobError
 	FatalError  bool
+	Log         string        // 命令结束时输出的最后一部分内容
+	CurrentItem *DownloadItem // 从dlstatus中解析出的正在下载的文件,无法解析时为nil
+	Downloaded  int           // dlstatus中已下载完成的文件数
+	MediaChange *MediaChange  // apt等待插入的介质,不需要更换介质时为nil
+	Package     string        // pmstatus中正在处理的包名,不带架构
+}
+
+// MediaChange apt通过media-change请求插入的光盘或U盘
+type MediaChange struct {
+	Medium  string // 介质卷标
+	Drive   string // 挂载路径
+	Message string
+}
+
+// DownloadItem 下载阶段正在处理的文件,序号、总数和剩余时间来自dlstatus,地址、包名和大小来自标准输出中序号相同的Get行,
+// apt输出中没有的字段为零值
+type DownloadItem struct {
+	URI       string `json:",omitempty"`
+	Name      string `json:",omitempty"`
+	Size      int64  `json:",omitempty"` // 字节
+	Index     int    `json:",omitempty"` // 第几个文件,从1开始
+	Total     int    `json:",omitempty"`
+	Remaining string `json:",omitempty"` // apt估算的剩余时间,如 1min 12s,无法估算时为空
 }
 
 type UpgradeInfo struct {
@@ -135,11 +166,15 @@ type System interface {
 	DistUpgrade(jobId string, packages []string, environ map[string]string, cmdArgs map[string]string) error
 	UpdateSource(jobId string, environ map[string]string, cmdArgs map[string]string) error
 	Clean(jobId string) error
+	AutoClean(jobId string, keepPackages []string, cmdArgs map[string]string) error
 	Abort(jobId string) error
 	AbortWithFailed(jobId string) error
+	PauseAtFileBoundary(jobId string, timeout time.Duration) error
+	ConfirmMediaChange(jobId string) error
 	AttachIndicator(Indicator)
 	FixError(jobId string, errType string, environ map[string]string, cmdArgs map[string]string) error
 	CheckSystem(jobId string, checkType string, environ map[string]string, cmdArgs map[string]string) error
+	ConfPath() string
 }
 
 type JobError struct {
@@ -147,6 +182,8 @@ type JobError struct {
 	ErrDetail    string
 	IsCheckError bool
 	ErrorLog     []string
+	Packages     []string `json:",omitempty"` // 与错误相关的包
+	ErrReason    string   `json:",omitempty"` // 确定ErrType的apt输出,如Failed to fetch ... 404  Not Found,便于不识别ErrType的客户端展示原因
 }
 
 func (e *JobError) GetType() string {
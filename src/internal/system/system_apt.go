@@ -20,6 +20,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/linuxdeepin/lastore-daemon/src/internal/utils"
@@ -43,6 +44,26 @@ const (
 	OfflineListPath = "/var/lib/lastore/offline_list"
 )
 
+// DefaultOfflineMountFsDir 离线更新包的默认挂载目录
+const DefaultOfflineMountFsDir = "/var/lib/lastore/mountfs"
+
+// OfflineMountFsDir 离线更新包的挂载目录,启动时根据配置设置
+var OfflineMountFsDir = DefaultOfflineMountFsDir
+
+// OfflineUnzipDirs 离线更新包可能使用的解压目录,启动时根据配置设置
+var OfflineUnzipDirs []string
+
+func IsMountPoint(path string) bool {
+	err := exec.Command("mountpoint", "-q", path).Run()
+	return err == nil
+}
+
+// ParallelUpdateSourceKey 检查更新任务的参数中包含该项时,每个仓库文件单独并行执行apt-get update,不会传给apt
+const ParallelUpdateSourceKey = "Lastore::ParallelUpdateSource"
+
+// DebDeltaKey 下载任务的参数中包含该项时,先通过debdelta下载增量包重建deb,剩余的包再完整下载,不会传给apt
+const DebDeltaKey = "Lastore::DebDelta"
+
 const (
 	LocalCachePath = "/var/cache/lastore/archives"
 )
@@ -144,7 +165,7 @@ func QueryFileCacheSize(path string) (float64, error) {
 
 // QueryPackageDownloadSize parsing the total size of download archives when installing the packages.
 // return arg0:需要下载的量;arg1:所有包的大小;arg2:error
-func QueryPackageDownloadSize(updateType UpdateType, packages ...string) (float64, float64, error) {
+func QueryPackageDownloadSize(environ map[string]string, updateType UpdateType, packages ...string) (float64, float64, error) {
 	startTime := time.Now()
 	if len(packages) == 0 {
 		logger.Warningf("%v %v mode don't have can update package", updateType.JobType(), updateType)
@@ -162,14 +183,14 @@ func QueryPackageDownloadSize(updateType UpdateType, packages ...string) (float6
 		var cmd *exec.Cmd
 		if utils2.IsDir(path) {
 			// #nosec G204
-			cmd = exec.Command("/usr/bin/apt-get",
+			cmd = AptCommand(environ, "apt-get",
 				append([]string{"-d", "-o", "Debug::NoLocking=1", "-c", LastoreAptV2CommonConfPath,
 					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::sourcelist", "/dev/null"),
 					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::SourceParts", path),
 					"--print-uris", "--assume-no", "install", "--"}, packages...)...)
 		} else {
 			// #nosec G204
-			cmd = exec.Command("/usr/bin/apt-get",
+			cmd = AptCommand(environ, "apt-get",
 				append([]string{"-d", "-o", "Debug::NoLocking=1", "-c", LastoreAptV2CommonConfPath,
 					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::sourcelist", path),
 					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::SourceParts", "/dev/null"),
@@ -204,7 +225,7 @@ func QueryPackageDownloadSize(updateType UpdateType, packages ...string) (float6
 }
 
 // QuerySourceDownloadSize 根据更新类型(仓库),获取需要的下载量,return arg0:需要下载的量;arg1:所有包的大小;arg2:error
-func QuerySourceDownloadSize(updateType UpdateType, pkgList []string) (float64, float64, error) {
+func QuerySourceDownloadSize(environ map[string]string, updateType UpdateType, pkgList []string) (float64, float64, error) {
 	startTime := time.Now()
 	downloadSize := new(float64)
 	allPackageSize := new(float64)
@@ -217,13 +238,13 @@ func QuerySourceDownloadSize(updateType UpdateType, pkgList []string) (float64,
 		var cmd *exec.Cmd
 		if utils2.IsDir(path) {
 			// #nosec G204
-			cmd = exec.Command("/usr/bin/apt-get",
+			cmd = AptCommand(environ, "apt-get",
 				append([]string{"dist-upgrade", "-d", "-o", "Debug::NoLocking=1", "-c", LastoreAptV2CommonConfPath, "--assume-no",
 					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::sourcelist", "/dev/null"),
 					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::SourceParts", path)}, pkgList...)...)
 		} else {
 			// #nosec G204
-			cmd = exec.Command("/usr/bin/apt-get",
+			cmd = AptCommand(environ, "apt-get",
 				append([]string{"dist-upgrade", "-d", "-o", "Debug::NoLocking=1", "-c", LastoreAptV2CommonConfPath, "--assume-no",
 					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::sourcelist", path),
 					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::SourceParts", "/dev/null")}, pkgList...)...)
@@ -256,6 +277,112 @@ func QuerySourceDownloadSize(updateType UpdateType, pkgList []string) (float64,
 	return *downloadSize, *allPackageSize, nil
 }
 
+const defaultArchivesDir = "/var/cache/apt/archives"
+
+// SpaceShortfall 下载或解压所需空间不足的信息,单位为B
+type SpaceShortfall struct {
+	Path  string  // 空间不足的目录
+	Need  float64 // 需要下载的大小
+	Free  float64 // 可用空间
+	Short float64 // 缺少的空间
+}
+
+func (s *SpaceShortfall) Error() string {
+	return fmt.Sprintf("You don't have enough free space in %s: need %.0f bytes, free %.0f bytes, %.0f bytes short",
+		s.Path, s.Need, s.Free, s.Short)
+}
+
+func newSpaceShortfall(path string, need, free float64) *SpaceShortfall {
+	if need <= free {
+		return nil
+	}
+	return &SpaceShortfall{
+		Path:  path,
+		Need:  need,
+		Free:  free,
+		Short: need - free,
+	}
+}
+
+// CheckSpaceShortfall 检查path所在分区的可用空间是否足够need字节,空间足够时返回nil
+func CheckSpaceShortfall(path string, need float64) (*SpaceShortfall, error) {
+	free, err := GetFreeSpace(path)
+	if err != nil {
+		return nil, err
+	}
+	return newSpaceShortfall(path, need, free), nil
+}
+
+// QueryDownloadSpaceShortfall 模拟执行apt-get args,根据Need to get的大小检查下载缓存分区的可用空间,空间足够时返回nil
+func QueryDownloadSpaceShortfall(environ map[string]string, args []string) (*SpaceShortfall, error) {
+	// #nosec G204
+	cmd := AptCommand(environ, "apt-get",
+		append([]string{"-o", "Debug::NoLocking=1", "-c", LastoreAptV2CommonConfPath, "--assume-no"}, args...)...)
+	lines, err := utils.FilterExecOutput(cmd, time.Second*120, func(line string) bool {
+		_, _, _err := parsePackageSize(line)
+		return _err == nil
+	})
+	if err != nil && len(lines) == 0 {
+		return nil, fmt.Errorf("run:%v failed-->%v", cmd.Args, err)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("run:%v failed-->can not get download size", cmd.Args)
+	}
+	need, _, err := parsePackageSize(lines[0])
+	if err != nil {
+		return nil, err
+	}
+	return CheckDownloadSpaceShortfall(need)
+}
+
+// CheckDownloadSpaceShortfall 检查lastore下载缓存目录所在分区的可用空间是否足够need字节,空间足够时返回nil
+func CheckDownloadSpaceShortfall(need float64) (*SpaceShortfall, error) {
+	archivesDir, err := GetArchivesDir(LastoreAptV2CommonConfPath)
+	if err != nil {
+		logger.Warning(err)
+		archivesDir = defaultArchivesDir
+	}
+	return CheckSpaceShortfall(archivesDir, need)
+}
+
+// DownloadSpaceShortfall 根据apt-get输出中Need to get的大小检查confPath下载缓存分区的可用空间,空间足够时返回nil
+func DownloadSpaceShortfall(confPath string, out []byte) (*SpaceShortfall, error) {
+	for _, line := range strings.Split(string(out), "\n") {
+		need, _, err := parsePackageSize(line)
+		if err != nil {
+			continue
+		}
+		archivesDir, err := GetArchivesDir(confPath)
+		if err != nil {
+			logger.Warning(err)
+			archivesDir = defaultArchivesDir
+		}
+		free, err := GetFreeSpace(archivesDir)
+		if err != nil {
+			return nil, err
+		}
+		return newSpaceShortfall(archivesDir, need, free), nil
+	}
+	return nil, errors.New("can not get download size")
+}
+
+// GetFreeSpace 返回path所在分区非root用户可用空间,path不存在时使用最近的已存在的上级目录
+func GetFreeSpace(path string) (float64, error) {
+	for {
+		_, err := os.Stat(path)
+		if err == nil || path == "/" || path == "." {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return float64(stat.Bavail) * float64(stat.Bsize), nil
+}
+
 // QueryPackageInstalled query whether the pkgId installed
 func QueryPackageInstalled(pkgId string) bool {
 	// #nosec G204
@@ -267,14 +394,32 @@ func QueryPackageInstalled(pkgId string) bool {
 	return status == "installed"
 }
 
+// QueryInstalledVersions 批量查询已安装的版本,未安装的包不在结果中
+func QueryInstalledVersions(names []string) map[string]string {
+	versions := make(map[string]string)
+	if len(names) == 0 {
+		return versions
+	}
+	args := append([]string{"-W", "-f", "${Package} ${Version} ${db:Status-Status}\n", "--"}, names...)
+	// 部分包未安装时退出码不为0,已安装的包仍会输出
+	out, _ := exec.Command("/usr/bin/dpkg-query", args...).Output() // #nosec G204
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[2] == "installed" {
+			versions[fields[0]] = fields[1]
+		}
+	}
+	return versions
+}
+
 // QueryPackageInstallable query whether the pkgId can be installed
-func QueryPackageInstallable(pkgId string) bool {
-	err := exec.Command("/usr/bin/apt-cache", "-c", LastoreAptV2CommonConfPath, "show", "--", pkgId).Run() // #nosec G204
+func QueryPackageInstallable(environ map[string]string, pkgId string) bool {
+	err := AptCommand(environ, "apt-cache", "-c", LastoreAptV2CommonConfPath, "show", "--", pkgId).Run() // #nosec G204
 	if err != nil {
 		return false
 	}
 
-	out, err := exec.Command("/usr/bin/apt-cache", "-c", LastoreAptV2CommonConfPath, "policy", "--", pkgId).CombinedOutput() // #nosec G204
+	out, err := AptCommand(environ, "apt-cache", "-c", LastoreAptV2CommonConfPath, "policy", "--", pkgId).CombinedOutput() // #nosec G204
 	if err != nil {
 		return false
 	}
@@ -284,7 +429,7 @@ func QueryPackageInstallable(pkgId string) bool {
 	return true
 }
 
-func QuerySourceAddSize(updateType UpdateType) (float64, error) {
+func QuerySourceAddSize(environ map[string]string, updateType UpdateType) (float64, error) {
 	startTime := time.Now()
 	addSize := new(float64)
 	err := CustomSourceWrapper(updateType, func(path string, unref func()) error {
@@ -296,13 +441,13 @@ func QuerySourceAddSize(updateType UpdateType) (float64, error) {
 		var cmd *exec.Cmd
 		if utils2.IsDir(path) {
 			// #nosec G204
-			cmd = exec.Command("/usr/bin/apt-get",
+			cmd = AptCommand(environ, "apt-get",
 				[]string{"dist-upgrade", "-d", "-o", "Debug::NoLocking=1", "-c", LastoreAptV2CommonConfPath, "--assume-no",
 					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::sourcelist", "/dev/null"),
 					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::SourceParts", path)}...)
 		} else {
 			// #nosec G204
-			cmd = exec.Command("/usr/bin/apt-get",
+			cmd = AptCommand(environ, "apt-get",
 				[]string{"dist-upgrade", "-d", "-o", "Debug::NoLocking=1", "-c", LastoreAptV2CommonConfPath, "--assume-no",
 					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::sourcelist", path),
 					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::SourceParts", "/dev/null")}...)
@@ -334,6 +479,125 @@ func QuerySourceAddSize(updateType UpdateType) (float64, error) {
 	return *addSize, nil
 }
 
+// DistUpgradePlan dist-upgrade 的完整事务计划,大小单位均为B
+type DistUpgradePlan struct {
+	Install        []string
+	Upgrade        []string
+	Remove         []string
+	DownloadSize   float64 // 需要下载的大小
+	AllPackageSize float64 // 所有包的大小
+	InstallAddSize float64 // 安装后磁盘占用的变化量,释放空间时为负数
+}
+
+const (
+	aptNewInstalledTitle = "The following NEW packages will be installed:"
+	aptUpgradedTitle     = "The following packages will be upgraded:"
+	aptRemovedTitle      = "The following packages will be REMOVED:"
+)
+
+var __SummaryLine__ = regexp.MustCompile(`^[0-9]+ upgraded, [0-9]+ newly installed, [0-9]+ to remove`)
+
+// QueryDistUpgradePlan 根据更新类型(仓库)模拟dist-upgrade,获取安装、升级、删除的包列表以及下载量和磁盘占用变化.
+// NOTE: apt-get -s 不会输出 Need to get 和 After this operation,因此使用 --assume-no 代替
+func QueryDistUpgradePlan(environ map[string]string, updateType UpdateType, pkgList []string) (*DistUpgradePlan, error) {
+	startTime := time.Now()
+	var plan *DistUpgradePlan
+	err := CustomSourceWrapper(updateType, func(path string, unref func()) error {
+		defer func() {
+			if unref != nil {
+				unref()
+			}
+		}()
+		var cmd *exec.Cmd
+		if utils2.IsDir(path) {
+			// #nosec G204
+			cmd = AptCommand(environ, "apt-get",
+				append([]string{"dist-upgrade", "-o", "Debug::NoLocking=1", "-c", LastoreAptV2CommonConfPath, "--assume-no",
+					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::sourcelist", "/dev/null"),
+					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::SourceParts", path)}, pkgList...)...)
+		} else {
+			// #nosec G204
+			cmd = AptCommand(environ, "apt-get",
+				append([]string{"dist-upgrade", "-o", "Debug::NoLocking=1", "-c", LastoreAptV2CommonConfPath, "--assume-no",
+					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::sourcelist", path),
+					"-o", fmt.Sprintf("%v=%v", "Dir::Etc::SourceParts", "/dev/null")}, pkgList...)...)
+		}
+		logger.Infof("%v dist-upgrade plan cmd: %v", updateType.JobType(), cmd.String())
+		var outBuf bytes.Buffer
+		cmd.Stdout = &outBuf
+		var errBuf bytes.Buffer
+		cmd.Stderr = &errBuf
+		// NOTE: 这里不能使用命令的退出码来判断，因为 --assume-no 会让命令的退出码为 1
+		_ = cmd.Run()
+		var err error
+		plan, err = parseDistUpgradePlan(outBuf.Bytes())
+		if err != nil {
+			return fmt.Errorf("run:%v failed-->%v %v", cmd.Args, err, errBuf.String())
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Warning(err)
+		return nil, err
+	}
+	logger.Debug("end QueryDistUpgradePlan duration:", time.Now().Sub(startTime))
+	return plan, nil
+}
+
+func parseDistUpgradePlan(output []byte) (*DistUpgradePlan, error) {
+	plan := &DistUpgradePlan{
+		Install: []string{},
+		Upgrade: []string{},
+		Remove:  []string{},
+	}
+	foundSummary := false
+	var current *[]string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if current != nil {
+			if strings.HasPrefix(line, " ") {
+				for _, f := range strings.Fields(line) {
+					// 去掉架构后缀以及REMOVED中表示purge的*
+					*current = append(*current, strings.TrimSuffix(strings.Split(f, ":")[0], "*"))
+				}
+				continue
+			}
+			current = nil
+		}
+		switch strings.TrimSpace(line) {
+		case aptNewInstalledTitle:
+			current = &plan.Install
+			continue
+		case aptUpgradedTitle:
+			current = &plan.Upgrade
+			continue
+		case aptRemovedTitle:
+			current = &plan.Remove
+			continue
+		}
+		if __SummaryLine__.MatchString(line) {
+			foundSummary = true
+			continue
+		}
+		if needDownloadSize, allSize, err := parsePackageSize(line); err == nil {
+			plan.DownloadSize = needDownloadSize
+			plan.AllPackageSize = allSize
+			continue
+		}
+		if addSize, err := parseInstallAddSize(line); err == nil {
+			if strings.Contains(line, "freed") {
+				addSize = -addSize
+			}
+			plan.InstallAddSize = addSize
+		}
+	}
+	if !foundSummary {
+		return nil, errors.New("failed to parse dist-upgrade plan")
+	}
+	return plan, nil
+}
+
 // SystemArchitectures return the system package manager supported architectures
 func SystemArchitectures() ([]Architecture, error) {
 	foreignArchs, err := exec.Command("dpkg", "--print-foreign-architectures").Output()
@@ -498,29 +762,16 @@ func parseInstallAddSize(line string) (float64, error) {
 	return SizeUnknown, fmt.Errorf("%q invalid", line)
 }
 
-func CheckInstallAddSize(updateType UpdateType) bool {
-	isSatisfied := false
-	addSize, err := QuerySourceAddSize(updateType)
+func CheckInstallAddSize(environ map[string]string, updateType UpdateType) bool {
+	addSize, err := QuerySourceAddSize(environ, updateType)
 	if err != nil {
 		logger.Warning(err)
 	}
 	logger.Debugf("add size is %v", addSize)
-	content, err := exec.Command("/bin/sh", []string{
-		"-c",
-		"df -BK --output='avail' /usr|awk 'NR==2'",
-	}...).CombinedOutput()
+	shortfall, err := CheckSpaceShortfall("/usr", addSize)
 	if err != nil {
-		logger.Warning(string(content))
-	} else {
-		spaceStr := strings.Replace(string(content), "K", "", -1)
-		spaceStr = strings.TrimSpace(spaceStr)
-		spaceNum, err := strconv.Atoi(spaceStr)
-		if err != nil {
-			logger.Warning(err)
-		} else {
-			spaceNum = spaceNum * 1000
-			isSatisfied = spaceNum > int(addSize)
-		}
+		logger.Warning(err)
+		return false
 	}
-	return isSatisfied
+	return shortfall == nil
 }
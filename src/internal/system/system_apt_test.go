@@ -5,6 +5,8 @@
 package system
 
 import (
+	"path/filepath"
+	"strings"
 	"testing"
 
 	C "gopkg.in/check.v1"
@@ -24,11 +26,11 @@ func (*testWrap) TestPackageDownloadSize(c *C.C) {
 	var packages = []string{"abiword", "0ad", "acl2"}
 	for _, p := range packages {
 		if QueryPackageInstalled(p) {
-			s, _, err := QueryPackageDownloadSize(AllCheckUpdate, p)
+			s, _, err := QueryPackageDownloadSize(nil, AllCheckUpdate, p)
 			c.Check(err, C.Equals, nil)
 			c.Check(s, C.Equals, float64(0))
 		} else {
-			s, _, err := QueryPackageDownloadSize(AllCheckUpdate, p)
+			s, _, err := QueryPackageDownloadSize(nil, AllCheckUpdate, p)
 			c.Check(err, C.Equals, nil)
 			c.Check(s >= 0, C.Equals, true)
 		}
@@ -72,3 +74,52 @@ func (*testWrap) TestParseSize(c *C.C) {
 		c.Check(s, C.Equals, d.Size)
 	}
 }
+
+func (*testWrap) TestParseDistUpgradePlan(c *C.C) {
+	output := `Reading package lists...
+Building dependency tree...
+Calculating upgrade...
+The following packages will be REMOVED:
+  dde-old* libfoo1:i386
+The following NEW packages will be installed:
+  libbar2
+The following packages will be upgraded:
+  dde-control-center dde-dock:amd64
+2 upgraded, 1 newly installed, 2 to remove and 0 not upgraded.
+Need to get 3,985 kB/26,200 kB of archives.
+After this operation, 1,024 kB disk space will be freed.
+Do you want to continue? [Y/n] Abort.
+`
+	plan, err := parseDistUpgradePlan([]byte(output))
+	c.Assert(err, C.Equals, nil)
+	c.Check(plan.Remove, C.DeepEquals, []string{"dde-old", "libfoo1"})
+	c.Check(plan.Install, C.DeepEquals, []string{"libbar2"})
+	c.Check(plan.Upgrade, C.DeepEquals, []string{"dde-control-center", "dde-dock"})
+	c.Check(plan.DownloadSize, C.Equals, float64(3985*1000))
+	c.Check(plan.AllPackageSize, C.Equals, float64(26200*1000))
+	c.Check(plan.InstallAddSize, C.Equals, float64(-1024*1000))
+
+	_, err = parseDistUpgradePlan([]byte("E: Unable to locate package foo\n"))
+	c.Check(err, C.NotNil)
+}
+
+func (*testWrap) TestNewSpaceShortfall(c *C.C) {
+	c.Check(newSpaceShortfall("/var/cache/apt/archives", 100, 100), C.IsNil)
+	s := newSpaceShortfall("/var/cache/apt/archives", 300, 100)
+	c.Assert(s, C.NotNil)
+	c.Check(s.Short, C.Equals, float64(200))
+	c.Check(strings.Contains(s.Error(), "200 bytes short"), C.Equals, true)
+
+	free, err := GetFreeSpace(filepath.Join(c.MkDir(), "not", "exist"))
+	c.Check(err, C.IsNil)
+	c.Check(free > 0, C.Equals, true)
+
+	dir := c.MkDir()
+	s, err = CheckSpaceShortfall(dir, 1)
+	c.Check(err, C.IsNil)
+	c.Check(s, C.IsNil)
+	s, err = CheckSpaceShortfall(dir, free*1000)
+	c.Check(err, C.IsNil)
+	c.Assert(s, C.NotNil)
+	c.Check(s.Path, C.Equals, dir)
+}
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/linuxdeepin/go-lib/strv"
 )
@@ -304,6 +307,65 @@ func UpdateOtherSystemSourceDir(otherSourceList []string) error {
 	return nil
 }
 
+const (
+	sourceWrapperParent  = "/tmp"
+	sourceWrapperPattern = "*Source.d"
+)
+
+var _sourceWrapperNameRegexp = regexp.MustCompile(`^[0-9]+Source\.d$`)
+
+// activeSourceWrappers 正在被任务使用(未unref)的组合仓库目录
+var activeSourceWrappers = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: make(map[string]bool)}
+
+func setSourceWrapperActive(dir string, active bool) {
+	activeSourceWrappers.Lock()
+	defer activeSourceWrappers.Unlock()
+	if active {
+		activeSourceWrappers.dirs[dir] = true
+	} else {
+		delete(activeSourceWrappers.dirs, dir)
+	}
+}
+
+func isSourceWrapperActive(dir string) bool {
+	activeSourceWrappers.Lock()
+	defer activeSourceWrappers.Unlock()
+	return activeSourceWrappers.dirs[dir]
+}
+
+// CleanOrphanedSourceWrappers 删除修改时间早于maxAge且没有被任务使用的组合仓库目录,
+// 用于回收异常退出时没有unref的目录,返回删除的数量
+func CleanOrphanedSourceWrappers(maxAge time.Duration) (int, error) {
+	return cleanOrphanedSourceWrappers(sourceWrapperParent, maxAge)
+}
+
+func cleanOrphanedSourceWrappers(parent string, maxAge time.Duration) (int, error) {
+	dirs, err := filepath.Glob(filepath.Join(parent, sourceWrapperPattern))
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, dir := range dirs {
+		if !_sourceWrapperNameRegexp.MatchString(filepath.Base(dir)) || isSourceWrapperActive(dir) {
+			continue
+		}
+		info, err := os.Lstat(dir)
+		if err != nil || !info.IsDir() || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		err = os.RemoveAll(dir)
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
 // CustomSourceWrapper 根据updateType组合source文件,doRealAction完成实际操作,unref用于释放资源
 func CustomSourceWrapper(updateType UpdateType, doRealAction func(path string, unref func()) error) error {
 	var sourcePathList []string
@@ -336,16 +398,18 @@ func CustomSourceWrapper(updateType UpdateType, doRealAction func(path string, u
 			var beforeDoRealErr error
 			var sourceDir string
 			// #nosec G301
-			sourceDir, beforeDoRealErr = os.MkdirTemp("/tmp", "*Source.d")
+			sourceDir, beforeDoRealErr = os.MkdirTemp(sourceWrapperParent, sourceWrapperPattern)
 			if beforeDoRealErr != nil {
 				logger.Warning(beforeDoRealErr)
 				return beforeDoRealErr
 			}
+			setSourceWrapperActive(sourceDir, true)
 			unref := func() {
 				err := os.RemoveAll(sourceDir)
 				if err != nil {
 					logger.Warning(err)
 				}
+				setSourceWrapperActive(sourceDir, false)
 			}
 			defer func() {
 				if beforeDoRealErr != nil {
@@ -384,8 +448,47 @@ func CustomSourceWrapper(updateType UpdateType, doRealAction func(path string, u
 					return fmt.Errorf("create symlink for %q failed: %v", filePath, beforeDoRealErr)
 				}
 			}
+			// 忽略的Stat和ReadDir错误不能导致doRealAction返回后释放资源,资源由doRealAction负责释放
+			beforeDoRealErr = nil
 			return doRealAction(sourceDir, unref)
 		}
 		return errors.New("doRealAction is nil")
 	}
 }
+
+// SourceWrapperFunc 组合仓库的实现,签名与CustomSourceWrapper相同
+type SourceWrapperFunc func(updateType UpdateType, doRealAction func(path string, unref func()) error) error
+
+// CustomSourceWrapperWithHold 和CustomSourceWrapper相同,但资源默认在doRealAction返回后释放.
+// 需要在doRealAction返回后继续使用仓库时调用hold,由调用方负责调用hold返回的release,
+// doRealAction返回错误时无论是否调用过hold都会释放资源,release多次调用只会释放一次
+func CustomSourceWrapperWithHold(updateType UpdateType, doRealAction func(path string, hold func() (release func())) error) error {
+	return SourceWrapperWithHold(CustomSourceWrapper, updateType, doRealAction)
+}
+
+// SourceWrapperWithHold 与CustomSourceWrapperWithHold相同,使用wrapper组合仓库
+func SourceWrapperWithHold(wrapper SourceWrapperFunc, updateType UpdateType, doRealAction func(path string, hold func() (release func())) error) error {
+	return wrapper(updateType, func(path string, unref func()) error {
+		return holdSource(path, unref, doRealAction)
+	})
+}
+
+func holdSource(path string, unref func(), doRealAction func(path string, hold func() (release func())) error) error {
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			if unref != nil {
+				unref()
+			}
+		})
+	}
+	held := false
+	err := doRealAction(path, func() func() {
+		held = true
+		return release
+	})
+	if err != nil || !held {
+		release()
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+// SPDX-FileCopyrightText: 2018 - 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package system
+
+import (
+	"container/list"
+	"errors"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+
+	debVersion "pault.ag/go/debian/version"
+)
+
+const versionCacheSize = 4096
+
+type versionPair struct {
+	a, b string
+}
+
+type versionCacheEntry struct {
+	key    versionPair
+	result int
+}
+
+// versionCache 版本比较结果的LRU缓存
+type versionCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[versionPair]*list.Element
+}
+
+func newVersionCache(size int) *versionCache {
+	return &versionCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[versionPair]*list.Element),
+	}
+}
+
+func (c *versionCache) get(key versionPair) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*versionCacheEntry).result, true
+	}
+	return 0, false
+}
+
+func (c *versionCache) add(key versionPair, result int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*versionCacheEntry).result = result
+		return
+	}
+	c.items[key] = c.ll.PushFront(&versionCacheEntry{key: key, result: result})
+	if c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*versionCacheEntry).key)
+	}
+}
+
+var _versionCache = newVersionCache(versionCacheSize)
+
+var _dpkgCompareFallbackCount uint64
+
+// CompareVersions 比较deb包版本, a < b 返回-1, a == b 返回0, a > b 返回1.
+// 优先使用debVersion解析比较,无法解析时回退到dpkg --compare-versions
+func CompareVersions(a, b string) (int, error) {
+	key := versionPair{a: a, b: b}
+	if result, ok := _versionCache.get(key); ok {
+		return result, nil
+	}
+	result, err := compareVersionsFast(a, b)
+	if err != nil {
+		count := atomic.AddUint64(&_dpkgCompareFallbackCount, 1)
+		logger.Debugf("compare %q and %q fallback to dpkg(%v times): %v", a, b, count, err)
+		result, err = compareVersionsDpkg(a, b)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_versionCache.add(key, result)
+	return result, nil
+}
+
+// DpkgCompareFallbackCount 返回版本比较回退到dpkg的次数
+func DpkgCompareFallbackCount() uint64 {
+	return atomic.LoadUint64(&_dpkgCompareFallbackCount)
+}
+
+func compareVersionsFast(a, b string) (int, error) {
+	v1, err := debVersion.Parse(a)
+	if err != nil {
+		return 0, err
+	}
+	v2, err := debVersion.Parse(b)
+	if err != nil {
+		return 0, err
+	}
+	result := debVersion.Compare(v1, v2)
+	switch {
+	case result < 0:
+		return -1, nil
+	case result > 0:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+func compareVersionsDpkg(a, b string) (int, error) {
+	for _, op := range []struct {
+		relation string
+		result   int
+	}{
+		{"lt", -1},
+		{"eq", 0},
+		{"gt", 1},
+	} {
+		err := exec.Command("dpkg", "--compare-versions", "--", a, op.relation, b).Run() // #nosec G204
+		if err == nil {
+			return op.result, nil
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return 0, err
+		}
+	}
+	return 0, errors.New("dpkg can not compare " + a + " and " + b)
+}
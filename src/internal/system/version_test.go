@@ -0,0 +1,45 @@
+// SPDX-FileCopyrightText: 2018 - 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package system
+
+import (
+	C "gopkg.in/check.v1"
+)
+
+func (*testWrap) TestCompareVersions(c *C.C) {
+	data := []struct {
+		a, b   string
+		result int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1:1.0", "2.0", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"5.6.1-1+deepin", "5.6.1-1", 1},
+	}
+	for _, d := range data {
+		result, err := CompareVersions(d.a, d.b)
+		c.Check(err, C.Equals, nil)
+		c.Check(result, C.Equals, d.result)
+		// 第二次比较命中缓存
+		result, err = CompareVersions(d.a, d.b)
+		c.Check(err, C.Equals, nil)
+		c.Check(result, C.Equals, d.result)
+	}
+}
+
+func (*testWrap) TestVersionCacheEvict(c *C.C) {
+	cache := newVersionCache(2)
+	cache.add(versionPair{"1", "2"}, -1)
+	cache.add(versionPair{"2", "1"}, 1)
+	_, ok := cache.get(versionPair{"1", "2"})
+	c.Check(ok, C.Equals, true)
+	cache.add(versionPair{"3", "3"}, 0)
+	_, ok = cache.get(versionPair{"2", "1"})
+	c.Check(ok, C.Equals, false)
+	_, ok = cache.get(versionPair{"1", "2"})
+	c.Check(ok, C.Equals, true)
+}
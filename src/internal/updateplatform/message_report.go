@@ -20,6 +20,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -46,6 +47,7 @@ type UpdatePlatformManager struct {
 
 	targetVersion          string // 更新到的目标版本号,本地os-baseline.b获取
 	targetBaseline         string // 更新到的目标基线号,本地os-baseline.b获取
+	targetNotesUrl         string // 目标版本的更新说明地址,更新平台未提供时为空
 	checkTime              string // 基线检查时间
 	systemTypeFromPlatform string // 从更新平台获取的系统类型,本地os-baseline.b获取
 	requestUrl             string // 更新平台请求地址
@@ -76,6 +78,12 @@ type UpdatePlatformManager struct {
 
 	jobPostMsgMap   map[string]*UpgradePostMsg
 	jobPostMsgMapMu sync.Mutex
+
+	reportQueue *reportQueue // 上报失败等待重试的消息
+
+	// 平台不确认分块上报时为true;重试上报时可能持有mu,因此使用单独的锁
+	chunkUnsupported   bool
+	chunkUnsupportedMu sync.Mutex
 }
 
 // 需要注意cache文件的同步时机，所有数据应该不会从os-version和os-baseline获取
@@ -116,7 +124,7 @@ func NewUpdatePlatformManager(c *Config, updateToken bool) *UpdatePlatformManage
 	if updateToken {
 		token = UpdateTokenConfigFile(c.IncludeDiskInfo) // update source时生成即可,初始化时由于授权服务返回SN非常慢(超过25s),因此不在初始化时生成
 	}
-	return &UpdatePlatformManager{
+	m := &UpdatePlatformManager{
 		config:                            c,
 		allowPostSystemUpgradeMessageType: system.SystemUpdate,
 		preBuild:                          genPreBuild(),
@@ -130,7 +138,10 @@ func NewUpdatePlatformManager(c *Config, updateToken bool) *UpdatePlatformManage
 		Tp:                                UnknownUpdate,
 		UpdateNowForce:                    false,
 		jobPostMsgMap:                     getLocalJobPostMsg(),
+		reportQueue:                       newReportQueue(reportQueueFile),
 	}
+	m.reportQueue.registerChunked(ReportKindStatusMessage, m.postStatusMessage)
+	return m
 }
 
 func (m *UpdatePlatformManager) GetCVEUpdateLogs(pkgs []string) map[string]CEVInfo {
@@ -172,16 +183,31 @@ func copyFile(src, dst string) {
 }
 
 type updateTarget struct {
-	TargetVersion   string
-	TargetOsVersion string
+	TargetVersion   string // 目标基线号,与BuildId相同,兼容旧版本保留
+	TargetOsVersion string // 目标系统版本号,与Version相同,兼容旧版本保留
 	CheckTime       string
+	Version         string // 目标系统版本号,如23.0.1
+	BuildId         string // 目标基线号
+	NotesUrl        string // 目标版本的更新说明地址,可能为空
+}
+
+// HasUpdateTarget 更新平台是否指定了与当前基线不同的目标版本
+func (m *UpdatePlatformManager) HasUpdateTarget() bool {
+	return len(m.targetBaseline) != 0 && m.preBaseline != m.targetBaseline
 }
 
+// GetUpdateTarget 返回更新目标的json字符串,没有需要更新到的目标版本时返回空
 func (m *UpdatePlatformManager) GetUpdateTarget() string {
+	if !m.HasUpdateTarget() {
+		return ""
+	}
 	target := &updateTarget{
 		TargetOsVersion: m.targetVersion,
 		TargetVersion:   m.targetBaseline,
 		CheckTime:       m.checkTime,
+		Version:         m.targetVersion,
+		BuildId:         m.targetBaseline,
+		NotesUrl:        m.targetNotesUrl,
 	}
 	content, err := json.Marshal(target)
 	if err != nil {
@@ -246,6 +272,7 @@ func (m *UpdatePlatformManager) ReplaceVersionCache() {
 			logger.Warning(err)
 		}
 		copyFile(realVersion, CacheVersion)
+		InvalidateOSVersionCache()
 	}
 }
 
@@ -259,6 +286,7 @@ func (m *UpdatePlatformManager) RecoverVersionLink() {
 	if err != nil {
 		logger.Warning(err)
 	}
+	InvalidateOSVersionCache()
 }
 
 func (m *UpdatePlatformManager) UpdateBaselineCache() {
@@ -334,6 +362,7 @@ func isUnstable() int {
 type Version struct {
 	Version  string `json:"version"`
 	Baseline string `json:"baseline"`
+	NotesUrl string `json:"notesUrl"` // 更新说明地址,可选
 }
 
 type Policy struct {
@@ -504,10 +533,34 @@ func (m *UpdatePlatformManager) genUpdateLogResponse() (*http.Response, error) {
 	return client.Do(request)
 }
 
+// reportChunk 分块上报时当前块的信息,平台按id和index合并,确认所有块后才处理
+type reportChunk struct {
+	id    string
+	index int
+	total int
+}
+
+// reportChunkAck 平台对分块上报的确认,Received为平台已经连续收到的块数
+type reportChunkAck struct {
+	ChunkId  string `json:"chunkId"`
+	Received int    `json:"received"`
+}
+
+// parseChunkAck 解析PostProcess返回的data中的分块确认,没有id对应的确认时ok为false,说明平台不支持分块上报
+func parseChunkAck(data json.RawMessage, id string) (received int, ok bool) {
+	var ack reportChunkAck
+	err := json.Unmarshal(data, &ack)
+	if err != nil || ack.ChunkId != id {
+		return 0, false
+	}
+	return ack.Received, true
+}
+
 // genPostProcessResponse 生成数据，发送请求，并返回response.
 // buf: 数据输入,io.Reader.
 // filePath: 生成的xz压缩的中间文件.
-func (m *UpdatePlatformManager) genPostProcessResponse(buf io.Reader, filePath string) (*http.Response, error) {
+// chunk: 分块上报时当前块的信息,不分块时为nil.
+func (m *UpdatePlatformManager) genPostProcessResponse(buf io.Reader, filePath string, chunk *reportChunk) (*http.Response, error) {
 	policyUrl := m.requestUrl + Urls[PostProcess].path
 	client := &http.Client{
 		Timeout: 40 * time.Second,
@@ -554,6 +607,11 @@ func (m *UpdatePlatformManager) genPostProcessResponse(buf io.Reader, filePath s
 	request.Header.Set("X-Time", xTime)
 	request.Header.Set("X-Sign", sign)
 	request.Header.Set("X-Repo-Token", base64.RawStdEncoding.EncodeToString([]byte(m.Token)))
+	if chunk != nil {
+		request.Header.Set("X-Chunk-Id", chunk.id)
+		request.Header.Set("X-Chunk-Index", strconv.Itoa(chunk.index))
+		request.Header.Set("X-Chunk-Total", strconv.Itoa(chunk.total))
+	}
 	return client.Do(request)
 }
 
@@ -667,6 +725,7 @@ func (m *UpdatePlatformManager) genUpdatePolicyByToken(updateInRelease bool) err
 	}
 	m.targetBaseline = msg.Version.Baseline
 	m.targetVersion = msg.Version.Version
+	m.targetNotesUrl = msg.Version.NotesUrl
 	m.systemTypeFromPlatform = msg.SystemType
 	m.repoInfos = msg.RepoInfos
 	m.checkTime = time.Now().String()
@@ -987,6 +1046,49 @@ func (m *UpdatePlatformManager) GetSystemMeta() map[string]system.PackageInfo {
 	return infos
 }
 
+// PlatformDowngrade 更新平台下发的目标版本低于已安装的版本,通常是平台数据配置错误
+type PlatformDowngrade struct {
+	Name             string
+	InstalledVersion string
+	TargetVersion    string
+}
+
+// findPlatformDowngrades 返回目标版本低于已安装版本的包,按包名排序;未安装或版本无法比较的包忽略
+func findPlatformDowngrades(targets map[string]system.PackageInfo, installed map[string]string) []PlatformDowngrade {
+	var downgrades []PlatformDowngrade
+	for name, info := range targets {
+		installedVersion, ok := installed[name]
+		if !ok || info.Version == "" {
+			continue
+		}
+		result, err := system.CompareVersions(installedVersion, info.Version)
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+		if result > 0 {
+			downgrades = append(downgrades, PlatformDowngrade{
+				Name:             name,
+				InstalledVersion: installedVersion,
+				TargetVersion:    info.Version,
+			})
+		}
+	}
+	sort.Slice(downgrades, func(i, j int) bool {
+		return downgrades[i].Name < downgrades[j].Name
+	})
+	return downgrades
+}
+
+// TargetDowngrades 检查必装清单中目标版本低于已安装版本的包
+func (m *UpdatePlatformManager) TargetDowngrades() []PlatformDowngrade {
+	names := make([]string, 0, len(m.TargetCorePkgs))
+	for name := range m.TargetCorePkgs {
+		names = append(names, name)
+	}
+	return findPlatformDowngrades(m.TargetCorePkgs, system.QueryInstalledVersions(names))
+}
+
 type UpdateLogMeta struct {
 	Baseline      string    `json:"baseline"`
 	ShowVersion   string    `json:"showVersion"`
@@ -1272,24 +1374,105 @@ func (m *UpdatePlatformManager) UpdateAllPlatformDataSync() error {
 }
 
 // PostStatusMessage 将检查\下载\安装过程中所有异常状态和每个阶段成功的正常状态上报
+// 上报失败时加入重试队列
 func (m *UpdatePlatformManager) PostStatusMessage(body string) {
 	logger.Debug("post status msg:", body)
+	acked, err := m.postStatusMessage(body, 0)
+	if err != nil {
+		m.reportQueue.pushPartial(ReportKindStatusMessage, body, acked, time.Now())
+	}
+}
+
+// postStatusMessage 较大的消息分块上报,从第from块开始,返回平台已确认的块数.
+// 平台不确认分块时改为完整上报,之后的消息也不再分块
+func (m *UpdatePlatformManager) postStatusMessage(body string, from int) (int, error) {
+	chunks := splitReportChunks(body, reportChunkSize)
 	if (m.config.PlatformDisabled & DisabledProcess) != 0 {
-		return
+		return len(chunks), nil
+	}
+	if len(chunks) == 1 || m.isChunkUnsupported() {
+		_, err := m.postStatusChunk(body, nil)
+		if err != nil {
+			return from, err
+		}
+		return len(chunks), nil
+	}
+	sum := sha256.Sum256([]byte(body))
+	id := hex.EncodeToString(sum[:8])
+	acked := from
+	for acked < len(chunks) {
+		if acked > from {
+			time.Sleep(reportChunkInterval)
+		}
+		data, err := m.postStatusChunk(chunks[acked], &reportChunk{id: id, index: acked, total: len(chunks)})
+		if err != nil {
+			return acked, err
+		}
+		received, ok := parseChunkAck(data, id)
+		if !ok {
+			logger.Warning("platform doesn't acknowledge status message chunks, post the whole message")
+			m.setChunkUnsupported()
+			_, err = m.postStatusChunk(body, nil)
+			if err != nil {
+				return acked, err
+			}
+			return len(chunks), nil
+		}
+		if received <= acked {
+			// 平台丢失了之前的块时从平台已收到的位置重新上报
+			return received, fmt.Errorf("platform didn't acknowledge chunk %d of %s, received %d", acked, id, received)
+		}
+		acked = received
 	}
-	buf := bytes.NewBufferString(body)
+	return len(chunks), nil
+}
+
+func (m *UpdatePlatformManager) isChunkUnsupported() bool {
+	m.chunkUnsupportedMu.Lock()
+	defer m.chunkUnsupportedMu.Unlock()
+	return m.chunkUnsupported
+}
+
+func (m *UpdatePlatformManager) setChunkUnsupported() {
+	m.chunkUnsupportedMu.Lock()
+	m.chunkUnsupported = true
+	m.chunkUnsupportedMu.Unlock()
+}
+
+// postStatusChunk 上报一块消息,返回平台响应中的data
+func (m *UpdatePlatformManager) postStatusChunk(content string, chunk *reportChunk) (json.RawMessage, error) {
+	buf := bytes.NewBufferString(content)
 	filePath := fmt.Sprintf("/tmp/%s_%s.xz", "update", time.Now().Format("20231019102233444"))
-	response, err := m.genPostProcessResponse(buf, filePath)
+	if chunk != nil {
+		filePath = fmt.Sprintf("/tmp/%s_%s_%s_%d.xz", "update", time.Now().Format("20231019102233444"), chunk.id, chunk.index)
+	}
+	response, err := m.genPostProcessResponse(buf, filePath, chunk)
 	if err != nil {
 		logger.Warningf("post status message failed:%v", err)
-		return
+		return nil, err
 	}
 	data, err := getResponseData(response, PostProcess)
 	if err != nil {
 		logger.Warningf("get post status response failed:%v", err)
-		return
+		return nil, err
 	}
 	logger.Info(string(data))
+	return data, nil
+}
+
+// EnqueueReport 将上报失败的消息持久化,等待RetryPostHistory时重试
+func (m *UpdatePlatformManager) EnqueueReport(kind, body string) {
+	m.reportQueue.push(kind, body, time.Now())
+}
+
+// RetryPendingReports 重试队列中到达重试时间的消息
+func (m *UpdatePlatformManager) RetryPendingReports() {
+	m.reportQueue.retry(time.Now())
+}
+
+// RegisterReportSender 注册kind类型消息的重试上报方法
+func (m *UpdatePlatformManager) RegisterReportSender(kind string, fn func(body string) error) {
+	m.reportQueue.register(kind, fn)
 }
 
 func tarFiles(files []string, outFile string) error {
@@ -1361,7 +1544,7 @@ func (m *UpdatePlatformManager) PostUpdateLogFiles(files []string) {
 		return
 	}
 	defer tarFile.Close()
-	response, err := m.genPostProcessResponse(tarFile, outFilename+".xz")
+	response, err := m.genPostProcessResponse(tarFile, outFilename+".xz", nil)
 	if err != nil {
 		logger.Warningf("post status message failed:%v", err)
 		return
@@ -1472,14 +1655,19 @@ func (m *UpdatePlatformManager) PostSystemUpgradeMessage(uuid string) {
 }
 
 func (m *UpdatePlatformManager) RetryPostHistory() {
+	var uuids []string
 	m.jobPostMsgMapMu.Lock()
-	defer m.jobPostMsgMapMu.Unlock()
 	for _, v := range m.jobPostMsgMap {
 		if v.PostStatus == WaitPost || v.PostStatus == PostFailure {
-			m.PostSystemUpgradeMessage(v.Uuid)
+			uuids = append(uuids, v.Uuid)
 		}
 	}
-	return
+	m.jobPostMsgMapMu.Unlock()
+	// PostSystemUpgradeMessage会获取jobPostMsgMapMu,不能在持有锁时调用
+	for _, uuid := range uuids {
+		m.PostSystemUpgradeMessage(uuid)
+	}
+	m.reportQueue.retry(time.Now())
 }
 
 func (m *UpdatePlatformManager) GetRules() []dut.RuleInfo {
@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package updateplatform
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindPlatformDowngrades(t *testing.T) {
+	targets := map[string]system.PackageInfo{
+		"openssl":       {Name: "openssl", Version: "1.1.1n-9"},
+		"dde-launcher":  {Name: "dde-launcher", Version: "5.6.1"},
+		"dde-dock":      {Name: "dde-dock", Version: "5.5.0"},
+		"lastore":       {Name: "lastore", Version: ""},
+		"not-installed": {Name: "not-installed", Version: "1.0"},
+	}
+	installed := map[string]string{
+		"openssl":      "1.1.1n-10",
+		"dde-launcher": "5.6.1",
+		"dde-dock":     "5.6.0",
+		"lastore":      "6.0",
+	}
+	assert.Equal(t, []PlatformDowngrade{
+		{Name: "dde-dock", InstalledVersion: "5.6.0", TargetVersion: "5.5.0"},
+		{Name: "openssl", InstalledVersion: "1.1.1n-10", TargetVersion: "1.1.1n-9"},
+	}, findPlatformDowngrades(targets, installed))
+
+	assert.Empty(t, findPlatformDowngrades(targets, nil))
+}
+
+func TestGetUpdateTarget(t *testing.T) {
+	m := &UpdatePlatformManager{preBaseline: "1000"}
+	assert.Equal(t, "", m.GetUpdateTarget())
+
+	// 目标基线与当前基线相同时没有需要更新到的版本
+	m.targetBaseline = "1000"
+	m.targetVersion = "23.0.0"
+	assert.False(t, m.HasUpdateTarget())
+	assert.Equal(t, "", m.GetUpdateTarget())
+
+	m.targetBaseline = "1234"
+	m.targetVersion = "23.0.1"
+	m.targetNotesUrl = "https://example.com/notes/23.0.1"
+	var target updateTarget
+	assert.NoError(t, json.Unmarshal([]byte(m.GetUpdateTarget()), &target))
+	assert.Equal(t, "23.0.1", target.Version)
+	assert.Equal(t, "1234", target.BuildId)
+	assert.Equal(t, "https://example.com/notes/23.0.1", target.NotesUrl)
+	// 兼容旧字段
+	assert.Equal(t, "23.0.1", target.TargetOsVersion)
+	assert.Equal(t, "1234", target.TargetVersion)
+}
+
+func TestParseChunkAck(t *testing.T) {
+	received, ok := parseChunkAck(json.RawMessage(`{"chunkId":"0a1b","received":3}`), "0a1b")
+	assert.True(t, ok)
+	assert.Equal(t, 3, received)
+
+	// 其他消息的确认和不支持分块的平台返回的data都不是确认
+	_, ok = parseChunkAck(json.RawMessage(`{"chunkId":"ffff","received":3}`), "0a1b")
+	assert.False(t, ok)
+	_, ok = parseChunkAck(json.RawMessage(`"ok"`), "0a1b")
+	assert.False(t, ok)
+	_, ok = parseChunkAck(nil, "0a1b")
+	assert.False(t, ok)
+}
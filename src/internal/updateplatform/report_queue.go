@@ -0,0 +1,258 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package updateplatform
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/linuxdeepin/go-lib/utils"
+)
+
+const (
+	ReportKindStatusMessage = "status-message" // 上报更新平台的状态信息
+	ReportKindLog           = "report-log"     // 数据埋点
+)
+
+const (
+	reportQueueMaxSize      = 200
+	reportQueueMaxAge       = 7 * 24 * time.Hour
+	reportRetryBaseInterval = time.Minute
+	reportRetryMaxInterval  = 6 * time.Hour
+
+	// reportChunkSize 超过该大小的消息分块上报,每块单独确认,失败后从未确认的块继续
+	reportChunkSize = 256 * 1024
+	// reportChunkInterval 连续上报两块之间的间隔,避免大量设备同时上报时占满平台带宽
+	reportChunkInterval = 500 * time.Millisecond
+)
+
+var reportQueueFile = filepath.Join("/var/cache/lastore", "report_queue.json")
+
+type pendingReport struct {
+	Kind      string
+	Body      string
+	CreatedAt time.Time
+	Attempts  int
+	NextRetry time.Time
+	Acked     int // 分块上报时平台已确认的块数
+}
+
+// chunkSender 从第from块开始上报body,返回平台已确认的块数
+type chunkSender func(body string, from int) (acked int, err error)
+
+// splitReportChunks 按size字节切分消息,不足size的消息为一块
+func splitReportChunks(body string, size int) []string {
+	if len(body) <= size {
+		return []string{body}
+	}
+	var chunks []string
+	for len(body) > size {
+		chunks = append(chunks, body[:size])
+		body = body[size:]
+	}
+	if body != "" {
+		chunks = append(chunks, body)
+	}
+	return chunks
+}
+
+// reportQueue 上报失败的消息队列,持久化到磁盘,在网络恢复后按退避时间重试
+type reportQueue struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int
+	maxAge  time.Duration
+	items   []*pendingReport
+	senders map[string]chunkSender
+
+	retrying bool // retry正在上报,上报时不持有mu
+}
+
+func newReportQueue(path string) *reportQueue {
+	q := &reportQueue{
+		path:    path,
+		maxSize: reportQueueMaxSize,
+		maxAge:  reportQueueMaxAge,
+		senders: make(map[string]chunkSender),
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warning(err)
+		}
+		return q
+	}
+	err = json.Unmarshal(content, &q.items)
+	if err != nil {
+		logger.Warning(err)
+	}
+	return q
+}
+
+func (q *reportQueue) register(kind string, fn func(body string) error) {
+	q.registerChunked(kind, func(body string, from int) (int, error) {
+		return from, fn(body)
+	})
+}
+
+// registerChunked 注册支持分块续传的上报方法
+func (q *reportQueue) registerChunked(kind string, fn chunkSender) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.senders[kind] = fn
+}
+
+// push 加入队列,相同的消息只保留一条
+func (q *reportQueue) push(kind, body string, now time.Time) {
+	q.pushPartial(kind, body, 0, now)
+}
+
+// pushPartial 加入已经确认了acked块的消息,重试时从未确认的块继续
+func (q *reportQueue) pushPartial(kind, body string, acked int, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, item := range q.items {
+		if item.Kind == kind && item.Body == body {
+			if acked > item.Acked {
+				item.Acked = acked
+				q.save()
+			}
+			return
+		}
+	}
+	q.items = append(q.items, &pendingReport{
+		Kind:      kind,
+		Body:      body,
+		CreatedAt: now,
+		NextRetry: now.Add(reportRetryBaseInterval),
+		Acked:     acked,
+	})
+	q.prune(now)
+	q.save()
+}
+
+// prune 丢弃过期的消息,超出容量时丢弃最早的消息
+func (q *reportQueue) prune(now time.Time) {
+	var items []*pendingReport
+	for _, item := range q.items {
+		if now.Sub(item.CreatedAt) > q.maxAge {
+			logger.Infof("drop expired %v report created at %v", item.Kind, item.CreatedAt)
+			continue
+		}
+		items = append(items, item)
+	}
+	if len(items) > q.maxSize {
+		logger.Infof("report queue is full, drop %d reports", len(items)-q.maxSize)
+		items = items[len(items)-q.maxSize:]
+	}
+	q.items = items
+}
+
+// retry 重试到达重试时间的消息,失败的消息按指数退避推迟下一次重试.
+// 上报时不持有锁,期间可以继续push;同一时间只有一个retry在上报
+func (q *reportQueue) retry(now time.Time) {
+	type dueReport struct {
+		item  *pendingReport
+		send  chunkSender
+		body  string
+		acked int
+		err   error
+	}
+	q.mu.Lock()
+	if q.retrying {
+		q.mu.Unlock()
+		return
+	}
+	q.prune(now)
+	var due []*dueReport
+	for _, item := range q.items {
+		send, ok := q.senders[item.Kind]
+		if ok && !now.Before(item.NextRetry) {
+			due = append(due, &dueReport{item: item, send: send, body: item.Body, acked: item.Acked})
+		}
+	}
+	if len(due) == 0 {
+		q.save()
+		q.mu.Unlock()
+		return
+	}
+	q.retrying = true
+	q.mu.Unlock()
+
+	for _, d := range due {
+		d.acked, d.err = d.send(d.body, d.acked)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.retrying = false
+	sent := make(map[*pendingReport]bool)
+	for _, d := range due {
+		if d.err == nil {
+			sent[d.item] = true
+			continue
+		}
+		logger.Warningf("retry %v report failed: %v", d.item.Kind, d.err)
+		if d.acked > d.item.Acked {
+			d.item.Acked = d.acked
+		}
+		d.item.Attempts++
+		d.item.NextRetry = now.Add(reportRetryInterval(d.item.Attempts))
+	}
+	var items []*pendingReport
+	for _, item := range q.items {
+		if !sent[item] {
+			items = append(items, item)
+		}
+	}
+	q.items = items
+	q.save()
+}
+
+func (q *reportQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+func (q *reportQueue) save() {
+	if len(q.items) == 0 {
+		err := os.Remove(q.path)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Warning(err)
+		}
+		return
+	}
+	content, err := json.Marshal(q.items)
+	if err != nil {
+		logger.Warning(err)
+		return
+	}
+	_ = utils.EnsureDirExist(filepath.Dir(q.path))
+	tmp := q.path + ".tmp"
+	err = os.WriteFile(tmp, content, 0600)
+	if err != nil {
+		logger.Warning(err)
+		return
+	}
+	err = os.Rename(tmp, q.path)
+	if err != nil {
+		logger.Warning(err)
+	}
+}
+
+func reportRetryInterval(attempts int) time.Duration {
+	interval := reportRetryBaseInterval
+	for i := 0; i < attempts && interval < reportRetryMaxInterval; i++ {
+		interval *= 2
+	}
+	if interval > reportRetryMaxInterval {
+		interval = reportRetryMaxInterval
+	}
+	return interval
+}
@@ -0,0 +1,140 @@
+// SPDX-FileCopyrightText: 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package updateplatform
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report_queue.json")
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	q := newReportQueue(path)
+	q.push(ReportKindStatusMessage, "a", now)
+	q.push(ReportKindStatusMessage, "a", now)
+	q.push(ReportKindLog, "a", now)
+	assert.Equal(t, 2, q.len())
+
+	// 重启后从磁盘恢复
+	q = newReportQueue(path)
+	assert.Equal(t, 2, q.len())
+
+	var sent []string
+	online := false
+	q.register(ReportKindStatusMessage, func(body string) error {
+		if !online {
+			return errors.New("offline")
+		}
+		sent = append(sent, body)
+		return nil
+	})
+	// 未到重试时间
+	q.retry(now)
+	assert.Empty(t, sent)
+
+	now = now.Add(reportRetryBaseInterval)
+	q.retry(now)
+	assert.Equal(t, 2, q.len())
+	assert.Equal(t, 1, q.items[0].Attempts)
+	assert.Equal(t, now.Add(2*reportRetryBaseInterval), q.items[0].NextRetry)
+
+	online = true
+	now = now.Add(2 * reportRetryBaseInterval)
+	q.retry(now)
+	assert.Equal(t, []string{"a"}, sent)
+	// 没有注册发送方法的消息保留在队列中
+	assert.Equal(t, 1, q.len())
+
+	q.retry(now.Add(reportQueueMaxAge))
+	assert.Equal(t, 0, q.len())
+	assert.NoFileExists(t, path)
+}
+
+func TestReportQueueRetryUnlocked(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	q := newReportQueue(filepath.Join(t.TempDir(), "report_queue.json"))
+	q.push(ReportKindStatusMessage, "a", now)
+	q.push(ReportKindStatusMessage, "b", now)
+	q.register(ReportKindStatusMessage, func(body string) error {
+		// 上报期间加入新的消息不会被阻塞,也不会被本次retry丢弃
+		q.push(ReportKindStatusMessage, "c", now)
+		// 上报期间的retry直接返回,不会重复上报
+		q.retry(now.Add(reportRetryBaseInterval))
+		if body == "b" {
+			return errors.New("offline")
+		}
+		return nil
+	})
+	q.retry(now.Add(reportRetryBaseInterval))
+	assert.Equal(t, 2, q.len())
+	assert.Equal(t, "b", q.items[0].Body)
+	assert.Equal(t, 1, q.items[0].Attempts)
+	assert.Equal(t, "c", q.items[1].Body)
+	assert.Equal(t, 0, q.items[1].Attempts)
+}
+
+func TestReportQueueMaxSize(t *testing.T) {
+	q := newReportQueue(filepath.Join(t.TempDir(), "report_queue.json"))
+	q.maxSize = 2
+	now := time.Now()
+	q.push(ReportKindLog, "1", now)
+	q.push(ReportKindLog, "2", now)
+	q.push(ReportKindLog, "3", now)
+	assert.Equal(t, 2, q.len())
+	assert.Equal(t, "2", q.items[0].Body)
+}
+
+func TestReportRetryInterval(t *testing.T) {
+	assert.Equal(t, reportRetryBaseInterval, reportRetryInterval(0))
+	assert.Equal(t, 4*reportRetryBaseInterval, reportRetryInterval(2))
+	assert.Equal(t, reportRetryMaxInterval, reportRetryInterval(100))
+}
+
+func TestReportQueueChunked(t *testing.T) {
+	assert.Equal(t, []string{"abc"}, splitReportChunks("abc", 3))
+	assert.Equal(t, []string{"ab", "cd", "e"}, splitReportChunks("abcde", 2))
+
+	path := filepath.Join(t.TempDir(), "report_queue.json")
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	q := newReportQueue(path)
+	q.pushPartial(ReportKindStatusMessage, "abcde", 1, now)
+	// 同一个消息只记录确认更多的进度
+	q.pushPartial(ReportKindStatusMessage, "abcde", 0, now)
+	assert.Equal(t, 1, q.items[0].Acked)
+
+	var sent []string
+	failAt := 2
+	q.registerChunked(ReportKindStatusMessage, func(body string, from int) (int, error) {
+		chunks := splitReportChunks(body, 2)
+		for i := from; i < len(chunks); i++ {
+			if i == failAt {
+				return i, errors.New("connection reset")
+			}
+			sent = append(sent, chunks[i])
+		}
+		return len(chunks), nil
+	})
+	now = now.Add(reportRetryBaseInterval)
+	q.retry(now)
+	assert.Equal(t, []string{"cd"}, sent)
+	// 重启后从未确认的块继续
+	q = newReportQueue(path)
+	assert.Equal(t, 2, q.items[0].Acked)
+
+	q.registerChunked(ReportKindStatusMessage, func(body string, from int) (int, error) {
+		chunks := splitReportChunks(body, 2)
+		sent = append(sent, chunks[from:]...)
+		return len(chunks), nil
+	})
+	q.retry(now.Add(reportRetryInterval(1)))
+	assert.Equal(t, []string{"cd", "e"}, sent)
+	assert.Equal(t, 0, q.len())
+}
@@ -19,6 +19,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/jouyouyun/hardware/utils"
@@ -187,6 +188,51 @@ func GetOSVersionInfo(filePath string) (map[string]string, error) {
 	return osVersionInfoMap, nil
 }
 
+type osVersionCacheEntry struct {
+	modTime time.Time
+	size    int64
+	info    map[string]string
+}
+
+var (
+	_osVersionCache   = make(map[string]osVersionCacheEntry)
+	_osVersionCacheMu sync.Mutex
+)
+
+// CachedOSVersionInfo 与GetOSVersionInfo相同,文件的修改时间和大小不变时使用上次的解析结果,
+// filePath为软链接时以链接指向的文件为准
+func CachedOSVersionInfo(filePath string) (map[string]string, error) {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		InvalidateOSVersionCache()
+		return nil, err
+	}
+	_osVersionCacheMu.Lock()
+	defer _osVersionCacheMu.Unlock()
+	entry, ok := _osVersionCache[filePath]
+	if !ok || !entry.modTime.Equal(fileInfo.ModTime()) || entry.size != fileInfo.Size() {
+		info, err := GetOSVersionInfo(filePath)
+		if err != nil {
+			delete(_osVersionCache, filePath)
+			return nil, err
+		}
+		entry = osVersionCacheEntry{modTime: fileInfo.ModTime(), size: fileInfo.Size(), info: info}
+		_osVersionCache[filePath] = entry
+	}
+	result := make(map[string]string, len(entry.info))
+	for k, v := range entry.info {
+		result[k] = v
+	}
+	return result, nil
+}
+
+// InvalidateOSVersionCache 清除CachedOSVersionInfo的缓存,os-version被替换(修改时间可能不变)后调用
+func InvalidateOSVersionCache() {
+	_osVersionCacheMu.Lock()
+	_osVersionCache = make(map[string]osVersionCacheEntry)
+	_osVersionCacheMu.Unlock()
+}
+
 func GetHardwareId(includeDiskInfo bool) string {
 	hhardware.IncludeDiskInfo = includeDiskInfo
 	machineID, err := hhardware.GenMachineID()
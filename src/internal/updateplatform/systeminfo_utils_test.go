@@ -5,12 +5,58 @@
 package updateplatform
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSystemInfoUtil(t *testing.T) {
 	sys := getSystemInfo(true)
 	assert.NotEmpty(t, sys)
 }
+
+func TestCachedOSVersionInfo(t *testing.T) {
+	const content = `[Version]
+SystemName=UOS
+ProductType=Desktop
+EditionName=%s
+MajorVersion=20
+MinorVersion=1070
+OsBuild=11018.107
+`
+	path := filepath.Join(t.TempDir(), "os-version")
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(content, "Enterprise")), 0644))
+	info, err := CachedOSVersionInfo(path)
+	require.NoError(t, err)
+	assert.Equal(t, "Enterprise", info["EditionName"])
+
+	// 修改返回值不影响缓存
+	info["EditionName"] = "Home"
+	info, err = CachedOSVersionInfo(path)
+	require.NoError(t, err)
+	assert.Equal(t, "Enterprise", info["EditionName"])
+
+	// 原地更新后版本变化,文件大小相同,修改时间变化时重新读取
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(content, "Government")), 0644))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	info, err = CachedOSVersionInfo(path)
+	require.NoError(t, err)
+	assert.Equal(t, "Government", info["EditionName"])
+
+	// 修改时间和大小都不变时使用缓存,需要显式清除
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(content, "Enterprise")), 0644))
+	require.NoError(t, os.Chtimes(path, later, later))
+	info, err = CachedOSVersionInfo(path)
+	require.NoError(t, err)
+	assert.Equal(t, "Government", info["EditionName"])
+	InvalidateOSVersionCache()
+	info, err = CachedOSVersionInfo(path)
+	require.NoError(t, err)
+	assert.Equal(t, "Enterprise", info["EditionName"])
+}
@@ -11,12 +11,14 @@ static const sd_bus_vtable agent_vtable[] = {
     SD_BUS_METHOD("ReportLog", "s", "", ReportLog, SD_BUS_VTABLE_UNPRIVILEGED),
     SD_BUS_METHOD("SendNotify", "susssasa{sv}i", "u", SendNotify,
                   SD_BUS_VTABLE_UNPRIVILEGED),
+    SD_BUS_SIGNAL("NotificationClosed", "uu", 0),
     SD_BUS_VTABLE_END};
 
 // 初始化lastore
 lastore_agent *agent_init() {
   lastore_agent *agent = (lastore_agent *)malloc(sizeof(lastore_agent));
   memset(agent, 0, sizeof(lastore_agent));
+  agent->notify_ids = g_hash_table_new(g_direct_hash, g_direct_equal);
 
   if (strcmp(getenv("XDG_SESSION_TYPE"), "wayland") == 0) {
     agent->is_wayland_session = true;
@@ -52,6 +54,16 @@ lastore_agent *agent_init() {
     LOG(LOG_ERR, "failed to issue method call: %s", strerror(-r));
     goto out;
   }
+
+  // 监听会话中通知被关闭的信号,转发给lastore
+  r = sd_bus_match_signal(agent->session_bus, NULL, BUS_OSD_NOTIFICATION_NAME,
+                          BUS_OSD_NOTIFICATION_PATH,
+                          BUS_OSD_NOTIFICATION_IF_NAME, "NotificationClosed",
+                          NotificationClosed, agent);
+  if (r < 0) {
+    LOG(LOG_ERR, "failed to add match: %s", strerror(-r));
+    goto out;
+  }
   r = bus_syslastore_register_agent(agent, OBJECT_PATH);
 out:
   if (r < 0) {
@@ -75,31 +87,42 @@ void agent_close(lastore_agent *agent) {
   if (agent->sys_bus)
     sd_bus_unref(agent->sys_bus);
 
+  if (agent->notify_ids)
+    g_hash_table_destroy(agent->notify_ids);
+
   free(agent);
 }
 
-// 启动dbus loop
+// 启动dbus loop,同时处理系统总线上lastore的调用和会话总线上的通知信号
 void agent_loop(lastore_agent *agent) {
-  int r = 0;
-  for (;;) {
-    /* Process requests */
-    r = sd_bus_process(agent->sys_bus, NULL);
-    if (r < 0) {
-      LOG(LOG_ERR, "failed to process bus: %s", strerror(-r));
-      goto finish;
-    }
-    if (r >
-        0) /* we processed a request, try to process another one, right-away */
-      continue;
-
-    /* Wait for the next request to process */
-    r = sd_bus_wait(agent->sys_bus, (uint64_t)-1);
-    if (r < 0) {
-      LOG(LOG_ERR, "failed to wait on bus: %s", strerror(-r));
-      goto finish;
-    }
+  sd_event *event = NULL;
+  int r = sd_event_default(&event);
+  if (r < 0) {
+    LOG(LOG_ERR, "failed to get event loop: %s", strerror(-r));
+    goto finish;
+  }
+
+  r = sd_bus_attach_event(agent->sys_bus, event, SD_EVENT_PRIORITY_NORMAL);
+  if (r < 0) {
+    LOG(LOG_ERR, "failed to attach system bus: %s", strerror(-r));
+    goto finish;
+  }
+
+  r = sd_bus_attach_event(agent->session_bus, event, SD_EVENT_PRIORITY_NORMAL);
+  if (r < 0) {
+    LOG(LOG_ERR, "failed to attach session bus: %s", strerror(-r));
+    goto finish;
+  }
+
+  r = sd_event_loop(event);
+  if (r < 0) {
+    LOG(LOG_ERR, "failed to run event loop: %s", strerror(-r));
   }
 
 finish:
+  sd_bus_detach_event(agent->sys_bus);
+  sd_bus_detach_event(agent->session_bus);
+  if (event)
+    sd_event_unref(event);
   agent_close(agent);
 }
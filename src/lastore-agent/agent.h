@@ -2,6 +2,7 @@
 #define __LASTORE_AGENT_H__
 
 #include "log.h"
+#include <glib.h>
 #include <stdbool.h>
 #include <stdio.h>
 #include <stdlib.h>
@@ -14,6 +15,7 @@ struct lastore_agent
   sd_bus *sys_bus;
   sd_bus_slot *slot;
   bool is_wayland_session;
+  GHashTable *notify_ids; // 通过SendNotify发出且未关闭的通知id,只转发这些通知的关闭信号
 };
 
 typedef struct lastore_agent lastore_agent;
@@ -889,6 +889,7 @@ int SendNotify(sd_bus_message *m, void *userdata, sd_bus_error *ret_error) {
                         strerror(-r));
       goto finish;
     }
+    g_hash_table_add(agent->notify_ids, GUINT_TO_POINTER(id));
     r = sd_bus_reply_method_return(m, "u", id);
   }
 finish:
@@ -899,4 +900,29 @@ finish:
     g_hash_table_destroy(hints_dict);
 
   return r;
-}
\ No newline at end of file
+}
+
+// 通过SendNotify发出的通知被关闭时,在系统总线上发出NotificationClosed信号,
+// 参数同org.freedesktop.Notifications的NotificationClosed
+int NotificationClosed(sd_bus_message *m, void *userdata,
+                       sd_bus_error *ret_error) {
+  lastore_agent *agent = (lastore_agent *)userdata;
+  uint32_t id = 0;
+  uint32_t reason = 0;
+
+  int r = sd_bus_message_read(m, "uu", &id, &reason);
+  if (r < 0) {
+    LOG(LOG_ERR, "Failed to read msg: %s", strerror(-r));
+    return 0;
+  }
+  if (!g_hash_table_remove(agent->notify_ids, GUINT_TO_POINTER(id))) {
+    return 0;
+  }
+  LOG(LOG_DEBUG, "notification %u closed, reason: %u", id, reason);
+  r = sd_bus_emit_signal(agent->sys_bus, OBJECT_PATH, INTERFACE_NAME,
+                         "NotificationClosed", "uu", id, reason);
+  if (r < 0) {
+    LOG(LOG_ERR, "Failed to emit signal: %s", strerror(-r));
+  }
+  return 0;
+}
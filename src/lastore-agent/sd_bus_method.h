@@ -112,5 +112,8 @@ int CloseNotification(sd_bus_message *m, void *userdata,
 int GetManualProxy(sd_bus_message *m, void *userdata, sd_bus_error *ret_error);
 int ReportLog(sd_bus_message *m, void *userdata, sd_bus_error *ret_error);
 int SendNotify(sd_bus_message *m, void *userdata, sd_bus_error *ret_error);
+// 会话总线信号处理
+int NotificationClosed(sd_bus_message *m, void *userdata,
+                       sd_bus_error *ret_error);
 
 #endif
\ No newline at end of file
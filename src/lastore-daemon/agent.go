@@ -16,7 +16,6 @@ import (
 	dbus2 "github.com/linuxdeepin/go-dbus-factory/system/org.freedesktop.dbus"
 	login1 "github.com/linuxdeepin/go-dbus-factory/system/org.freedesktop.login1"
 	"github.com/linuxdeepin/go-lib/dbusutil"
-	"github.com/linuxdeepin/go-lib/gettext"
 	"github.com/linuxdeepin/go-lib/strv"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/utils"
 )
@@ -96,8 +95,7 @@ func (m *userAgentMap) recoverLastoreAgents(service *dbusutil.Service, sessionNe
 	}
 	lang := m.getActiveLastoreAgentLang()
 	if len(lang) != 0 {
-		logger.Info("SetLocale", lang)
-		gettext.SetLocale(gettext.LcAll, lang)
+		setProcessLocale(lang)
 	}
 }
 
@@ -264,7 +262,29 @@ func (m *userAgentMap) getActiveLastoreAgentLang() string {
 	return item.lang
 }
 
-const lastoreAgentPath = "/org/deepin/dde/Lastore1/Agent"
+// getActiveSessions 返回当前活跃用户的uid和session
+func (m *userAgentMap) getActiveSessions() (string, []login1.Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.activeUid == "" {
+		return "", nil
+	}
+	item := m.uidItemMap[m.activeUid]
+	if item == nil {
+		return m.activeUid, nil
+	}
+	var sessions []login1.Session
+	for _, session := range item.sessions {
+		sessions = append(sessions, session)
+	}
+	return m.activeUid, sessions
+}
+
+const (
+	lastoreAgentPath      = "/org/deepin/dde/Lastore1/Agent"
+	lastoreAgentInterface = "org.deepin.dde.Lastore1.Agent"
+)
 
 func (m *userAgentMap) getActiveLastoreAgent() lastoreAgent.Agent {
 	return m.getActiveAgent(lastoreAgentPath)
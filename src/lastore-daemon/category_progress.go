@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// pmstatus中包处理完成的描述前缀,apt以无语言环境执行,输出不会被翻译
+var pkgDoneDescPrefixes = []string{"Installed ", "Removed ", "Completely removed "}
+
+// categoryProgress 同时更新多个分类时,根据pmstatus中正在处理的包统计各分类的安装进度,
+// 融合更新拆分出的多个job共用一个实例
+type categoryProgress struct {
+	mu          sync.Mutex
+	categories  map[string][]string // 包名 -> 所属分类(更新类型的JobType)
+	packages    map[string]int      // 分类 -> 包数量
+	pkgProgress map[string]float64  // 包名 -> 进度,开始处理时为0.5,安装或卸载完成后为1
+}
+
+// newCategoryProgress packageMap为分类到包列表的映射,有包的分类少于两个时不需要统计,返回nil
+func newCategoryProgress(packageMap map[string][]string) *categoryProgress {
+	c := &categoryProgress{
+		categories:  make(map[string][]string),
+		packages:    make(map[string]int),
+		pkgProgress: make(map[string]float64),
+	}
+	for category, pkgs := range packageMap {
+		seen := make(map[string]bool, len(pkgs))
+		for _, pkg := range pkgs {
+			if pkg == "" || seen[pkg] {
+				continue
+			}
+			seen[pkg] = true
+			c.categories[pkg] = append(c.categories[pkg], category)
+			c.packages[category]++
+		}
+	}
+	if len(c.packages) < 2 {
+		return nil
+	}
+	return c
+}
+
+// update 记录pkg的处理状态,pkg不属于任何分类时返回false
+func (c *categoryProgress) update(pkg, description string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.categories[pkg]) == 0 {
+		return false
+	}
+	progress := 0.5
+	for _, prefix := range pkgDoneDescPrefixes {
+		if strings.HasPrefix(description, prefix) {
+			progress = 1
+			break
+		}
+	}
+	if progress > c.pkgProgress[pkg] {
+		c.pkgProgress[pkg] = progress
+	}
+	return true
+}
+
+// progress 返回各分类的进度,为分类中所有包进度的平均值
+func (c *categoryProgress) progress() map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sum := make(map[string]float64, len(c.packages))
+	for category := range c.packages {
+		sum[category] = 0
+	}
+	for pkg, progress := range c.pkgProgress {
+		for _, category := range c.categories[pkg] {
+			sum[category] += progress
+		}
+	}
+	for category, total := range c.packages {
+		sum[category] /= float64(total)
+	}
+	return sum
+}
+
+// json 返回各分类进度的json字符串
+func (c *categoryProgress) json() string {
+	data, err := json.Marshal(c.progress())
+	if err != nil {
+		logger.Warning(err)
+		return ""
+	}
+	return string(data)
+}
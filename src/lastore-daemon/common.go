@@ -96,18 +96,38 @@ func NormalizePackageNames(s string) ([]string, error) {
 	return pkgNames, nil
 }
 
-// makeEnvironWithSender 从sender获取 DISPLAY XAUTHORITY DEEPIN_LASTORE_LANG环境变量,从manager的agent获取系统代理(手动)的环境变量
-func makeEnvironWithSender(m *Manager, sender dbus.Sender) (map[string]string, error) {
+// aptConfPath 返回任务使用的apt配置文件,查询和模拟执行需要与任务使用相同的配置
+func (m *Manager) aptConfPath() string {
+	if m.updateApi == nil {
+		return apt.DefaultConfPath()
+	}
+	return m.updateApi.ConfPath()
+}
+
+// proxyEnviron 从当前活跃用户的agent获取系统代理(手动)的环境变量,用于不属于任何任务的apt调用,获取失败时返回空的map
+func (m *Manager) proxyEnviron() map[string]string {
 	environ := make(map[string]string)
-	var err error
+	if m.userAgents == nil {
+		return environ
+	}
 	agent := m.userAgents.getActiveLastoreAgent()
-	if agent != nil {
-		environ, err = agent.GetManualProxy(0)
-		if err != nil {
-			logger.Warning(err)
-			environ = make(map[string]string)
-		}
+	if agent == nil {
+		return environ
 	}
+	proxy, err := agent.GetManualProxy(0)
+	if err != nil {
+		logger.Warning(err)
+		return environ
+	}
+	for key, value := range proxy {
+		environ[key] = value
+	}
+	return environ
+}
+
+// makeEnvironWithSender 从sender获取 DISPLAY XAUTHORITY DEEPIN_LASTORE_LANG环境变量,从manager的agent获取系统代理(手动)的环境变量
+func makeEnvironWithSender(m *Manager, sender dbus.Sender) (map[string]string, error) {
+	environ := m.proxyEnviron()
 	pid, err := m.service.GetConnPID(string(sender))
 	if err != nil {
 		return nil, err
@@ -230,17 +250,17 @@ const autoDownloadTimeLayout = "15:04"
 var _minDelayTime = 10 * time.Second
 
 // getCustomTimeDuration 按照autoDownloadTimeLayout的格式计算时间差
-func getCustomTimeDuration(presetTime string) time.Duration {
+func getCustomTimeDuration(presetTime string, now time.Time) time.Duration {
 	presetTimer, err := time.Parse(autoDownloadTimeLayout, presetTime)
 	if err != nil {
 		logger.Warning(err)
 		return _minDelayTime
 	}
 	var timeStr string
-	if time.Now().Minute() < 10 {
-		timeStr = fmt.Sprintf("%v:0%v", time.Now().Hour(), time.Now().Minute())
+	if now.Minute() < 10 {
+		timeStr = fmt.Sprintf("%v:0%v", now.Hour(), now.Minute())
 	} else {
-		timeStr = fmt.Sprintf("%v:%v", time.Now().Hour(), time.Now().Minute())
+		timeStr = fmt.Sprintf("%v:%v", now.Hour(), now.Minute())
 	}
 	nowTimer, err := time.Parse(autoDownloadTimeLayout, timeStr)
 	if err != nil {
@@ -371,7 +391,7 @@ func SystemUpgradeInfo() (map[string][]system.UpgradeInfo, error) {
 }
 
 func cleanAllCache() {
-	err := exec.Command("apt-get", "clean", "-c", system.LastoreAptV2CommonConfPath).Run()
+	err := system.AptCommand(nil, "apt-get", "clean", "-c", system.LastoreAptV2CommonConfPath).Run()
 	if err != nil {
 		logger.Warning(err)
 	}
@@ -447,7 +467,7 @@ const (
 )
 
 // 下载并解压coreList
-func downloadAndDecompressCoreList() (string, error) {
+func downloadAndDecompressCoreList(confPath string) (string, error) {
 	downloadPackages := []string{coreListPkgName}
 	systemSource := system.GetCategorySourceMap()[system.SystemUpdate]
 	var options map[string]string
@@ -464,7 +484,7 @@ func downloadAndDecompressCoreList() (string, error) {
 			}
 		}
 	}
-	downloadPkg, err := apt.DownloadPackages(downloadPackages, nil, options)
+	downloadPkg, err := apt.DownloadPackages(downloadPackages, nil, confPath, options)
 	if err != nil {
 		// 下载失败则直接去本地目录查找
 		logger.Warningf("download %v failed:%v", downloadPackages, err)
@@ -521,6 +541,28 @@ func getCoreListFromCache() []string {
 	return pkgs
 }
 
+// getCoreListVersionsFromCache 返回缓存的必装清单中更新平台指定的版本,没有指定版本的包不在结果中
+func getCoreListVersionsFromCache() map[string]string {
+	data, err := os.ReadFile(coreListVarPath)
+	if err != nil {
+		logger.Warning(err)
+		return nil
+	}
+	var pkgList PackageList
+	err = json.Unmarshal(data, &pkgList)
+	if err != nil {
+		logger.Warning(err)
+		return nil
+	}
+	versions := make(map[string]string)
+	for _, pkg := range pkgList.PkgList {
+		if pkg.Version != "" {
+			versions[pkg.PkgName] = pkg.Version
+		}
+	}
+	return versions
+}
+
 type Package struct {
 	PkgName string `json:"PkgName"`
 	Version string `json:"Version"`
@@ -531,10 +573,10 @@ type PackageList struct {
 	Version string    `json:"Version"`
 }
 
-func getCoreListOnline() []string {
+func getCoreListOnline(confPath string) []string {
 	// 1. download coreList to /var/cache/lastore/archives/
 	// 2. 使用dpkg-deb解压deb得到coreList文件
-	coreFilePath, err := downloadAndDecompressCoreList()
+	coreFilePath, err := downloadAndDecompressCoreList(confPath)
 	if err != nil {
 		logger.Warning(err)
 		return nil
@@ -91,6 +91,15 @@ func (v *Updater) emitPropChangedClassifiedUpdatablePackages(value map[string][]
 	return v.service.EmitPropertyChanged(v, "ClassifiedUpdatablePackages", value)
 }
 
+func (v *Updater) setPropClassifiedRemovedPackages(value map[string][]string) {
+	v.ClassifiedRemovedPackages = value
+	v.emitPropChangedClassifiedRemovedPackages(value)
+}
+
+func (v *Updater) emitPropChangedClassifiedRemovedPackages(value map[string][]string) error {
+	return v.service.EmitPropertyChanged(v, "ClassifiedRemovedPackages", value)
+}
+
 func (v *Updater) setPropAutoInstallUpdates(value bool) (changed bool) {
 	if v.AutoInstallUpdates != value {
 		v.AutoInstallUpdates = value
@@ -182,6 +191,19 @@ func (v *Updater) emitPropChangedP2PUpdateEnable(value bool) error {
 	return v.service.EmitPropertyChanged(v, "P2PUpdateEnable", value)
 }
 
+func (v *Updater) setPropPDiffsEnabled(value bool) (changed bool) {
+	if v.PDiffsEnabled != value {
+		v.PDiffsEnabled = value
+		v.emitPropChangedPDiffsEnabled(value)
+		return true
+	}
+	return false
+}
+
+func (v *Updater) emitPropChangedPDiffsEnabled(value bool) error {
+	return v.service.EmitPropertyChanged(v, "PDiffsEnabled", value)
+}
+
 func (v *Updater) setPropP2PUpdateSupport(value bool) (changed bool) {
 	if v.P2PUpdateSupport != value {
 		v.P2PUpdateSupport = value
@@ -195,6 +217,80 @@ func (v *Updater) emitPropChangedP2PUpdateSupport(value bool) error {
 	return v.service.EmitPropertyChanged(v, "P2PUpdateSupport", value)
 }
 
+func (v *Updater) setPropExcludedPackages(value []string) {
+	v.ExcludedPackages = value
+	v.emitPropChangedExcludedPackages(value)
+}
+
+func (v *Updater) emitPropChangedExcludedPackages(value []string) error {
+	return v.service.EmitPropertyChanged(v, "ExcludedPackages", value)
+}
+
+func (v *Updater) setPropLastCheckTime(value string) (changed bool) {
+	if v.LastCheckTime != value {
+		v.LastCheckTime = value
+		v.emitPropChangedLastCheckTime(value)
+		return true
+	}
+	return false
+}
+
+func (v *Updater) emitPropChangedLastCheckTime(value string) error {
+	return v.service.EmitPropertyChanged(v, "LastCheckTime", value)
+}
+
+func (v *Updater) setPropLastCheckSucceeded(value bool) (changed bool) {
+	if v.LastCheckSucceeded != value {
+		v.LastCheckSucceeded = value
+		v.emitPropChangedLastCheckSucceeded(value)
+		return true
+	}
+	return false
+}
+
+func (v *Updater) emitPropChangedLastCheckSucceeded(value bool) error {
+	return v.service.EmitPropertyChanged(v, "LastCheckSucceeded", value)
+}
+
+func (v *Updater) setPropLastCheckError(value string) (changed bool) {
+	if v.LastCheckError != value {
+		v.LastCheckError = value
+		v.emitPropChangedLastCheckError(value)
+		return true
+	}
+	return false
+}
+
+func (v *Updater) emitPropChangedLastCheckError(value string) error {
+	return v.service.EmitPropertyChanged(v, "LastCheckError", value)
+}
+
+func (v *Updater) setPropLastCheckAttempt(value int32) (changed bool) {
+	if v.LastCheckAttempt != value {
+		v.LastCheckAttempt = value
+		v.emitPropChangedLastCheckAttempt(value)
+		return true
+	}
+	return false
+}
+
+func (v *Updater) emitPropChangedLastCheckAttempt(value int32) error {
+	return v.service.EmitPropertyChanged(v, "LastCheckAttempt", value)
+}
+
+func (v *Updater) setPropStagingPolicy(value string) (changed bool) {
+	if v.StagingPolicy != value {
+		v.StagingPolicy = value
+		v.emitPropChangedStagingPolicy(value)
+		return true
+	}
+	return false
+}
+
+func (v *Updater) emitPropChangedStagingPolicy(value string) error {
+	return v.service.EmitPropertyChanged(v, "StagingPolicy", value)
+}
+
 func (v *Job) setPropId(value string) (changed bool) {
 	if v.Id != value {
 		v.Id = value
@@ -256,6 +352,19 @@ func (v *Job) emitPropChangedDownloadSize(value int64) error {
 	return v.service.EmitPropertyChanged(v, "DownloadSize", value)
 }
 
+func (v *Job) setPropSpaceDelta(value int64) (changed bool) {
+	if v.SpaceDelta != value {
+		v.SpaceDelta = value
+		v.emitPropChangedSpaceDelta(value)
+		return true
+	}
+	return false
+}
+
+func (v *Job) emitPropChangedSpaceDelta(value int64) error {
+	return v.service.EmitPropertyChanged(v, "SpaceDelta", value)
+}
+
 func (v *Job) setPropType(value string) (changed bool) {
 	if v.Type != value {
 		v.Type = value
@@ -308,6 +417,84 @@ func (v *Job) emitPropChangedDescription(value string) error {
 	return v.service.EmitPropertyChanged(v, "Description", value)
 }
 
+func (v *Job) setPropCurrentItem(value string) (changed bool) {
+	if v.CurrentItem != value {
+		v.CurrentItem = value
+		v.emitPropChangedCurrentItem(value)
+		return true
+	}
+	return false
+}
+
+func (v *Job) emitPropChangedCurrentItem(value string) error {
+	return v.service.EmitPropertyChanged(v, "CurrentItem", value)
+}
+
+func (v *Job) setPropMediaChange(value string) (changed bool) {
+	if v.MediaChange != value {
+		v.MediaChange = value
+		v.emitPropChangedMediaChange(value)
+		return true
+	}
+	return false
+}
+
+func (v *Job) emitPropChangedMediaChange(value string) error {
+	return v.service.EmitPropertyChanged(v, "MediaChange", value)
+}
+
+func (v *Job) setPropCategoryProgress(value string) (changed bool) {
+	if v.CategoryProgress != value {
+		v.CategoryProgress = value
+		v.emitPropChangedCategoryProgress(value)
+		return true
+	}
+	return false
+}
+
+func (v *Job) emitPropChangedCategoryProgress(value string) error {
+	return v.service.EmitPropertyChanged(v, "CategoryProgress", value)
+}
+
+func (v *Job) setPropPlatformDowngrades(value string) (changed bool) {
+	if v.PlatformDowngrades != value {
+		v.PlatformDowngrades = value
+		v.emitPropChangedPlatformDowngrades(value)
+		return true
+	}
+	return false
+}
+
+func (v *Job) emitPropChangedPlatformDowngrades(value string) error {
+	return v.service.EmitPropertyChanged(v, "PlatformDowngrades", value)
+}
+
+func (v *Job) setPropETA(value int64) (changed bool) {
+	if v.ETA != value {
+		v.ETA = value
+		v.emitPropChangedETA(value)
+		return true
+	}
+	return false
+}
+
+func (v *Job) emitPropChangedETA(value int64) error {
+	return v.service.EmitPropertyChanged(v, "ETA", value)
+}
+
+func (v *Job) setPropQueuePosition(value int32) (changed bool) {
+	if v.QueuePosition != value {
+		v.QueuePosition = value
+		v.emitPropChangedQueuePosition(value)
+		return true
+	}
+	return false
+}
+
+func (v *Job) emitPropChangedQueuePosition(value int32) error {
+	return v.service.EmitPropertyChanged(v, "QueuePosition", value)
+}
+
 func (v *Job) setPropSpeed(value int64) (changed bool) {
 	if v.Speed != value {
 		v.Speed = value
@@ -378,6 +565,19 @@ func (v *Manager) emitPropChangedAutoClean(value bool) error {
 	return v.service.EmitPropertyChanged(v, "AutoClean", value)
 }
 
+func (v *Manager) setPropSafecacheReady(value bool) (changed bool) {
+	if v.SafecacheReady != value {
+		v.SafecacheReady = value
+		v.emitPropChangedSafecacheReady(value)
+		return true
+	}
+	return false
+}
+
+func (v *Manager) emitPropChangedSafecacheReady(value bool) error {
+	return v.service.EmitPropertyChanged(v, "SafecacheReady", value)
+}
+
 func (v *Manager) setPropUpdateMode(value system.UpdateType) (changed bool) {
 	if v.UpdateMode != value {
 		v.UpdateMode = value
@@ -429,3 +629,60 @@ func (v *Manager) setPropHardwareId(value string) (changed bool) {
 func (v *Manager) emitPropChangedHardwareId(value string) error {
 	return v.service.EmitPropertyChanged(v, "HardwareId", value)
 }
+
+func (v *Manager) setPropOSEdition(value string) (changed bool) {
+	if v.OSEdition != value {
+		v.OSEdition = value
+		v.emitPropChangedOSEdition(value)
+		return true
+	}
+	return false
+}
+
+func (v *Manager) emitPropChangedOSEdition(value string) error {
+	return v.service.EmitPropertyChanged(v, "OSEdition", value)
+}
+
+func (v *Manager) setPropRebootRequired(value bool) (changed bool) {
+	if v.RebootRequired != value {
+		v.RebootRequired = value
+		v.emitPropChangedRebootRequired(value)
+		return true
+	}
+	return false
+}
+
+func (v *Manager) emitPropChangedRebootRequired(value bool) error {
+	return v.service.EmitPropertyChanged(v, "RebootRequired", value)
+}
+
+func (v *Manager) setPropRebootRequiredPackages(value []string) {
+	v.RebootRequiredPackages = value
+	v.emitPropChangedRebootRequiredPackages(value)
+}
+
+func (v *Manager) emitPropChangedRebootRequiredPackages(value []string) error {
+	return v.service.EmitPropertyChanged(v, "RebootRequiredPackages", value)
+}
+
+func (v *Manager) setPropOfflineMode(value bool) (changed bool) {
+	if v.OfflineMode != value {
+		v.OfflineMode = value
+		v.emitPropChangedOfflineMode(value)
+		return true
+	}
+	return false
+}
+
+func (v *Manager) emitPropChangedOfflineMode(value bool) error {
+	return v.service.EmitPropertyChanged(v, "OfflineMode", value)
+}
+
+func (v *Manager) setPropDeferredPackages(value []string) {
+	v.DeferredPackages = value
+	v.emitPropChangedDeferredPackages(value)
+}
+
+func (v *Manager) emitPropChangedDeferredPackages(value []string) error {
+	return v.service.EmitPropertyChanged(v, "DeferredPackages", value)
+}
@@ -8,6 +8,37 @@ import (
 
 func (v *Manager) GetExportedMethods() dbusutil.ExportedMethods {
 	return dbusutil.ExportedMethods{
+		{
+			Name:    "AbortAll",
+			Fn:      v.AbortAll,
+			OutArgs: []string{"result"},
+		},
+		{
+			Name:   "AllowProtectedRemoval",
+			Fn:     v.AllowProtectedRemoval,
+			InArgs: []string{"jobId", "packages"},
+		},
+		{
+			Name:    "ApplyDeferredPackages",
+			Fn:      v.ApplyDeferredPackages,
+			OutArgs: []string{"job"},
+		},
+		{
+			Name:    "AutoCleanArchives",
+			Fn:      v.AutoCleanArchives,
+			OutArgs: []string{"job"},
+		},
+		{
+			Name:    "CheckSourceReachable",
+			Fn:      v.CheckSourceReachable,
+			OutArgs: []string{"result"},
+		},
+		{
+			Name:    "CheckUpdatesForType",
+			Fn:      v.CheckUpdatesForType,
+			InArgs:  []string{"mode"},
+			OutArgs: []string{"result"},
+		},
 		{
 			Name:    "CheckUpgrade",
 			Fn:      v.CheckUpgrade,
@@ -30,6 +61,11 @@ func (v *Manager) GetExportedMethods() dbusutil.ExportedMethods {
 			Fn:     v.CleanJob,
 			InArgs: []string{"jobId"},
 		},
+		{
+			Name:   "ConfirmMediaChange",
+			Fn:     v.ConfirmMediaChange,
+			InArgs: []string{"jobId"},
+		},
 		{
 			Name:    "DistUpgrade",
 			Fn:      v.DistUpgrade,
@@ -41,6 +77,12 @@ func (v *Manager) GetExportedMethods() dbusutil.ExportedMethods {
 			InArgs:  []string{"mode", "needBackup"},
 			OutArgs: []string{"job"},
 		},
+		{
+			Name:    "DistUpgradeWithMirror",
+			Fn:      v.DistUpgradeWithMirror,
+			InArgs:  []string{"mirror"},
+			OutArgs: []string{"job"},
+		},
 		{
 			Name:    "FixError",
 			Fn:      v.FixError,
@@ -57,17 +99,67 @@ func (v *Manager) GetExportedMethods() dbusutil.ExportedMethods {
 			Fn:      v.GetHistoryLogs,
 			OutArgs: []string{"changeLogs"},
 		},
+		{
+			Name:    "GetJobLog",
+			Fn:      v.GetJobLog,
+			InArgs:  []string{"jobId"},
+			OutArgs: []string{"log"},
+		},
+		{
+			Name:    "GetMergedUpdatablePackages",
+			Fn:      v.GetMergedUpdatablePackages,
+			OutArgs: []string{"packages"},
+		},
+		{
+			Name:    "GetUpdatablePackageOrigins",
+			Fn:      v.GetUpdatablePackageOrigins,
+			OutArgs: []string{"origins"},
+		},
+		{
+			Name:    "GetUpdateChangelog",
+			Fn:      v.GetUpdateChangelog,
+			InArgs:  []string{"packages"},
+			OutArgs: []string{"changelog"},
+		},
 		{
 			Name:    "GetUpdateLogs",
 			Fn:      v.GetUpdateLogs,
 			InArgs:  []string{"updateType"},
 			OutArgs: []string{"changeLogs"},
 		},
+		{
+			Name:    "GetUpdateSize",
+			Fn:      v.GetUpdateSize,
+			InArgs:  []string{"mode"},
+			OutArgs: []string{"size"},
+		},
+		{
+			Name:    "GetUpdateStateSnapshot",
+			Fn:      v.GetUpdateStateSnapshot,
+			OutArgs: []string{"snapshot"},
+		},
+		{
+			Name:    "GetUpdatesDelta",
+			Fn:      v.GetUpdatesDelta,
+			OutArgs: []string{"delta"},
+		},
 		{
 			Name:   "HandleSystemEvent",
 			Fn:     v.HandleSystemEvent,
 			InArgs: []string{"eventType"},
 		},
+		{
+			Name:    "ImportSourceKey",
+			Fn:      v.ImportSourceKey,
+			InArgs:  []string{"keyData"},
+			OutArgs: []string{"fingerprint"},
+		},
+		{
+			Name:    "InstallLocalPackage",
+			Fn:      v.InstallLocalPackage,
+			InArgs:  []string{"jobName", "path"},
+			OutArgs: []string{"job"},
+		},
 		{
 			Name:    "InstallPackage",
 			Fn:      v.InstallPackage,
@@ -80,6 +172,28 @@ func (v *Manager) GetExportedMethods() dbusutil.ExportedMethods {
 			InArgs:  []string{"jobName", "sourceListPath", "repoListPath", "cachePath", "packageName"},
 			OutArgs: []string{"jobPath"},
 		},
+		{
+			Name:    "InstallPackagesWithVersion",
+			Fn:      v.InstallPackagesWithVersion,
+			InArgs:  []string{"jobName", "packages"},
+			OutArgs: []string{"job"},
+		},
+		{
+			Name:    "IsPackageSystemBusy",
+			Fn:      v.IsPackageSystemBusy,
+			OutArgs: []string{"busy", "pid", "name"},
+		},
+		{
+			Name:    "ListJobs",
+			Fn:      v.ListJobs,
+			OutArgs: []string{"jobs"},
+		},
+		{
+			Name:    "ListUpdateHistory",
+			Fn:      v.ListUpdateHistory,
+			InArgs:  []string{"limit"},
+			OutArgs: []string{"history"},
+		},
 		{
 			Name:    "PackageDesktopPath",
 			Fn:      v.PackageDesktopPath,
@@ -110,6 +224,11 @@ func (v *Manager) GetExportedMethods() dbusutil.ExportedMethods {
 			InArgs:  []string{"packages"},
 			OutArgs: []string{"outArg0"},
 		},
+		{
+			Name:   "PauseDownloadJob",
+			Fn:     v.PauseDownloadJob,
+			InArgs: []string{"jobId"},
+		},
 		{
 			Name:   "PauseJob",
 			Fn:     v.PauseJob,
@@ -131,11 +250,23 @@ func (v *Manager) GetExportedMethods() dbusutil.ExportedMethods {
 			InArgs:  []string{"mode"},
 			OutArgs: []string{"job"},
 		},
+		{
+			Name:    "PrepareDistUpgradeWithMirror",
+			Fn:      v.PrepareDistUpgradeWithMirror,
+			InArgs:  []string{"mirror"},
+			OutArgs: []string{"job"},
+		},
 		{
 			Name:   "PrepareFullScreenUpgrade",
 			Fn:     v.PrepareFullScreenUpgrade,
 			InArgs: []string{"option"},
 		},
+		{
+			Name:    "PreviewDistUpgrade",
+			Fn:      v.PreviewDistUpgrade,
+			InArgs:  []string{"mode"},
+			OutArgs: []string{"plan"},
+		},
 		{
 			Name:   "PowerOff",
 			Fn:     v.PowerOff,
@@ -147,22 +278,53 @@ func (v *Manager) GetExportedMethods() dbusutil.ExportedMethods {
 			InArgs:  []string{"mode"},
 			OutArgs: []string{"outArg0"},
 		},
+		{
+			Name: "RecomputeUpdatable",
+			Fn:   v.RecomputeUpdatable,
+		},
+		{
+			Name:    "ReconfigureSources",
+			Fn:      v.ReconfigureSources,
+			InArgs:  []string{"systemSourceList", "nonUnknownList", "otherList"},
+			OutArgs: []string{"changed"},
+		},
 		{
 			Name:   "RegisterAgent",
 			Fn:     v.RegisterAgent,
 			InArgs: []string{"path"},
 		},
+		{
+			Name:    "ReinstallPackages",
+			Fn:      v.ReinstallPackages,
+			InArgs:  []string{"packages"},
+			OutArgs: []string{"job"},
+		},
 		{
 			Name:    "RemovePackage",
 			Fn:      v.RemovePackage,
 			InArgs:  []string{"jobName", "packages"},
 			OutArgs: []string{"job"},
 		},
+		{
+			Name:   "RemoveSourceKey",
+			Fn:     v.RemoveSourceKey,
+			InArgs: []string{"fingerprint"},
+		},
 		{
 			Name:   "SetAutoClean",
 			Fn:     v.SetAutoClean,
 			InArgs: []string{"enable"},
 		},
+		{
+			Name:   "SetJobPriority",
+			Fn:     v.SetJobPriority,
+			InArgs: []string{"jobId", "priority"},
+		},
+		{
+			Name:   "SetOfflineMode",
+			Fn:     v.SetOfflineMode,
+			InArgs: []string{"enable"},
+		},
 		{
 			Name:   "SetRegion",
 			Fn:     v.SetRegion,
@@ -200,6 +362,18 @@ func (v *Manager) GetExportedMethods() dbusutil.ExportedMethods {
 			Fn:      v.UpdateSource,
 			OutArgs: []string{"job"},
 		},
+		{
+			Name:    "ValidateDistUpgrade",
+			Fn:      v.ValidateDistUpgrade,
+			InArgs:  []string{"mode"},
+			OutArgs: []string{"result"},
+		},
+		{
+			Name:    "ValidateOup",
+			Fn:      v.ValidateOup,
+			InArgs:  []string{"path"},
+			OutArgs: []string{"info"},
+		},
 	}
 }
 func (v *Updater) GetExportedMethods() dbusutil.ExportedMethods {
@@ -240,6 +414,11 @@ func (v *Updater) GetExportedMethods() dbusutil.ExportedMethods {
 			Fn:     v.SetDownloadSpeedLimit,
 			InArgs: []string{"limitConfig"},
 		},
+		{
+			Name:   "SetExcludedPackages",
+			Fn:     v.SetExcludedPackages,
+			InArgs: []string{"packages"},
+		},
 		{
 			Name:   "SetIdleDownloadConfig",
 			Fn:     v.SetIdleDownloadConfig,
@@ -255,11 +434,21 @@ func (v *Updater) GetExportedMethods() dbusutil.ExportedMethods {
 			Fn:     v.SetMirrorSource,
 			InArgs: []string{"id"},
 		},
+		{
+			Name:   "SetPDiffsEnabled",
+			Fn:     v.SetPDiffsEnabled,
+			InArgs: []string{"enable"},
+		},
 		{
 			Name:   "SetP2PUpdateEnable",
 			Fn:     v.SetP2PUpdateEnable,
 			InArgs: []string{"enable"},
 		},
+		{
+			Name:   "SetStagingPolicy",
+			Fn:     v.SetStagingPolicy,
+			InArgs: []string{"policy"},
+		},
 		{
 			Name:   "SetUpdateNotify",
 			Fn:     v.SetUpdateNotify,
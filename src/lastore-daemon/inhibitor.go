@@ -20,6 +20,19 @@ const (
 	methodCallerOfflineTool
 )
 
+func (c methodCaller) String() string {
+	switch c {
+	case methodCallerControlCenter:
+		return "control-center"
+	case methodCallerAppStore:
+		return "app-store"
+	case methodCallerOfflineTool:
+		return "offline-tool"
+	default:
+		return "other"
+	}
+}
+
 func mapMethodCaller(execPath string, cmdLine string) methodCaller {
 	logger.Debug("execPath:", execPath, "cmdLine:", cmdLine)
 	switch execPath {
@@ -16,6 +16,7 @@ import (
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
 
 	"github.com/linuxdeepin/go-lib/dbusutil"
+	"github.com/linuxdeepin/go-lib/strv"
 	"github.com/linuxdeepin/go-lib/utils"
 )
 
@@ -48,6 +49,11 @@ type JobManager struct {
 
 	dispatchMux sync.Mutex
 	notify      func()
+
+	history *updateHistory
+
+	recoverDpkgInterrupted func(*Job) // job因dpkg中断失败时的修复方法
+	jobEnded               func(*Job) // job及其后续job全部结束并移除后调用
 }
 
 func NewJobManager(service *dbusutil.Service, api system.System, notifyFn func()) *JobManager {
@@ -214,7 +220,7 @@ func (jm *JobManager) CreateJob(jobName, jobType string, packages []string, envi
 
 	case system.UpdateJobType:
 		job = NewJob(jm.service, genJobId(jobType), jobName, packages, jobType, SystemChangeQueue, environ)
-	case system.CleanJobType:
+	case system.CleanJobType, system.AutoCleanJobType:
 		job = NewJob(jm.service, genJobId(jobType), jobName, packages, jobType, LockQueue, environ)
 	case system.FixErrorJobType:
 		var errType string
@@ -337,6 +343,41 @@ func (jm *JobManager) PauseJob(jobId string) error {
 	return err
 }
 
+// downloadPauseTimeout 等待当前文件下载完成的最长时间
+const downloadPauseTimeout = time.Minute
+
+// PauseDownloadJob 在当前文件下载完成后暂停下载任务,已下载的包保留在缓存中,后续下载或安装时可以直接使用
+func (jm *JobManager) PauseDownloadJob(jobId string) error {
+	job := jm.findJobById(jobId)
+	if job == nil {
+		return system.NotFoundError("PauseDownloadJob jobId")
+	}
+	if job.Type != system.DownloadJobType && job.Type != system.PrepareDistUpgradeJobType {
+		return fmt.Errorf("job %s is not a download job", jobId)
+	}
+	job.PropsMu.Lock()
+	defer job.PropsMu.Unlock()
+	if job.Status != system.RunningStatus {
+		return jm.pauseJob(job)
+	}
+	return jm.system.PauseAtFileBoundary(job.Id, downloadPauseTimeout)
+}
+
+// ConfirmMediaChange 用户已插入任务请求的光盘或U盘,通知apt继续
+func (jm *JobManager) ConfirmMediaChange(jobId string) error {
+	job := jm.findJobById(jobId)
+	if job == nil {
+		return system.NotFoundError("ConfirmMediaChange jobId")
+	}
+	job.PropsMu.RLock()
+	waiting := job.MediaChange != ""
+	job.PropsMu.RUnlock()
+	if !waiting {
+		return fmt.Errorf("job %s is not waiting for media change", jobId)
+	}
+	return jm.system.ConfirmMediaChange(job.Id)
+}
+
 // ForceAbortAndRetry 终止该job，并将退出状态设置为failed
 func (jm *JobManager) ForceAbortAndRetry(job *Job) error {
 	job.PropsMu.Lock()
@@ -357,6 +398,108 @@ func (jm *JobManager) ForceAbortAndRetry(job *Job) error {
 	return nil
 }
 
+// AbortAllResult AbortAll的结果,Skipped为正在安装无法中断的job
+type AbortAllResult struct {
+	Aborted []JobSummary
+	Skipped []JobSummary
+}
+
+// AbortAll 终止所有正在执行和等待中的job,包括尚未加入队列的后续job,终止的job会切换到EndStatus以释放组合仓库等资源.
+// 执行期间持有dispatchMux,不会启动或添加新的job
+func (jm *JobManager) AbortAll() AbortAllResult {
+	jm.dispatchMux.Lock()
+	defer jm.dispatchMux.Unlock()
+	result := AbortAllResult{
+		Aborted: []JobSummary{},
+		Skipped: []JobSummary{},
+	}
+	for _, job := range jm.List() {
+		summary := job.summary()
+		job.PropsMu.Lock()
+		if job.Status == system.EndStatus {
+			job.PropsMu.Unlock()
+			continue
+		}
+		if job.Status == system.RunningStatus {
+			if !job.Cancelable {
+				job.PropsMu.Unlock()
+				logger.Warningf("job %s is not cancelable, skip aborting it", job.Id)
+				result.Skipped = append(result.Skipped, summary)
+				continue
+			}
+			err := jm.pauseJob(job)
+			if err != nil {
+				job.PropsMu.Unlock()
+				logger.Warningf("abort job %s failed: %v", job.Id, err)
+				result.Skipped = append(result.Skipped, summary)
+				continue
+			}
+		}
+		next := job.next
+		job.next = nil
+		job.retry = 0
+		err := TransitionJobState(job, system.EndStatus)
+		job.PropsMu.Unlock()
+		if err != nil {
+			logger.Warningf("abort job %s failed: %v", job.Id, err)
+			result.Skipped = append(result.Skipped, summary)
+			continue
+		}
+		result.Aborted = append(result.Aborted, summary)
+		// 后续job的EndStatus hook中会释放组合仓库
+		for ; next != nil; next = next.next {
+			next.PropsMu.Lock()
+			err = TransitionJobState(next, system.EndStatus)
+			next.PropsMu.Unlock()
+			if err != nil {
+				logger.Warningf("abort job %s failed: %v", next.Id, err)
+			}
+		}
+	}
+	jm.markDirty()
+	return result
+}
+
+// upgradeJobTypes 安装更新和下载更新的任务类型,这些任务执行期间不自动下载
+var upgradeJobTypes = strv.Strv{
+	system.DistUpgradeJobType,
+	system.PrepareDistUpgradeJobType,
+	system.InstallJobType,
+	system.RemoveJobType,
+	system.DownloadJobType,
+	system.OfflineUpdateJobType,
+}
+
+// isActive job是否在等待、执行或暂停中,失败后等待重试的job同样视为进行中.调用者需要持有job.PropsMu
+func (j *Job) isActive() bool {
+	switch j.Status {
+	case system.ReadyStatus, system.RunningStatus, system.PausedStatus:
+		return true
+	case system.FailedStatus:
+		return j.retry > 0
+	}
+	return false
+}
+
+// HasActiveUpgradeJob 是否有进行中的安装更新或下载更新的job,包括尚未加入队列的后续job.
+// 持有dispatchMux,检查期间不会启动或添加新的job
+func (jm *JobManager) HasActiveUpgradeJob() bool {
+	jm.dispatchMux.Lock()
+	defer jm.dispatchMux.Unlock()
+	for _, job := range jm.List() {
+		job.PropsMu.RLock()
+		active := job.isActive()
+		for j := job; active && j != nil; j = j.next {
+			if upgradeJobTypes.Contains(j.Type) {
+				job.PropsMu.RUnlock()
+				return true
+			}
+		}
+		job.PropsMu.RUnlock()
+	}
+	return false
+}
+
 // Dispatch transition Job status in Job Queues
 // 1. Clean Jobs whose status is system.EndStatus
 // 2. Run all Pending Jobs.
@@ -371,6 +514,14 @@ func (jm *JobManager) dispatch() {
 
 	for _, job := range pendingDeleteJobs {
 		_ = jm.removeJob(job.Id, job.queueName)
+		job.PropsMu.RLock()
+		if job.endResult == system.SucceedStatus || job.endResult == system.FailedStatus {
+			jm.history.recordJob(job, job.endResult)
+		}
+		job.PropsMu.RUnlock()
+		if job.next == nil && jm.jobEnded != nil {
+			go jm.jobEnded(job)
+		}
 		if job.next != nil {
 			logger.Infof("Job(%q).next is %v\n", job.Id, job.next)
 			// 部分属性需要继承
@@ -412,6 +563,40 @@ func (jm *JobManager) dispatch() {
 	}
 
 	jm.sendNotify()
+	jm.updateQueuePositions()
+}
+
+func (jm *JobManager) updateQueuePositions() {
+	if NotUseDBus {
+		return
+	}
+	for _, queue := range jm.queues {
+		for job, pos := range queue.QueuePositions() {
+			job.PropsMu.Lock()
+			job.setPropQueuePosition(pos)
+			job.PropsMu.Unlock()
+		}
+	}
+}
+
+// SetJobPriority 调整等待中job的优先级,与dispatch互斥,避免调度过程中队列顺序发生变化
+func (jm *JobManager) SetJobPriority(jobId string, priority int) error {
+	jm.dispatchMux.Lock()
+	defer jm.dispatchMux.Unlock()
+	job := jm.findJobById(jobId)
+	if job == nil {
+		return system.NotFoundError("SetJobPriority " + jobId)
+	}
+	queue, ok := jm.queues[job.queueName]
+	if !ok {
+		return system.NotFoundError("SetJobPriority in queues " + job.queueName)
+	}
+	err := queue.SetPriority(jobId, priority)
+	if err != nil {
+		return err
+	}
+	jm.updateQueuePositions()
+	return nil
 }
 
 func (jm *JobManager) markDirty() {
@@ -552,6 +737,20 @@ func (jm *JobManager) handleJobProgressInfo(info system.JobProgressInfo) {
 	if j.updateInfo(info) {
 		jm.markDirty()
 	}
+
+	if info.Status == system.FailedStatus && info.Error != nil &&
+		info.Error.ErrType == system.ErrorDpkgInterrupted && jm.recoverDpkgInterrupted != nil {
+		j.PropsMu.Lock()
+		// retry大于0时job还会自动重试,无需修复
+		needRecover := j.Status == system.FailedStatus && j.retry == 0 && !j.dpkgRecovered
+		if needRecover {
+			j.dpkgRecovered = true
+		}
+		j.PropsMu.Unlock()
+		if needRecover {
+			go jm.recoverDpkgInterrupted(j)
+		}
+	}
 }
 
 func (jm *JobManager) findJobById(jobId string) *Job {
@@ -596,7 +795,7 @@ var genJobId = func() func(string) string {
 	return func(jobType string) string {
 		switch jobType {
 		case system.PrepareDistUpgradeJobType, system.DistUpgradeJobType,
-			system.UpdateSourceJobType, system.CleanJobType, system.PrepareSystemUpgradeJobType,
+			system.UpdateSourceJobType, system.CleanJobType, system.AutoCleanJobType, system.PrepareSystemUpgradeJobType,
 			system.PrepareAppStoreUpgradeJobType, system.PrepareSecurityUpgradeJobType, system.PrepareUnknownUpgradeJobType,
 			system.SystemUpgradeJobType, system.AppStoreUpgradeJobType, system.SecurityUpgradeJobType, system.UnknownUpgradeJobType, system.CheckSystemJobType:
 			return jobType
@@ -5,11 +5,13 @@
 package main
 
 import (
+	"github.com/linuxdeepin/lastore-daemon/src/internal/config"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system/apt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestJobManager(t *testing.T) {
@@ -71,3 +73,79 @@ func Test_GetUpgradeInfoMap(t *testing.T) {
 	_, ok = upgradeInfoMap[system.SecurityUpdate]
 	assert.Equal(t, true, ok)
 }
+
+func TestJobManagerAbortAll(t *testing.T) {
+	NotUseDBus = true
+	jm := NewJobManager(nil, apt.NewSystem(nil, nil), nil)
+	_, installing, err := jm.CreateJob("", system.RemoveJobType, []string{"a"}, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, jm.addJob(installing))
+	installing.Status = system.RunningStatus
+	installing.Cancelable = false
+
+	_, download, err := jm.CreateJob("", system.DownloadJobType, []string{"b"}, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, jm.addJob(download))
+	next := NewJob(nil, "next", "", []string{"b"}, system.InstallJobType, SystemChangeQueue, nil)
+	var released bool
+	next.setPreHooks(map[string]func() error{
+		string(system.EndStatus): func() error {
+			released = true
+			return nil
+		},
+	})
+	download.next = next
+
+	result := jm.AbortAll()
+	assert.Len(t, result.Aborted, 1)
+	assert.Equal(t, download.Id, result.Aborted[0].Id)
+	assert.Len(t, result.Skipped, 1)
+	assert.Equal(t, installing.Id, result.Skipped[0].Id)
+	assert.Equal(t, system.EndStatus, download.Status)
+	assert.Nil(t, download.next)
+	assert.Equal(t, system.EndStatus, next.Status)
+	assert.True(t, released)
+	assert.Equal(t, system.RunningStatus, installing.Status)
+}
+
+func TestJobManagerHasActiveUpgradeJob(t *testing.T) {
+	NotUseDBus = true
+	jm := NewJobManager(nil, apt.NewSystem(nil, nil), nil)
+	assert.False(t, jm.HasActiveUpgradeJob())
+
+	_, check, err := jm.CreateJob("", system.UpdateSourceJobType, nil, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, jm.addJob(check))
+	assert.False(t, jm.HasActiveUpgradeJob())
+
+	// 用户手动开始安装更新
+	upgrade := NewJob(nil, system.DistUpgradeJobType, "", []string{"a"}, system.DistUpgradeJobType, LockQueue, nil)
+	require.NoError(t, jm.addJob(upgrade))
+	upgrade.Status = system.RunningStatus
+	assert.True(t, jm.HasActiveUpgradeJob())
+
+	upgrade.Status = system.FailedStatus
+	upgrade.retry = 1
+	assert.True(t, jm.HasActiveUpgradeJob())
+	upgrade.retry = 0
+	assert.False(t, jm.HasActiveUpgradeJob())
+
+	// 检查更新后才安装的后续job
+	check.next = NewJob(nil, "next", "", []string{"a"}, system.DistUpgradeJobType, SystemChangeQueue, nil)
+	assert.True(t, jm.HasActiveUpgradeJob())
+}
+
+func TestAutoDownloadSkippedDuringUpgrade(t *testing.T) {
+	NotUseDBus = true
+	jm := NewJobManager(nil, apt.NewSystem(nil, nil), nil)
+	upgrade := NewJob(nil, system.DistUpgradeJobType, "", []string{"a"}, system.DistUpgradeJobType, LockQueue, nil)
+	require.NoError(t, jm.addJob(upgrade))
+	upgrade.Status = system.RunningStatus
+
+	cfg := &config.Config{}
+	m := &Manager{config: cfg, updater: &Updater{config: cfg}, jobManager: jm}
+	// 没有跳过时会使用为nil的m.service创建下载job
+	m.autoDownload(system.SystemUpdate)
+	assert.Len(t, jm.List(), 1)
+	assert.Equal(t, system.RunningStatus, upgrade.Status)
+}
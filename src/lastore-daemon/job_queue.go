@@ -10,6 +10,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 type JobList []*Job
@@ -22,6 +23,9 @@ func (l JobList) Less(i, j int) bool {
 	if l[i].Type == system.UpdateSourceJobType {
 		return true
 	}
+	if l[i].priority != l[j].priority {
+		return l[i].priority > l[j].priority
+	}
 	return l[i].CreateTime < l[j].CreateTime
 }
 
@@ -67,7 +71,7 @@ func (l *JobQueue) PendingJobs() JobList {
 
 		switch jobStatus {
 		case system.FailedStatus:
-			if job.retry > 0 {
+			if job.retry > 0 && !time.Now().Before(job.retryAfter) {
 				readyJobs = append(readyJobs, job)
 			}
 		case system.RunningStatus:
@@ -189,6 +193,54 @@ func (l *JobQueue) Raise(jobId string) error {
 	return nil
 }
 
+// SetPriority 修改等待中job的优先级并重新排序,运行中的job不受影响
+func (l *JobQueue) SetPriority(jobId string, priority int) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	var target *Job
+	for _, job := range l.jobs {
+		if job.Id == jobId {
+			target = job
+			break
+		}
+	}
+	if target == nil {
+		return system.NotFoundError("JobQueue.SetPriority " + jobId)
+	}
+	target.PropsMu.RLock()
+	status := target.Status
+	target.PropsMu.RUnlock()
+	if status != system.ReadyStatus && status != system.FailedStatus && status != system.PausedStatus {
+		return fmt.Errorf("job %s is %s, only waiting job can be reordered", jobId, status)
+	}
+	target.priority = priority
+	sort.Sort(l.jobs)
+	return nil
+}
+
+// QueuePositions 返回每个job在等待队列中的位置,从1开始,运行中或已结束的job为0
+func (l *JobQueue) QueuePositions() map[*Job]int32 {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	positions := make(map[*Job]int32, len(l.jobs))
+	var pos int32
+	for _, job := range l.jobs {
+		job.PropsMu.RLock()
+		status := job.Status
+		waiting := status == system.ReadyStatus || (status == system.FailedStatus && job.retry > 0)
+		job.PropsMu.RUnlock()
+		if waiting {
+			pos++
+			positions[job] = pos
+		} else {
+			positions[job] = 0
+		}
+	}
+	return positions
+}
+
 func (l *JobQueue) Find(id string) *Job {
 	l.mux.RLock()
 	defer l.mux.RUnlock()
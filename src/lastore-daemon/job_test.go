@@ -47,3 +47,15 @@ func TestJob(t *testing.T) {
 		})
 	}
 }
+
+func TestJobSummary(t *testing.T) {
+	job := NewJob(nil, "summary", "summary", nil, system.UpdateSourceJobType, "", map[string]string{"PACKAGEKIT_CALLER_UID": "1000"})
+	job.caller = methodCallerControlCenter
+	s := job.summary()
+	if s.Id != "summary" || s.Type != system.UpdateSourceJobType || s.Path != job.getPath() {
+		t.Errorf("unexpected summary %+v", s)
+	}
+	if s.Caller != "control-center" || s.CallerUid != "1000" {
+		t.Errorf("unexpected caller %q uid %q", s.Caller, s.CallerUid)
+	}
+}
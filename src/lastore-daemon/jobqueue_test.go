@@ -6,8 +6,11 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
 )
 
 func TestJobQueue(t *testing.T) {
@@ -52,3 +55,42 @@ func TestJobQueue(t *testing.T) {
 		}
 	}
 }
+
+func TestJobQueueSetPriority(t *testing.T) {
+	q := NewJobQueue("test", 1)
+	for i, id := range []string{"download", "install", "security"} {
+		j := NewJob(nil, id, id, nil, id, "test", nil)
+		j.CreateTime = int64(i)
+		if err := q.Add(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Find("download").Status = system.RunningStatus
+
+	if err := q.SetPriority("download", 10); err == nil {
+		t.Fatal("running job should not be reordered")
+	}
+	if err := q.SetPriority("not-exists", 10); err == nil {
+		t.Fatal("SetPriority none exists Job")
+	}
+	if err := q.SetPriority("security", 10); err != nil {
+		t.Fatal(err)
+	}
+	pending := q.PendingJobs()
+	if len(pending) != 0 {
+		t.Fatalf("queue is full, got pending jobs %v", pending)
+	}
+	var ids []string
+	for _, j := range q.AllJobs() {
+		ids = append(ids, j.Id)
+	}
+	if strings.Join(ids, ",") != "security,download,install" {
+		t.Fatalf("unexpected order %v", ids)
+	}
+	positions := q.QueuePositions()
+	for id, want := range map[string]int32{"security": 1, "download": 0, "install": 2} {
+		if got := positions[q.Find(id)]; got != want {
+			t.Errorf("position of %s is %d, want %d", id, got, want)
+		}
+	}
+}
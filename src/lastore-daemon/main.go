@@ -13,6 +13,7 @@ import (
 
 	. "github.com/linuxdeepin/lastore-daemon/src/internal/config"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system/apt"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system/dut"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/utils"
 
@@ -32,7 +33,10 @@ const (
 	securityConfFileName = "99security.conf"
 )
 
+// Tr 使用守护进程当前的语言环境翻译,与Manager.Tr互斥,避免翻译时语言环境被临时切换
 func Tr(text string) string {
+	localeMu.Lock()
+	defer localeMu.Unlock()
 	return gettext.Tr(text)
 }
 
@@ -67,6 +71,7 @@ func main() {
 	_ = utils.UnsetEnv("LANG")
 
 	gettext.InitI18n()
+	daemonLocale = gettext.SetLocale(gettext.LcAll, "")
 	gettext.Textdomain("lastore-daemon")
 
 	if os.Getenv("DBUS_STARTER_BUS_TYPE") != "" {
@@ -76,6 +81,9 @@ func main() {
 	config := NewConfig(path.Join(system.VarLibDir, "config.json"))
 	aptImpl := dut.NewSystem(config.NonUnknownList, config.OtherSourceList)
 	system.SetSystemUpdate(config.PlatformUpdate) // 设置是否通过平台更新
+	if len(config.ProtectedPackages) > 0 {
+		apt.SetProtectedPackages(config.ProtectedPackages)
+	}
 	allowInstallPackageExecPaths = append(allowInstallPackageExecPaths, config.AllowInstallRemovePkgExecPaths...)
 	allowRemovePackageExecPaths = append(allowRemovePackageExecPaths, config.AllowInstallRemovePkgExecPaths...)
 	manager := NewManager(service, aptImpl, config)
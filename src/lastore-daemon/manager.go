@@ -9,7 +9,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,6 +19,7 @@ import (
 
 	"github.com/linuxdeepin/lastore-daemon/src/internal/config"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system/apt"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/updateplatform"
 
 	"github.com/godbus/dbus/v5"
@@ -32,7 +35,6 @@ import (
 	systemd1 "github.com/linuxdeepin/go-dbus-factory/system/org.freedesktop.systemd1"
 
 	"github.com/linuxdeepin/go-lib/dbusutil"
-	"github.com/linuxdeepin/go-lib/gettext"
 	"github.com/linuxdeepin/go-lib/keyfile"
 	"github.com/linuxdeepin/go-lib/strv"
 	"github.com/linuxdeepin/go-lib/utils"
@@ -70,12 +72,28 @@ type Manager struct {
 
 	SystemOnChanging bool
 	AutoClean        bool
-
-	inhibitFd        dbus.UnixFD
-	updateSourceOnce bool
+	SafecacheReady   bool // build_safecache.sh 是否已成功执行
+
+	inhibitFd         dbus.UnixFD
+	updateSourceOnce  bool
+	purgePartialFiles bool // 上次检查更新因文件损坏失败,需要清理全部未下载完成的文件
+
+	updateSourceDoneTime time.Time // 最近一次检查更新完成的时间
+	updateSizeCache      map[system.UpdateType]updateSizeCacheEntry
+	updateSizeCacheMu    sync.Mutex
+	changelogCache       map[string]changelogCacheEntry
+	changelogCacheMu     sync.Mutex
+	refreshUpdateInfosMu sync.Mutex     // 检查更新结束时的刷新和RecomputeUpdatable不能同时执行
+	updatableState       updatableState // 最近一次刷新的可更新包、分类包和会被卸载的包,GetUpdateStateSnapshot使用,updatableStateMu保护
+	updatableStateMu     sync.RWMutex
+	spaceDeltaMap        map[string]int64 // 最近一次检查更新得到的各分类更新后磁盘空间的变化(字节),key为UpdateType.JobType(),PropsMu保护
+	notifyThrottle       *notifyThrottle
+	updateNotify         updateNotifyRecord // 最近一次发出的"有新版本"通知
 
 	apps                     apps.Apps
 	sysPower                 power.Power
+	batteryPower             power.Power       // 只用于自动下载的电源监听,更新结束时会移除sysPower上的所有属性监听
+	batteryDeferredMode      system.UpdateType // 因使用电池被推迟的自动下载类型,接通电源后重新触发,PropsMu保护
 	abRecovery               abrecovery.ABRecovery
 	atomic                   atomic1.AtomicUpgrade1
 	signalLoop               *dbusutil.SignalLoop
@@ -87,6 +105,16 @@ type Manager struct {
 	UpdateStatus    string            // 每一个更新项的状态 json字符串
 
 	HardwareId string
+	OSEdition  string // 当前检测到的系统版本,即os-version中的EditionName,离线更新包按此检查是否适用
+
+	RebootRequired bool // 更新后是否需要重启才能生效
+	// dbusutil-gen: equal=nil
+	RebootRequiredPackages []string // 导致需要重启的包
+
+	OfflineMode bool // 离线仓库生效中,期间不自动在线检查更新,可更新内容只来自挂载的离线仓库
+
+	// dbusutil-gen: equal=nil
+	DeferredPackages []string // 安全模式下推迟到维护窗口安装的包,通过ApplyDeferredPackages安装
 
 	SystemSourceConfig   UpdateSourceConfig
 	SecuritySourceConfig UpdateSourceConfig
@@ -107,7 +135,9 @@ type Manager struct {
 	isDownloading  bool
 
 	offline            *OfflineManager
+	sourceWrapper      system.SourceWrapperFunc // 组合仓库的实现,为nil时使用system.CustomSourceWrapper
 	rebootTimeoutTimer *time.Timer
+	pkgStatus          *pkgStatusCache // dpkg包状态快照,系统更新和安全更新等并发生成更新内容时共用
 
 	coreList   []string
 	updateTime string // 定时时间，记录定时更新通知，防止重复发通知
@@ -143,20 +173,57 @@ func NewManager(service *dbusutil.Service, updateApi system.System, c *config.Co
 		apps:                 apps.NewApps(service.Conn()),
 		systemd:              systemd1.NewManager(service.Conn()),
 		sysPower:             power.NewPower(service.Conn()),
+		batteryPower:         power.NewPower(service.Conn()),
 		abObj:                abrecovery.NewABRecovery(service.Conn()),
 		SecuritySourceConfig: make(UpdateSourceConfig),
 		SystemSourceConfig:   make(UpdateSourceConfig),
 		resetIdleDownload:    true,
+		pkgStatus:            newPkgStatusCache(),
+		sourceWrapper:        system.CustomSourceWrapper,
 	}
 	m.reloadOemConfig(true)
 	m.signalLoop.Start()
 	m.grub = newGrubManager(service.Conn(), m.signalLoop)
 	m.jobManager = NewJobManager(service, updateApi, m.updateJobList)
-	m.offline = NewOfflineManager()
+	m.jobManager.history = newUpdateHistory(updateHistoryFile)
+	m.jobManager.recoverDpkgInterrupted = m.recoverDpkgInterrupted
+	m.jobManager.jobEnded = func(job *Job) {
+		removePreferencesParts(job.option[preferencesPartsKey])
+		m.trimArchiveCache(job)
+	}
+	// 清理上次未正常退出时残留的任务优先级配置
+	err = os.RemoveAll(preferencesPartsRoot)
+	if err != nil {
+		logger.Warning(err)
+	}
+	err = writeBlockPreferences(legacySafeModePreferencesPath, nil)
+	if err != nil {
+		logger.Warning(err)
+	}
+	m.notifyThrottle = newNotifyThrottle(m.config.NotifyThrottleWindow)
+	m.offline = NewOfflineManager(m.config.OfflineUnzipDir, m.config.OfflineMountDir)
+	apt.DownloadJobMaxRuntime = m.config.DownloadJobMaxRuntime
+	apt.UpgradeJobMaxRuntime = m.config.UpgradeJobMaxRuntime
+	pinnedHelperHashes = parsePinnedHelperHashes(m.config.OfflineHelperSha256)
+	setExtraAptOptions(m.config.ExtraAptOptions)
+	// 清理上次未正常退出时残留的离线仓库挂载
+	err = m.offline.CleanCache()
+	if err != nil {
+		logger.Warning(err)
+	}
 	go m.handleOSSignal()
+	go m.loopCleanOrphanedSourceWrappers()
+	go func() {
+		ready := apt.WaitSafecache(0)
+		m.PropsMu.Lock()
+		m.setPropSafecacheReady(ready)
+		m.PropsMu.Unlock()
+	}()
 	m.updateJobList()
 	m.initStatusManager()
 	m.HardwareId = updateplatform.GetHardwareId(m.config.IncludeDiskInfo)
+	m.OSEdition = getOSEdition()
+	m.RebootRequired, m.RebootRequiredPackages = checkRebootRequired()
 
 	m.initDbusSignalListen()
 	m.initDSettingsChangedHandle()
@@ -175,6 +242,53 @@ func NewManager(service *dbusutil.Service, updateApi system.System, c *config.Co
 	return m
 }
 
+const (
+	// orphanedSourceWrapperAge 组合仓库目录超过该时间没有修改且不在使用时认为是残留
+	orphanedSourceWrapperAge = 24 * time.Hour
+	// orphanedSourceWrapperInterval 运行期间检查残留组合仓库目录的间隔
+	orphanedSourceWrapperInterval = 6 * time.Hour
+)
+
+// loopCleanOrphanedSourceWrappers 启动时和运行期间定期清理异常退出后残留的组合仓库目录
+func (m *Manager) loopCleanOrphanedSourceWrappers() {
+	clean := func() {
+		count, err := system.CleanOrphanedSourceWrappers(orphanedSourceWrapperAge)
+		if err != nil {
+			logger.Warning(err)
+			return
+		}
+		if count > 0 {
+			logger.Infof("reclaimed %d orphaned source wrapper directories", count)
+		}
+	}
+	clean()
+	ticker := time.NewTicker(orphanedSourceWrapperInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		clean()
+	}
+}
+
+func getOSEdition() string {
+	infoMap, err := updateplatform.CachedOSVersionInfo(updateplatform.CacheVersion)
+	if err != nil {
+		logger.Warning(err)
+		return ""
+	}
+	return infoMap["EditionName"]
+}
+
+// refreshOSEdition 系统更新可能修改os-version,更新完成后重新读取
+func (m *Manager) refreshOSEdition() {
+	updateplatform.InvalidateOSVersionCache()
+	edition := getOSEdition()
+	m.PropsMu.Lock()
+	if m.setPropOSEdition(edition) {
+		logger.Info("os edition changed to", edition)
+	}
+	m.PropsMu.Unlock()
+}
+
 func (m *Manager) initDbusSignalListen() {
 	m.loginManager.InitSignalExt(m.signalLoop, true)
 	m.abObj.InitSignalExt(m.signalLoop, true)
@@ -202,7 +316,28 @@ func (m *Manager) initDbusSignalListen() {
 	if err != nil {
 		logger.Warning(err)
 	}
+	// agent转发的会话中通知被关闭的信号
+	rule := dbusutil.NewMatchRuleBuilder().Type("signal").Path(lastoreAgentPath).
+		Interface(lastoreAgentInterface).Member("NotificationClosed").Build()
+	err = rule.AddTo(m.service.Conn())
+	if err != nil {
+		logger.Warning(err)
+	} else {
+		m.signalLoop.AddHandler(&dbusutil.SignalRule{
+			Path: lastoreAgentPath,
+			Name: lastoreAgentInterface + ".NotificationClosed",
+		}, m.handleNotificationClosed)
+	}
 	m.sysPower.InitSignalExt(m.signalLoop, true)
+	m.batteryPower.InitSignalExt(m.signalLoop, true)
+	err = m.batteryPower.OnBattery().ConnectChanged(func(hasValue bool, onBattery bool) {
+		if hasValue && !onBattery {
+			go m.resumeBatteryDeferredDownload()
+		}
+	})
+	if err != nil {
+		logger.Warning(err)
+	}
 }
 
 func (m *Manager) initDSettingsChangedHandle() {
@@ -252,6 +387,7 @@ func (m *Manager) initAgent() {
 
 func (m *Manager) initPlatformManager() {
 	m.updatePlatform = updateplatform.NewUpdatePlatformManager(m.config, false)
+	m.updatePlatform.RegisterReportSender(updateplatform.ReportKindLog, m.sendReportLog)
 	m.loadPlatformCache()
 	if isFirstBoot() {
 		// 不能阻塞初始化流程,防止dbus服务激活超时
@@ -313,7 +449,9 @@ func (m *Manager) installPackage(sender dbus.Sender, jobName string, packages st
 		return m.installPkg(jobName, packages, environ)
 	}
 
-	localePkgs := QueryEnhancedLocalePackages(system.QueryPackageInstallable, lang, pkgs...)
+	localePkgs := QueryEnhancedLocalePackages(func(pkgId string) bool {
+		return system.QueryPackageInstallable(environ, pkgId)
+	}, lang, pkgs...)
 	if len(localePkgs) != 0 {
 		logger.Infof("Follow locale packages will be installed:%v\n", localePkgs)
 	}
@@ -322,6 +460,113 @@ func (m *Manager) installPackage(sender dbus.Sender, jobName string, packages st
 	return m.installPkg(jobName, strings.Join(pkgs, " "), environ)
 }
 
+// installPackagesWithVersion 安装指定版本的包,packages为包名到版本的映射,任何一个版本无法安装时不创建任务
+func (m *Manager) installPackagesWithVersion(sender dbus.Sender, jobName string, packages map[string]string) (*Job, error) {
+	for name := range packages {
+		if !pkgNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid package name %q", name)
+		}
+	}
+	environ, err := makeEnvironWithSender(m, sender)
+	if err != nil {
+		return nil, err
+	}
+	m.ensureUpdateSourceOnce()
+	// 指定的版本可能低于已安装的版本
+	extraOption := map[string]string{"APT::Get::allow-downgrades": "true"}
+	// 与installPkgWithOption创建的任务使用相同的仓库和参数检查
+	err = m.getSourceWrapper()(system.AllCheckUpdate, func(path string, unref func()) error {
+		if unref != nil {
+			defer unref()
+		}
+		option, err := sourceListOption(path)
+		if err != nil {
+			return err
+		}
+		for k, v := range extraOption {
+			option[k] = v
+		}
+		return apt.CheckVersionsInstallable(environ, m.aptConfPath(), packages, option)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []string
+	for name, version := range packages {
+		pkgs = append(pkgs, name+"="+version)
+	}
+	sort.Strings(pkgs)
+	return m.installPkgWithOption(jobName, strings.Join(pkgs, " "), environ, extraOption)
+}
+
+// reinstallPackages 重新安装包的当前版本,用于修复被损坏的文件.任何一个包未安装或当前版本已无法从仓库下载时不创建任务
+func (m *Manager) reinstallPackages(sender dbus.Sender, packages []string) (*Job, error) {
+	if len(packages) == 0 {
+		return nil, errors.New("empty packages")
+	}
+	for _, name := range packages {
+		if !pkgNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid package name %q", name)
+		}
+	}
+	versions := m.pkgStatus.installedVersions(packages)
+	var notInstalled []string
+	for _, name := range packages {
+		if _, ok := versions[name]; !ok {
+			notInstalled = append(notInstalled, name)
+		}
+	}
+	if len(notInstalled) > 0 {
+		return nil, fmt.Errorf("packages are not installed: %s", strings.Join(notInstalled, " "))
+	}
+	environ, err := makeEnvironWithSender(m, sender)
+	if err != nil {
+		return nil, err
+	}
+	m.ensureUpdateSourceOnce()
+	err = m.getSourceWrapper()(system.AllCheckUpdate, func(path string, unref func()) error {
+		if unref != nil {
+			defer unref()
+		}
+		option, err := sourceListOption(path)
+		if err != nil {
+			return err
+		}
+		return apt.CheckReinstallable(environ, m.aptConfPath(), versions, option)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []string
+	for name, version := range versions {
+		pkgs = append(pkgs, name+"="+version)
+	}
+	sort.Strings(pkgs)
+	// 下载任务也需要该参数,否则已安装的版本不会被下载
+	return m.installPkgWithOption("", strings.Join(pkgs, " "), environ, map[string]string{"APT::Get::ReInstall": "true"})
+}
+
+// installLocalPackage 安装本地deb文件,依赖从已配置的仓库获取
+func (m *Manager) installLocalPackage(sender dbus.Sender, jobName string, path string) (*Job, error) {
+	// installPkg按空白切分包列表
+	if strings.ContainsAny(path, " \t\r\n") {
+		return nil, fmt.Errorf("invalid deb path %q", path)
+	}
+	absPath, pkgName, err := apt.ValidateLocalDeb(path)
+	if err != nil {
+		return nil, err
+	}
+	if jobName == "" {
+		jobName = pkgName
+	}
+	m.ensureUpdateSourceOnce()
+	environ, err := makeEnvironWithSender(m, sender)
+	if err != nil {
+		return nil, err
+	}
+	return m.installPkg(jobName, absPath, environ)
+}
+
 func (m *Manager) installPackageFromRepo(sender dbus.Sender, jobName string, sourceListPath string,
 	repoListPath string, cachePath string, packageName []string) (*Job, error) {
 	if !utils.IsDir(repoListPath) {
@@ -394,11 +639,16 @@ func (m *Manager) installPackageFromRepo(sender dbus.Sender, jobName string, sou
 }
 
 func (m *Manager) installPkg(jobName, packages string, environ map[string]string) (*Job, error) {
+	return m.installPkgWithOption(jobName, packages, environ, nil)
+}
+
+// installPkgWithOption 创建安装任务,extraOption为下载和安装都需要的额外apt参数
+func (m *Manager) installPkgWithOption(jobName, packages string, environ map[string]string, extraOption map[string]string) (*Job, error) {
 	pList := strings.Fields(packages)
 	var job *Job
 	var isExist bool
 	var err error
-	err = system.CustomSourceWrapper(system.AllCheckUpdate, func(path string, unref func()) error {
+	err = m.getSourceWrapper()(system.AllCheckUpdate, func(path string, unref func()) error {
 		m.do.Lock()
 		defer m.do.Unlock()
 		isExist, job, err = m.jobManager.CreateJob(jobName, system.InstallJobType, pList, environ, nil)
@@ -429,6 +679,9 @@ func (m *Manager) installPkg(jobName, packages string, environ map[string]string
 				"Dir::Etc::SourceParts": "/dev/null",
 			}
 		}
+		for k, v := range extraOption {
+			job.option[k] = v
+		}
 		if job.next != nil {
 			job.next.option = job.option
 			job.next.setPreHooks(map[string]func() error{
@@ -492,17 +745,17 @@ func (m *Manager) removePackage(sender dbus.Sender, jobName string, packages str
 	}
 	job.setPreHooks(map[string]func() error{
 		string(system.SucceedStatus): func() error {
-			msg := gettext.Tr("Removed successfully")
+			msg := m.Tr("Removed successfully")
 			go m.sendNotify(system.GetAppStoreAppName(), 0, "deepin-appstore", "", msg, nil, nil, system.NotifyExpireTimeoutDefault)
 			return nil
 		},
 		string(system.FailedStatus): func() error {
-			msg := gettext.Tr("Failed to remove the app")
+			msg := m.Tr("Failed to remove the app")
 			action := []string{
 				"retry",
-				gettext.Tr("Retry"),
+				m.Tr("Retry"),
 				"cancel",
-				gettext.Tr("Cancel"),
+				m.Tr("Cancel"),
 			}
 			hints := map[string]dbus.Variant{
 				"x-deepin-action-retry":  dbus.MakeVariant(fmt.Sprintf("dbus-send,--system,--print-reply,--dest=org.deepin.dde.Lastore1,/org/deepin/dde/Lastore1,org.deepin.dde.Lastore1.Manager.StartJob,string:%s", job.Id)),
@@ -528,7 +781,7 @@ func (m *Manager) classifiedUpgrade(sender dbus.Sender, updateType system.Update
 		if category != 0 {
 			var upgradeJob, prepareJob *Job
 			if isUpgrade {
-				prepareJob, err = m.prepareDistUpgrade(sender, category, true)
+				prepareJob, err = m.prepareDistUpgrade(sender, category, true, "")
 				if err != nil {
 					if !strings.Contains(err.Error(), system.NotFoundErrorMsg) {
 						errList = append(errList, err.Error())
@@ -539,7 +792,7 @@ func (m *Manager) classifiedUpgrade(sender dbus.Sender, updateType system.Update
 						// 可能无需下载,因此继续后面安装job的创建
 					}
 				}
-				upgradeJob, err = m.distUpgrade(sender, category, true, false, false)
+				upgradeJob, err = m.distUpgrade(sender, category, true, false, false, "")
 				if err != nil && !errors.Is(err, JobExistError) {
 					if !strings.Contains(err.Error(), system.NotFoundErrorMsg) {
 						errList = append(errList, err.Error())
@@ -561,7 +814,7 @@ func (m *Manager) classifiedUpgrade(sender dbus.Sender, updateType system.Update
 				}
 				jobPaths = append(jobPaths, upgradeJob.getPath())
 			} else {
-				prepareJob, err = m.prepareDistUpgrade(sender, category, true)
+				prepareJob, err = m.prepareDistUpgrade(sender, category, true, "")
 				if err != nil {
 					if !strings.Contains(err.Error(), system.NotFoundErrorMsg) {
 						errList = append(errList, err.Error())
@@ -600,7 +853,7 @@ func (m *Manager) cleanArchives(needNotify bool) (*Job, error) {
 	job.setPreHooks(map[string]func() error{
 		string(system.EndStatus): func() error {
 			// 清理完成的通知
-			msg := gettext.Tr("Package cache wiped")
+			msg := m.Tr("Package cache wiped")
 			go m.sendNotify(updateNotifyShow, 0, "deepin-appstore", "", msg, nil, nil, system.NotifyExpireTimeoutDefault)
 			return nil
 		},
@@ -620,6 +873,124 @@ func (m *Manager) cleanArchives(needNotify bool) (*Job, error) {
 	return job, err
 }
 
+// distUpgradePlanPackages 返回模拟全量更新时会升级和新安装的包及目标版本(包名=版本),包括新引入的依赖,清理缓存时需要保留这些版本的包
+func (m *Manager) distUpgradePlanPackages() ([]string, error) {
+	var packages []string
+	environ := m.proxyEnviron()
+	err := m.getSourceWrapper()(system.AllInstallUpdate, func(path string, unref func()) error {
+		if unref != nil {
+			defer unref()
+		}
+		var err error
+		packages, err = apt.ListDistUpgradeVersions(environ, m.aptConfPath(), path, nil)
+		return err
+	})
+	return packages, err
+}
+
+// archiveKeepPackages 返回清理缓存时需要保留的包:全量更新计划中的包只保留目标版本,不在计划中的待更新包保留所有版本,
+// 无法模拟更新时返回错误,避免删除更新需要的包
+func (m *Manager) archiveKeepPackages() ([]string, error) {
+	keepPackages, err := m.distUpgradePlanPackages()
+	if err != nil {
+		return nil, err
+	}
+	planned := make(map[string]bool, len(keepPackages))
+	for _, pkg := range keepPackages {
+		name, _, _ := strings.Cut(pkg, "=")
+		planned[name] = true
+	}
+	for _, pkg := range m.updater.getUpdatablePackagesByType(system.AllInstallUpdate) {
+		if !planned[pkg] {
+			keepPackages = append(keepPackages, pkg)
+		}
+	}
+	return keepPackages, nil
+}
+
+// autoCleanArchives 与cleanArchives不同,保留已经下载的待更新包和全量更新需要的包,任务成功后Description为apt.AutoCleanResult
+func (m *Manager) autoCleanArchives() (*Job, error) {
+	keepPackages, err := m.archiveKeepPackages()
+	if err != nil {
+		logger.Warningf("AutoCleanArchives error: %v", err)
+		return nil, err
+	}
+	m.do.Lock()
+	defer m.do.Unlock()
+	isExist, job, err := m.jobManager.CreateJob("", system.AutoCleanJobType, keepPackages, nil, nil)
+	if err != nil {
+		logger.Warningf("AutoCleanArchives error: %v", err)
+		return nil, err
+	}
+	if isExist {
+		return job, nil
+	}
+	if err := m.jobManager.addJob(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// trimArchiveCache 下载和安装任务结束后,缓存超过MaxCacheSize时通过AutoClean任务删除最旧的包,待更新包、全量更新需要的包和未结束任务的包会保留
+func (m *Manager) trimArchiveCache(endedJob *Job) {
+	switch endedJob.Type {
+	case system.DownloadJobType, system.PrepareDistUpgradeJobType, system.InstallJobType,
+		system.DistUpgradeJobType, system.UpdateJobType:
+	default:
+		return
+	}
+	maxSize := m.config.MaxCacheSize * 1024 * 1024
+	if maxSize <= 0 {
+		return
+	}
+	size, err := apt.CacheSize(m.aptConfPath())
+	if err != nil {
+		logger.Warning(err)
+		return
+	}
+	if size <= maxSize {
+		return
+	}
+	keepPackages, err := m.archiveKeepPackages()
+	if err != nil {
+		logger.Warning("skip trimming archive cache:", err)
+		return
+	}
+	for _, job := range m.jobManager.List() {
+		job.PropsMu.RLock()
+		if job.Status != system.EndStatus {
+			for _, pkg := range job.Packages {
+				if !strv.Strv(keepPackages).Contains(pkg) {
+					keepPackages = append(keepPackages, pkg)
+				}
+			}
+		}
+		job.PropsMu.RUnlock()
+	}
+	m.do.Lock()
+	defer m.do.Unlock()
+	isExist, job, err := m.jobManager.CreateJob("", system.AutoCleanJobType, keepPackages, nil, nil)
+	if err != nil {
+		logger.Warningf("trim archive cache error: %v", err)
+		return
+	}
+	if isExist {
+		return
+	}
+	job.option[apt.AutoCleanMaxSizeOption] = strconv.FormatInt(maxSize, 10)
+	job.setAfterHooks(map[string]func() error{
+		string(system.SucceedStatus): func() error {
+			job.PropsMu.RLock()
+			logger.Infof("archive cache trimmed from %d bytes to limit %d bytes: %s", size, maxSize, job.Description)
+			job.PropsMu.RUnlock()
+			return nil
+		},
+	})
+	if err := m.jobManager.addJob(job); err != nil {
+		logger.Warning(err)
+	}
+}
+
 func (m *Manager) fixError(sender dbus.Sender, errType string) (*Job, error) {
 	m.ensureUpdateSourceOnce()
 	environ, err := makeEnvironWithSender(m, sender)
@@ -650,6 +1021,37 @@ func (m *Manager) fixError(sender dbus.Sender, errType string) (*Job, error) {
 	return job, err
 }
 
+// recoverDpkgInterrupted 执行修复dpkg中断的job,修复成功后重新执行失败的job
+func (m *Manager) recoverDpkgInterrupted(failedJob *Job) {
+	if !m.config.AutoFixDpkgInterrupted {
+		return
+	}
+	logger.Infof("job %v failed because dpkg was interrupted, try to fix it", failedJob.Id)
+	fixJob, err := m.fixError(dbus.Sender(m.service.Conn().Names()[0]), string(system.ErrorDpkgInterrupted))
+	if err != nil {
+		logger.Warning("create fix dpkg interrupted job failed:", err)
+		m.updatePlatform.PostStatusMessage(fmt.Sprintf("auto fix dpkg interrupted for %v failed: %v", failedJob.Id, err))
+		return
+	}
+	fixJob.wrapAfterHooks(map[string]func() error{
+		string(system.SucceedStatus): func() error {
+			go func() {
+				m.do.Lock()
+				err := m.jobManager.MarkStart(failedJob.Id)
+				m.do.Unlock()
+				if err != nil {
+					logger.Warningf("retry job %v after fix dpkg interrupted failed: %v", failedJob.Id, err)
+				}
+			}()
+			return nil
+		},
+		string(system.FailedStatus): func() error {
+			go m.updatePlatform.PostStatusMessage(fmt.Sprintf("auto fix dpkg interrupted for %v failed, detail is: %v", failedJob.Id, fixJob.Description))
+			return nil
+		},
+	})
+}
+
 func (m *Manager) installUOSReleaseNote() {
 	logger.Info("installUOSReleaseNote begin")
 	bExists, _ := m.PackageExists(uosReleaseNotePkgName)
@@ -664,7 +1066,7 @@ func (m *Manager) installUOSReleaseNote() {
 			}
 		}
 	} else {
-		bInstalled := system.QueryPackageInstallable(uosReleaseNotePkgName)
+		bInstalled := system.QueryPackageInstallable(m.proxyEnviron(), uosReleaseNotePkgName)
 		if bInstalled {
 			_, err := m.installPkg("", uosReleaseNotePkgName, nil)
 			if err != nil {
@@ -846,7 +1248,10 @@ func (m *Manager) categorySupportAutoInstall(category system.UpdateType) bool {
 }
 
 func (m *Manager) handleAutoCheckEvent() error {
-	if m.config.AutoCheckUpdates {
+	if m.isOfflineMode() {
+		// 离线仓库生效时在线检查会覆盖离线的可更新内容
+		logger.Info("offline repo is active, skip auto check")
+	} else if m.config.AutoCheckUpdates {
 		_, err := m.updateSource(dbus.Sender(m.service.Conn().Names()[0]))
 		if err != nil {
 			logger.Warning(err)
@@ -927,8 +1332,7 @@ func (m *Manager) watchSession(uid string, session login1.Session) {
 			lang := m.userAgents.getActiveLastoreAgentLang()
 			if len(lang) != 0 {
 				// Active的用户切换后,语言环境切换至对应用户的语言环境,用于发通知
-				logger.Info("SetLocale", lang)
-				gettext.SetLocale(gettext.LcAll, lang)
+				setProcessLocale(lang)
 			} else {
 				m.updateLocaleByUser(uid)
 			}
@@ -948,8 +1352,7 @@ func (m *Manager) watchSession(uid string, session login1.Session) {
 		m.userAgents.setActiveUid(uid)
 		lang := m.userAgents.getActiveLastoreAgentLang()
 		if len(lang) != 0 {
-			logger.Info("SetLocale", lang)
-			gettext.SetLocale(gettext.LcAll, lang)
+			setProcessLocale(lang)
 		} else {
 			m.updateLocaleByUser(uid)
 		}
@@ -996,24 +1399,26 @@ func (m *Manager) handleSessionRemoved(sessionId string, sessionPath dbus.Object
 
 func (m *Manager) updateLocaleByUser(uid string) {
 	logger.Info("update locale by user", uid)
-	obj := accounts.NewAccounts(m.service.Conn())
-	path, err := obj.FindUserById(0, uid)
+	locale, err := m.getUserLocale(uid)
 	if err != nil {
 		logger.Warning(err)
 		return
 	}
-	user, err := accounts.NewUser(m.service.Conn(), dbus.ObjectPath(path))
+	setProcessLocale(locale)
+}
+
+// getUserLocale 从AccountsService获取用户设置的语言环境
+func (m *Manager) getUserLocale(uid string) (string, error) {
+	obj := accounts.NewAccounts(m.service.Conn())
+	path, err := obj.FindUserById(0, uid)
 	if err != nil {
-		logger.Warning(err)
-		return
+		return "", err
 	}
-	locale, err := user.Locale().Get(0)
+	user, err := accounts.NewUser(m.service.Conn(), dbus.ObjectPath(path))
 	if err != nil {
-		logger.Warning(err)
-		return
+		return "", err
 	}
-	logger.Info("SetLocale", locale)
-	gettext.SetLocale(gettext.LcAll, locale)
+	return user.Locale().Get(0)
 }
 
 func (m *Manager) handleUserRemoved(uid uint32, userPath dbus.ObjectPath) {
@@ -1027,6 +1432,23 @@ const (
 	updateNotifyShowOptional = "dde-control-center-optional" // 根据控制中心更新模块焦点状态,选择性的发通知(由dde-session-daemon的lastore agent判断后控制)
 )
 
+// sendThrottledNotify 发送去重的通知,相同内容的通知在窗口期内只发一次,窗口期后替换旧通知.
+// fingerprint 不为空时,只有fingerprint变化才会再次发送.
+func (m *Manager) sendThrottledNotify(fingerprint string, appName string, appIcon string, summary string, body string, actions []string, hints map[string]dbus.Variant, expireTimeout int32) uint32 {
+	if !m.updater.UpdateNotify {
+		return 0
+	}
+	key := appName + "\x00" + summary + "\x00" + body
+	replacesId, ok := m.notifyThrottle.acquire(key, fingerprint, time.Now())
+	if !ok {
+		logger.Debugf("notification %q is throttled", body)
+		return 0
+	}
+	id := m.sendNotify(appName, replacesId, appIcon, summary, body, actions, hints, expireTimeout)
+	m.notifyThrottle.update(key, id)
+	return id
+}
+
 func (m *Manager) sendNotify(appName string, replacesId uint32, appIcon string, summary string, body string, actions []string, hints map[string]dbus.Variant, expireTimeout int32) uint32 {
 	if !m.updater.UpdateNotify {
 		return 0
@@ -1146,6 +1568,40 @@ func (m *Manager) closeNotify(id uint32) error {
 	return nil
 }
 
+// notificationClosedByUser NotificationClosed信号中表示通知被用户关闭的原因
+const notificationClosedByUser = 2
+
+// handleNotificationClosed 处理agent转发的通知关闭信号,用户关闭"有新版本"通知时记录关闭时的可更新包,
+// UpdateNotifyDismissCooldown内不再提醒
+func (m *Manager) handleNotificationClosed(sig *dbus.Signal) {
+	var id, reason uint32
+	err := dbus.Store(sig.Body, &id, &reason)
+	if err != nil {
+		logger.Warning(err)
+		return
+	}
+	agent := m.userAgents.getActiveLastoreAgent()
+	if agent == nil || agent.ServiceName_() != sig.Sender {
+		return
+	}
+	packages, ok := m.updateNotify.take(id)
+	if !ok || reason != notificationClosedByUser {
+		return
+	}
+	content, err := json.Marshal(updateNotifyDismissal{
+		Time:     time.Now(),
+		Packages: packages,
+	})
+	if err != nil {
+		logger.Warning(err)
+		return
+	}
+	err = m.config.SetUpdateNotifyDismissed(string(content))
+	if err != nil {
+		logger.Warning(err)
+	}
+}
+
 // ChangePrepareDistUpgradeJobOption 当下载job的配置需要修改,通过该接口触发
 func (m *Manager) ChangePrepareDistUpgradeJobOption() {
 	logger.Info("start changed download job option by ForceAbortAndRetry")
@@ -1180,6 +1636,10 @@ func (m *Manager) afterUpdateModeChanged(change *dbusutil.PropertyChanged) {
 		m.updatableApps(updatableApps) // Manager的UpgradableApps实际为可更新的包,而非应用;
 		m.updater.setUpdatablePackages(updatableApps)
 		m.updater.updateUpdatableApps()
+		m.updater.PropsMu.RLock()
+		classified := m.updater.ClassifiedUpdatablePackages
+		m.updater.PropsMu.RUnlock()
+		m.publishUpdatableState(classified, updatableApps)
 	}()
 }
 
@@ -1198,7 +1658,7 @@ func (m *Manager) handleDownloadLimitChanged(job *Job) {
 }
 
 func (m *Manager) installSpecialPackageSync(pkgName string, option map[string]string, environ map[string]string) {
-	if strv.Strv(m.updater.UpdatablePackages).Contains(pkgName) || system.QueryPackageInstallable(pkgName) {
+	if strv.Strv(m.updater.UpdatablePackages).Contains(pkgName) || system.QueryPackageInstallable(environ, pkgName) {
 		// 该包可更新或者该包未安装可以安装
 		var wg sync.WaitGroup
 		wg.Add(1)
@@ -1306,34 +1766,46 @@ const (
 )
 
 type reportLogInfo struct {
-	Tid    int
-	Result bool
-	Reason string
+	Tid     int
+	Result  bool
+	Reason  string
+	Attempt int `json:",omitempty"` // 检查更新成功时为第几次尝试
 }
 
-// 数据埋点接口
+// 数据埋点接口,上报失败时加入重试队列
 func (m *Manager) reportLog(category reportCategory, status bool, description string) {
+	m.reportLogInfo(category, reportLogInfo{
+		Result: status,
+		Reason: description,
+	})
+}
+
+// reportLogInfo 上报logInfo,Tid由category决定
+func (m *Manager) reportLogInfo(category reportCategory, logInfo reportLogInfo) {
+	switch category {
+	case updateStatusReport:
+		logInfo.Tid = 1000600002
+	case downloadStatusReport:
+		logInfo.Tid = 1000600003
+	case upgradeStatusReport:
+		logInfo.Tid = 1000600004
+	}
+	infoContent, err := json.Marshal(logInfo)
+	if err != nil {
+		logger.Warning(err)
+		return
+	}
+	err = m.sendReportLog(string(infoContent))
+	if err != nil {
+		logger.Warning(err)
+		m.updatePlatform.EnqueueReport(updateplatform.ReportKindLog, string(infoContent))
+	}
+}
+
+func (m *Manager) sendReportLog(content string) error {
 	agent := m.userAgents.getActiveLastoreAgent()
-	if agent != nil {
-		logInfo := reportLogInfo{
-			Result: status,
-			Reason: description,
-		}
-		switch category {
-		case updateStatusReport:
-			logInfo.Tid = 1000600002
-		case downloadStatusReport:
-			logInfo.Tid = 1000600003
-		case upgradeStatusReport:
-			logInfo.Tid = 1000600004
-		}
-		infoContent, err := json.Marshal(logInfo)
-		if err != nil {
-			logger.Warning(err)
-		}
-		err = agent.ReportLog(0, string(infoContent))
-		if err != nil {
-			logger.Warning(err)
-		}
+	if agent == nil {
+		return errors.New("no active lastore agent")
 	}
+	return agent.ReportLog(0, content)
 }
@@ -4,21 +4,149 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os/exec"
-	"strconv"
 	"strings"
 	"sync"
 
+	"github.com/linuxdeepin/lastore-daemon/src/internal/config"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system/apt"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/updateplatform"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/linuxdeepin/go-lib/dbusutil"
-	"github.com/linuxdeepin/go-lib/gettext"
 )
 
+// DistUpgradeValidation ValidateDistUpgrade的结果,Blockers为空时才可以开始下载
+type DistUpgradeValidation struct {
+	Plan     *system.DistUpgradePlan
+	Blockers []*system.JobError
+}
+
+// validateDistUpgrade 只通过模拟执行检查mode类型的更新能否进行,不会下载包
+func (m *Manager) validateDistUpgrade(mode system.UpdateType) (*DistUpgradeValidation, error) {
+	var pkgList []string
+	if mode&system.SystemUpdate != 0 {
+		pkgList = m.coreList
+	}
+	environ := m.proxyEnviron()
+	plan, err := system.QueryDistUpgradePlan(environ, mode, pkgList)
+	if err != nil {
+		return nil, err
+	}
+	option, cleanup, err := m.updater.getBlockedUpdateAptOption(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	return &DistUpgradeValidation{
+		Plan:     plan,
+		Blockers: apt.ValidateDistUpgrade(environ, m.aptConfPath(), mode, pkgList, option),
+	}, nil
+}
+
+// exceedsBatteryDownloadLimit 下载量size(字节)是否超过电池供电时的下载上限limit(MB)
+func exceedsBatteryDownloadLimit(size float64, limit int64) bool {
+	return limit > 0 && size > float64(limit)*1024*1024
+}
+
+// deferDownloadOnBattery 使用电池且mode的下载量超过BatteryDownloadLimit时记录并推迟自动下载,返回是否推迟
+func (m *Manager) deferDownloadOnBattery(mode system.UpdateType) bool {
+	if m.config.BatteryDownloadLimit <= 0 {
+		return false
+	}
+	onBattery, err := m.batteryPower.OnBattery().Get(0)
+	if err != nil {
+		logger.Warning(err)
+		return false
+	}
+	if !onBattery {
+		return false
+	}
+	size, _, err := system.QueryPackageDownloadSize(m.proxyEnviron(), mode, m.updater.getUpdatablePackagesByType(mode)...)
+	if err != nil {
+		logger.Warning(err)
+		return false
+	}
+	if !exceedsBatteryDownloadLimit(size, m.config.BatteryDownloadLimit) {
+		return false
+	}
+	logger.Infof("on battery, defer auto download of %v (%.0f bytes) until AC power is restored", mode, size)
+	m.PropsMu.Lock()
+	m.batteryDeferredMode |= mode
+	m.PropsMu.Unlock()
+	return true
+}
+
+// resumeBatteryDeferredDownload 接通电源后重新触发因使用电池推迟的自动下载,仍需满足空闲下载时间段和下载策略
+func (m *Manager) resumeBatteryDeferredDownload() {
+	m.PropsMu.Lock()
+	mode := m.batteryDeferredMode
+	m.batteryDeferredMode = 0
+	m.PropsMu.Unlock()
+	if mode == 0 {
+		return
+	}
+	if m.updater.getStagingPolicy() == config.StagingPolicyOff {
+		logger.Info("staging policy is off, drop battery deferred download")
+		return
+	}
+	logger.Info("AC power restored, resume deferred auto download")
+	m.autoDownload(mode)
+}
+
+// applyMirrorOverride 将job及所有next中的系统仓库替换为mirror,只影响这些job,各job的命令执行前由apt后端从镜像下载索引,临时文件在各job结束时删除
+func applyMirrorOverride(job *Job, mirror string) error {
+	var cleanups []func()
+	for j := job; j != nil; j = j.next {
+		if j.option == nil {
+			j.option = make(map[string]string)
+		}
+		cleanup, err := system.ApplyMirrorOverride(j.option, system.GetCategorySourceMap()[system.SystemUpdate], mirror)
+		if err != nil {
+			for _, fn := range cleanups {
+				fn()
+			}
+			return err
+		}
+		if cleanup == nil {
+			continue
+		}
+		cleanups = append(cleanups, cleanup)
+		j.wrapPreHooks(map[string]func() error{
+			string(system.EndStatus): func() error {
+				cleanup()
+				return nil
+			},
+		})
+	}
+	if len(cleanups) == 0 {
+		return errors.New("no system update in the job, mirror can't be overridden")
+	}
+	logger.Infof("job %s uses mirror %s", job.Id, mirror)
+	return nil
+}
+
+// downloadSpaceShortfall 下载缓存目录所在分区的可用空间不足以下载need字节时返回缺少的空间,获取可用空间失败时不阻止下载
+func downloadSpaceShortfall(need float64) *system.SpaceShortfall {
+	if need <= 0 {
+		return nil
+	}
+	shortfall, err := system.CheckDownloadSpaceShortfall(need)
+	if err != nil {
+		logger.Warning(err)
+		return nil
+	}
+	return shortfall
+}
+
 // prepareDistUpgrade isClassify true: mode只能是单类型,创建一个单类型的下载job; false: mode类型不限,创建一个全mode类型的下载job
-func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateType, isClassify bool) (*Job, error) {
+// mirror不为空时,只在本次下载中使用该地址替换系统仓库的地址
+func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateType, isClassify bool, mirror string) (*Job, error) {
+	if mirror != "" {
+		if _, err := system.NormalizeMirrorURL(mirror); err != nil {
+			return nil, err
+		}
+	}
 	if !system.IsAuthorized() {
 		return nil, errors.New("not authorized, don't allow to exec download")
 	}
@@ -26,6 +154,8 @@ func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateTyp
 	if err != nil {
 		return nil, err
 	}
+	// 自动下载由lastore自身发起,用户主动下载时不发送下载完成可以安装的通知
+	autoTriggered := m.isSelfSender(sender)
 	m.ensureUpdateSourceOnce()
 	m.updateJobList()
 	var mode system.UpdateType
@@ -44,37 +174,16 @@ func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateTyp
 		return nil, system.NotFoundError("empty UpgradableApps")
 	}
 	var needDownloadSize float64
-	needDownloadSize, _, _ = system.QueryPackageDownloadSize(mode, packages...)
+	needDownloadSize, _, _ = system.QueryPackageDownloadSize(environ, mode, packages...)
 	// 不再处理needDownloadSize == 0的情况,因为有可能是其他仓库包含了该仓库的包,导致该仓库无需下载,可以直接继续后续流程,用来切换该仓库的状态
-	// 下载前检查/var分区的磁盘空间是否足够下载,
-	isInsufficientSpace := false
-	if needDownloadSize > 0 {
-		content, err := exec.Command("/bin/sh", []string{
-			"-c",
-			"df -BK --output='avail' /var|awk 'NR==2'",
-		}...).CombinedOutput()
-		if err != nil {
-			logger.Warning(string(content))
-		} else {
-			spaceStr := strings.Replace(string(content), "K", "", -1)
-			spaceStr = strings.TrimSpace(spaceStr)
-			spaceNum, err := strconv.Atoi(spaceStr)
-			if err != nil {
-				logger.Warning(err)
-			} else {
-				spaceNum = spaceNum * 1000
-				isInsufficientSpace = spaceNum < int(needDownloadSize)
-			}
-		}
-	}
-
-	if isInsufficientSpace {
+	// 下载前检查下载缓存目录所在分区的磁盘空间是否足够下载
+	if shortfall := downloadSpaceShortfall(needDownloadSize); shortfall != nil {
 		dbusError := system.JobError{
 			ErrType:      system.ErrorInsufficientSpace,
-			ErrDetail:    "You don't have enough free space to download",
+			ErrDetail:    shortfall.Error(),
 			IsCheckError: true,
 		}
-		msg := fmt.Sprintf(gettext.Tr("Downloading updates failed. Please free up %g GB disk space first."), needDownloadSize/(1000*1000*1000))
+		msg := m.Tr("Downloading updates failed. Please free up %g GB disk space first.", needDownloadSize/(1000*1000*1000))
 		go m.sendNotify(updateNotifyShowOptional, 0, "preferences-system", "", msg, nil, nil, system.NotifyExpireTimeoutNoHide)
 		logger.Warning(dbusError.Error())
 		errStr, _ := json.Marshal(dbusError)
@@ -88,9 +197,15 @@ func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateTyp
 	// 新的下载处理方式
 	m.do.Lock()
 	defer m.do.Unlock()
+	// 优先级配置目录在job结束时由jobEnded删除
+	aptOption, cleanupAptOption, err := m.updater.getBlockedUpdateAptOption(nil)
+	if err != nil {
+		return nil, err
+	}
 	if isClassify {
 		jobType := GetUpgradeInfoMap()[mode].PrepareJobId
 		if jobType == "" {
+			cleanupAptOption()
 			return nil, fmt.Errorf("invalid args: %v", mode)
 		}
 		const jobName = "OnlyDownload" // 提供给daemon的lastore模块判断当前下载任务是否还有后续更新任务
@@ -106,14 +221,20 @@ func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateTyp
 		m.updater.PropsMu.Unlock()
 	}
 	if err != nil {
+		cleanupAptOption()
 		logger.Warningf("Prepare DistUpgrade error: %v\n", err)
 		return nil, err
 	}
 	if isExist {
+		cleanupAptOption()
+		if mirror != "" {
+			return nil, fmt.Errorf("%v: can't override mirror of existing job %s", JobExistError, job.Id)
+		}
 		return job, nil
 	}
 	currentJob := job
 	var sendDownloadingOnce sync.Once
+	downloadOnly := m.updater.getStagingPolicy() == config.StagingPolicyDownloadOnly
 	// 遍历job和所有next
 	for currentJob != nil {
 		j := currentJob
@@ -122,6 +243,12 @@ func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateTyp
 		if limitEnable {
 			j.option[aptLimitKey] = limitConfig
 		}
+		for k, v := range aptOption {
+			j.option[k] = v
+		}
+		if m.config.DebDeltaEnabled && apt.DebDeltaAvailable() {
+			j.option[system.DebDeltaKey] = "true"
+		}
 		j.subRetryHookFn = func(job *Job) {
 			// 下载限速的配置修改需要在job失败重试的时候修改配置(此处失败为手动终止设置的失败状态)
 			m.handleDownloadLimitChanged(job)
@@ -130,12 +257,12 @@ func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateTyp
 			m.PropsMu.Lock()
 			m.PropsMu.Unlock()
 			m.statusManager.SetUpdateStatus(mode, system.IsDownloading)
-			if !m.updatePlatform.UpdateNowForce { // 立即更新则不发通知
+			if !m.updatePlatform.UpdateNowForce && !downloadOnly { // 立即更新或静默下载则不发通知
 				sendDownloadingOnce.Do(func() {
-					msg := gettext.Tr("New version available! Downloading...")
+					msg := m.Tr("New version available! Downloading...")
 					action := []string{
 						"view",
-						gettext.Tr("View"),
+						m.Tr("View"),
 					}
 					hints := map[string]dbus.Variant{"x-deepin-action-view": dbus.MakeVariant("dde-control-center,-m,update")}
 					go m.sendNotify(updateNotifyShowOptional, 0, "preferences-system", "", msg, action, hints, system.NotifyExpireTimeoutDefault)
@@ -160,24 +287,24 @@ func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateTyp
 				if err == nil {
 					if strings.Contains(errorContent.ErrType.String(), system.ErrorInsufficientSpace.String()) {
 						var msg string
-						size, _, err := system.QueryPackageDownloadSize(mode, packages...)
+						size, _, err := system.QueryPackageDownloadSize(j.environ, mode, packages...)
 						if err != nil {
 							logger.Warning(err)
 							size = needDownloadSize
 						}
-						msg = fmt.Sprintf(gettext.Tr("Downloading updates failed. Please free up %g GB disk space first."), size/(1000*1000*1000))
+						msg = m.Tr("Downloading updates failed. Please free up %g GB disk space first.", size/(1000*1000*1000))
 						go m.sendNotify(updateNotifyShowOptional, 0, "preferences-system", "", msg, nil, nil, system.NotifyExpireTimeoutDefault)
 					} else if strings.Contains(errorContent.ErrType.String(), system.ErrorDamagePackage.String()) {
 						// 下载更新失败，需要apt-get clean后重新下载
 						cleanAllCache()
-						msg := gettext.Tr("Updates failed: damaged files. Please update again.")
-						action := []string{"retry", gettext.Tr("Try Again")}
+						msg := m.Tr("Updates failed: damaged files. Please update again.")
+						action := []string{"retry", m.Tr("Try Again")}
 						hints := map[string]dbus.Variant{"x-deepin-action-retry": dbus.MakeVariant("dde-control-center,-m,update")}
 						go m.sendNotify(updateNotifyShowOptional, 0, "preferences-system", "", msg, action, hints, system.NotifyExpireTimeoutDefault)
 					} else if strings.Contains(errorContent.ErrType.String(), system.ErrorFetchFailed.String()) {
 						// 网络原因下载更新失败
-						msg := gettext.Tr("Downloading updates failed. Please check your network.")
-						action := []string{"view", gettext.Tr("View")}
+						msg := m.Tr("Downloading updates failed. Please check your network.")
+						action := []string{"view", m.Tr("View")}
 						hints := map[string]dbus.Variant{"x-deepin-action-view": dbus.MakeVariant("dde-control-center,-m,network")}
 						go m.sendNotify(updateNotifyShowOptional, 0, "preferences-system", "", msg, action, hints, system.NotifyExpireTimeoutDefault)
 					}
@@ -192,17 +319,22 @@ func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateTyp
 			},
 			string(system.SucceedStatus): func() error {
 				m.statusManager.SetUpdateStatus(j.updateTyp, system.CanUpgrade)
+				if saved := apt.TakeDebDeltaSaved(j.Id); saved > 0 {
+					m.updatePlatform.PostStatusMessage(fmt.Sprintf("download %v package saved %d bytes by debdelta", j.updateTyp.JobType(), saved))
+				}
 				if j.next == nil {
 					go func() {
 						m.inhibitAutoQuitCountAdd()
 						defer m.inhibitAutoQuitCountSub()
-						if !m.updatePlatform.UpdateNowForce {
-							msg := gettext.Tr("Downloading completed. You can install updates when shutdown or reboot.")
+						if m.shouldNotifyDownloadReady(autoTriggered, downloadOnly) {
+							m.sendDownloadReadyNotify(mode)
+						} else if !m.updatePlatform.UpdateNowForce && !downloadOnly {
+							msg := m.Tr("Downloading completed. You can install updates when shutdown or reboot.")
 							action := []string{
 								"updateNow",
-								gettext.Tr("Update Now"),
+								m.Tr("Update Now"),
 								"ignore",
-								gettext.Tr("Dismiss"),
+								m.Tr("Dismiss"),
 							}
 							hints := map[string]dbus.Variant{"x-deepin-action-updateNow": dbus.MakeVariant("dbus-send,--session,--print-reply,--dest=org.deepin.dde.shutdownFront1,/org/deepin/dde/shutdownFront1,org.deepin.dde.shutdownFront1.Show")}
 							m.sendNotify(updateNotifyShowOptional, 0, "preferences-system", "", msg, action, hints, system.NotifyExpireTimeoutDefault)
@@ -210,7 +342,8 @@ func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateTyp
 						m.reportLog(downloadStatusReport, true, "")
 					}()
 
-					if m.updatePlatform.UpdateNowForce {
+					// 仅下载策略下不允许触发任何安装
+					if m.updatePlatform.UpdateNowForce && !downloadOnly {
 						m.inhibitAutoQuitCountAdd()
 						_, err := m.distUpgradePartly(dbus.Sender(m.service.Conn().Names()[0]), mode, true)
 						if err != nil {
@@ -223,6 +356,8 @@ func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateTyp
 				return nil
 			},
 			string(system.EndStatus): func() error {
+				// 失败或取消的任务不上报节省的下载量
+				apt.TakeDebDeltaSaved(j.Id)
 				if j.next == nil {
 					logger.Info("running in last end hook")
 					// 如果出现单项失败,其他的状态需要修改,IsDownloading->notDownload
@@ -230,7 +365,7 @@ func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateTyp
 					m.statusManager.SetUpdateStatus(mode, system.NotDownload)
 					// 除了下载失败和下载成功之外,之前的状态为 IsDownloading DownloadPause 的都通过size进行状态修正
 					if j.Status != system.FailedStatus && j.Status != system.SucceedStatus {
-						m.statusManager.updateModeStatusBySize(j.updateTyp, m.coreList)
+						m.statusManager.updateModeStatusBySize(j.environ, j.updateTyp, m.coreList)
 					}
 					m.statusManager.UpdateCheckCanUpgradeByEachStatus()
 				}
@@ -239,8 +374,46 @@ func (m *Manager) prepareDistUpgrade(sender dbus.Sender, origin system.UpdateTyp
 		})
 	}
 
+	if mirror != "" {
+		if err = applyMirrorOverride(job, mirror); err != nil {
+			cleanupAptOption()
+			return nil, err
+		}
+	}
 	if err = m.jobManager.addJob(job); err != nil {
+		cleanupAptOption()
 		return nil, err
 	}
 	return job, nil
 }
+
+// isSelfSender 判断调用者是否为lastore自身,自动检查、自动下载等由lastore发起的操作使用自身的总线名调用
+func (m *Manager) isSelfSender(sender dbus.Sender) bool {
+	if m.service == nil {
+		return false
+	}
+	names := m.service.Conn().Names()
+	return len(names) > 0 && sender == dbus.Sender(names[0])
+}
+
+// shouldNotifyDownloadReady 自动下载完成后是否发送可以安装的通知,强制更新会直接安装,仅下载策略不发送通知
+func (m *Manager) shouldNotifyDownloadReady(autoTriggered, downloadOnly bool) bool {
+	if !autoTriggered || downloadOnly || !m.config.DownloadReadyNotify {
+		return false
+	}
+	return !m.updatePlatform.UpdateNowForce
+}
+
+// sendDownloadReadyNotify 发送更新已下载可以安装的通知,立即安装会触发mode的更新,稍后则只关闭通知
+func (m *Manager) sendDownloadReadyNotify(mode system.UpdateType) {
+	msg := m.Tr("Updates have been downloaded and are ready to install.")
+	action := []string{
+		"installNow",
+		m.Tr("Install Now"),
+		"later",
+		m.Tr("Later"),
+	}
+	hints := map[string]dbus.Variant{"x-deepin-action-installNow": dbus.MakeVariant(
+		fmt.Sprintf("dbus-send,--system,--print-reply,--dest=org.deepin.dde.Lastore1,/org/deepin/dde/Lastore1,org.deepin.dde.Lastore1.Manager.DistUpgradePartly,uint64:%v,boolean:%v", mode, true))}
+	m.sendNotify(updateNotifyShowOptional, 0, "preferences-system", "", msg, action, hints, system.NotifyExpireTimeoutDefault)
+}
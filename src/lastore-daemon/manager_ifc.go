@@ -17,14 +17,16 @@ import (
 
 	"github.com/linuxdeepin/lastore-daemon/src/internal/config"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system/apt"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/utils"
 
 	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/dde-api/polkit"
 	agent "github.com/linuxdeepin/go-dbus-factory/session/org.deepin.dde.lastore1.agent"
 	login1 "github.com/linuxdeepin/go-dbus-factory/system/org.freedesktop.login1"
 	"github.com/linuxdeepin/go-lib/dbusutil"
-	"github.com/linuxdeepin/go-lib/gettext"
 	"github.com/linuxdeepin/go-lib/procfs"
+	"github.com/linuxdeepin/go-lib/strv"
 	utils2 "github.com/linuxdeepin/go-lib/utils"
 )
 
@@ -47,6 +49,15 @@ func (m *Manager) CleanArchives() (job dbus.ObjectPath, busErr *dbus.Error) {
 	return jobObj.getPath(), nil
 }
 
+func (m *Manager) AutoCleanArchives() (job dbus.ObjectPath, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	jobObj, err := m.autoCleanArchives()
+	if err != nil {
+		return "/", dbusutil.ToError(err)
+	}
+	return jobObj.getPath(), nil
+}
+
 func (m *Manager) CleanJob(jobId string) *dbus.Error {
 	m.service.DelayAutoQuit()
 	m.do.Lock()
@@ -65,13 +76,32 @@ func (m *Manager) DistUpgrade(sender dbus.Sender) (job dbus.ObjectPath, busErr *
 	m.PropsMu.RLock()
 	mode := m.UpdateMode
 	m.PropsMu.RUnlock()
-	jobObj, err := m.distUpgrade(sender, mode, false, true, false)
+	jobObj, err := m.distUpgrade(sender, mode, false, true, false, "")
 	if err != nil && !errors.Is(err, JobExistError) {
 		return "/", dbusutil.ToError(err)
 	}
 	return jobObj.getPath(), nil
 }
 
+// DistUpgradeWithMirror 与DistUpgrade相同,但本次更新使用mirror替换系统仓库的地址,不修改系统的仓库配置
+func (m *Manager) DistUpgradeWithMirror(sender dbus.Sender, mirror string) (job dbus.ObjectPath, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	// 管理员鉴权
+	err := checkInvokePermission(m.service, sender)
+	if err != nil {
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+	m.PropsMu.RLock()
+	mode := m.UpdateMode
+	m.PropsMu.RUnlock()
+	jobObj, err := m.distUpgrade(sender, mode, false, true, false, mirror)
+	if err != nil {
+		return "/", dbusutil.ToError(err)
+	}
+	return jobObj.getPath(), nil
+}
+
 func (m *Manager) FixError(sender dbus.Sender, errType string) (job dbus.ObjectPath, busErr *dbus.Error) {
 	m.service.DelayAutoQuit()
 	jobObj, err := m.fixError(sender, errType)
@@ -123,6 +153,136 @@ func (m *Manager) InstallPackage(sender dbus.Sender, jobName string, packages st
 	return jobObj.getPath(), nil
 }
 
+// InstallPackagesWithVersion 安装指定版本的包,packages为包名到版本的映射,版本格式错误或仓库中没有该版本时返回错误
+func (m *Manager) InstallPackagesWithVersion(sender dbus.Sender, jobName string, packages map[string]string) (job dbus.ObjectPath,
+	busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	execPath, cmdLine, err := getExecutablePathAndCmdline(m.service, sender)
+	if err != nil {
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+
+	uid, err := m.service.GetConnUID(string(sender))
+	if err != nil {
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+	if !allowInstallPackageExecPaths.Contains(execPath) &&
+		uid != 0 {
+		err = fmt.Errorf("%q is not allowed to install packages", execPath)
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+
+	jobObj, err := m.installPackagesWithVersion(sender, jobName, packages)
+	if err != nil {
+		logger.Warning(err)
+		var jobErr *system.JobError
+		if errors.As(err, &jobErr) {
+			errStr, _ := json.Marshal(jobErr)
+			return "/", dbusutil.ToError(errors.New(string(errStr)))
+		}
+		return "/", dbusutil.ToError(err)
+	}
+	if jobObj.next != nil {
+		jobObj.next.caller = mapMethodCaller(execPath, cmdLine)
+	} else {
+		jobObj.caller = mapMethodCaller(execPath, cmdLine)
+	}
+	return jobObj.getPath(), nil
+}
+
+// ReinstallPackages 重新安装已安装的包的当前版本,用于修复被损坏的文件,当前版本已无法从仓库下载时返回versionNotFound错误
+func (m *Manager) ReinstallPackages(sender dbus.Sender, packages []string) (job dbus.ObjectPath, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	execPath, cmdLine, err := getExecutablePathAndCmdline(m.service, sender)
+	if err != nil {
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+
+	uid, err := m.service.GetConnUID(string(sender))
+	if err != nil {
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+	if !allowInstallPackageExecPaths.Contains(execPath) &&
+		uid != 0 {
+		err = fmt.Errorf("%q is not allowed to install packages", execPath)
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+
+	jobObj, err := m.reinstallPackages(sender, packages)
+	if err != nil {
+		logger.Warning(err)
+		var jobErr *system.JobError
+		if errors.As(err, &jobErr) {
+			errStr, _ := json.Marshal(jobErr)
+			return "/", dbusutil.ToError(errors.New(string(errStr)))
+		}
+		return "/", dbusutil.ToError(err)
+	}
+	if jobObj.next != nil {
+		jobObj.next.caller = mapMethodCaller(execPath, cmdLine)
+	} else {
+		jobObj.caller = mapMethodCaller(execPath, cmdLine)
+	}
+	return jobObj.getPath(), nil
+}
+
+// ApplyDeferredPackages 在维护窗口安装安全模式推迟的包,推迟的包见DeferredPackages属性
+func (m *Manager) ApplyDeferredPackages(sender dbus.Sender) (job dbus.ObjectPath, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	err := checkInvokePermission(m.service, sender)
+	if err != nil {
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+	jobObj, err := m.applyDeferredPackages(sender)
+	if err != nil {
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+	return jobObj.getPath(), nil
+}
+
+// InstallLocalPackage 安装本地deb文件,path为绝对路径,依赖从已配置的仓库获取
+func (m *Manager) InstallLocalPackage(sender dbus.Sender, jobName string, path string) (job dbus.ObjectPath,
+	busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	execPath, cmdLine, err := getExecutablePathAndCmdline(m.service, sender)
+	if err != nil {
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+
+	uid, err := m.service.GetConnUID(string(sender))
+	if err != nil {
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+	if !allowInstallPackageExecPaths.Contains(execPath) &&
+		uid != 0 {
+		err = fmt.Errorf("%q is not allowed to install packages", execPath)
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+
+	jobObj, err := m.installLocalPackage(sender, jobName, path)
+	if err != nil {
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+	if jobObj.next != nil {
+		jobObj.next.caller = mapMethodCaller(execPath, cmdLine)
+	} else {
+		jobObj.caller = mapMethodCaller(execPath, cmdLine)
+	}
+	return jobObj.getPath(), nil
+}
+
 func (m *Manager) InstallPackageFromRepo(sender dbus.Sender, jobName string, sourceListPath string, repoListPath string, cachePath string, packageName []string) (jobPath dbus.ObjectPath,
 	busErr *dbus.Error) {
 	logger.Infof("enter InstallPackageFromRepo,jobName:%v, sourceListPath:%v, repoListPath:%v, cachePath:%v", jobName, sourceListPath, repoListPath, cachePath)
@@ -154,7 +314,7 @@ func (m *Manager) PackageExists(pkgId string) (exist bool, busErr *dbus.Error) {
 
 func (m *Manager) PackageInstallable(pkgId string) (installable bool, busErr *dbus.Error) {
 	m.service.DelayAutoQuit()
-	return system.QueryPackageInstallable(pkgId), nil
+	return system.QueryPackageInstallable(m.proxyEnviron(), pkgId), nil
 }
 
 func (m *Manager) GetUpdateLogs(updateType system.UpdateType) (changeLogs string, busErr *dbus.Error) {
@@ -201,13 +361,13 @@ func (m *Manager) PackagesSize(packages []string) (int64, *dbus.Error) {
 	mode := m.UpdateMode
 	m.PropsMu.RUnlock()
 	if packages == nil || len(packages) == 0 { // 如果传的参数为空,则根据updateMode获取所有需要下载包的大小
-		_, allPackageSize, err = system.QuerySourceDownloadSize(mode, nil)
+		_, allPackageSize, err = system.QuerySourceDownloadSize(m.proxyEnviron(), mode, nil)
 		if err != nil {
 			logger.Warning(err)
 		}
 	} else {
 		// 查询包(可能不止一个)的大小,即使当前开启的仓库没有包含该包,依旧返回该包的大小
-		_, allPackageSize, err = system.QueryPackageDownloadSize(system.AllInstallUpdate, packages...)
+		_, allPackageSize, err = system.QueryPackageDownloadSize(m.proxyEnviron(), system.AllInstallUpdate, packages...)
 	}
 	if err != nil || allPackageSize == system.SizeUnknown {
 		logger.Warningf("PackagesDownloadSize(%q)=%0.2f %v\n", strings.Join(packages, " "), allPackageSize, err)
@@ -225,13 +385,13 @@ func (m *Manager) PackagesDownloadSize(packages []string) (int64, *dbus.Error) {
 	mode := m.UpdateMode
 	m.PropsMu.RUnlock()
 	if packages == nil || len(packages) == 0 { // 如果传的参数为空,则根据updateMode获取所有需要下载包的大小
-		size, _, err = system.QuerySourceDownloadSize(mode, nil)
+		size, _, err = system.QuerySourceDownloadSize(m.proxyEnviron(), mode, nil)
 		if err != nil {
 			logger.Warning(err)
 		}
 	} else {
 		// 查询包(可能不止一个)需要下载的大小,如果当前打开的仓库没有该包,则返回0
-		size, _, err = system.QueryPackageDownloadSize(mode, packages...)
+		size, _, err = system.QueryPackageDownloadSize(m.proxyEnviron(), mode, packages...)
 	}
 	if err != nil || size == system.SizeUnknown {
 		logger.Warningf("PackagesDownloadSize(%q)=%0.2f %v\n", strings.Join(packages, " "), size, err)
@@ -251,12 +411,64 @@ func (m *Manager) PauseJob(jobId string) *dbus.Error {
 	return dbusutil.ToError(err)
 }
 
+// PauseDownloadJob 与PauseJob不同,会等待正在下载的文件完成后再暂停
+func (m *Manager) PauseDownloadJob(jobId string) *dbus.Error {
+	m.service.DelayAutoQuit()
+	m.do.Lock()
+	err := m.jobManager.PauseDownloadJob(jobId)
+	m.do.Unlock()
+
+	if err != nil {
+		logger.Warningf("PauseDownloadJob %q error: %v\n", jobId, err)
+	}
+	return dbusutil.ToError(err)
+}
+
+// ConfirmMediaChange job的MediaChange不为空时,插入对应的介质后调用
+func (m *Manager) ConfirmMediaChange(jobId string) *dbus.Error {
+	m.service.DelayAutoQuit()
+	err := m.jobManager.ConfirmMediaChange(jobId)
+	if err != nil {
+		logger.Warningf("ConfirmMediaChange %q error: %v\n", jobId, err)
+	}
+	return dbusutil.ToError(err)
+}
+
+// SetJobPriority 调整等待中job的优先级,值越大越先执行,默认为0
+func (m *Manager) SetJobPriority(jobId string, priority int32) *dbus.Error {
+	m.service.DelayAutoQuit()
+	err := m.jobManager.SetJobPriority(jobId, int(priority))
+	if err != nil {
+		logger.Warningf("SetJobPriority %q error: %v\n", jobId, err)
+	}
+	return dbusutil.ToError(err)
+}
+
 func (m *Manager) PrepareDistUpgrade(sender dbus.Sender) (job dbus.ObjectPath, busErr *dbus.Error) {
 	m.service.DelayAutoQuit()
 	m.PropsMu.RLock()
 	mode := m.CheckUpdateMode
 	m.PropsMu.RUnlock()
-	jobObj, err := m.prepareDistUpgrade(sender, mode, false)
+	jobObj, err := m.prepareDistUpgrade(sender, mode, false, "")
+	if err != nil {
+		return "/", dbusutil.ToError(err)
+	}
+	return jobObj.getPath(), nil
+}
+
+// PrepareDistUpgradeWithMirror 与PrepareDistUpgrade相同,但本次下载使用mirror替换系统仓库的地址,不修改系统的仓库配置
+func (m *Manager) PrepareDistUpgradeWithMirror(sender dbus.Sender, mirror string) (job dbus.ObjectPath, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	// 管理员鉴权
+	err := checkInvokePermission(m.service, sender)
+	if err != nil {
+		logger.Warning(err)
+		return "/", dbusutil.ToError(err)
+	}
+	m.PropsMu.RLock()
+	mode := m.CheckUpdateMode
+	m.PropsMu.RUnlock()
+	jobObj, err := m.prepareDistUpgrade(sender, mode, false, mirror)
 	if err != nil {
 		return "/", dbusutil.ToError(err)
 	}
@@ -293,7 +505,7 @@ func (m *Manager) RegisterAgent(sender dbus.Sender, path dbus.ObjectPath) *dbus.
 		logger.Warningf("failed to get process %d environ: %v", proc, err)
 	} else {
 		m.userAgents.addLang(uidStr, getLang(envVars))
-		gettext.SetLocale(gettext.LcAll, m.userAgents.getActiveLastoreAgentLang())
+		setProcessLocale(m.userAgents.getActiveLastoreAgentLang())
 	}
 
 	for _, detail := range sessionDetails {
@@ -575,7 +787,7 @@ func (m *Manager) QueryAllSizeWithSource(mode system.UpdateType) (int64, *dbus.E
 	if mode&system.SystemUpdate != 0 {
 		pkgList = m.coreList
 	}
-	_, allSize, err := system.QuerySourceDownloadSize(mode, pkgList)
+	_, allSize, err := system.QuerySourceDownloadSize(m.proxyEnviron(), mode, pkgList)
 	if err != nil || allSize == system.SizeUnknown {
 		logger.Warningf("failed to get %v source size:%v", strings.Join(sourcePathList, " and "), err)
 	} else {
@@ -585,9 +797,319 @@ func (m *Manager) QueryAllSizeWithSource(mode system.UpdateType) (int64, *dbus.E
 	return int64(allSize), dbusutil.ToError(err)
 }
 
+// GetUpdateSize 返回mode类型更新需要下载的大小(B),仓库不存在时该类型的大小为0
+func (m *Manager) GetUpdateSize(mode system.UpdateType) (size int64, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	for _, t := range system.AllInstallUpdateType() {
+		if mode&t == 0 {
+			continue
+		}
+		typeSize, err := m.getUpdateSizeByType(t)
+		if err != nil {
+			logger.Warning(err)
+			return 0, dbusutil.ToError(err)
+		}
+		size += typeSize
+	}
+	return size, nil
+}
+
+// CheckUpdatesForType 获取mode中各分类的可更新包,不受UpdateMode限制,也不修改UpdateMode和可更新属性.
+// result为json数据,UpdateType.JobType()映射到该分类的可更新包,已排除不参与更新的包
+func (m *Manager) CheckUpdatesForType(mode system.UpdateType) (result string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	if mode&system.AllCheckUpdate == 0 {
+		return "", dbusutil.ToError(fmt.Errorf("invalid update type %v", mode))
+	}
+	pkgMap, _, errList := m.listUpgradablePackages(mode)
+	err := errors.Join(errList...)
+	if err != nil {
+		logger.Warning(err)
+		return "", dbusutil.ToError(err)
+	}
+	excluded := m.updater.getExcludedPackages()
+	for t, packages := range pkgMap {
+		pkgMap[t] = excludePackages(packages, excluded)
+	}
+	content, err := json.Marshal(pkgMap)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return string(content), nil
+}
+
+// ValidateDistUpgrade 下载前模拟检查mode类型的更新,result为DistUpgradeValidation的json数据,Blockers为空时才可以开始下载
+func (m *Manager) ValidateDistUpgrade(mode system.UpdateType) (result string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	validation, err := m.validateDistUpgrade(mode)
+	if err != nil {
+		logger.Warning(err)
+		return "", dbusutil.ToError(err)
+	}
+	content, err := json.Marshal(validation)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return string(content), nil
+}
+
+// PreviewDistUpgrade 预览mode类型的dist-upgrade事务,plan为system.DistUpgradePlan的json数据,用于更新前的确认
+func (m *Manager) PreviewDistUpgrade(mode system.UpdateType) (plan string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	var pkgList []string
+	if mode&system.SystemUpdate != 0 {
+		pkgList = m.coreList
+	}
+	p, err := system.QueryDistUpgradePlan(m.proxyEnviron(), mode, pkgList)
+	if err != nil {
+		logger.Warning(err)
+		return "", dbusutil.ToError(err)
+	}
+	content, err := json.Marshal(p)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return string(content), nil
+}
+
+// GetMergedUpdatablePackages 返回各更新分类去重后的可更新包列表(json),同一个包只出现一次
+func (m *Manager) GetMergedUpdatablePackages() (packages string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	merged, err := m.getMergedUpdatablePackages()
+	if err != nil {
+		logger.Warning(err)
+		return "", dbusutil.ToError(err)
+	}
+	content, err := json.Marshal(merged)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return string(content), nil
+}
+
+// GetUpdatablePackageOrigins 返回可更新包的候选版本来自哪些仓库文件(json),包名映射到仓库文件路径列表
+func (m *Manager) GetUpdatablePackageOrigins() (origins string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	result, err := m.getUpdatablePackageOrigins()
+	if err != nil {
+		logger.Warning(err)
+		return "", dbusutil.ToError(err)
+	}
+	content, err := json.Marshal(result)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return string(content), nil
+}
+
+// RecomputeUpdatable 不重新下载索引,只根据已有索引和更新平台数据重新计算可更新内容,用于更新策略变化后快速刷新
+func (m *Manager) RecomputeUpdatable() *dbus.Error {
+	m.service.DelayAutoQuit()
+	err := m.recomputeUpdatable()
+	if err != nil {
+		logger.Warning(err)
+		return dbusutil.ToError(err)
+	}
+	return nil
+}
+
+// GetUpdateStateSnapshot 返回同一时刻的更新模式、可更新包、分类包和最近一次检查更新结果(json)
+func (m *Manager) GetUpdateStateSnapshot() (snapshot string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	content, err := json.Marshal(m.getUpdateStateSnapshot())
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return string(content), nil
+}
+
+// AbortAll 终止所有正在执行和等待中的任务,用于紧急停止;返回AbortAllResult的json数据,正在安装无法中断的任务在Skipped中
+func (m *Manager) AbortAll(sender dbus.Sender) (result string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	err := checkInvokePermission(m.service, sender)
+	if err != nil {
+		logger.Warning(err)
+		return "", dbusutil.ToError(err)
+	}
+	// 持有m.do,终止期间不会创建新的任务
+	m.do.Lock()
+	aborted := m.jobManager.AbortAll()
+	m.jobManager.dispatch()
+	m.do.Unlock()
+	for _, job := range aborted.Aborted {
+		if job.Type == system.OfflineUpdateJobType {
+			// 离线检查更新被终止时释放oup的解压目录和挂载
+			err = m.offline.CleanCache()
+			if err != nil {
+				logger.Warning(err)
+			}
+			break
+		}
+	}
+	logger.Warningf("abort all jobs, aborted: %d, skipped: %d", len(aborted.Aborted), len(aborted.Skipped))
+	content, err := json.Marshal(aborted)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return string(content), nil
+}
+
+// ReconfigureSources 重新生成系统、未知来源和其他系统仓库目录,供部署工具放入新的仓库文件后调用,无需重启服务.
+// systemSourceList和otherList为list文件的绝对路径,nonUnknownList为不属于未知来源的list文件名,为空时使用配置中的列表.
+// 有任务正在执行时返回错误,changed为仓库有变化的更新类型
+func (m *Manager) ReconfigureSources(sender dbus.Sender, systemSourceList []string, nonUnknownList []string, otherList []string) (changed []string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	err := checkInvokePermission(m.service, sender)
+	if err != nil {
+		logger.Warning(err)
+		return nil, dbusutil.ToError(err)
+	}
+	changed, err = m.reconfigureSources(systemSourceList, nonUnknownList, otherList)
+	if err != nil {
+		logger.Warning("reconfigure sources failed:", err)
+		return nil, dbusutil.ToError(err)
+	}
+	logger.Info("reconfigure sources, changed:", changed)
+	if changed == nil {
+		changed = []string{}
+	}
+	return changed, nil
+}
+
+// ListJobs 返回所有等待和正在执行的任务概要(json),为JobSummary列表,按JobList的顺序排列
+func (m *Manager) ListJobs() (jobs string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	summaries := make([]JobSummary, 0)
+	for _, job := range m.jobManager.List() {
+		summaries = append(summaries, job.summary())
+	}
+	content, err := json.Marshal(summaries)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return string(content), nil
+}
+
+// IsPackageSystemBusy 返回dpkg或apt是否被其他程序锁定,以及持有锁的进程号和进程名,无法获取持有者时pid为0、name为空
+func (m *Manager) IsPackageSystemBusy() (busy bool, pid int32, name string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	busy, holder, name := system.PackageSystemBusy()
+	return busy, int32(holder), name, nil
+}
+
+// GetUpdateChangelog 返回packages从已安装版本到候选版本之间的更新说明(json),包名映射到apt.PackageChangelog;
+// 单次最多查询maxChangelogPackages个包
+func (m *Manager) GetUpdateChangelog(packages []string) (changelog string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	pkgs, err := NormalizePackageNames(strings.Join(packages, " "))
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	if len(pkgs) > maxChangelogPackages {
+		return "", dbusutil.ToError(fmt.Errorf("too many packages: %d, at most %d", len(pkgs), maxChangelogPackages))
+	}
+	content, err := json.Marshal(m.getUpdateChangelog(pkgs))
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return string(content), nil
+}
+
+// GetUpdatesDelta 返回最近一次检查更新相比上一次新增、移除和目标版本变化的包(json),为UpdatesDelta;
+// 没有上一次的记录时所有包都作为新增
+func (m *Manager) GetUpdatesDelta() (delta string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	result, err := getUpdatesDelta()
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	content, err := json.Marshal(result)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return string(content), nil
+}
+
+// GetJobLog 返回job执行的apt命令最后一部分输出,job被移除后无法获取
+func (m *Manager) GetJobLog(jobId string) (log string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	job := m.jobManager.findJobById(jobId)
+	if job == nil {
+		return "", dbusutil.ToError(system.NotFoundError("GetJobLog " + jobId))
+	}
+	return job.getLog(), nil
+}
+
+// AllowProtectedRemoval 管理员允许任务在下一次执行时卸载指定的受保护的包,用于确认后重新开始因ErrorDangerousRemoval失败的任务
+func (m *Manager) AllowProtectedRemoval(sender dbus.Sender, jobId string, packages []string) *dbus.Error {
+	m.service.DelayAutoQuit()
+	uid, err := m.service.GetConnUID(string(sender))
+	if err != nil {
+		return dbusutil.ToError(err)
+	}
+	if uid != 0 {
+		err = polkit.CheckAuth(polkitActionChangeOwnData, string(sender), nil)
+		if err != nil {
+			logger.Warning(err)
+			return dbusutil.ToError(err)
+		}
+	}
+	job := m.jobManager.findJobById(jobId)
+	if job == nil {
+		return dbusutil.ToError(system.NotFoundError("AllowProtectedRemoval " + jobId))
+	}
+	protected := strv.Strv(apt.GetProtectedPackages())
+	for _, pkg := range packages {
+		if !protected.Contains(pkg) {
+			return dbusutil.ToError(fmt.Errorf("%q is not a protected package", pkg))
+		}
+	}
+	logger.Warningf("uid %d allow job %s to remove protected packages %v", uid, jobId, packages)
+	apt.AllowProtectedRemoval(jobId, packages)
+	return nil
+}
+
+// CheckSourceReachable 检查各更新类型仓库是否可以访问,返回json数据,包含每个仓库InRelease的地址、是否可达和耗时(毫秒).
+// 不会更新apt索引,也不需要dpkg锁
+func (m *Manager) CheckSourceReachable(sender dbus.Sender) (result string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	environ, err := makeEnvironWithSender(m, sender)
+	if err != nil {
+		logger.Warning(err)
+		return "", dbusutil.ToError(err)
+	}
+	results := checkSourcesReachable(system.GetCategorySourceMap(), environ, sourceReachableTimeout)
+	if results == nil {
+		results = []sourceReachability{}
+	}
+	content, err := json.Marshal(results)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return string(content), nil
+}
+
+// ListUpdateHistory 返回最近limit条更新记录的json数据,按时间倒序,limit <= 0 时返回全部
+func (m *Manager) ListUpdateHistory(limit int32) (history string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	entries, err := m.jobManager.history.list(int(limit))
+	if err != nil {
+		logger.Warning(err)
+		return "", dbusutil.ToError(err)
+	}
+	if entries == nil {
+		entries = []updateHistoryEntry{}
+	}
+	content, err := json.Marshal(entries)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return string(content), nil
+}
+
 func (m *Manager) PrepareDistUpgradePartly(sender dbus.Sender, mode system.UpdateType) (job dbus.ObjectPath, busErr *dbus.Error) {
 	m.service.DelayAutoQuit()
-	jobObj, err := m.prepareDistUpgrade(sender, mode, false)
+	jobObj, err := m.prepareDistUpgrade(sender, mode, false, "")
 	if err != nil {
 		logger.Warning(err)
 		return "/", dbusutil.ToError(err)
@@ -595,6 +1117,32 @@ func (m *Manager) PrepareDistUpgradePartly(sender dbus.Sender, mode system.Updat
 	return jobObj.getPath(), nil
 }
 
+// ValidateOup 只校验oup的元数据,不解压仓库,返回info.json的内容
+func (m *Manager) ValidateOup(path string) (info string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	repoInfo, err := validateOup(path)
+	if err != nil {
+		logger.Warningf("validate %v failed: %v", path, err)
+		// 不匹配时返回JobError,前端根据ErrType提示离线包适用于其他版本或架构
+		var errType system.JobErrorType
+		switch {
+		case errors.Is(err, ErrOupSystemTypeMismatch):
+			errType = system.ErrorOupSystemTypeMismatch
+		case errors.Is(err, ErrOupArchMismatch):
+			errType = system.ErrorOupArchMismatch
+		default:
+			return "", dbusutil.ToError(err)
+		}
+		errStr, _ := json.Marshal(system.JobError{ErrType: errType, ErrDetail: err.Error()})
+		return "", dbusutil.ToError(errors.New(string(errStr)))
+	}
+	content, err := json.Marshal(repoInfo)
+	if err != nil {
+		return "", dbusutil.ToError(err)
+	}
+	return string(content), nil
+}
+
 func (m *Manager) CheckUpgrade(sender dbus.Sender, checkMode system.UpdateType, checkOrder uint32) (job dbus.ObjectPath, busErr *dbus.Error) {
 	m.service.DelayAutoQuit()
 	job, err := m.checkUpgrade(sender, checkMode, checkType(checkOrder))
@@ -618,6 +1166,22 @@ func (m *Manager) UpdateOfflineSource(sender dbus.Sender, paths []string, option
 	return jobObj.getPath(), nil
 }
 
+// SetOfflineMode 开启或关闭离线模式,关闭时卸载离线仓库并恢复在线检查更新
+func (m *Manager) SetOfflineMode(sender dbus.Sender, enable bool) *dbus.Error {
+	m.service.DelayAutoQuit()
+	err := checkInvokePermission(m.service, sender)
+	if err != nil {
+		logger.Warning(err)
+		return dbusutil.ToError(err)
+	}
+	err = m.setOfflineMode(enable)
+	if err != nil {
+		logger.Warning(err)
+		return dbusutil.ToError(err)
+	}
+	return nil
+}
+
 func (m *Manager) PowerOff(sender dbus.Sender, reboot bool) *dbus.Error {
 	checkExecPath := func() error {
 		// 只有dde-update可以设置
@@ -688,7 +1252,7 @@ func (m *Manager) SetUpdateSources(sender dbus.Sender, updateType system.UpdateT
 		if err != nil {
 			logger.Warning(err)
 		} else {
-			o, err := exec.Command("/usr/bin/apt-get", "check", "-o", "Debug::NoLocking=1",
+			o, err := system.AptCommand(m.proxyEnviron(), "apt-get", "check", "-o", "Debug::NoLocking=1",
 				"-o", fmt.Sprintf("Dir::Etc::sourcelist=%v", tmpList), "-o", "Dir::Etc::SourceParts=/dev/null").CombinedOutput()
 			if err != nil {
 				logger.Warning("apt-get check error", string(o))
@@ -739,3 +1303,40 @@ func (m *Manager) SetUpdateSources(sender dbus.Sender, updateType system.UpdateT
 	m.reloadOemConfig(false)
 	return nil
 }
+
+// ImportSourceKey 导入并信任自定义仓库的签名公钥,返回公钥指纹
+func (m *Manager) ImportSourceKey(sender dbus.Sender, keyData []byte) (fingerprint string, busErr *dbus.Error) {
+	m.service.DelayAutoQuit()
+	if !system.IsAuthorized() {
+		return "", dbusutil.ToError(errors.New("not authorized, don't allow to import source key"))
+	}
+	err := checkInvokePermission(m.service, sender)
+	if err != nil {
+		logger.Warning(err)
+		return "", dbusutil.ToError(err)
+	}
+	fingerprint, err = system.ImportSourceKey(keyData)
+	if err != nil {
+		logger.Warning(err)
+		return "", dbusutil.ToError(err)
+	}
+	return fingerprint, nil
+}
+
+// RemoveSourceKey 删除通过ImportSourceKey导入的公钥
+func (m *Manager) RemoveSourceKey(sender dbus.Sender, fingerprint string) *dbus.Error {
+	m.service.DelayAutoQuit()
+	if !system.IsAuthorized() {
+		return dbusutil.ToError(errors.New("not authorized, don't allow to remove source key"))
+	}
+	err := checkInvokePermission(m.service, sender)
+	if err != nil {
+		logger.Warning(err)
+		return dbusutil.ToError(err)
+	}
+	err = system.RemoveSourceKey(fingerprint)
+	if err != nil {
+		logger.Warning(err)
+	}
+	return dbusutil.ToError(err)
+}
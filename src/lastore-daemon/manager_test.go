@@ -5,15 +5,26 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/godbus/dbus/v5"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/config"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system/apt"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/updateplatform"
 
 	"github.com/linuxdeepin/go-lib/keyfile"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_handleAutoCheckEvent(t *testing.T) {
@@ -27,6 +38,19 @@ func Test_handleAutoCheckEvent(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func Test_handleAutoCheckEventOfflineMode(t *testing.T) {
+	// 离线仓库生效时不进行在线检查,m没有dbus服务,检查更新时会panic
+	m := &Manager{
+		config: &config.Config{
+			AutoCheckUpdates:      true,
+			DisableUpdateMetadata: true,
+		},
+		OfflineMode: true,
+	}
+	err := m.handleAutoCheckEvent()
+	assert.Nil(t, err)
+}
+
 func Test_handleAutoCleanEvent(t *testing.T) {
 	m := &Manager{
 		config: &config.Config{
@@ -78,3 +102,1008 @@ func Test_saveUpdateSourceOnce(t *testing.T) {
 	m.loadUpdateSourceOnce()
 	assert.Equal(t, true, m.updateSourceOnce)
 }
+
+func Test_pkgStatusCache(t *testing.T) {
+	statusFile, err := os.CreateTemp("", "dpkg-status")
+	assert.Nil(t, err)
+	defer func() {
+		_ = os.Remove(statusFile.Name())
+	}()
+	loadCount := 0
+	c := &pkgStatusCache{
+		statusFile: statusFile.Name(),
+		loadFn: func() (map[string]statusVersion, error) {
+			loadCount++
+			return map[string]statusVersion{
+				"dde-dock":    {status: "ii", version: "1.0"},
+				"dde-control": {status: "rc", version: "2.0"},
+			}, nil
+		},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := c.get()
+			assert.Nil(t, err)
+			assert.Equal(t, "1.0", data["dde-dock"].version)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, loadCount)
+
+	modTime := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(statusFile.Name(), modTime, modTime))
+	_, err = c.get()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, loadCount)
+
+	versions := c.installedVersions([]string{"dde-dock", "dde-control", "dde-launcher"})
+	assert.Equal(t, map[string]string{"dde-dock": "1.0"}, versions)
+	assert.Equal(t, 2, loadCount)
+}
+
+func Benchmark_loadPkgStatusVersion(b *testing.B) {
+	if _, err := os.Stat(dpkgStatusFile); err != nil {
+		b.Skip("dpkg status file not found")
+	}
+	for i := 0; i < b.N; i++ {
+		_, _ = loadPkgStatusVersion()
+	}
+}
+
+func Benchmark_pkgStatusCache(b *testing.B) {
+	if _, err := os.Stat(dpkgStatusFile); err != nil {
+		b.Skip("dpkg status file not found")
+	}
+	c := newPkgStatusCache()
+	for i := 0; i < b.N; i++ {
+		_, _ = c.get()
+	}
+}
+
+func Test_cleanPartialFiles(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+	fresh := filepath.Join(dir, "fresh_InRelease")
+	stale := filepath.Join(dir, "stale_Packages.xz")
+	for _, f := range []string{fresh, stale} {
+		assert.NoError(t, os.WriteFile(f, []byte("partial"), 0644))
+	}
+	assert.NoError(t, os.Chtimes(stale, now.Add(-48*time.Hour), now.Add(-48*time.Hour)))
+
+	cleanPartialFiles([]string{dir, filepath.Join(dir, "not_exist")}, 24*time.Hour, false, now)
+	assert.FileExists(t, fresh)
+	assert.NoFileExists(t, stale)
+
+	cleanPartialFiles([]string{dir}, 24*time.Hour, true, now)
+	assert.NoFileExists(t, fresh)
+}
+
+func Test_checkSourcesReachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/deepin/dists/beige/InRelease":
+			w.WriteHeader(http.StatusOK)
+		case "/nohead/dists/beige/InRelease":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	systemSource := filepath.Join(dir, "system.list")
+	content := "deb " + server.URL + "/deepin beige main\n" +
+		"deb " + server.URL + "/nohead beige main\n" +
+		"deb " + server.URL + "/missing beige main\n"
+	assert.NoError(t, os.WriteFile(systemSource, []byte(content), 0644))
+
+	results := checkSourcesReachable(map[system.UpdateType]string{
+		system.SystemUpdate:   systemSource,
+		system.SecurityUpdate: filepath.Join(dir, "not-exist"),
+	}, map[string]string{}, time.Second)
+	assert.Len(t, results, 3)
+	reachable := make(map[string]bool)
+	for _, r := range results {
+		assert.Equal(t, system.SystemUpdate, r.UpdateType)
+		reachable[r.URL] = r.Reachable
+	}
+	assert.True(t, reachable[server.URL+"/deepin/dists/beige/InRelease"])
+	assert.True(t, reachable[server.URL+"/nohead/dists/beige/InRelease"])
+	assert.False(t, reachable[server.URL+"/missing/dists/beige/InRelease"])
+}
+
+func Test_retryPlatformRequest(t *testing.T) {
+	var waits []time.Duration
+	sleep := func(d time.Duration) { waits = append(waits, d) }
+
+	// 前两次失败,第三次成功
+	calls := 0
+	err := retryPlatformRequest("test", 3, time.Second, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("platform unreachable")
+		}
+		return nil
+	}, sleep)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, waits)
+
+	// 重试用尽后返回最后一次的错误
+	waits = nil
+	calls = 0
+	err = retryPlatformRequest("test", 2, time.Second, func() error {
+		calls++
+		return errors.New("platform unreachable")
+	}, sleep)
+	assert.EqualError(t, err, "platform unreachable")
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, waits)
+
+	// 不重试
+	waits = nil
+	calls = 0
+	err = retryPlatformRequest("test", 0, time.Second, func() error {
+		calls++
+		return errors.New("platform unreachable")
+	}, sleep)
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Empty(t, waits)
+}
+
+func Test_updateSourceRetryPolicy(t *testing.T) {
+	first := system.SystemUpdate | system.SecurityUpdate | system.AppendUpdate
+	tests := []struct {
+		name      string
+		config    config.Config
+		wantTypes []system.UpdateType
+		wantDelay []time.Duration
+	}{
+		{
+			name:      "default",
+			config:    config.Config{UpdateSourceRetryCount: 1},
+			wantTypes: []system.UpdateType{first},
+			wantDelay: []time.Duration{0},
+		},
+		{
+			name: "escalation with backoff",
+			config: config.Config{
+				UpdateSourceRetryCount: 4,
+				UpdateSourceRetryDelay: time.Minute,
+				UpdateSourceRetryTypes: []system.UpdateType{first, system.SystemUpdate},
+			},
+			wantTypes: []system.UpdateType{first, system.SystemUpdate, system.SystemUpdate, system.SystemUpdate},
+			wantDelay: []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute},
+		},
+		{
+			name:   "no retry",
+			config: config.Config{UpdateSourceRetryCount: 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := newUpdateSourceRetryPolicy(&tt.config)
+			q := NewJobQueue("test", 1)
+			j := NewJob(nil, "update_source", "", nil, system.UpdateSourceJobType, "test", nil)
+			j.retry = policy.maxRetry
+			j.retryDelayFn = policy.retryDelay
+			require.NoError(t, q.Add(j))
+			var types []system.UpdateType
+			var delays []time.Duration
+			j.subRetryHookFn = func(j *Job) {
+				types = append(types, policy.prepareRetry(j))
+			}
+			// 模拟连续失败,retry为0后job_queue不再重试
+			for i := 0; i < 10 && j.retry > 0; i++ {
+				j.Status = system.RunningStatus
+				before := time.Now()
+				j.PropsMu.Lock()
+				require.NoError(t, TransitionJobState(j, system.FailedStatus))
+				j.PropsMu.Unlock()
+				delay := j.retryAfter.Sub(before).Round(time.Second)
+				delays = append(delays, delay)
+				// 失败时已经设置了重试时间,等待时间未到时不会被重新选中
+				assert.Equal(t, delay == 0, len(q.PendingJobs()) == 1)
+				// job_queue选中失败的job后减少retry
+				j.subRetryCount(false)
+			}
+			assert.Equal(t, tt.wantTypes, types)
+			assert.Equal(t, tt.wantDelay, delays)
+			assert.Equal(t, 0, j.retry)
+			assert.Equal(t, len(tt.wantTypes)+1, j.getAttempt())
+		})
+	}
+
+	policy := newUpdateSourceRetryPolicy(&config.Config{UpdateSourceRetryCount: 20, UpdateSourceRetryDelay: time.Minute})
+	_, delay := policy.retryFor(20)
+	assert.Equal(t, maxUpdateSourceRetryDelay, delay)
+}
+
+func Test_mergeUpdatablePackages(t *testing.T) {
+	infos := map[system.UpdateType]map[string]system.PackageInfo{
+		system.SystemUpdate: {
+			"dde-dock": {Name: "dde-dock", Version: "5.6.9"},
+			"openssl":  {Name: "openssl", Version: "1.1.1n-9"},
+			"libfoo":   {Name: "libfoo", Version: "1:1.0"},
+		},
+		system.SecurityUpdate: {
+			// 按字符串比较"1.1.1n-9"更大,按deb版本规则"1.1.1n-10"更大
+			"openssl": {Name: "openssl", Version: "1.1.1n-10"},
+			"libfoo":  {Name: "libfoo", Version: "2.0"},
+		},
+		system.UnknownUpdate: {
+			"vim": {Name: "vim", Version: "9.0"},
+		},
+	}
+	merged := mergeUpdatablePackages(infos)
+	assert.Equal(t, []MergedUpdatablePackage{
+		{Name: "dde-dock", Version: "5.6.9", Categories: []string{system.SystemUpdate.JobType()}},
+		{Name: "libfoo", Version: "1:1.0", Categories: []string{system.SystemUpdate.JobType(), system.SecurityUpdate.JobType()}},
+		{Name: "openssl", Version: "1.1.1n-10", Categories: []string{system.SystemUpdate.JobType(), system.SecurityUpdate.JobType()}},
+		{Name: "vim", Version: "9.0", Categories: []string{system.UnknownUpdate.JobType()}},
+	}, merged)
+	assert.Empty(t, mergeUpdatablePackages(nil))
+}
+
+type fakeRestorer struct {
+	canRestore bool
+	started    bool
+	startErr   error
+}
+
+func (r *fakeRestorer) CanRestore(flags dbus.Flags) (bool, error) {
+	return r.canRestore, nil
+}
+
+func (r *fakeRestorer) StartRestore(flags dbus.Flags) error {
+	r.started = r.startErr == nil
+	return r.startErr
+}
+
+func Test_runPostUpgradeHealthCheck(t *testing.T) {
+	broken := func() error {
+		return &system.JobError{ErrType: system.ErrorDependenciesBroken, ErrDetail: "packages need to be fixed: libfoo"}
+	}
+	restorer := &fakeRestorer{canRestore: true}
+	result := runPostUpgradeHealthCheck(func() error { return nil }, true, restorer)
+	assert.True(t, result.Healthy)
+	assert.False(t, restorer.started)
+
+	result = runPostUpgradeHealthCheck(broken, false, restorer)
+	assert.False(t, result.Healthy)
+	assert.False(t, result.RollbackStarted)
+	assert.False(t, restorer.started)
+
+	result = runPostUpgradeHealthCheck(broken, true, restorer)
+	assert.False(t, result.Healthy)
+	assert.True(t, result.RollbackStarted)
+	assert.Empty(t, result.RollbackError)
+	assert.True(t, restorer.started)
+
+	result = runPostUpgradeHealthCheck(broken, true, &fakeRestorer{})
+	assert.False(t, result.RollbackStarted)
+	assert.Equal(t, "no backup to restore", result.RollbackError)
+
+	result = runPostUpgradeHealthCheck(broken, true, &fakeRestorer{canRestore: true, startErr: errors.New("busy")})
+	assert.False(t, result.RollbackStarted)
+	assert.Equal(t, "busy", result.RollbackError)
+}
+
+func Test_buildUpdatableExport(t *testing.T) {
+	now := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	classified := map[string][]string{
+		system.SystemUpdate.JobType():   {"openssl", "dde-launcher"},
+		system.SecurityUpdate.JobType(): {"openssl"},
+	}
+	targets := map[string]map[string]system.PackageInfo{
+		system.SystemUpdate.JobType(): {
+			"openssl":      {Name: "openssl", Version: "1.1.1n-10"},
+			"dde-launcher": {Name: "dde-launcher", Version: "5.6.1"},
+		},
+	}
+	current := map[string]string{"openssl": "1.1.1n-9"}
+	export := buildUpdatableExport(classified, targets, current, now)
+	assert.Equal(t, updatableExportSchemaVersion, export.SchemaVersion)
+	assert.Equal(t, now, export.GeneratedAt)
+	assert.Equal(t, []UpdatableExportPackage{
+		{Name: "openssl", CurrentVersion: "1.1.1n-9", Category: system.SecurityUpdate.JobType()},
+		{Name: "dde-launcher", TargetVersion: "5.6.1", Category: system.SystemUpdate.JobType()},
+		{Name: "openssl", CurrentVersion: "1.1.1n-9", TargetVersion: "1.1.1n-10", Category: system.SystemUpdate.JobType()},
+	}, export.Packages)
+
+	empty := buildUpdatableExport(nil, nil, nil, now)
+	assert.NotNil(t, empty.Packages)
+}
+
+func Test_getUpdateStateSnapshot(t *testing.T) {
+	m := &Manager{
+		UpdateMode:       system.SystemUpdate | system.SecurityUpdate,
+		CheckUpdateMode:  system.SystemUpdate,
+		updateSourceOnce: true,
+		updater: &Updater{
+			LastCheckTime:      "2023-05-01T10:00:00Z",
+			LastCheckSucceeded: true,
+			ClassifiedRemovedPackages: map[string][]string{
+				system.SystemUpdate.JobType(): {"libssl1.1"},
+			},
+		},
+	}
+	classified := map[string][]string{
+		system.SystemUpdate.JobType(): {"openssl"},
+	}
+	apps := []string{"openssl"}
+	m.publishUpdatableState(classified, apps)
+	snapshot := m.getUpdateStateSnapshot()
+	assert.Equal(t, system.SystemUpdate|system.SecurityUpdate, snapshot.UpdateMode)
+	assert.Equal(t, system.SystemUpdate, snapshot.CheckUpdateMode)
+	assert.Equal(t, []string{"openssl"}, snapshot.UpgradableApps)
+	assert.Equal(t, []string{"libssl1.1"}, snapshot.ClassifiedRemovedPackages[system.SystemUpdate.JobType()])
+	assert.Equal(t, uint64(1), snapshot.UpdatableVersion)
+	assert.Equal(t, "2023-05-01T10:00:00Z", snapshot.LastCheckTime)
+	assert.True(t, snapshot.LastCheckSucceeded)
+	assert.True(t, snapshot.UpdateSourceOnce)
+
+	// 快照与属性不共享底层数据
+	apps[0] = "dde-dock"
+	classified[system.SystemUpdate.JobType()][0] = "dde-dock"
+	assert.Equal(t, []string{"openssl"}, snapshot.UpgradableApps)
+	assert.Equal(t, []string{"openssl"}, snapshot.ClassifiedUpdatablePackages[system.SystemUpdate.JobType()])
+	m.updater.ClassifiedRemovedPackages[system.SystemUpdate.JobType()][0] = "libssl3"
+	assert.Equal(t, []string{"libssl1.1"}, snapshot.ClassifiedRemovedPackages[system.SystemUpdate.JobType()])
+
+	m.publishUpdatableState(nil, nil)
+	snapshot = m.getUpdateStateSnapshot()
+	assert.Empty(t, snapshot.UpgradableApps)
+	assert.Equal(t, uint64(2), snapshot.UpdatableVersion)
+}
+
+func Test_checkUpdateSourceType(t *testing.T) {
+	assert.Equal(t, system.SecurityUpdate, checkUpdateSourceType(system.SecurityUpdate))
+	assert.Equal(t, system.SecurityUpdate, checkUpdateSourceType(system.SecurityUpdate|system.OnlySecurityUpdate))
+	assert.Equal(t, system.AllCheckUpdate, checkUpdateSourceType(system.SystemUpdate|system.SecurityUpdate))
+	assert.Equal(t, system.AllCheckUpdate, checkUpdateSourceType(system.UnknownUpdate))
+	assert.Equal(t, system.AllCheckUpdate, checkUpdateSourceType(0))
+}
+
+func Test_recomputeUpdatableRejected(t *testing.T) {
+	m := &Manager{}
+	assert.EqualError(t, m.recomputeUpdatable(), "no update source has been checked")
+
+	m.updateSourceOnce = true
+	m.jobManager = NewJobManager(nil, apt.NewSystem(nil, nil), nil)
+	m.refreshUpdateInfosMu.Lock()
+	defer m.refreshUpdateInfosMu.Unlock()
+	assert.EqualError(t, m.recomputeUpdatable(), "updatable packages are being recomputed")
+}
+
+func Test_exceedsBatteryDownloadLimit(t *testing.T) {
+	const mb = 1024 * 1024
+	assert.False(t, exceedsBatteryDownloadLimit(2048*mb, 0))
+	assert.False(t, exceedsBatteryDownloadLimit(2048*mb, -1))
+	assert.False(t, exceedsBatteryDownloadLimit(100*mb, 100))
+	assert.True(t, exceedsBatteryDownloadLimit(100*mb+1, 100))
+}
+
+func Test_repoLayersOfMembers(t *testing.T) {
+	members := []string{"oup-format", "oup-format_sign", "info.json", "info.json_sign", "repo.sfs.0", "repo.sfs.0_sign", "repo.sfs.1", "repo.sfs.1_sign"}
+	layers, err := repoLayersOfMembers(members, oupFormatV2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"repo.sfs.0", "repo.sfs.1"}, layers)
+
+	_, err = repoLayersOfMembers(members, oupFormatV1)
+	assert.Error(t, err)
+
+	layers, err = repoLayersOfMembers([]string{"oup-format", "repo.sfs", "repo.sfs_sign"}, oupFormatV1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"repo.sfs"}, layers)
+
+	_, err = repoLayersOfMembers([]string{"repo.sfs.1"}, oupFormatV2)
+	assert.Error(t, err)
+	_, err = repoLayersOfMembers(members, "3.0")
+	assert.Error(t, err)
+}
+
+func Test_parseMountInfo(t *testing.T) {
+	const mountInfo = `22 1 8:2 / / rw,relatime shared:1 - ext4 /dev/sda2 rw
+120 22 7:0 / /var/lib/lastore/mountfs/abc rw,relatime shared:60 - squashfs /dev/loop0 ro,errors=continue
+121 120 7:1 / /var/lib/lastore/mountfs/abc rw,relatime shared:61 - squashfs /dev/loop1 ro,errors=continue
+130 22 0:50 / /var/lib/lastore/mountfs/def/merged rw,relatime shared:70 - overlay overlay ro,lowerdir=/var/lib/lastore/mountfs/def/layer.1:/var/lib/lastore/mountfs/def/layer.0
+140 22 7:2 / /media/my\040disk rw,relatime - vfat /dev/sdb1 rw
+`
+	entry, ok := parseMountInfo(strings.NewReader(mountInfo), "/var/lib/lastore/mountfs/abc")
+	assert.True(t, ok)
+	// 叠加挂载时返回最上层
+	assert.Equal(t, mountEntry{fsType: "squashfs", source: "/dev/loop1", superOpts: "ro,errors=continue"}, entry)
+
+	entry, ok = parseMountInfo(strings.NewReader(mountInfo), "/var/lib/lastore/mountfs/def/merged")
+	assert.True(t, ok)
+	assert.Equal(t, "overlay", entry.fsType)
+	assert.Contains(t, entry.superOpts, "lowerdir=/var/lib/lastore/mountfs/def/layer.1:/var/lib/lastore/mountfs/def/layer.0")
+
+	entry, ok = parseMountInfo(strings.NewReader(mountInfo), "/media/my disk")
+	assert.True(t, ok)
+	assert.Equal(t, "/dev/sdb1", entry.source)
+
+	_, ok = parseMountInfo(strings.NewReader(mountInfo), "/var/lib/lastore/mountfs/def")
+	assert.False(t, ok)
+}
+
+func Test_diffUpdatableExport(t *testing.T) {
+	sys := system.SystemUpdate.JobType()
+	sec := system.SecurityUpdate.JobType()
+	current := UpdatableExport{Packages: []UpdatableExportPackage{
+		{Name: "openssl", TargetVersion: "1.1.1n-11", Category: sec},
+		{Name: "openssl", TargetVersion: "1.1.1n-11", Category: sys},
+		{Name: "dde-launcher", TargetVersion: "5.6.1", Category: sys},
+		{Name: "vim", TargetVersion: "2:9.0-1", Category: sys},
+	}}
+
+	first := diffUpdatableExport(nil, current)
+	assert.True(t, first.FirstCheck)
+	assert.Equal(t, current.Packages, first.Added)
+	assert.Empty(t, first.Removed)
+
+	previous := &UpdatableExport{Packages: []UpdatableExportPackage{
+		{Name: "openssl", TargetVersion: "1.1.1n-10", Category: sys},
+		{Name: "dde-launcher", TargetVersion: "5.6.1", Category: sys},
+		{Name: "vim", TargetVersion: "2:9.0-01", Category: sys},
+		{Name: "curl", TargetVersion: "7.88", Category: sys},
+	}}
+	delta := diffUpdatableExport(previous, current)
+	assert.False(t, delta.FirstCheck)
+	assert.Equal(t, []UpdatableExportPackage{{Name: "openssl", TargetVersion: "1.1.1n-11", Category: sec}}, delta.Added)
+	assert.Equal(t, []UpdatableExportPackage{{Name: "curl", TargetVersion: "7.88", Category: sys}}, delta.Removed)
+	// 2:9.0-01和2:9.0-1是同一个版本
+	assert.Equal(t, []UpdatesDeltaChange{{Name: "openssl", Category: sys, PreviousVersion: "1.1.1n-10", TargetVersion: "1.1.1n-11"}}, delta.Changed)
+}
+
+func Test_rotateUpdatableExport(t *testing.T) {
+	dir := t.TempDir()
+	exportPath, previousPath := updatableExportPath, updatablePreviousPath
+	updatableExportPath = filepath.Join(dir, "updatable.json")
+	updatablePreviousPath = filepath.Join(dir, "updatable.previous.json")
+	defer func() {
+		updatableExportPath, updatablePreviousPath = exportPath, previousPath
+	}()
+	sys := system.SystemUpdate.JobType()
+	first := UpdatableExport{Packages: []UpdatableExportPackage{{Name: "vim", TargetVersion: "2:9.0-1", Category: sys}}}
+	second := UpdatableExport{Packages: []UpdatableExportPackage{{Name: "curl", TargetVersion: "7.88", Category: sys}}}
+
+	// 第一次检查没有上一次的记录
+	require.NoError(t, os.WriteFile(updatablePreviousPath, []byte("{}"), 0644))
+	require.NoError(t, rotateUpdatableExport(first))
+	assert.NoFileExists(t, updatablePreviousPath)
+	delta, err := getUpdatesDelta()
+	require.NoError(t, err)
+	assert.True(t, delta.FirstCheck)
+
+	require.NoError(t, rotateUpdatableExport(second))
+	delta, err = getUpdatesDelta()
+	require.NoError(t, err)
+	assert.False(t, delta.FirstCheck)
+	assert.Equal(t, second.Packages, delta.Added)
+	assert.Equal(t, first.Packages, delta.Removed)
+}
+
+func Test_updateNotifyDismissal(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var none *updateNotifyDismissal
+	assert.True(t, none.allowUpdateNotify([]string{"openssl"}, time.Hour, now))
+	assert.Nil(t, parseUpdateNotifyDismissal(""))
+
+	content, err := json.Marshal(updateNotifyDismissal{Time: now, Packages: []string{"openssl", "vim"}})
+	require.NoError(t, err)
+	d := parseUpdateNotifyDismissal(string(content))
+	require.NotNil(t, d)
+	assert.False(t, d.allowUpdateNotify([]string{"openssl"}, time.Hour, now.Add(time.Minute)))
+	// 出现新的包时立即提醒
+	assert.True(t, d.allowUpdateNotify([]string{"openssl", "curl"}, time.Hour, now.Add(time.Minute)))
+	assert.True(t, d.allowUpdateNotify([]string{"openssl"}, time.Hour, now.Add(time.Hour)))
+}
+
+func Test_updateNotifyRecord(t *testing.T) {
+	var r updateNotifyRecord
+	_, ok := r.take(0)
+	assert.False(t, ok)
+
+	r.set(3, []string{"openssl"})
+	_, ok = r.take(2)
+	assert.False(t, ok)
+	packages, ok := r.take(3)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"openssl"}, packages)
+	// 同一个通知只记录一次
+	_, ok = r.take(3)
+	assert.False(t, ok)
+}
+
+func Test_computeRebootRequiredPackages(t *testing.T) {
+	assert.Empty(t, computeRebootRequiredPackages(nil, "6.1.32-amd64-desktop", []string{"6.1.32-amd64-desktop"}, []string{"vim", "curl"}))
+	// 安装了比正在运行的更新的内核
+	assert.Equal(t, []string{"linux-image-6.1.40-amd64-desktop"},
+		computeRebootRequiredPackages(nil, "6.1.32-amd64-desktop", []string{"6.1.32-amd64-desktop", "6.1.40-amd64-desktop"}, nil))
+	assert.Equal(t, []string{"dbus", "libc6", "openssl"},
+		computeRebootRequiredPackages([]string{"openssl"}, "", nil, []string{"vim", "libc6", "dbus", "openssl"}))
+	// 按完整包名判断,不匹配同前缀的其他包
+	assert.Equal(t, []string{"grub-pc", "libc6:amd64", "systemd"},
+		computeRebootRequiredPackages(nil, "", nil, []string{"libc6-dev", "dbus-x11", "systemd-timesyncd",
+			"grub-customizer", "grub-pc", "libc6:amd64", "systemd"}))
+}
+
+func Test_recordRebootRequiredPackages(t *testing.T) {
+	origin := lastoreRebootRequiredPkgsFile
+	lastoreRebootRequiredPkgsFile = filepath.Join(t.TempDir(), "lastore", "reboot-required.pkgs")
+	defer func() { lastoreRebootRequiredPkgsFile = origin }()
+
+	require.NoError(t, recordRebootRequiredPackages([]string{"vim"}))
+	assert.NoFileExists(t, lastoreRebootRequiredPkgsFile)
+
+	require.NoError(t, recordRebootRequiredPackages([]string{"vim", "libc6"}))
+	require.NoError(t, recordRebootRequiredPackages([]string{"libc6", "dbus"}))
+	assert.Equal(t, []string{"libc6", "dbus"}, readLines(lastoreRebootRequiredPkgsFile))
+}
+
+func Test_splitSafeModePackages(t *testing.T) {
+	immediate, deferred := splitSafeModePackages([]string{"openssl", "linux-image-6.1.40-amd64-desktop", "curl", "libc6", "firefox"},
+		[]string{"firefox"})
+	assert.Equal(t, []string{"openssl", "curl"}, immediate)
+	assert.Equal(t, []string{"firefox", "libc6", "linux-image-6.1.40-amd64-desktop"}, deferred)
+
+	immediate, deferred = splitSafeModePackages([]string{"openssl"}, nil)
+	assert.Equal(t, []string{"openssl"}, immediate)
+	assert.Empty(t, deferred)
+}
+
+func Test_selectUnzipRoot(t *testing.T) {
+	free := map[string]float64{"/var/lib/lastore/unzip": 100, "/var/lib/lastore/unzipcache": 300, "/tmp/lastore/unzipcache": 500}
+	freeSpace := func(dir string) (float64, error) {
+		if v, ok := free[dir]; ok {
+			return v, nil
+		}
+		return 0, errors.New("not writable")
+	}
+	roots := []string{"/var/lib/lastore/unzip", "/var/lib/lastore/unzipcache", "/tmp/lastore/unzipcache"}
+	root, err := selectUnzipRoot(roots, 50, freeSpace)
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/lastore/unzip", root)
+	// 配置的目录空间不足时使用可用空间最大的目录
+	root, err = selectUnzipRoot(roots, 200, freeSpace)
+	require.NoError(t, err)
+	assert.Equal(t, "/tmp/lastore/unzipcache", root)
+
+	_, err = selectUnzipRoot(roots, 800, freeSpace)
+	var shortfall *system.SpaceShortfall
+	require.True(t, errors.As(err, &shortfall))
+	assert.Equal(t, "/tmp/lastore/unzipcache", shortfall.Path)
+	assert.Equal(t, float64(300), shortfall.Short)
+
+	_, err = selectUnzipRoot([]string{"/not/writable"}, 1, freeSpace)
+	assert.Error(t, err)
+}
+
+func Test_checkOfflineDirRoot(t *testing.T) {
+	assert.NoError(t, checkOfflineDirRoot("/var/lib/lastore/unzipcache"))
+	assert.NoError(t, checkOfflineDirRoot("/tmp"))
+	assert.Error(t, checkOfflineDirRoot("/"))
+	assert.Error(t, checkOfflineDirRoot("/home"))
+	assert.Error(t, checkOfflineDirRoot("/var/lib/lastore/../../.."))
+	assert.Error(t, checkOfflineDirRoot("/var/lib/lastore-other"))
+	assert.Error(t, checkOfflineDirRoot("unzipcache"))
+
+	// 软链接指向允许的目录之外时拒绝
+	dir := t.TempDir()
+	link := filepath.Join(dir, "link")
+	require.NoError(t, os.Symlink("/etc", link))
+	assert.Error(t, checkOfflineDirRoot(link))
+}
+
+func TestOfflineCleanCacheOwnedDirs(t *testing.T) {
+	unzipDir := t.TempDir()
+	mountDir := t.TempDir()
+	oldFallback := fallbackUnzipOupDirs
+	oldMountDir := system.OfflineMountFsDir
+	fallbackUnzipOupDirs = nil
+	system.OfflineMountFsDir = mountDir
+	defer func() {
+		fallbackUnzipOupDirs = oldFallback
+		system.OfflineMountFsDir = oldMountDir
+	}()
+
+	unzipTarget := filepath.Join(unzipDir, getUnzipName("/tmp/a.oup"))
+	mountTarget := getMountDir(unzipTarget)
+	for _, dir := range []string{unzipTarget, mountTarget, filepath.Join(unzipDir, "other"), filepath.Join(mountDir, "other")} {
+		require.NoError(t, os.MkdirAll(dir, 0755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(unzipDir, "keep"), nil, 0644))
+
+	m := &OfflineManager{unzipDir: unzipDir}
+	require.NoError(t, m.CleanCache())
+	assert.NoDirExists(t, unzipTarget)
+	assert.NoDirExists(t, mountTarget)
+	// 不是lastore创建的内容保留
+	assert.DirExists(t, filepath.Join(unzipDir, "other"))
+	assert.DirExists(t, filepath.Join(mountDir, "other"))
+	assert.FileExists(t, filepath.Join(unzipDir, "keep"))
+}
+
+func TestOfflineCleanImports(t *testing.T) {
+	unzipDir := t.TempDir()
+	oldFallback := fallbackUnzipOupDirs
+	oldMountDir := system.OfflineMountFsDir
+	fallbackUnzipOupDirs = nil
+	system.OfflineMountFsDir = t.TempDir()
+	defer func() {
+		fallbackUnzipOupDirs = oldFallback
+		system.OfflineMountFsDir = oldMountDir
+	}()
+
+	own := filepath.Join(unzipDir, getUnzipName("/tmp/a.oup"))
+	other := filepath.Join(unzipDir, getUnzipName("/tmp/b.oup"))
+	busy := filepath.Join(unzipDir, getUnzipName("/tmp/c.oup"))
+	for _, dir := range []string{own, getMountDir(own), other, getMountDir(other), busy} {
+		require.NoError(t, os.MkdirAll(dir, 0755))
+	}
+	unlock, err := lockOfflineImport(getUnzipName("/tmp/c.oup"))
+	require.NoError(t, err)
+	defer unlock()
+
+	m := &OfflineManager{unzipDir: unzipDir}
+	m.CleanImports([]string{"/tmp/a.oup", "/tmp/c.oup"})
+	assert.NoDirExists(t, own)
+	assert.NoDirExists(t, getMountDir(own))
+	// 其他导入和正在进行的导入不受影响
+	assert.DirExists(t, other)
+	assert.DirExists(t, getMountDir(other))
+	assert.DirExists(t, busy)
+}
+
+func Test_createUpdateSourceJob(t *testing.T) {
+	cfg := &config.Config{}
+	sourceDir := t.TempDir()
+	var gotType system.UpdateType
+	unrefCount := 0
+	sourcePath := sourceDir
+	m := &Manager{
+		config:     cfg,
+		updater:    &Updater{config: cfg},
+		jobManager: NewJobManager(nil, apt.NewSystem(nil, nil), nil),
+		sourceWrapper: func(updateType system.UpdateType, doRealAction func(path string, unref func()) error) error {
+			gotType = updateType
+			return doRealAction(sourcePath, func() { unrefCount++ })
+		},
+	}
+
+	job, err := m.createUpdateSourceJob(nil)
+	require.NoError(t, err)
+	require.NotNil(t, job)
+	assert.Equal(t, system.AllCheckUpdate, gotType)
+	assert.Equal(t, "/dev/null", job.option["Dir::Etc::SourceList"])
+	assert.Equal(t, sourceDir, job.option["Dir::Etc::SourceParts"])
+	// 组合仓库在job结束前不能释放
+	assert.Equal(t, 0, unrefCount)
+
+	// job已存在时直接释放组合仓库
+	_, err = m.createUpdateSourceJob(nil)
+	assert.Equal(t, JobExistError, err)
+	assert.Equal(t, 1, unrefCount)
+
+	require.NoError(t, job.getPreHook(string(system.EndStatus))())
+	assert.Equal(t, 2, unrefCount)
+	require.NoError(t, m.jobManager.removeJob(job.Id, job.queueName))
+
+	// 只开启安全更新时使用安全仓库,仓库为文件
+	m.UpdateMode = system.SecurityUpdate
+	sourcePath = filepath.Join(sourceDir, "security.list")
+	require.NoError(t, os.WriteFile(sourcePath, nil, 0644))
+	job, err = m.createUpdateSourceJob(nil)
+	require.NoError(t, err)
+	assert.Equal(t, system.SecurityUpdate, gotType)
+	assert.Equal(t, sourcePath, job.option["Dir::Etc::SourceList"])
+	assert.Equal(t, "/dev/null", job.option["Dir::Etc::SourceParts"])
+	require.NoError(t, job.getPreHook(string(system.EndStatus))())
+	assert.Equal(t, 3, unrefCount)
+	require.NoError(t, m.jobManager.removeJob(job.Id, job.queueName))
+
+	// 仓库路径不存在时不创建job参数并释放组合仓库
+	sourcePath = filepath.Join(sourceDir, "missing")
+	_, err = m.createUpdateSourceJob(nil)
+	assert.Error(t, err)
+	assert.Equal(t, 4, unrefCount)
+}
+
+func Test_sourceDirLinks(t *testing.T) {
+	dir := t.TempDir()
+	assert.Empty(t, sourceDirLinks(filepath.Join(dir, "missing")))
+
+	require.NoError(t, os.Symlink("/etc/apt/sources.list.d/a.list", filepath.Join(dir, "a.list")))
+	before := sourceDirLinks(dir)
+	assert.Equal(t, map[string]string{"a.list": "/etc/apt/sources.list.d/a.list"}, before)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "a.list")))
+	require.NoError(t, os.Symlink("/etc/apt/sources.list.d/b.list", filepath.Join(dir, "a.list")))
+	assert.NotEqual(t, before, sourceDirLinks(dir))
+}
+
+func Test_reconfigureSourcesInvalid(t *testing.T) {
+	m := &Manager{config: &config.Config{}}
+	_, err := m.reconfigureSources([]string{"relative.list"}, nil, nil)
+	assert.Error(t, err)
+	_, err = m.reconfigureSources(nil, []string{"/etc/apt/sources.list.d/a.list"}, nil)
+	assert.Error(t, err)
+	_, err = m.reconfigureSources(nil, nil, []string{"/etc/apt/../a.list"})
+	assert.Error(t, err)
+	_, err = m.reconfigureSources(nil, nil, []string{"/etc/apt/sources.list.d/a.sources"})
+	assert.Error(t, err)
+	assert.NoError(t, validateSourceFiles([]string{"/etc/apt/sources.list.d/a.list"}, true))
+	assert.NoError(t, validateSourceFiles([]string{"a.list"}, false))
+}
+
+func Test_listUpgradablePackages(t *testing.T) {
+	origin := getUpgradablePackageList
+	defer func() {
+		getUpgradablePackageList = origin
+	}()
+	var mu sync.Mutex
+	var called []system.UpdateType
+	fake := func(t system.UpdateType, install []string, removed []string) func(map[string]string, string, []string) (apt.DistUpgradeResult, error) {
+		return func(map[string]string, string, []string) (apt.DistUpgradeResult, error) {
+			mu.Lock()
+			called = append(called, t)
+			mu.Unlock()
+			return apt.DistUpgradeResult{Packages: install, Removed: removed}, nil
+		}
+	}
+	getUpgradablePackageList = map[system.UpdateType]func(map[string]string, string, []string) (apt.DistUpgradeResult, error){
+		system.SystemUpdate:   fake(system.SystemUpdate, []string{"dde-dock"}, []string{"deepin-old-tool"}),
+		system.SecurityUpdate: fake(system.SecurityUpdate, []string{"openssl"}, nil),
+		system.UnknownUpdate:  fake(system.UnknownUpdate, []string{"foo"}, nil),
+	}
+	cfg := &config.Config{}
+	m := &Manager{config: cfg, updater: &Updater{config: cfg}}
+	// UpdateMode只开启系统更新时仍可以获取安全更新
+	m.UpdateMode = system.SystemUpdate
+	pkgMap, removedMap, errList := m.listUpgradablePackages(system.SecurityUpdate)
+	assert.Empty(t, errList)
+	assert.Equal(t, map[string][]string{system.SecurityUpgradeJobType: {"openssl"}}, pkgMap)
+	assert.Empty(t, removedMap)
+	assert.Equal(t, []system.UpdateType{system.SecurityUpdate}, called)
+	assert.Equal(t, system.SystemUpdate, m.UpdateMode)
+
+	pkgMap, removedMap, errList = m.listUpgradablePackages(system.SystemUpdate | system.UnknownUpdate)
+	assert.Empty(t, errList)
+	assert.Equal(t, []string{"dde-dock"}, pkgMap[system.SystemUpgradeJobType])
+	assert.Equal(t, []string{"foo"}, pkgMap[system.UnknownUpgradeJobType])
+	assert.Equal(t, map[string][]string{system.SystemUpgradeJobType: {"deepin-old-tool"}}, removedMap)
+}
+
+func Test_downloadSpaceShortfall(t *testing.T) {
+	assert.Nil(t, downloadSpaceShortfall(0))
+	assert.Nil(t, downloadSpaceShortfall(1))
+	shortfall := downloadSpaceShortfall(1 << 62)
+	require.NotNil(t, shortfall)
+	assert.Equal(t, float64(1<<62), shortfall.Need)
+	assert.Equal(t, shortfall.Need-shortfall.Free, shortfall.Short)
+}
+
+func Test_lowSpaceCategories(t *testing.T) {
+	spaceMap := map[string]int64{
+		system.SystemUpgradeJobType:   2000,
+		system.SecurityUpgradeJobType: 500,
+		system.UnknownUpgradeJobType:  -3000,
+	}
+	assert.Equal(t, []string{system.SystemUpgradeJobType}, lowSpaceCategories(spaceMap, 1000))
+	assert.Empty(t, lowSpaceCategories(spaceMap, 2000))
+	assert.Equal(t, []string{system.SecurityUpgradeJobType, system.SystemUpgradeJobType}, lowSpaceCategories(spaceMap, 0))
+}
+
+func Test_spaceDeltaOf(t *testing.T) {
+	spaceMap := map[string]int64{
+		system.SystemUpgradeJobType:  2000,
+		system.UnknownUpgradeJobType: -3000,
+	}
+	assert.Equal(t, int64(-1000), spaceDeltaOf(spaceMap, system.SystemUpdate|system.SecurityUpdate|system.UnknownUpdate))
+	assert.Equal(t, int64(2000), spaceDeltaOf(spaceMap, system.SystemUpdate|system.SecurityUpdate))
+	assert.Equal(t, int64(0), spaceDeltaOf(spaceMap, system.SecurityUpdate))
+	assert.Equal(t, int64(0), spaceDeltaOf(nil, system.SystemUpdate))
+}
+
+func Test_verifyHelperBin(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "helper")
+	require.NoError(t, os.WriteFile(bin, []byte("#!/bin/sh\n"), 0755))
+	link := filepath.Join(dir, "helper-link")
+	require.NoError(t, os.Symlink(bin, link))
+	uid := uint32(os.Getuid())
+	sum, err := fileSha256(bin, nil)
+	require.NoError(t, err)
+
+	resolved, err := verifyHelperBin(link, nil, uid)
+	require.NoError(t, err)
+	assert.Equal(t, bin, resolved)
+
+	pinned := parsePinnedHelperHashes([]string{sum + "  " + link, "invalid", "abc /usr/bin/ar"})
+	assert.Equal(t, map[string]string{link: sum}, pinned)
+	_, err = verifyHelperBin(link, pinned, uid)
+	assert.NoError(t, err)
+
+	// 内容被替换后校验失败
+	require.NoError(t, os.WriteFile(bin, []byte("#!/bin/sh\nexit 0\n"), 0755))
+	_, err = verifyHelperBin(link, pinned, uid)
+	assert.Error(t, err)
+
+	// 其他用户可写的程序不能执行
+	require.NoError(t, os.Chmod(bin, 0777))
+	_, err = verifyHelperBin(bin, nil, uid)
+	assert.Error(t, err)
+
+	_, err = verifyHelperBin(filepath.Join(dir, "missing"), nil, uid)
+	assert.Error(t, err)
+}
+
+func Test_shouldNotifyDownloadReady(t *testing.T) {
+	cfg := &config.Config{DownloadReadyNotify: true}
+	m := &Manager{config: cfg, updatePlatform: &updateplatform.UpdatePlatformManager{}}
+	assert.True(t, m.shouldNotifyDownloadReady(true, false))
+	// 用户主动下载时已经知道下载完成
+	assert.False(t, m.shouldNotifyDownloadReady(false, false))
+	// 仅下载策略不发送通知
+	assert.False(t, m.shouldNotifyDownloadReady(true, true))
+	// 强制更新会直接安装
+	m.updatePlatform.UpdateNowForce = true
+	assert.False(t, m.shouldNotifyDownloadReady(true, false))
+	m.updatePlatform.UpdateNowForce = false
+	cfg.DownloadReadyNotify = false
+	assert.False(t, m.shouldNotifyDownloadReady(true, false))
+	assert.False(t, m.isSelfSender(":1.1"))
+}
+
+func Test_getUpdateSourceAptOption(t *testing.T) {
+	u := &Updater{config: &config.Config{DownloadPipelineDepth: -1}, PDiffsEnabled: true}
+	assert.Equal(t, map[string]string{"Acquire::PDiffs": "true"}, u.getUpdateSourceAptOption())
+	u.PDiffsEnabled = false
+	u.config.DownloadQueueMode = "host"
+	assert.Equal(t, map[string]string{"Acquire::PDiffs": "false", "Acquire::Queue-Mode": "host"}, u.getUpdateSourceAptOption())
+}
+
+func TestJobAptOption(t *testing.T) {
+	defer setExtraAptOptions(nil)
+	j := &Job{Type: system.PrepareDistUpgradeJobType, option: map[string]string{"Acquire::Retries": "1"}}
+	assert.Equal(t, j.option, jobAptOption(j))
+
+	setExtraAptOptions(map[string]map[string]string{
+		extraAptOptionsAll: {"Acquire::http::Proxy": "http://proxy:3128", "Acquire::Retries": "3"},
+		system.PrepareDistUpgradeJobType: {
+			"Acquire::http::Timeout": "30",
+			"Dir::Etc::SourceList":   "/tmp/sources.list",
+		},
+	})
+	assert.Equal(t, map[string]string{
+		"Acquire::http::Proxy":   "http://proxy:3128",
+		"Acquire::http::Timeout": "30",
+		"Acquire::Retries":       "1",
+	}, jobAptOption(j))
+	// 任务自身的参数不被修改
+	assert.Equal(t, map[string]string{"Acquire::Retries": "1"}, j.option)
+
+	j = &Job{Type: system.DistUpgradeJobType}
+	assert.Equal(t, map[string]string{
+		"Acquire::http::Proxy": "http://proxy:3128",
+		"Acquire::Retries":     "3",
+	}, jobAptOption(j))
+}
+
+func Test_reinstallPackagesInvalid(t *testing.T) {
+	m := &Manager{config: &config.Config{}}
+	_, err := m.reinstallPackages("", nil)
+	assert.Error(t, err)
+	_, err = m.reinstallPackages("", []string{"foo;rm -rf /"})
+	assert.Error(t, err)
+	_, err = m.reinstallPackages("", []string{"lastore-test-not-installed"})
+	assert.ErrorContains(t, err, "not installed")
+}
+
+func TestCategoryProgress(t *testing.T) {
+	assert.Nil(t, newCategoryProgress(map[string][]string{
+		system.SystemUpdate.JobType(): {"dde-dock"},
+	}))
+
+	c := newCategoryProgress(map[string][]string{
+		system.SystemUpdate.JobType():   {"dde-dock", "libc6"},
+		system.SecurityUpdate.JobType(): {"libc6", "openssl"},
+	})
+	require.NotNil(t, c)
+	assert.False(t, c.update("dpkg-exec", "Running dpkg"))
+
+	assert.True(t, c.update("libc6", "Unpacking libc6 (amd64)"))
+	assert.Equal(t, map[string]float64{
+		system.SystemUpdate.JobType():   0.25,
+		system.SecurityUpdate.JobType(): 0.25,
+	}, c.progress())
+
+	assert.True(t, c.update("libc6", "Installed libc6 (amd64)"))
+	assert.True(t, c.update("openssl", "Installed openssl (amd64)"))
+	// 完成后再次出现的状态不会降低进度
+	assert.True(t, c.update("openssl", "Preparing to configure openssl (amd64)"))
+	assert.Equal(t, map[string]float64{
+		system.SystemUpdate.JobType():   0.5,
+		system.SecurityUpdate.JobType(): 1,
+	}, c.progress())
+}
+
+func Test_missingDebVersions(t *testing.T) {
+	out := []byte("Package: dde-dock\nVersion: 5.6.0\nPriority: optional\nDescription: deepin desktop dock\n" +
+		"\nPackage: libc6\nVersion: 2.36-9\n\n")
+	assert.Equal(t, []string{"dde-dock=5.5.0", "foo;rm -rf /", "$(touch pwned)"},
+		missingDebVersions([]string{"dde-dock=5.6.0", "dde-dock=5.5.0", "libc6:amd64=2.36-9", "libc6",
+			"foo;rm -rf /", "$(touch pwned)"}, out))
+	assert.Empty(t, missingDebVersions(nil, out))
+}
+
+func Test_checkDebExistWithVersion(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	proxyFile := filepath.Join(dir, "proxy")
+	script := "#!/bin/sh\necho \"$http_proxy\" > " + proxyFile + "\n" +
+		"for a in \"$@\"; do printf '%s\\n' \"$a\" >> " + argsFile + "; done\n" +
+		"printf 'Package: dde-dock\\nVersion: 5.6.0\\n\\n'\nexit 100\n"
+	fakeApt := filepath.Join(dir, "apt")
+	require.NoError(t, os.WriteFile(fakeApt, []byte(script), 0755))
+	origin := aptBin
+	aptBin = fakeApt
+	defer func() { aptBin = origin }()
+
+	pwned := filepath.Join(dir, "pwned")
+	pkgs := []string{"dde-dock=5.6.0", "$(touch " + pwned + ")", "foo;touch " + pwned, "`touch " + pwned + "`", "-o=APT::Foo"}
+	missing, err := checkDebExistWithVersion(map[string]string{"http_proxy": "http://127.0.0.1:8080"}, pkgs)
+	require.NoError(t, err)
+	assert.Equal(t, pkgs[1:], missing)
+	proxy, err := os.ReadFile(proxyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:8080\n", string(proxy))
+
+	// 包名原样作为单独的参数传递,不经过shell展开
+	data, err := os.ReadFile(argsFile)
+	require.NoError(t, err)
+	assert.Equal(t, append([]string{"show", "--"}, pkgs...), strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"))
+	assert.NoFileExists(t, pwned)
+}
+
+func Test_newPreferencesParts(t *testing.T) {
+	originRoot, originSystem := preferencesPartsRoot, systemPreferencesParts
+	preferencesPartsRoot = filepath.Join(t.TempDir(), "preferences")
+	systemPreferencesParts = t.TempDir()
+	defer func() { preferencesPartsRoot, systemPreferencesParts = originRoot, originSystem }()
+	require.NoError(t, os.WriteFile(filepath.Join(systemPreferencesParts, "admin"), []byte("Package: foo\n"), 0644))
+
+	dir, err := newPreferencesParts(nil)
+	require.NoError(t, err)
+	assert.Empty(t, dir)
+
+	dir, err = newPreferencesParts([]string{"bar", "baz"})
+	require.NoError(t, err)
+	assert.Equal(t, preferencesPartsRoot, filepath.Dir(dir))
+	// 保留系统配置片段,阻止安装的配置只写在任务自己的目录中
+	content, err := os.ReadFile(filepath.Join(dir, "admin"))
+	require.NoError(t, err)
+	assert.Equal(t, "Package: foo\n", string(content))
+	content, err = os.ReadFile(filepath.Join(dir, blockPreferencesName))
+	require.NoError(t, err)
+	assert.Equal(t, "Package: bar baz\nPin: version *\nPin-Priority: -1\n", string(content))
+	entries, err := os.ReadDir(systemPreferencesParts)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	removePreferencesParts(systemPreferencesParts)
+	assert.DirExists(t, systemPreferencesParts)
+	removePreferencesParts(dir)
+	assert.NoDirExists(t, dir)
+}
@@ -332,8 +332,9 @@ func (m *Manager) getNextIdleUnitDelay() (time.Duration, time.Duration) {
 	m.PropsMu.RLock()
 	defer m.PropsMu.RUnlock()
 	m.updater.PropsMu.RLock()
-	beginDur := getCustomTimeDuration(m.updater.idleDownloadConfigObj.BeginTime)
-	endDur := getCustomTimeDuration(m.updater.idleDownloadConfigObj.EndTime)
+	now := m.updater.idleDownloadConfigObj.now()
+	beginDur := getCustomTimeDuration(m.updater.idleDownloadConfigObj.BeginTime, now)
+	endDur := getCustomTimeDuration(m.updater.idleDownloadConfigObj.EndTime, now)
 	m.updater.PropsMu.RUnlock()
 	defer func() {
 		logger.Debug("auto download begin time duration:", beginDur)
@@ -393,6 +394,16 @@ func (m *Manager) startCheckPolicyTask() {
 }
 
 func (m *Manager) handleAutoDownload() {
+	if m.updater.getStagingPolicy() == config.StagingPolicyOff {
+		logger.Info("staging policy is off, skip idle download")
+		return
+	}
+	m.PropsMu.RLock()
+	mode := m.CheckUpdateMode
+	m.PropsMu.RUnlock()
+	if m.deferDownloadOnBattery(mode) {
+		return
+	}
 	_, err := m.PrepareDistUpgrade(dbus.Sender(m.service.Conn().Names()[0]))
 	if err != nil {
 		logger.Warning(err)
@@ -452,7 +463,10 @@ func (m *Manager) handleSystemEvent(sender dbus.Sender, eventType string) error
 		go updateplatform.UpdateTokenConfigFile(m.config.IncludeDiskInfo)
 	case AutoDownload:
 		if m.updater.getIdleDownloadEnabled() { // 如果自动下载关闭,则空闲下载同样会关闭
-			m.handleAutoDownload()
+			// 定时器每天触发,不在允许的星期内时只更新定时器
+			if m.updater.inIdleDownloadWindow() {
+				m.handleAutoDownload()
+			}
 			go func() {
 				m.resetIdleDownload = false
 				err := m.updateAutoDownloadTimer()
@@ -3,43 +3,62 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/godbus/dbus/v5"
-	"github.com/linuxdeepin/go-lib/gettext"
+	"github.com/linuxdeepin/go-lib/strv"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/config"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system/apt"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/updateplatform"
-	debVersion "pault.ag/go/debian/version"
 )
 
-func prepareUpdateSource() {
-	partialFilePaths := []string{
-		"/var/lib/apt/lists/partial",
-		"/var/lib/lastore/lists/partial",
-		"/var/cache/apt/archives/partial",
-		"/var/cache/lastore/archives/partial",
-	}
-	for _, partialFilePath := range partialFilePaths {
+var partialFilePaths = []string{
+	"/var/lib/apt/lists/partial",
+	"/var/lib/lastore/lists/partial",
+	"/var/cache/apt/archives/partial",
+	"/var/cache/lastore/archives/partial",
+}
+
+// prepareUpdateSource 清理未下载完成的文件,较新的文件保留用于断点续传,purgeAll为true或maxAge<=0时全部清理
+func prepareUpdateSource(maxAge time.Duration, purgeAll bool) {
+	cleanPartialFiles(partialFilePaths, maxAge, purgeAll, time.Now())
+}
+
+func cleanPartialFiles(dirs []string, maxAge time.Duration, purgeAll bool, now time.Time) {
+	for _, partialFilePath := range dirs {
+		// 取消检查更新时移出的文件不能用于断点续传,直接清理
+		err := os.RemoveAll(system.AbortedPartialDir(partialFilePath))
+		if err != nil {
+			logger.Warning(err)
+		}
 		infos, err := os.ReadDir(partialFilePath)
 		if err != nil {
 			continue
 		}
 		for _, info := range infos {
+			if !purgeAll && maxAge > 0 {
+				fileInfo, err := info.Info()
+				if err == nil && now.Sub(fileInfo.ModTime()) <= maxAge {
+					continue
+				}
+			}
 			err = os.RemoveAll(filepath.Join(partialFilePath, info.Name()))
 			if err != nil {
 				logger.Warning(err)
 			}
 		}
 	}
-
 }
 
 // updateSource 检查更新主要步骤:1.从更新平台获取数据并解析;2.apt update;3.最终可更新内容确定(模拟安装的方式);4.数据上报;
@@ -50,6 +69,9 @@ func (m *Manager) updateSource(sender dbus.Sender) (*Job, error) {
 	if !system.IsAuthorized() {
 		return nil, errors.New("not authorized, don't allow to exec update")
 	}
+	if m.isOfflineMode() {
+		return nil, errors.New("offline repo is active, leave offline mode before checking online updates")
+	}
 	defer func() {
 		if err == nil {
 			err1 := m.config.UpdateLastCheckTime()
@@ -66,51 +88,60 @@ func (m *Manager) updateSource(sender dbus.Sender) (*Job, error) {
 	if err != nil {
 		return nil, err
 	}
-	prepareUpdateSource()
+	m.PropsMu.Lock()
+	purgePartial := m.purgePartialFiles
+	m.purgePartialFiles = false
+	m.PropsMu.Unlock()
+	prepareUpdateSource(m.config.PartialFileMaxAge, purgePartial)
 	m.reloadOemConfig(true)
 	m.updatePlatform.Token = updateplatform.UpdateTokenConfigFile(m.config.IncludeDiskInfo)
 	m.jobManager.dispatch() // 解决 bug 59351问题（防止CreatJob获取到状态为end但是未被删除的job）
+	var job *Job
+	job, err = m.createUpdateSourceJob(environ)
+	if err != nil && !errors.Is(err, JobExistError) { // exist的err无需返回
+		logger.Warning(err)
+		return nil, err
+	}
+	return job, nil
+}
+
+// createUpdateSourceJob 组合检查更新的仓库并创建检查更新的job,组合仓库在job结束时释放
+func (m *Manager) createUpdateSourceJob(environ map[string]string) (*Job, error) {
 	var job *Job
 	var isExist bool
-	err = system.CustomSourceWrapper(system.AllCheckUpdate, func(path string, unref func()) error {
+	var err error
+	err = system.SourceWrapperWithHold(m.getSourceWrapper(), checkUpdateSourceType(m.getUpdateMode()), func(path string, hold func() func()) error {
 		m.do.Lock()
 		defer m.do.Unlock()
 		isExist, job, err = m.jobManager.CreateJob("", system.UpdateSourceJobType, nil, environ, nil)
 		if err != nil {
 			logger.Warningf("UpdateSource error: %v\n", err)
-			if unref != nil {
-				unref()
-			}
 			return err
 		}
 		if isExist {
-			if unref != nil {
-				unref()
-			}
 			logger.Info(JobExistError)
 			return JobExistError
 		}
 		// 设置apt命令参数
-		info, err := os.Stat(path)
+		job.option, err = sourceListOption(path)
 		if err != nil {
-			if unref != nil {
-				unref()
-			}
 			return err
 		}
-		if info.IsDir() {
-			job.option = map[string]string{
-				"Dir::Etc::SourceList":  "/dev/null",
-				"Dir::Etc::SourceParts": path,
-			}
-		} else {
-			job.option = map[string]string{
-				"Dir::Etc::SourceList":  path,
-				"Dir::Etc::SourceParts": "/dev/null",
-			}
+		// 仓库在job结束时释放
+		release := hold()
+		// 重试时会重新设置参数,使用普通方式检查
+		downloadOption := m.updater.getUpdateSourceAptOption()
+		for k, v := range downloadOption {
+			job.option[k] = v
 		}
+		if m.config.ParallelUpdateSource {
+			job.option[system.ParallelUpdateSourceKey] = "true"
+		}
+		retryPolicy := newUpdateSourceRetryPolicy(m.config)
+		job.retry = retryPolicy.maxRetry
+		job.retryDelayFn = retryPolicy.retryDelay
 		job.subRetryHookFn = func(j *Job) {
-			handleUpdateSourceFailed(j)
+			handleUpdateSourceFailed(m.getSourceWrapper(), j, retryPolicy.prepareRetry(j), downloadOption)
 		}
 		job.setPreHooks(map[string]func() error{
 			string(system.RunningStatus): func() error {
@@ -119,23 +150,59 @@ func (m *Manager) updateSource(sender dbus.Sender) (*Job, error) {
 				return nil
 			},
 			string(system.SucceedStatus): func() error {
+				m.refreshUpdateInfosMu.Lock()
 				m.refreshUpdateInfos(true)
+				m.updater.PropsMu.RLock()
+				classified := m.updater.ClassifiedUpdatablePackages
+				m.updater.PropsMu.RUnlock()
+				err := m.exportUpdatable(classified)
+				if err != nil {
+					logger.Warning("write updatable export failed:", err)
+				}
+				m.refreshUpdateInfosMu.Unlock()
+				attempt := job.getAttempt()
+				m.updater.setLastCheckResult(true, "", attempt)
 				m.PropsMu.Lock()
 				m.updateSourceOnce = true
+				m.updateSourceDoneTime = time.Now()
 				m.PropsMu.Unlock()
-				if len(m.UpgradableApps) > 0 {
-					go m.reportLog(updateStatusReport, true, "")
+				// 检查更新成功说明网络已恢复,重试之前上报失败的消息
+				go m.updatePlatform.RetryPendingReports()
+				var warning string
+				job.PropsMu.RLock()
+				if job.PlatformDowngrades != "" {
+					warning = "platform downgrades: " + job.PlatformDowngrades
+				}
+				job.PropsMu.RUnlock()
+				m.PropsMu.RLock()
+				upgradableApps := append([]string(nil), m.UpgradableApps...)
+				m.PropsMu.RUnlock()
+				if len(upgradableApps) == 0 {
+					// 没有可更新的包时不显示更新目标
+					m.updater.setUpdateTarget("")
+				}
+				if len(upgradableApps) > 0 {
+					go m.reportLogInfo(updateStatusReport, reportLogInfo{Result: true, Reason: warning, Attempt: attempt})
 					// 开启自动下载时触发自动下载,发自动下载通知,不发送可更新通知;
 					// 关闭自动下载时,发可更新的通知;
-					if !m.updater.AutoDownloadUpdates {
+					dismissal := parseUpdateNotifyDismissal(m.config.UpdateNotifyDismissed)
+					if !dismissal.allowUpdateNotify(upgradableApps, m.config.UpdateNotifyDismissCooldown, time.Now()) {
+						logger.Info("new version notification was dismissed recently, skip it")
+					} else if !m.updater.AutoDownloadUpdates {
 						// msg := gettext.Tr("New system edition available")
-						msg := gettext.Tr("New version available!")
-						action := []string{"view", gettext.Tr("View")}
+						msg := m.Tr("New version available!")
+						action := []string{"view", m.Tr("View")}
 						hints := map[string]dbus.Variant{"x-deepin-action-view": dbus.MakeVariant("dde-control-center,-m,update")}
-						go m.sendNotify(updateNotifyShowOptional, 0, "preferences-system", "", msg, action, hints, system.NotifyExpireTimeoutDefault)
+						go func() {
+							// 可更新内容没有变化时不重复提醒
+							id := m.sendThrottledNotify(strings.Join(upgradableApps, ","), updateNotifyShowOptional, "preferences-system", "", msg, action, hints, system.NotifyExpireTimeoutDefault)
+							if id != 0 {
+								m.updateNotify.set(id, upgradableApps)
+							}
+						}()
 					}
 				} else {
-					go m.reportLog(updateStatusReport, false, "")
+					go m.reportLogInfo(updateStatusReport, reportLogInfo{Result: false, Reason: warning, Attempt: attempt})
 				}
 				go func() {
 					m.inhibitAutoQuitCountAdd()
@@ -150,16 +217,31 @@ func (m *Manager) updateSource(sender dbus.Sender) (*Job, error) {
 				// 网络问题检查更新失败和空间不足下载索引失败,需要发通知
 				var errorContent system.JobError
 				err = json.Unmarshal([]byte(job.Description), &errorContent)
+				lastCheckErr := system.ErrorUnknown
+				if err == nil && errorContent.ErrType != "" {
+					lastCheckErr = errorContent.ErrType
+				}
+				m.updater.setLastCheckResult(false, lastCheckErr.String(), job.getAttempt())
 				if err == nil {
-					if strings.Contains(errorContent.ErrType.String(), system.ErrorFetchFailed.String()) || strings.Contains(errorContent.ErrType.String(), system.ErrorIndexDownloadFailed.String()) {
-						msg := gettext.Tr("Failed to check for updates. Please check your network.")
-						action := []string{"view", gettext.Tr("View")}
+					// 文件损坏时,下次检查更新需要清理全部未下载完成的文件
+					if errorContent.ErrType == system.ErrorDamagePackage {
+						m.PropsMu.Lock()
+						m.purgePartialFiles = true
+						m.PropsMu.Unlock()
+					}
+					switch errorContent.ErrType {
+					case system.ErrorIndexNotFound, system.ErrorReleaseExpired:
+						msg := m.Tr("Failed to check for updates. Please check your repository settings.")
+						go m.sendThrottledNotify("", updateNotifyShowOptional, "preferences-system", "", msg, nil, nil, system.NotifyExpireTimeoutDefault)
+					case system.ErrorFetchFailed, system.ErrorIndexDownloadFailed, system.ErrorIndexNetworkFailed:
+						msg := m.Tr("Failed to check for updates. Please check your network.")
+						action := []string{"view", m.Tr("View")}
 						hints := map[string]dbus.Variant{"x-deepin-action-view": dbus.MakeVariant("dde-control-center,-m,network")}
-						go m.sendNotify(updateNotifyShowOptional, 0, "preferences-system", "", msg, action, hints, system.NotifyExpireTimeoutDefault)
+						go m.sendThrottledNotify("", updateNotifyShowOptional, "preferences-system", "", msg, action, hints, system.NotifyExpireTimeoutDefault)
 					}
 					if strings.Contains(errorContent.ErrType.String(), system.ErrorInsufficientSpace.String()) {
-						msg := gettext.Tr("Failed to check for updates. Please clean up your disk first.")
-						go m.sendNotify(updateNotifyShowOptional, 0, "preferences-system", "", msg, nil, nil, system.NotifyExpireTimeoutDefault)
+						msg := m.Tr("Failed to check for updates. Please clean up your disk first.")
+						go m.sendThrottledNotify("", updateNotifyShowOptional, "preferences-system", "", msg, nil, nil, system.NotifyExpireTimeoutDefault)
 					}
 				}
 				// 发通知 end
@@ -173,20 +255,26 @@ func (m *Manager) updateSource(sender dbus.Sender) (*Job, error) {
 			},
 			string(system.EndStatus): func() error {
 				// wrapper的资源释放
-				if unref != nil {
-					unref()
-				}
+				release()
 				return nil
 			},
 		})
 		job.setAfterHooks(map[string]func() error{
 			string(system.RunningStatus): func() error {
 				job.setPropProgress(0.01)
+				// 更新平台的请求使用进程的环境变量,apt命令通过system.AptCommand使用任务environ中的代理
 				_ = os.Setenv("http_proxy", environ["http_proxy"])
 				_ = os.Setenv("https_proxy", environ["https_proxy"])
 				// 检查任务开始后,从更新平台获取仓库、更新注记等信息
 				// 从更新平台获取数据:系统更新和安全更新流程都包含
-				err = m.updatePlatform.GenUpdatePolicyByToken(true)
+				// 必须使用更新平台时,请求失败先按退避重试,重试用尽后才终止检查且不再进行apt的重试
+				platformRetry := 0
+				if m.config.PlatformUpdate {
+					platformRetry = m.config.PlatformRetryCount
+				}
+				err = retryPlatformRequest("get update policy by token", platformRetry, m.config.PlatformRetryDelay, func() error {
+					return m.updatePlatform.GenUpdatePolicyByToken(true)
+				}, time.Sleep)
 				if err != nil {
 					if m.config.PlatformUpdate {
 						job.retry = 0
@@ -200,7 +288,8 @@ func (m *Manager) updateSource(sender dbus.Sender) (*Job, error) {
 					}
 				}
 
-				err = m.updatePlatform.UpdateAllPlatformDataSync()
+				err = retryPlatformRequest("get update info by update platform", platformRetry, m.config.PlatformRetryDelay,
+					m.updatePlatform.UpdateAllPlatformDataSync, time.Sleep)
 				if err != nil {
 					logger.Warning(err)
 					if m.config.PlatformUpdate {
@@ -213,7 +302,29 @@ func (m *Manager) updateSource(sender dbus.Sender) (*Job, error) {
 						return nil
 					}
 				}
-				m.updater.setPropUpdateTarget(m.updatePlatform.GetUpdateTarget()) // 更新目标 历史版本控制中心获取UpdateTarget,获取更新日志
+				m.updater.setUpdateTarget(m.updatePlatform.GetUpdateTarget()) // 更新目标 历史版本控制中心获取UpdateTarget,获取更新日志
+				if m.config.PlatformDowngradeStrict {
+					// 平台数据配置错误时只作为警告,不影响检查更新
+					downgrades := m.updatePlatform.TargetDowngrades()
+					if len(downgrades) > 0 {
+						content, _ := json.Marshal(downgrades)
+						logger.Warning("update platform target versions are lower than installed:", string(content))
+						job.PropsMu.Lock()
+						job.setPropPlatformDowngrades(string(content))
+						job.PropsMu.Unlock()
+					}
+				}
+
+				// 从更新平台获取数据后,在6%-10%阶段检查依赖关系,系统处于无法更新的状态时终止检查更新
+				job.setPropProgress(0.06)
+				err = apt.CheckSystemHealth(environ, system.QuickCheckSystem, func(progress float64) {
+					job.setPropProgress(0.06 + progress*0.04)
+				})
+				if err != nil {
+					logger.Warning("check system failed:", err)
+					job.retry = 0
+					return err
+				}
 
 				// 从更新平台获取数据并处理完成后,进度更新到10%
 				job.setPropProgress(0.10)
@@ -223,65 +334,140 @@ func (m *Manager) updateSource(sender dbus.Sender) (*Job, error) {
 
 		if err = m.jobManager.addJob(job); err != nil {
 			logger.Warning(err)
-			if unref != nil {
-				unref()
-			}
 			return err
 		}
 		return nil
 	})
-	if err != nil && !errors.Is(err, JobExistError) { // exist的err无需返回
-		logger.Warning(err)
-		return nil, err
-	}
-	return job, nil
+	return job, err
 }
 
-// 暂时废弃获取可更新列表的详细信息
-var getUpgradablePackageListMap = map[system.UpdateType]func([]string) (map[string]system.PackageInfo, map[string]system.PackageInfo, error){
+// 获取可更新列表的详细信息,目前只用于合并各分类的可更新包
+var getUpgradablePackageListMap = map[system.UpdateType]func(map[string]string, string, []string) (map[string]system.PackageInfo, map[string]system.PackageInfo, error){
 	system.SystemUpdate:   getSystemUpgradablePackagesMap,
 	system.SecurityUpdate: getSecurityUpgradablePackagesMap,
 	system.UnknownUpdate:  getUnknownUpgradablePackagesMap,
 }
 
-// 生成系统更新内容和安全更新内容
-func (m *Manager) generateUpdateInfo() (errList []error) {
-	propPkgMap := make(map[string][]string) // updater的ClassifiedUpdatablePackages用
-	var propPkgMapMu sync.Mutex
-	var errListMu sync.Mutex
-	appendErrorSafe := func(err error) {
-		errListMu.Lock()
-		errList = append(errList, err)
-		errListMu.Unlock()
+// sourceListOption 根据仓库路径是目录还是文件返回apt的仓库配置,path不存在时返回错误
+func sourceListOption(path string) (map[string]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
 	}
-	updatePropPkgMapSafe := func(t string, packageList []string) {
-		propPkgMapMu.Lock()
-		propPkgMap[t] = packageList
-		propPkgMapMu.Unlock()
+	if info.IsDir() {
+		return map[string]string{
+			"Dir::Etc::SourceList":  "/dev/null",
+			"Dir::Etc::SourceParts": path,
+		}, nil
 	}
+	return map[string]string{
+		"Dir::Etc::SourceList":  path,
+		"Dir::Etc::SourceParts": "/dev/null",
+	}, nil
+}
 
-	var wg sync.WaitGroup
-	for updateType, getFn := range getUpgradablePackageList {
-		wg.Add(1)
-		fn := getFn
-		t := updateType
-		go func() {
-			logger.Infof("start get %v upgradable package", t.JobType())
-			installList, err := fn(m.coreList)
-			if err != nil {
-				appendErrorSafe(err)
-			} else {
-				updatePropPkgMapSafe(t.JobType(), installList)
-			}
-			wg.Done()
-		}()
+// getSourceWrapper 返回组合仓库的实现,默认为system.CustomSourceWrapper,测试时可以替换
+func (m *Manager) getSourceWrapper() system.SourceWrapperFunc {
+	if m.sourceWrapper == nil {
+		return system.CustomSourceWrapper
+	}
+	return m.sourceWrapper
+}
+
+// checkUpdateSourceType 返回检查更新需要处理的仓库,UpdateMode只开启安全更新时只检查安全仓库,跳过耗时的系统更新模拟安装
+func checkUpdateSourceType(updateMode system.UpdateType) system.UpdateType {
+	if updateMode&system.AllInstallUpdate == system.SecurityUpdate {
+		return system.SecurityUpdate
+	}
+	return system.AllCheckUpdate
+}
+
+func (m *Manager) getUpdateMode() system.UpdateType {
+	m.PropsMu.RLock()
+	defer m.PropsMu.RUnlock()
+	return m.UpdateMode
+}
+
+// 生成系统更新内容和安全更新内容
+func (m *Manager) generateUpdateInfo() (errList []error) {
+	if m.isOfflineMode() {
+		// 离线仓库生效时可更新内容只来自挂载的离线仓库
+		err := m.offline.AfterUpdateOffline(m.proxyEnviron(), m.aptConfPath(), m.coreList)
+		if err != nil {
+			return []error{err}
+		}
+		return nil
+	}
+	propPkgMap, propRemovedMap, errList := m.listUpgradablePackages(checkUpdateSourceType(m.getUpdateMode()))
+	if propPkgMap == nil {
+		return errList
 	}
-	wg.Wait()
 	m.updater.setClassifiedUpdatablePackages(propPkgMap)
+	m.updater.setClassifiedRemovedPackages(propRemovedMap)
 	return
 }
 
-func getSystemUpgradablePackagesMap(coreList []string) (map[string]system.PackageInfo, map[string]system.PackageInfo, error) {
+// systemSourceArgs 只使用系统更新仓库的apt参数
+func systemSourceArgs() []string {
+	systemSource := system.GetCategorySourceMap()[system.SystemUpdate]
+	info, err := os.Stat(systemSource)
+	if err != nil {
+		return nil
+	}
+	if info.IsDir() {
+		return []string{
+			"-o", "Dir::Etc::sourcelist=/dev/null",
+			"-o", fmt.Sprintf("Dir::Etc::SourceParts=%v", systemSource),
+		}
+	}
+	return []string{
+		"-o", fmt.Sprintf("Dir::Etc::sourcelist=%v", systemSource),
+		"-o", "Dir::Etc::SourceParts=/dev/null",
+		"-o", "Dir::Etc::preferences=/dev/null", // 系统更新仓库来自更新平台，为了不收本地优先级配置影响，覆盖本地优先级配置
+		"-o", "Dir::Etc::PreferencesParts=/dev/null",
+	}
+}
+
+// validateCoreList 检查必装清单中更新平台指定的版本能否在系统仓库中找到,返回去掉无法解析的包后的清单.
+// 无法解析的包单独上报,不再交给模拟安装,防止整个模拟安装失败且无法定位原因
+func (m *Manager) validateCoreList(coreList []string) []string {
+	platformVersions := getCoreListVersionsFromCache()
+	pkgs := make(map[string]string)
+	for _, name := range coreList {
+		if version, ok := platformVersions[name]; ok {
+			pkgs[name] = version
+		}
+	}
+	unresolvable, err := apt.ListUnresolvableVersions(m.proxyEnviron(), m.aptConfPath(), pkgs, systemSourceArgs())
+	if err != nil {
+		logger.Warning("validate corelist versions failed:", err)
+		return coreList
+	}
+	if len(unresolvable) == 0 {
+		return coreList
+	}
+	jobErr := &system.JobError{
+		ErrType:   system.ErrorVersionNotFound,
+		ErrDetail: "corelist versions are not found in system repository: " + strings.Join(unresolvable, " "),
+		Packages:  unresolvable,
+	}
+	logger.Warning(jobErr.ErrDetail)
+	go func() {
+		m.inhibitAutoQuitCountAdd()
+		defer m.inhibitAutoQuitCountSub()
+		data, _ := json.Marshal(jobErr)
+		m.updatePlatform.PostStatusMessage(fmt.Sprintf("corelist has unresolvable versions, detail is: %s", data))
+	}()
+	var valid []string
+	for _, name := range coreList {
+		if !strv.Strv(unresolvable).Contains(name + "=" + pkgs[name]) {
+			valid = append(valid, name)
+		}
+	}
+	return valid
+}
+
+func getSystemUpgradablePackagesMap(environ map[string]string, confPath string, coreList []string) (map[string]system.PackageInfo, map[string]system.PackageInfo, error) {
 	if len(coreList) == 0 {
 		return nil, nil, errors.New("coreList is nil,can not get system update package list")
 	}
@@ -291,78 +477,324 @@ func getSystemUpgradablePackagesMap(coreList []string) (map[string]system.Packag
 	var emulateRemovePkgList map[string]system.PackageInfo
 
 	// 模拟安装更新平台下发所有包(不携带版本号)，获取可升级包的版本
-	systemSource := system.GetCategorySourceMap()[system.SystemUpdate]
-	var options []string
-	if info, err := os.Stat(systemSource); err == nil {
-		if info.IsDir() {
-			options = []string{
-				"-o", "Dir::Etc::sourcelist=/dev/null",
-				"-o", fmt.Sprintf("Dir::Etc::SourceParts=%v", systemSource),
-			}
-		} else {
-			options = []string{
-				"-o", fmt.Sprintf("Dir::Etc::sourcelist=%v", systemSource),
-				"-o", "Dir::Etc::SourceParts=/dev/null",
-				"-o", "Dir::Etc::preferences=/dev/null", // 系统更新仓库来自更新平台，为了不收本地优先级配置影响，覆盖本地优先级配置
-				"-o", "Dir::Etc::PreferencesParts=/dev/null",
-			}
-		}
-	}
-
-	emulateInstallPkgList, emulateRemovePkgList, err = apt.GenOnlineUpdatePackagesByEmulateInstall(coreList, options)
+	emulateInstallPkgList, emulateRemovePkgList, err = apt.GenOnlineUpdatePackagesByEmulateInstall(environ, confPath, coreList, systemSourceArgs())
 	if err != nil {
 		return nil, nil, err
 	}
 	return emulateInstallPkgList, emulateRemovePkgList, nil
 }
 
-func getSecurityUpgradablePackagesMap(coreList []string) (map[string]system.PackageInfo, map[string]system.PackageInfo, error) {
-	return apt.GenOnlineUpdatePackagesByEmulateInstall(nil, []string{
+func getSecurityUpgradablePackagesMap(environ map[string]string, confPath string, coreList []string) (map[string]system.PackageInfo, map[string]system.PackageInfo, error) {
+	return apt.GenOnlineUpdatePackagesByEmulateInstall(environ, confPath, nil, []string{
 		"-o", fmt.Sprintf("Dir::Etc::sourcelist=%v", system.GetCategorySourceMap()[system.SecurityUpdate]),
 		"-o", "Dir::Etc::SourceParts=/dev/null",
 	})
 }
 
-func getUnknownUpgradablePackagesMap(coreList []string) (map[string]system.PackageInfo, map[string]system.PackageInfo, error) {
-	return apt.GenOnlineUpdatePackagesByEmulateInstall(nil, []string{
+func getUnknownUpgradablePackagesMap(environ map[string]string, confPath string, coreList []string) (map[string]system.PackageInfo, map[string]system.PackageInfo, error) {
+	return apt.GenOnlineUpdatePackagesByEmulateInstall(environ, confPath, nil, []string{
 		"-o", fmt.Sprintf("Dir::Etc::SourceParts=%v", system.GetCategorySourceMap()[system.UnknownUpdate]),
 		"-o", "Dir::Etc::sourcelist=/dev/null",
 	})
 }
 
-var getUpgradablePackageList = map[system.UpdateType]func([]string) ([]string, error){
+// MergedUpdatablePackage 合并各更新分类后的可更新包,同一个包在多个分类中时取最高的目标版本
+type MergedUpdatablePackage struct {
+	Name       string
+	Version    string
+	Categories []string // 包所属的更新分类,值为UpdateType.JobType()
+}
+
+// mergeUpdatablePackages 按包名去重,版本使用CompareVersions比较,无法比较时保留先出现的版本
+func mergeUpdatablePackages(infos map[system.UpdateType]map[string]system.PackageInfo) []MergedUpdatablePackage {
+	merged := make(map[string]*MergedUpdatablePackage)
+	for _, t := range system.AllInstallUpdateType() {
+		for name, info := range infos[t] {
+			pkg, ok := merged[name]
+			if !ok {
+				merged[name] = &MergedUpdatablePackage{
+					Name:       name,
+					Version:    info.Version,
+					Categories: []string{t.JobType()},
+				}
+				continue
+			}
+			pkg.Categories = append(pkg.Categories, t.JobType())
+			if compareVersionLt(pkg.Version, info.Version) {
+				pkg.Version = info.Version
+			}
+		}
+	}
+	result := make([]MergedUpdatablePackage, 0, len(merged))
+	for _, pkg := range merged {
+		result = append(result, *pkg)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// getMergedUpdatablePackages 获取各分类可更新包的目标版本并合并,只保留ClassifiedUpdatablePackages中的包
+func (m *Manager) getMergedUpdatablePackages() ([]MergedUpdatablePackage, error) {
+	infos, err := m.getUpdatablePackageInfos()
+	if err != nil {
+		return nil, err
+	}
+	return mergeUpdatablePackages(infos), nil
+}
+
+// getUpdatablePackageOrigins 按更新分类分别查询可更新包来自哪些仓库文件,无法匹配到仓库文件时使用分类的仓库路径
+func (m *Manager) getUpdatablePackageOrigins() (map[string][]string, error) {
+	result := make(map[string][]string)
+	environ := m.proxyEnviron()
+	for _, t := range system.AllInstallUpdateType() {
+		updatable := m.updater.getUpdatablePackagesByType(t)
+		sourcePath := system.GetCategorySourceMap()[t]
+		if len(updatable) == 0 || sourcePath == "" {
+			continue
+		}
+		origins, err := apt.QueryPackageOrigins(environ, m.aptConfPath(), sourcePath, updatable)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range updatable {
+			files := origins[name]
+			if len(files) == 0 {
+				files = []string{sourcePath}
+			}
+			for _, file := range files {
+				if !strv.Strv(result[name]).Contains(file) {
+					result[name] = append(result[name], file)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// getUpdatablePackageInfos 获取各分类可更新包的目标版本,出错时返回已成功获取的分类
+func (m *Manager) getUpdatablePackageInfos() (map[system.UpdateType]map[string]system.PackageInfo, error) {
+	infos := make(map[system.UpdateType]map[string]system.PackageInfo)
+	environ := m.proxyEnviron()
+	confPath := m.aptConfPath()
+	var mu sync.Mutex
+	var errList []error
+	var wg sync.WaitGroup
+	for _, t := range system.AllInstallUpdateType() {
+		getFn, ok := getUpgradablePackageListMap[t]
+		if !ok {
+			continue
+		}
+		updatable := m.updater.getUpdatablePackagesByType(t)
+		if len(updatable) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(t system.UpdateType, getFn func(map[string]string, string, []string) (map[string]system.PackageInfo, map[string]system.PackageInfo, error)) {
+			defer wg.Done()
+			install, _, err := getFn(environ, confPath, m.coreList)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errList = append(errList, err)
+				return
+			}
+			filtered := make(map[string]system.PackageInfo)
+			for _, name := range updatable {
+				if info, ok := install[name]; ok {
+					filtered[name] = info
+				}
+			}
+			infos[t] = filtered
+		}(t, getFn)
+	}
+	wg.Wait()
+	return infos, errors.Join(errList...)
+}
+
+// listUpgradablePackages 分别获取types中各分类的可更新包和更新时会被卸载的包,结果以UpdateType.JobType()为key.
+// 获取apt参数失败时pkgMap为nil
+func (m *Manager) listUpgradablePackages(types system.UpdateType) (pkgMap map[string][]string, removedMap map[string][]string, errList []error) {
+	pkgMap = make(map[string][]string)
+	removedMap = make(map[string][]string)
+	var mu sync.Mutex
+
+	// 排除更新的包通过apt优先级配置屏蔽,防止通过依赖关系重新引入;分阶段更新推迟的包不计入可更新列表
+	option, cleanup, err := m.updater.getBlockedUpdateAptOption(nil)
+	if err != nil {
+		return nil, nil, []error{err}
+	}
+	defer cleanup()
+	args, err := apt.OptionToArgs(option)
+	if err != nil {
+		return nil, nil, []error{err}
+	}
+	args = append(args, m.coreList...)
+	environ := m.proxyEnviron()
+	confPath := m.aptConfPath()
+	spaceMap := make(map[string]int64)
+	var wg sync.WaitGroup
+	for updateType, getFn := range getUpgradablePackageList {
+		if updateType&types == 0 {
+			logger.Infof("skip get %v upgradable package", updateType.JobType())
+			continue
+		}
+		wg.Add(1)
+		go func(t system.UpdateType, fn func(map[string]string, string, []string) (apt.DistUpgradeResult, error)) {
+			defer wg.Done()
+			logger.Infof("start get %v upgradable package", t.JobType())
+			result, err := fn(environ, confPath, args)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errList = append(errList, err)
+				return
+			}
+			if len(result.Removed) > 0 {
+				logger.Infof("%v update will remove packages: %v", t.JobType(), result.Removed)
+				removedMap[t.JobType()] = result.Removed
+			}
+			if result.SpaceKnown {
+				spaceMap[t.JobType()] = result.SpaceDelta
+			}
+			pkgMap[t.JobType()] = result.Packages
+		}(updateType, getFn)
+	}
+	wg.Wait()
+	m.PropsMu.Lock()
+	m.spaceDeltaMap = spaceMap
+	m.PropsMu.Unlock()
+	free, err := system.GetFreeSpace("/usr")
+	if err != nil {
+		logger.Warning(err)
+	} else if low := lowSpaceCategories(spaceMap, free); len(low) > 0 {
+		logger.Warningf("free space %v B of /usr is not enough for %v updates, space needed: %v", free, low, spaceMap)
+	}
+	return pkgMap, removedMap, errList
+}
+
+// spaceDeltaOf 返回mode中各分类更新后磁盘空间变化的总和,检查更新时没有得到空间信息的分类不计算在内
+func spaceDeltaOf(spaceMap map[string]int64, mode system.UpdateType) int64 {
+	var delta int64
+	for _, typ := range system.AllInstallUpdateType() {
+		if typ&mode != 0 {
+			delta += spaceMap[typ.JobType()]
+		}
+	}
+	return delta
+}
+
+// setJobSpaceDelta 将检查更新得到的空间变化设置到安装任务中,融合更新时第三方仓库由next单独安装
+func (m *Manager) setJobSpaceDelta(job *Job, mode system.UpdateType) {
+	m.PropsMu.RLock()
+	spaceMap := m.spaceDeltaMap
+	m.PropsMu.RUnlock()
+	if job.next != nil {
+		job.next.PropsMu.Lock()
+		job.next.setPropSpaceDelta(spaceDeltaOf(spaceMap, mode&system.UnknownUpdate))
+		job.next.PropsMu.Unlock()
+		mode &^= system.UnknownUpdate
+	}
+	job.PropsMu.Lock()
+	job.setPropSpaceDelta(spaceDeltaOf(spaceMap, mode))
+	job.PropsMu.Unlock()
+}
+
+// lowSpaceCategories 返回更新后额外占用的空间超过free的分类
+func lowSpaceCategories(spaceMap map[string]int64, free float64) []string {
+	var low []string
+	for category, delta := range spaceMap {
+		if delta > 0 && float64(delta) > free {
+			low = append(low, category)
+		}
+	}
+	sort.Strings(low)
+	return low
+}
+
+// 获取各分类的可更新包、更新时会被卸载的包和更新后磁盘空间的变化
+var getUpgradablePackageList = map[system.UpdateType]func(map[string]string, string, []string) (apt.DistUpgradeResult, error){
 	system.SystemUpdate:   getSystemUpgradablePackageList,
 	system.SecurityUpdate: getSecurityUpgradablePackageList,
 	system.UnknownUpdate:  getUnknownUpgradablePackageList,
 }
 
-func getSystemUpgradablePackageList(coreList []string) ([]string, error) {
-	return apt.ListDistUpgradePackages(system.GetCategorySourceMap()[system.SystemUpdate], coreList)
+func getSystemUpgradablePackageList(environ map[string]string, confPath string, coreList []string) (apt.DistUpgradeResult, error) {
+	return apt.ListDistUpgrade(environ, confPath, system.GetCategorySourceMap()[system.SystemUpdate], coreList)
 }
 
-func getSecurityUpgradablePackageList(coreList []string) ([]string, error) {
-	return apt.ListDistUpgradePackages(system.GetCategorySourceMap()[system.SecurityUpdate], coreList)
+func getSecurityUpgradablePackageList(environ map[string]string, confPath string, coreList []string) (apt.DistUpgradeResult, error) {
+	return apt.ListDistUpgrade(environ, confPath, system.GetCategorySourceMap()[system.SecurityUpdate], coreList)
 }
 
-func getUnknownUpgradablePackageList(coreList []string) ([]string, error) {
-	return apt.ListDistUpgradePackages(system.GetCategorySourceMap()[system.UnknownUpdate], coreList)
+func getUnknownUpgradablePackageList(environ map[string]string, confPath string, coreList []string) (apt.DistUpgradeResult, error) {
+	return apt.ListDistUpgrade(environ, confPath, system.GetCategorySourceMap()[system.UnknownUpdate], coreList)
 }
 
-// 判断包对应版本是否存在
-func checkDebExistWithVersion(pkgList []string) bool {
-	args := strings.Join(pkgList, " ")
-	args = "apt show " + args
-	cmd := exec.Command("/bin/sh", "-c", args)
+// aptBin apt show使用的命令,测试时替换
+var aptBin = "apt"
+
+// checkDebExistWithVersion 返回pkgList中在仓库中不存在的包,元素为name或name=version,
+// 包名作为单独的参数传给apt,不经过shell
+func checkDebExistWithVersion(environ map[string]string, pkgList []string) ([]string, error) {
+	if len(pkgList) == 0 {
+		return nil, nil
+	}
+	// --之后的参数都作为包名,不会被当作选项
+	cmd := system.AptCommand(environ, aptBin, append([]string{"show", "--"}, pkgList...)...)
 	var outBuf bytes.Buffer
 	cmd.Stdout = &outBuf
 	var errBuf bytes.Buffer
 	cmd.Stderr = &errBuf
 	err := cmd.Run()
 	if err != nil {
-		logger.Warning(outBuf.String())
+		// 部分包不存在时apt show也会失败,已找到的包仍会输出
 		logger.Warning(errBuf.String())
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, err
+		}
 	}
-	return err == nil
+	return missingDebVersions(pkgList, outBuf.Bytes()), nil
+}
+
+// missingDebVersions 根据apt show的输出返回pkgList中没有找到的包
+func missingDebVersions(pkgList []string, out []byte) []string {
+	found := make(map[string]bool)
+	for _, stanza := range bytes.Split(out, []byte("\n\n")) {
+		var name, version string
+		scanner := bufio.NewScanner(bytes.NewReader(stanza))
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(scanner.Text(), ":")
+			if !ok {
+				continue
+			}
+			switch key {
+			case "Package":
+				name = strings.TrimSpace(value)
+			case "Version":
+				version = strings.TrimSpace(value)
+			}
+		}
+		if name != "" {
+			found[name] = true
+			found[name+"="+version] = true
+		}
+	}
+	var missing []string
+	for _, pkg := range pkgList {
+		name, version, hasVersion := strings.Cut(pkg, "=")
+		name, _, _ = strings.Cut(name, ":") // apt show的Package字段不带架构
+		key := name
+		if hasVersion {
+			key = name + "=" + version
+		}
+		if !found[key] {
+			missing = append(missing, pkg)
+		}
+	}
+	return missing
 }
 
 type statusVersion struct {
@@ -399,45 +831,88 @@ func loadPkgStatusVersion() (map[string]statusVersion, error) {
 	return result, nil
 }
 
-// ver1 >= ver2
-func compareVersionsGe(ver1, ver2 string) bool {
-	gt, err := compareVersionsGeFast(ver1, ver2)
-	if err != nil {
-		return compareVersionsGeDpkg(ver1, ver2)
-	}
-	return gt
+const dpkgStatusFile = "/var/lib/dpkg/status"
+
+// pkgStatusCache dpkg包状态快照,dpkg status文件修改时间变化后才重新加载,可并发访问
+type pkgStatusCache struct {
+	mu         sync.Mutex
+	statusFile string
+	modTime    time.Time
+	data       map[string]statusVersion
+	loadFn     func() (map[string]statusVersion, error)
 }
 
-// ver1 < ver2
-func compareVersionLt(ver1, ver2 string) bool {
-	return compareVersionsLtDpkg(ver1, ver2)
+func newPkgStatusCache() *pkgStatusCache {
+	return &pkgStatusCache{
+		statusFile: dpkgStatusFile,
+		loadFn:     loadPkgStatusVersion,
+	}
 }
 
-func compareVersionsGeFast(ver1, ver2 string) (bool, error) {
-	v1, err := debVersion.Parse(ver1)
+// get 返回的map在多个调用者之间共享,调用者不能修改
+func (c *pkgStatusCache) get() (map[string]statusVersion, error) {
+	if c == nil {
+		return loadPkgStatusVersion()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, err := os.Stat(c.statusFile)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	v2, err := debVersion.Parse(ver2)
+	if c.data != nil && info.ModTime().Equal(c.modTime) {
+		return c.data, nil
+	}
+	data, err := c.loadFn()
+	if err != nil {
+		return nil, err
+	}
+	c.data = data
+	c.modTime = info.ModTime()
+	return c.data, nil
+}
+
+// installedVersions 从快照中查询names中已安装包的版本,未安装的包不在结果中,快照加载失败时直接查询dpkg
+func (c *pkgStatusCache) installedVersions(names []string) map[string]string {
+	data, err := c.get()
 	if err != nil {
-		return false, err
+		logger.Warning(err)
+		return system.QueryInstalledVersions(names)
 	}
-	return debVersion.Compare(v1, v2) >= 0, nil
+	versions := make(map[string]string)
+	for _, name := range names {
+		sv, ok := data[name]
+		// db:Status-Abbrev的第二个字符为当前状态,i表示已安装
+		if ok && len(sv.status) > 1 && sv.status[1] == 'i' {
+			versions[name] = sv.version
+		}
+	}
+	return versions
 }
 
-func compareVersionsGeDpkg(ver1, ver2 string) bool {
-	err := exec.Command("dpkg", "--compare-versions", "--", ver1, "ge", ver2).Run() // #nosec G204
-	return err == nil
+// ver1 >= ver2
+func compareVersionsGe(ver1, ver2 string) bool {
+	result, err := system.CompareVersions(ver1, ver2)
+	if err != nil {
+		logger.Warning(err)
+		return false
+	}
+	return result >= 0
 }
 
-func compareVersionsLtDpkg(ver1, ver2 string) bool {
-	err := exec.Command("dpkg", "--compare-versions", "--", ver1, "lt", ver2).Run() // #nosec G204
-	return err == nil
+// ver1 < ver2
+func compareVersionLt(ver1, ver2 string) bool {
+	result, err := system.CompareVersions(ver1, ver2)
+	if err != nil {
+		logger.Warning(err)
+		return false
+	}
+	return result < 0
 }
 
-func listDistUpgradePackages(updateType system.UpdateType) ([]string, error) {
+func listDistUpgradePackages(environ map[string]string, confPath string, updateType system.UpdateType) ([]string, error) {
 	sourcePath := system.GetCategorySourceMap()[updateType]
-	return apt.ListDistUpgradePackages(sourcePath, nil)
+	return apt.ListDistUpgradePackages(environ, confPath, sourcePath, nil)
 }
 
 func (m *Manager) getCoreList(online bool) []string {
@@ -445,18 +920,49 @@ func (m *Manager) getCoreList(online bool) []string {
 		return nil
 	}
 	if online {
-		return getCoreListOnline()
+		return getCoreListOnline(m.aptConfPath())
 	}
 	return getCoreListFromCache()
 }
 
 const TimeOnly = "15:04:05"
 
+// recomputeUpdatable 使用已下载的索引和缓存的必装清单重新生成可更新内容,不访问网络也不加dpkg锁.
+// 检查更新进行中或已有重新生成在执行时直接返回错误
+func (m *Manager) recomputeUpdatable() error {
+	m.PropsMu.RLock()
+	updateOnce := m.updateSourceOnce
+	m.PropsMu.RUnlock()
+	if !updateOnce {
+		return errors.New("no update source has been checked")
+	}
+	m.do.Lock()
+	checking := m.jobManager.findJobById(system.UpdateSourceJobType) != nil
+	m.do.Unlock()
+	if checking {
+		return errors.New("checking for updates")
+	}
+	if !m.refreshUpdateInfosMu.TryLock() {
+		return errors.New("updatable packages are being recomputed")
+	}
+	defer m.refreshUpdateInfosMu.Unlock()
+
+	m.coreList = m.getCoreList(false)
+	errList := m.generateUpdateInfo()
+	for _, e := range errList {
+		logger.Warning(e)
+	}
+	m.statusManager.UpdateModeAllStatusBySize(m.proxyEnviron(), m.coreList)
+	m.statusManager.UpdateCheckCanUpgradeByEachStatus()
+	m.updateUpdatableProp(m.updater.ClassifiedUpdatablePackages)
+	return errors.Join(errList...)
+}
+
 func (m *Manager) refreshUpdateInfos(sync bool) {
 	// 检查更新时,同步修改canUpgrade状态;检查更新时需要同步操作
 	if sync {
 		// 检查更新后，先下载解析coreList，获取必装清单
-		m.coreList = m.getCoreList(true)
+		m.coreList = m.validateCoreList(m.getCoreList(true))
 		logger.Debug("generateUpdateInfo get coreList:", m.coreList)
 		for _, e := range m.generateUpdateInfo() {
 			go func() {
@@ -467,7 +973,7 @@ func (m *Manager) refreshUpdateInfos(sync bool) {
 			logger.Warning(e)
 		}
 		m.statusManager.updateSourceOnce = true
-		m.statusManager.UpdateModeAllStatusBySize(m.coreList)
+		m.statusManager.UpdateModeAllStatusBySize(m.proxyEnviron(), m.coreList)
 		m.statusManager.UpdateCheckCanUpgradeByEachStatus()
 	} else {
 		m.coreList = m.getCoreList(false)
@@ -483,7 +989,7 @@ func (m *Manager) refreshUpdateInfos(sync bool) {
 					logger.Warning(e)
 				}
 			}
-			m.statusManager.UpdateModeAllStatusBySize(m.coreList)
+			m.statusManager.UpdateModeAllStatusBySize(m.proxyEnviron(), m.coreList)
 			m.statusManager.UpdateCheckCanUpgradeByEachStatus()
 		}()
 	}
@@ -491,9 +997,14 @@ func (m *Manager) refreshUpdateInfos(sync bool) {
 	m.statusManager.SetFrontForceUpdate(m.updatePlatform.Tp == updateplatform.UpdateShutdown)
 	if updateplatform.IsForceUpdate(m.updatePlatform.Tp) {
 		go func() {
+			if m.jobManager.HasActiveUpgradeJob() {
+				// 下次检查更新后再下载
+				logger.Info("upgrade or download job is in progress, skip auto download force updates")
+				return
+			}
 			m.inhibitAutoQuitCountAdd()
 			logger.Info("auto download force updates")
-			_, err := m.prepareDistUpgrade(dbus.Sender(m.service.Conn().Names()[0]), system.SystemUpdate, false) // TODO system.SystemUpdate
+			_, err := m.prepareDistUpgrade(dbus.Sender(m.service.Conn().Names()[0]), system.SystemUpdate, false, "") // TODO system.SystemUpdate
 			if err != nil {
 				logger.Error("failed to prepare dist-upgrade:", err)
 			}
@@ -503,7 +1014,7 @@ func (m *Manager) refreshUpdateInfos(sync bool) {
 			timeStr := m.updatePlatform.UpdateTime.Format(TimeOnly)
 			if timeStr != m.updateTime {
 				m.updateTime = timeStr
-				msg := fmt.Sprintf(gettext.Tr("The computer will be updated at %s"), m.updateTime)
+				msg := m.Tr("The computer will be updated at %s", m.updateTime)
 				go m.sendNotify(updateNotifyShow, 0, "preferences-system", "", msg, nil, nil, system.NotifyExpireTimeoutDefault)
 			}
 		}
@@ -513,16 +1024,228 @@ func (m *Manager) refreshUpdateInfos(sync bool) {
 		// 强制更新开启后，以强制更新下载策略优先
 		return
 	}
-	if m.updater.AutoDownloadUpdates && len(m.updater.UpdatablePackages) > 0 && sync && !m.updater.getIdleDownloadEnabled() {
-		logger.Info("auto download updates")
+	if len(m.updater.UpdatablePackages) == 0 || !sync {
+		return
+	}
+	switch m.updater.getStagingPolicy() {
+	case config.StagingPolicyOff:
+		return
+	case config.StagingPolicyDownloadOnly, config.StagingPolicyDownloadAndNotify:
+		// 两种策略都只下载,安装必须由用户操作触发;是否通知在下载job的hook中根据策略判断
+		m.PropsMu.RLock()
+		mode := m.CheckUpdateMode & checkUpdateSourceType(m.UpdateMode)
+		m.PropsMu.RUnlock()
+		m.autoDownload(mode)
+	}
+}
+
+// autoDownload 依次检查空闲下载时间段和电池策略,都满足时下载mode的更新
+func (m *Manager) autoDownload(mode system.UpdateType) {
+	if m.updater.getIdleDownloadEnabled() && !m.updater.inIdleDownloadWindow() {
+		// 不在空闲时间段内,推迟到下一个空闲时间段开始时再下载,届时再检查电池策略
+		logger.Info("not in idle download window, defer auto download")
 		go func() {
-			m.inhibitAutoQuitCountAdd()
-			_, err := m.PrepareDistUpgrade(dbus.Sender(m.service.Conn().Names()[0]))
+			m.resetIdleDownload = true
+			err := m.updateAutoDownloadTimer()
 			if err != nil {
-				logger.Error("failed to prepare dist-upgrade:", err)
+				logger.Warning(err)
 			}
-			m.inhibitAutoQuitCountSub()
 		}()
+		return
+	}
+	if m.deferDownloadOnBattery(mode) {
+		return
+	}
+	// 用户手动安装或下载更新时自动下载会竞争dpkg锁,跳过本次自动下载,下次检查更新后再下载
+	if m.jobManager.HasActiveUpgradeJob() {
+		logger.Info("upgrade or download job is in progress, skip auto download")
+		return
+	}
+	logger.Info("auto download updates")
+	go func() {
+		m.inhibitAutoQuitCountAdd()
+		_, err := m.prepareDistUpgrade(dbus.Sender(m.service.Conn().Names()[0]), mode, false, "")
+		if err != nil {
+			logger.Error("failed to prepare dist-upgrade:", err)
+		}
+		m.inhibitAutoQuitCountSub()
+	}()
+}
+
+type changelogCacheEntry struct {
+	updateSourceTime time.Time
+	changelog        apt.PackageChangelog
+}
+
+const (
+	// maxChangelogPackages 单次最多查询的包数量,每个包都需要单独执行apt-get changelog
+	maxChangelogPackages = 20
+	// changelogQueryTimeout 单个包查询更新说明的超时时间,apt-get changelog需要从网络下载
+	changelogQueryTimeout = 15 * time.Second
+)
+
+// getUpdateChangelog 获取包从已安装版本到候选版本的更新说明,检查更新完成前成功获取的结果会被缓存.
+// 查询在changelogCacheMu外执行,避免一个慢查询阻塞其他调用
+func (m *Manager) getUpdateChangelog(packages []string) map[string]apt.PackageChangelog {
+	m.PropsMu.RLock()
+	doneTime := m.updateSourceDoneTime
+	m.PropsMu.RUnlock()
+
+	result := make(map[string]apt.PackageChangelog, len(packages))
+	var missing []string
+	m.changelogCacheMu.Lock()
+	for _, pkg := range packages {
+		if entry, ok := m.changelogCache[pkg]; ok && entry.updateSourceTime.Equal(doneTime) {
+			result[pkg] = entry.changelog
+			continue
+		}
+		missing = append(missing, pkg)
+	}
+	m.changelogCacheMu.Unlock()
+
+	fetched := make(map[string]apt.PackageChangelog, len(missing))
+	environ := m.proxyEnviron()
+	for _, pkg := range missing {
+		ctx, cancel := context.WithTimeout(context.Background(), changelogQueryTimeout)
+		changelog, err := apt.QueryChangelog(ctx, environ, m.aptConfPath(), pkg)
+		cancel()
+		result[pkg] = changelog
+		if err != nil {
+			// 失败的结果不缓存,下次调用时重新获取
+			logger.Warning(err)
+			continue
+		}
+		fetched[pkg] = changelog
+	}
+	if len(fetched) == 0 {
+		return result
+	}
+
+	m.changelogCacheMu.Lock()
+	defer m.changelogCacheMu.Unlock()
+	if m.changelogCache == nil {
+		m.changelogCache = make(map[string]changelogCacheEntry)
+	}
+	for pkg, changelog := range fetched {
+		m.changelogCache[pkg] = changelogCacheEntry{
+			updateSourceTime: doneTime,
+			changelog:        changelog,
+		}
+	}
+	return result
+}
+
+type updateSizeCacheEntry struct {
+	updateSourceTime time.Time
+	size             int64
+}
+
+// getUpdateSizeByType 获取单个类型更新需要下载的大小,检查更新完成前结果会被缓存
+func (m *Manager) getUpdateSizeByType(updateType system.UpdateType) (int64, error) {
+	sourcePath := system.GetCategorySourceMap()[updateType]
+	if sourcePath == "" {
+		return 0, nil
+	}
+	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
+		return 0, nil
+	}
+	m.PropsMu.RLock()
+	doneTime := m.updateSourceDoneTime
+	m.PropsMu.RUnlock()
+
+	m.updateSizeCacheMu.Lock()
+	defer m.updateSizeCacheMu.Unlock()
+	if entry, ok := m.updateSizeCache[updateType]; ok && entry.updateSourceTime.Equal(doneTime) {
+		return entry.size, nil
+	}
+	var pkgList []string
+	if updateType == system.SystemUpdate {
+		pkgList = m.coreList
+	}
+	needDownloadSize, _, err := system.QuerySourceDownloadSize(m.proxyEnviron(), updateType, pkgList)
+	if err != nil {
+		return 0, err
+	}
+	if needDownloadSize == system.SizeUnknown {
+		return 0, fmt.Errorf("failed to get %v download size", updateType.JobType())
+	}
+	if m.updateSizeCache == nil {
+		m.updateSizeCache = make(map[system.UpdateType]updateSizeCacheEntry)
+	}
+	m.updateSizeCache[updateType] = updateSizeCacheEntry{
+		updateSourceTime: doneTime,
+		size:             int64(needDownloadSize),
+	}
+	return int64(needDownloadSize), nil
+}
+
+// UpdateStateSnapshot 一次性获取的更新相关属性,避免分别读取属性时数量和列表不一致
+type UpdateStateSnapshot struct {
+	UpdateMode                  system.UpdateType
+	CheckUpdateMode             system.UpdateType
+	UpgradableApps              []string
+	ClassifiedUpdatablePackages map[string][]string
+	ClassifiedRemovedPackages   map[string][]string // 各分类更新时会被卸载的包
+	UpdatableVersion            uint64              // UpgradableApps、ClassifiedUpdatablePackages和ClassifiedRemovedPackages的版本,每次刷新可更新内容后增加
+	LastCheckTime               string
+	LastCheckSucceeded          bool
+	LastCheckError              string
+	UpdateSourceOnce            bool // 是否完成过检查更新
+}
+
+// updatableState 同一次刷新得到的可更新包、分类包和会被卸载的包,整体替换,不会读到不一致的数量和列表
+type updatableState struct {
+	version        uint64
+	upgradableApps []string
+	classified     map[string][]string
+	removed        map[string][]string
+}
+
+func copyPackagesMap(src map[string][]string) map[string][]string {
+	dst := make(map[string][]string, len(src))
+	for k, v := range src {
+		dst[k] = append([]string{}, v...)
+	}
+	return dst
+}
+
+// publishUpdatableState 记录同一次刷新得到的分类包、过滤后的可更新包和Updater中会被卸载的包
+func (m *Manager) publishUpdatableState(classified map[string][]string, upgradableApps []string) {
+	m.updater.PropsMu.RLock()
+	removed := copyPackagesMap(m.updater.ClassifiedRemovedPackages)
+	m.updater.PropsMu.RUnlock()
+	state := updatableState{
+		upgradableApps: append([]string{}, upgradableApps...),
+		classified:     copyPackagesMap(classified),
+		removed:        removed,
+	}
+	m.updatableStateMu.Lock()
+	state.version = m.updatableState.version + 1
+	m.updatableState = state
+	m.updatableStateMu.Unlock()
+}
+
+// getUpdateStateSnapshot 同时持有updatableStateMu、Updater和Manager的读锁复制所有属性,不会读到不同时刻的模式、包列表和检查结果;
+// 加锁顺序为updatableStateMu、Updater.PropsMu、Manager.PropsMu,持有updatableStateMu写锁时不能再获取其他锁
+func (m *Manager) getUpdateStateSnapshot() UpdateStateSnapshot {
+	m.updatableStateMu.RLock()
+	defer m.updatableStateMu.RUnlock()
+	m.updater.PropsMu.RLock()
+	defer m.updater.PropsMu.RUnlock()
+	m.PropsMu.RLock()
+	defer m.PropsMu.RUnlock()
+	state := m.updatableState
+	return UpdateStateSnapshot{
+		UpdateMode:                  m.UpdateMode,
+		CheckUpdateMode:             m.CheckUpdateMode,
+		UpgradableApps:              state.upgradableApps,
+		ClassifiedUpdatablePackages: state.classified,
+		ClassifiedRemovedPackages:   state.removed,
+		UpdatableVersion:            state.version,
+		LastCheckTime:               m.updater.LastCheckTime,
+		LastCheckSucceeded:          m.updater.LastCheckSucceeded,
+		LastCheckError:              m.updater.LastCheckError,
+		UpdateSourceOnce:            m.updateSourceOnce,
 	}
 }
 
@@ -530,10 +1253,11 @@ func (m *Manager) updateUpdatableProp(infosMap map[string][]string) {
 	m.PropsMu.RLock()
 	updateType := m.UpdateMode
 	m.PropsMu.RUnlock()
-	filterInfos := getFilterPackages(infosMap, updateType)
+	filterInfos := excludePackages(getFilterPackages(infosMap, updateType), m.updater.getExcludedPackages())
 	m.updatableApps(filterInfos) // Manager的UpgradableApps实际为可更新的包,而非应用;
 	m.updater.setUpdatablePackages(filterInfos)
 	m.updater.updateUpdatableApps()
+	m.publishUpdatableState(infosMap, filterInfos)
 }
 
 func (m *Manager) ensureUpdateSourceOnce() {
@@ -552,44 +1276,122 @@ func (m *Manager) ensureUpdateSourceOnce() {
 	}
 }
 
-// retry次数为1
-// 默认检查为 AllCheckUpdate
-// 重试检查为 AllInstallUpdate
-func handleUpdateSourceFailed(j *Job) {
+const maxUpdateSourceRetryDelay = time.Hour
+
+// retryPlatformRequest 执行更新平台请求fn,失败后最多重试retry次,第一次重试前等待delay,之后每次翻倍,
+// 返回最后一次请求的错误
+func retryPlatformRequest(name string, retry int, delay time.Duration, fn func() error, sleep func(time.Duration)) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 0 {
+				logger.Infof("%s succeeded after %d retries", name, attempt)
+			}
+			return nil
+		}
+		if attempt >= retry {
+			logger.Warningf("%s failed after %d attempts: %v", name, attempt+1, err)
+			return err
+		}
+		wait := delay
+		for i := 0; i < attempt && wait < maxUpdateSourceRetryDelay; i++ {
+			wait *= 2
+		}
+		if wait > maxUpdateSourceRetryDelay {
+			wait = maxUpdateSourceRetryDelay
+		}
+		logger.Warningf("%s attempt %d failed: %v, retry after %v", name, attempt+1, err, wait)
+		if wait > 0 {
+			sleep(wait)
+		}
+	}
+}
+
+// updateSourceRetryPolicy 检查更新失败后的重试策略,默认检查 AllCheckUpdate,重试时按types依次缩小检查的仓库范围
+type updateSourceRetryPolicy struct {
+	maxRetry int
+	delay    time.Duration
+	types    []system.UpdateType
+}
+
+func newUpdateSourceRetryPolicy(c *config.Config) updateSourceRetryPolicy {
+	p := updateSourceRetryPolicy{
+		maxRetry: c.UpdateSourceRetryCount,
+		delay:    c.UpdateSourceRetryDelay,
+		types:    c.UpdateSourceRetryTypes,
+	}
+	if p.maxRetry < 0 {
+		p.maxRetry = 0
+	}
+	if len(p.types) == 0 {
+		p.types = []system.UpdateType{system.SystemUpdate | system.SecurityUpdate | system.AppendUpdate}
+	}
+	return p
+}
+
+// retryFor 返回第attempt(从1开始)次重试检查的仓库类型和重试前的等待时间
+func (p updateSourceRetryPolicy) retryFor(attempt int) (system.UpdateType, time.Duration) {
+	if attempt < 1 {
+		attempt = 1
+	}
+	updateType := p.types[len(p.types)-1]
+	if attempt <= len(p.types) {
+		updateType = p.types[attempt-1]
+	}
+	if p.delay <= 0 {
+		return updateType, 0
+	}
+	delay := p.delay
+	for i := 1; i < attempt && delay < maxUpdateSourceRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxUpdateSourceRetryDelay {
+		delay = maxUpdateSourceRetryDelay
+	}
+	return updateType, delay
+}
+
+// nextAttempt 返回job下一次是第几次重试,从1开始
+func (p updateSourceRetryPolicy) nextAttempt(j *Job) int {
 	retry := j.retry
-	if retry > 1 {
-		retry = 1
-		j.retry = retry
+	if retry > p.maxRetry {
+		retry = p.maxRetry
 	}
-	retryMap := map[int]system.UpdateType{
-		1: system.SystemUpdate | system.SecurityUpdate | system.AppendUpdate,
+	return p.maxRetry - retry + 1
+}
+
+// retryDelay 在job失败后、重新进入队列前调用,返回下一次重试前的等待时间
+func (p updateSourceRetryPolicy) retryDelay(j *Job) time.Duration {
+	_, delay := p.retryFor(p.nextAttempt(j))
+	logger.Infof("retry %s after %v", j.Id, delay)
+	return delay
+}
+
+// prepareRetry 在job.retry减少前调用,返回本次重试检查的仓库类型
+func (p updateSourceRetryPolicy) prepareRetry(j *Job) system.UpdateType {
+	if j.retry > p.maxRetry {
+		j.retry = p.maxRetry
 	}
-	updateType := retryMap[retry]
-	err := system.CustomSourceWrapper(updateType, func(path string, unref func()) error {
+	updateType, _ := p.retryFor(p.nextAttempt(j))
+	logger.Infof("retry %s with update type %v", j.Id, updateType)
+	return updateType
+}
+
+func handleUpdateSourceFailed(wrapper system.SourceWrapperFunc, j *Job, updateType system.UpdateType, downloadOption map[string]string) {
+	err := system.SourceWrapperWithHold(wrapper, updateType, func(path string, hold func() func()) error {
 		// 重新设置apt命令参数
-		info, err := os.Stat(path)
+		option, err := sourceListOption(path)
 		if err != nil {
-			if unref != nil {
-				unref()
-			}
 			return err
 		}
-		if info.IsDir() {
-			j.option = map[string]string{
-				"Dir::Etc::SourceList":  "/dev/null",
-				"Dir::Etc::SourceParts": path,
-			}
-		} else {
-			j.option = map[string]string{
-				"Dir::Etc::SourceList":  path,
-				"Dir::Etc::SourceParts": "/dev/null",
-			}
+		release := hold()
+		j.option = option
+		for k, v := range downloadOption {
+			j.option[k] = v
 		}
 		j.wrapPreHooks(map[string]func() error{
 			string(system.EndStatus): func() error {
-				if unref != nil {
-					unref()
-				}
+				release()
 				return nil
 			},
 		})
@@ -19,13 +19,13 @@ import (
 
 	"github.com/linuxdeepin/lastore-daemon/src/internal/config"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system/apt"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system/dut"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/updateplatform"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/linuxdeepin/go-lib/dbusutil"
 	"github.com/linuxdeepin/go-lib/dbusutil/proxy"
-	"github.com/linuxdeepin/go-lib/gettext"
 	"github.com/linuxdeepin/go-lib/utils"
 )
 
@@ -47,7 +47,7 @@ func (m *Manager) distUpgradePartly(sender dbus.Sender, origin system.UpdateType
 	if updateplatform.IsForceUpdate(m.updatePlatform.Tp) {
 		mode = origin
 	}
-	upgradeJob, createJobErr = m.distUpgrade(sender, mode, false, false, true)
+	upgradeJob, createJobErr = m.distUpgrade(sender, mode, false, false, true, "")
 	if createJobErr != nil {
 		if !errors.Is(createJobErr, JobExistError) {
 			return "/", dbusutil.ToError(createJobErr)
@@ -138,8 +138,8 @@ func (m *Manager) distUpgradePartly(sender dbus.Sender, origin system.UpdateType
 		if abErr != nil || !canBackup {
 			logger.Info("can not backup,", abErr)
 
-			msg := gettext.Tr("Backup failed!")
-			action := []string{"continue", gettext.Tr("Proceed to Update")}
+			msg := m.Tr("Backup failed!")
+			action := []string{"continue", m.Tr("Proceed to Update")}
 			hints := map[string]dbus.Variant{"x-deepin-action-continue": dbus.MakeVariant(
 				fmt.Sprintf("dbus-send,--system,--print-reply,--dest=org.deepin.dde.Lastore1,/org/deepin/dde/Lastore1,org.deepin.dde.Lastore1.Manager.DistUpgradePartly,uint64:%v,boolean:%v", mode, false))}
 			go m.sendNotify(updateNotifyShowOptional, 0, "preferences-system", "", msg, action, hints, system.NotifyExpireTimeoutDefault)
@@ -161,8 +161,8 @@ func (m *Manager) distUpgradePartly(sender dbus.Sender, origin system.UpdateType
 			if abErr != nil {
 				logger.Warning(abErr)
 
-				msg := gettext.Tr("Backup failed!")
-				action := []string{"backup", gettext.Tr("Back Up Again"), "continue", gettext.Tr("Proceed to Update")}
+				msg := m.Tr("Backup failed!")
+				action := []string{"backup", m.Tr("Back Up Again"), "continue", m.Tr("Proceed to Update")}
 				hints := map[string]dbus.Variant{
 					"x-deepin-action-backup": dbus.MakeVariant(
 						fmt.Sprintf("dbus-send,--system,--print-reply,--dest=org.deepin.dde.Lastore1,/org/deepin/dde/Lastore1,org.deepin.dde.Lastore1.Manager.DistUpgradePartly,uint64:%v,boolean:%v", mode, true)),
@@ -185,8 +185,8 @@ func (m *Manager) distUpgradePartly(sender dbus.Sender, origin system.UpdateType
 					logger.Warning(err)
 				}
 				m.statusManager.SetUpdateStatus(mode, system.CanUpgrade)
-				msg := gettext.Tr("Backup failed!")
-				action := []string{"backup", gettext.Tr("Back Up Again"), "continue", gettext.Tr("Proceed to Update")}
+				msg := m.Tr("Backup failed!")
+				action := []string{"backup", m.Tr("Back Up Again"), "continue", m.Tr("Proceed to Update")}
 				hints := map[string]dbus.Variant{
 					"x-deepin-action-backup": dbus.MakeVariant(
 						fmt.Sprintf("dbus-send,--system,--print-reply,"+
@@ -241,7 +241,13 @@ func (m *Manager) distUpgradePartly(sender dbus.Sender, origin system.UpdateType
 
 // distUpgrade isClassify true: mode只能是单类型,创建一个单类型的更新job; false: mode类型不限,创建一个全mode类型的更新job
 // needAdd true: 返回的job已经被add到jobManager中；false: 返回的job需要被调用者add
-func (m *Manager) distUpgrade(sender dbus.Sender, mode system.UpdateType, isClassify bool, needAdd bool, needChangeGrub bool) (*Job, error) {
+// mirror不为空时,只在本次更新中使用该地址替换系统仓库的地址
+func (m *Manager) distUpgrade(sender dbus.Sender, mode system.UpdateType, isClassify bool, needAdd bool, needChangeGrub bool, mirror string) (*Job, error) {
+	if mirror != "" {
+		if _, err := system.NormalizeMirrorURL(mirror); err != nil {
+			return nil, err
+		}
+	}
 	m.checkDpkgCapabilityOnce.Do(func() {
 		m.supportDpkgScriptIgnore = checkSupportDpkgScriptIgnore()
 	})
@@ -273,6 +279,10 @@ func (m *Manager) distUpgrade(sender dbus.Sender, mode system.UpdateType, isClas
 			return nil, system.NotFoundError(fmt.Sprintf("empty %v UpgradableApps", mode))
 		}
 	}
+	safeModeDeferred, err := m.prepareSafeMode(mode)
+	if err != nil {
+		return nil, err
+	}
 
 	var isExist bool
 	var job *Job
@@ -286,7 +296,7 @@ func (m *Manager) distUpgrade(sender dbus.Sender, mode system.UpdateType, isClas
 		2. 多仓库包含第三方时,先融合非第三方仓库内容生成path,CreateJob中,分别创建排除第三方的更新job和第三方更新job,源配置分别在CreateJob后和CreateJob时设置;
 		TODO: 该处逻辑和下载逻辑代码将业务和机制耦合太死,需要根据现有需求规划对该部分做新的设计;
 	*/
-	err = system.CustomSourceWrapper(mergeMode, func(path string, unref func()) error {
+	err = m.getSourceWrapper()(mergeMode, func(path string, unref func()) error {
 		m.do.Lock()
 		defer m.do.Unlock()
 		if isClassify {
@@ -332,6 +342,49 @@ func (m *Manager) distUpgrade(sender dbus.Sender, mode system.UpdateType, isClas
 			job.option["DPkg::Options::"] = "--script-ignore-error"
 		}
 
+		// 优先级配置目录在job结束时由jobEnded删除,安全模式推迟的包只在本次更新中阻止安装
+		aptOption, cleanupAptOption, err := m.updater.getBlockedUpdateAptOption(safeModeDeferred)
+		if err != nil {
+			if unref != nil {
+				unref()
+			}
+			return err
+		}
+		for _, j := range []*Job{job, job.next} {
+			if j == nil {
+				continue
+			}
+			if j.option == nil {
+				j.option = make(map[string]string)
+			}
+			for k, v := range aptOption {
+				j.option[k] = v
+			}
+		}
+		// 融合更新时统计各分类的安装进度
+		if !isClassify {
+			if tracker := newCategoryProgress(m.updater.getClassifiedPackagesByType(mode)); tracker != nil {
+				for _, j := range []*Job{job, job.next} {
+					if j != nil {
+						j.PropsMu.Lock()
+						j.categoryProgress = tracker
+						j.setPropCategoryProgress(tracker.json())
+						j.PropsMu.Unlock()
+					}
+				}
+			}
+		}
+		m.setJobSpaceDelta(job, mode)
+		if mirror != "" {
+			if err := applyMirrorOverride(job, mirror); err != nil {
+				cleanupAptOption()
+				if unref != nil {
+					unref()
+				}
+				return err
+			}
+		}
+
 		m.handleSysPowerChanged()
 
 		// 设置hook
@@ -343,8 +396,14 @@ func (m *Manager) distUpgrade(sender dbus.Sender, mode system.UpdateType, isClas
 		} else {
 			endJob = job
 		}
+		var hookEnv []string
+		var upgradePackages []string
 		startJob.setPreHooks(map[string]func() error{
 			string(system.RunningStatus): func() error {
+				// 更新依赖safecache,等待启动时的构建结束;脚本执行有超时,缺失或失败时不阻止更新
+				if !apt.WaitSafecache(0) {
+					logger.Warning("safecache is not ready, continue upgrading without it")
+				}
 				// 防止还在检查更新的时候，就生成了meta文件，此时meta文件可能不准
 				uuid, err = m.prepareAptCheck(mode)
 				if err != nil {
@@ -363,13 +422,22 @@ func (m *Manager) distUpgrade(sender dbus.Sender, mode system.UpdateType, isClas
 					m.updatePlatform.PostStatusMessage(fmt.Sprintf("%v CheckSystem failed, detail is: %v", mode.JobType(), systemErr.Error()))
 					return systemErr
 				}
-				if !system.CheckInstallAddSize(mode) {
+				if !system.CheckInstallAddSize(job.environ, mode) {
 					return &system.JobError{
 						ErrType:      system.ErrorInsufficientSpace,
 						ErrDetail:    "There is not enough space on the disk to upgrade",
 						IsCheckError: true,
 					}
 				}
+				// 更新完成后可更新包列表会刷新,在开始时记录本次更新的包供post-upgrade.d使用
+				upgradePackages = m.updater.getUpdatablePackagesByType(mode)
+				hookEnv = upgradeHookEnv(mode, upgradePackages)
+				err := runPreUpgradeHooks(hookEnv)
+				if err != nil {
+					logger.Warning(err)
+					m.updatePlatform.PostStatusMessage(fmt.Sprintf("%v pre-upgrade hook failed, detail is: %v", mode.JobType(), err.Error()))
+					return err
+				}
 				m.preRunningHook(needChangeGrub, mode)
 				return nil
 			},
@@ -387,6 +455,11 @@ func (m *Manager) distUpgrade(sender dbus.Sender, mode system.UpdateType, isClas
 					m.updatePlatform.PostStatusMessage(fmt.Sprintf("%v CheckSystem failed, detail is: %v", mode.JobType(), systemErr.Error()))
 					return systemErr
 				}
+				// 安装完成后检查依赖关系,损坏时按配置回滚
+				err := m.postUpgradeHealthCheck(mode)
+				if err != nil {
+					return err
+				}
 
 				if mode&system.SystemUpdate != 0 {
 					recordUpgradeLog(uuid, system.SystemUpdate, m.updatePlatform.SystemUpdateLogs, upgradeRecordPath)
@@ -410,6 +483,7 @@ func (m *Manager) distUpgrade(sender dbus.Sender, mode system.UpdateType, isClas
 				if err != nil {
 					logger.Warning(err)
 				}
+				runPostUpgradeHooks(hookEnv)
 				return m.afterUpgradeCmdSuccessHook()
 			},
 			string(system.EndStatus): func() error {
@@ -417,11 +491,31 @@ func (m *Manager) distUpgrade(sender dbus.Sender, mode system.UpdateType, isClas
 				if unref != nil {
 					unref()
 				}
+				// 成功时本次更新的包都已安装;失败或取消时只有交给了dpkg的包可能已经被替换
+				endJob.PropsMu.RLock()
+				succeed := endJob.endResult == system.SucceedStatus
+				endJob.PropsMu.RUnlock()
+				installed := upgradePackages
+				if !succeed {
+					installed = startJob.reachedDpkg(upgradePackages)
+					if endJob != startJob {
+						installed = append(installed, endJob.reachedDpkg(upgradePackages)...)
+					}
+				}
+				m.refreshRebootRequired(installed)
+				if mode == system.OfflineUpdate {
+					// 离线更新结束后(成功、失败或取消)释放repo.sfs的挂载,恢复在线仓库
+					err := m.leaveOfflineMode()
+					if err != nil {
+						logger.Warning(err)
+					}
+				}
 				return nil
 			},
 		})
 		if needAdd { // 分类下载的job需要外部判断是否add
 			if err := m.jobManager.addJob(job); err != nil {
+				cleanupAptOption()
 				if unref != nil {
 					unref()
 				}
@@ -465,7 +559,7 @@ func (m *Manager) handleSysPowerChanged() {
 			defer handleSysPowerBatteryEventMu.Unlock()
 			if onBatteryGlobal && batteryPercentage < 60.0 && m.statusManager.isUpgrading() && lowPowerNotifyId == 0 {
 				go func() {
-					msg := gettext.Tr("The battery capacity is lower than 60%. To get successful updates, please plug in.")
+					msg := m.Tr("The battery capacity is lower than 60%. To get successful updates, please plug in.")
 					lowPowerNotifyId = m.sendNotify(updateNotifyShow, 0, "notification-battery_low", "", msg, nil, nil, system.NotifyExpireTimeoutNoHide)
 				}()
 			}
@@ -521,6 +615,17 @@ func (m *Manager) preRunningHook(needChangeGrub bool, mode system.UpdateType) {
 	}
 }
 
+// failedPackageOf 返回dpkg执行失败时第一个出错的包,无法确定时返回空
+func failedPackageOf(jobErr *system.JobError) string {
+	if jobErr.ErrType != system.ErrorDpkgError || len(jobErr.Packages) == 0 {
+		return ""
+	}
+	return jobErr.Packages[0]
+}
+
+// aptTermLog dpkg执行的完整输出,安装失败时在通知中提示查看
+const aptTermLog = "/var/log/apt/term.log"
+
 func (m *Manager) preFailedHook(job *Job, mode system.UpdateType, uuid string) error {
 	// 状态更新为failed
 	var errorContent system.JobError
@@ -544,19 +649,19 @@ func (m *Manager) preFailedHook(job *Job, mode system.UpdateType, uuid string) e
 		if strings.Contains(errType, system.ErrorDamagePackage.String()) {
 			// 包损坏，需要下apt-get clean，然后重试更新
 			cleanAllCache()
-			msg := gettext.Tr("Updates failed: damaged files. Please update again.")
-			action := []string{"retry", gettext.Tr("Try Again")}
+			msg := m.Tr("Updates failed: damaged files. Please update again.")
+			action := []string{"retry", m.Tr("Try Again")}
 			hints := map[string]dbus.Variant{"x-deepin-action-retry": dbus.MakeVariant("dde-control-center,-m,update")}
 			go m.sendNotify(updateNotifyShowOptional, 0, "preferences-system", "", msg, action, hints, system.NotifyExpireTimeoutDefault)
 		} else if strings.Contains(errType, system.ErrorInsufficientSpace.String()) {
 			// 空间不足
 			// 已备份
-			msg := gettext.Tr("Updates failed: insufficient disk space. Please reboot to avoid the effect on your system.")
-			action := []string{"reboot", gettext.Tr("Reboot")}
+			msg := m.Tr("Updates failed: insufficient disk space. Please reboot to avoid the effect on your system.")
+			action := []string{"reboot", m.Tr("Reboot")}
 			hints := map[string]dbus.Variant{"x-deepin-action-reboot": dbus.MakeVariant("dbus-send,--session,--print-reply,--dest=org.deepin.dde.shutdownFront1,/org/deepin/dde/shutdownFront1,org.deepin.dde.shutdownFront1.Restart")}
 			// 未备份
 			if !canBackup {
-				msg = gettext.Tr("Updates failed: insufficient disk space.")
+				msg = m.Tr("Updates failed: insufficient disk space.")
 				action = []string{}
 				hints = nil
 			}
@@ -564,15 +669,29 @@ func (m *Manager) preFailedHook(job *Job, mode system.UpdateType, uuid string) e
 		} else {
 			// 其他原因
 			// 已备份
-			msg := gettext.Tr("Updates failed. Please reboot to avoid the effect on your system.")
-			action := []string{"reboot", gettext.Tr("Reboot")}
+			msg := m.Tr("Updates failed. Please reboot to avoid the effect on your system.")
+			action := []string{"reboot", m.Tr("Reboot")}
 			hints := map[string]dbus.Variant{"x-deepin-action-reboot": dbus.MakeVariant("dbus-send,--session,--print-reply,--dest=org.deepin.dde.shutdownFront1,/org/deepin/dde/shutdownFront1,org.deepin.dde.shutdownFront1.Restart")}
 			// 未备份
 			if !canBackup {
-				msg = gettext.Tr("Updates failed.")
+				msg = m.Tr("Updates failed.")
 				action = []string{}
 				hints = nil
 			}
+			// 能确定出错的包时提示该包和日志位置,并提供打开控制中心更新页面的操作
+			if failedPkg := failedPackageOf(&errorContent); failedPkg != "" {
+				if canBackup {
+					msg = m.Tr("Updates failed: an error occurred while installing %s. Please reboot to avoid the effect on your system.", failedPkg)
+				} else {
+					msg = m.Tr("Updates failed: an error occurred while installing %s.", failedPkg)
+				}
+				msg += " " + m.Tr("See %s for details.", aptTermLog)
+				if hints == nil {
+					hints = make(map[string]dbus.Variant)
+				}
+				action = append(action, "view", m.Tr("View"))
+				hints["x-deepin-action-view"] = dbus.MakeVariant("dde-control-center,-m,update")
+			}
 			go m.sendNotify(updateNotifyShowOptional, 0, "preferences-system", "", msg, action, hints, system.NotifyExpireTimeoutDefault)
 		}
 	}
@@ -604,7 +723,7 @@ func (m *Manager) preFailedHook(job *Job, mode system.UpdateType, uuid string) e
 			allErrMsg = append(allErrMsg, string(content))
 		}
 		if !errorContent.IsCheckError {
-			msg, err := os.ReadFile("/var/log/apt/term.log")
+			msg, err := os.ReadFile(aptTermLog)
 			if err != nil {
 				logger.Warning("failed to get upgrade failed lod:", err)
 			} else {
@@ -664,9 +783,9 @@ func (m *Manager) afterUpgradeCmdSuccessHook() error {
 	if err != nil {
 		logger.Warning(err)
 	}
-	summary := gettext.Tr("Updates successful")
-	msg := gettext.Tr("Restart the computer to use the system and applications properly.")
-	action := []string{"reboot", gettext.Tr("Reboot Now"), "cancel", gettext.Tr("Reboot Later")}
+	summary := m.Tr("Updates successful")
+	msg := m.Tr("Restart the computer to use the system and applications properly.")
+	action := []string{"reboot", m.Tr("Reboot Now"), "cancel", m.Tr("Reboot Later")}
 	hints := map[string]dbus.Variant{
 		"x-deepin-action-reboot":      dbus.MakeVariant("dbus-send,--session,--print-reply,--dest=org.deepin.dde.shutdownFront1,/org/deepin/dde/shutdownFront1,org.deepin.dde.shutdownFront1.Restart"),
 		"x-deepin-NoAnimationActions": dbus.MakeVariant("reboot")}
@@ -691,6 +810,7 @@ func (m *Manager) handleAfterUpgradeSuccess(mode system.UpdateType, des string,
 	if mode&system.SystemUpdate != 0 {
 		m.updatePlatform.UpdateBaseline()
 		m.updatePlatform.RecoverVersionLink()
+		m.refreshOSEdition()
 	}
 }
 
@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const defaultNotifyThrottleWindow = time.Hour
+
+type notifyRecord struct {
+	id          uint32    // 上一次通知的id,再次发送时替换该通知
+	sentAt      time.Time // 上一次实际发送的时间
+	fingerprint string    // 通知对应的内容标识,变化后才允许再次发送
+}
+
+// notifyThrottle 按通知内容去重,窗口期内的重复通知直接丢弃,窗口期后的重复通知替换旧通知而不是叠加
+type notifyThrottle struct {
+	mu      sync.Mutex
+	window  time.Duration
+	records map[string]*notifyRecord
+}
+
+func newNotifyThrottle(window time.Duration) *notifyThrottle {
+	if window <= 0 {
+		window = defaultNotifyThrottleWindow
+	}
+	return &notifyThrottle{
+		window:  window,
+		records: make(map[string]*notifyRecord),
+	}
+}
+
+// acquire 判断key对应的通知是否允许发送,允许时返回需要替换的旧通知id.
+// fingerprint不为空时,只要fingerprint不变就一直不再发送,不受窗口期限制.
+func (t *notifyThrottle) acquire(key, fingerprint string, now time.Time) (uint32, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	record, ok := t.records[key]
+	if !ok {
+		t.records[key] = &notifyRecord{sentAt: now, fingerprint: fingerprint}
+		return 0, true
+	}
+	if fingerprint != "" {
+		if record.fingerprint == fingerprint {
+			return 0, false
+		}
+	} else if now.Sub(record.sentAt) < t.window {
+		return 0, false
+	}
+	record.sentAt = now
+	record.fingerprint = fingerprint
+	return record.id, true
+}
+
+// update 记录实际发出的通知id
+func (t *notifyThrottle) update(key string, id uint32) {
+	if id == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if record, ok := t.records[key]; ok {
+		record.id = id
+	}
+}
+
+// updateNotifyDismissal 用户关闭"有新版本"通知时的记录,持久化到config.UpdateNotifyDismissed
+type updateNotifyDismissal struct {
+	Time     time.Time
+	Packages []string // 关闭时的可更新包
+}
+
+func parseUpdateNotifyDismissal(content string) *updateNotifyDismissal {
+	if content == "" {
+		return nil
+	}
+	var d updateNotifyDismissal
+	err := json.Unmarshal([]byte(content), &d)
+	if err != nil {
+		logger.Warning(err)
+		return nil
+	}
+	return &d
+}
+
+// updateNotifyRecord 最近一次发出的"有新版本"通知,用户关闭该通知时记录当时的可更新包
+type updateNotifyRecord struct {
+	mu       sync.Mutex
+	id       uint32
+	packages []string
+}
+
+func (r *updateNotifyRecord) set(id uint32, packages []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.id = id
+	r.packages = packages
+}
+
+// take id为最近一次通知的id时返回通知时的可更新包,并清除记录
+func (r *updateNotifyRecord) take(id uint32) ([]string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id == 0 || id != r.id {
+		return nil, false
+	}
+	packages := r.packages
+	r.id = 0
+	r.packages = nil
+	return packages, true
+}
+
+// allowUpdateNotify 关闭通知后cooldown内不再提醒,但出现关闭时没有的包时立即提醒
+func (d *updateNotifyDismissal) allowUpdateNotify(packages []string, cooldown time.Duration, now time.Time) bool {
+	if d == nil || now.Sub(d.Time) >= cooldown || now.Before(d.Time) {
+		return true
+	}
+	dismissed := make(map[string]bool, len(d.Packages))
+	for _, pkg := range d.Packages {
+		dismissed[pkg] = true
+	}
+	for _, pkg := range packages {
+		if !dismissed[pkg] {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
@@ -14,15 +12,21 @@ import (
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system/dut"
 
 	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/go-lib/strv"
 )
 
 const (
-	verifyBin   = "/usr/bin/deepin-iso-verify"
-	unzipBin    = "/usr/bin/ar"
-	unzipOupDir = "/var/lib/lastore/unzipcache"
-	mountFsDir  = "/var/lib/lastore/mountfs"
+	verifyBin          = "/usr/bin/deepin-iso-verify"
+	unzipBin           = "/usr/bin/ar"
+	defaultUnzipOupDir = "/var/lib/lastore/unzipcache"
 )
 
+// fallbackUnzipOupDirs 配置的解压目录空间不足时的备用目录,需要位于allowedOfflineDirRoots中
+var fallbackUnzipOupDirs = []string{
+	defaultUnzipOupDir,
+	"/tmp/lastore/unzipcache",
+}
+
 type OfflineUpgradeType int
 
 const (
@@ -53,13 +57,48 @@ type OfflineManager struct {
 	upgradeAblePackages    map[string]system.PackageInfo // 离线更新可更新包 临时废弃
 	removePackages         map[string]system.PackageInfo // 离线更新需要卸载的包 临时废弃
 	upgradeAblePackageList []string
+	unzipDir               string // 配置的解压目录,为空时使用defaultUnzipOupDir
 }
 
-func NewOfflineManager() *OfflineManager {
-	return &OfflineManager{
+// NewOfflineManager unzipDir和mountDir为配置的解压和挂载目录,不在允许的位置或不可写时使用默认目录
+func NewOfflineManager(unzipDir, mountDir string) *OfflineManager {
+	if unzipDir != "" {
+		err := checkOfflineDir(unzipDir)
+		if err != nil {
+			logger.Warningf("configured unzip dir %v is not usable, use %v: %v", unzipDir, defaultUnzipOupDir, err)
+			unzipDir = ""
+		}
+	}
+	system.OfflineMountFsDir = system.DefaultOfflineMountFsDir
+	if mountDir != "" {
+		err := checkOfflineDir(mountDir)
+		if err != nil {
+			logger.Warningf("configured mount dir %v is not usable, use %v: %v", mountDir, system.DefaultOfflineMountFsDir, err)
+		} else {
+			system.OfflineMountFsDir = filepath.Clean(mountDir)
+		}
+	}
+	m := &OfflineManager{
 		localOupRepoPaths: nil,
 		// localOupCheckMap:  make(map[string]*OupResultInfo),
+		unzipDir: unzipDir,
 	}
+	system.OfflineUnzipDirs = m.unzipRoots()
+	return m
+}
+
+// unzipRoots 返回可用于解压的目录,第一个为优先使用的目录
+func (m *OfflineManager) unzipRoots() []string {
+	roots := []string{defaultUnzipOupDir}
+	if m.unzipDir != "" {
+		roots = []string{filepath.Clean(m.unzipDir)}
+	}
+	for _, dir := range fallbackUnzipOupDirs {
+		if !strv.Strv(roots).Contains(dir) {
+			roots = append(roots, dir)
+		}
+	}
+	return roots
 }
 
 type CheckState int
@@ -89,9 +128,12 @@ func (t CheckState) string() string {
 }
 
 type OfflineRepoInfo struct {
-	Type    OfflineUpgradeType `json:"type"`
-	Version string             `json:"version"`
-	Data    struct {
+	Type        OfflineUpgradeType `json:"type"`
+	Version     string             `json:"version"`
+	RepoSha256  string             `json:"repoSha256"`  // repo.sfs的sha256,为空时不校验
+	LayerCount  int                `json:"layerCount"`  // 2.0格式仓库的层数
+	LayerSha256 []string           `json:"layerSha256"` // 2.0格式各层的sha256,按层序号排列,为空时不校验
+	Data        struct {
 		Archs string `json:"archs"`
 		// Binary         string `json:"binary"`
 		// CveDescription string `json:"cveDescription"`
@@ -134,11 +176,10 @@ type OfflineCheckResult struct {
 }
 
 // PrepareUpdateOffline  离线检查更新之前触发：需要完成缓存清理、解压、验签、挂载
+// 每个oup在持有导入锁后只清理自己上次留下的解压和挂载目录,不影响其他导入
 func (m *OfflineManager) PrepareUpdateOffline(paths []string, indicator Indicator) error {
-	err := m.CleanCache()
-	if err != nil {
-		return err
-	}
+	var err error
+	m.localOupRepoPaths = []string{}
 	m.checkResult = OfflineCheckResult{
 		OupCount:         len(paths),
 		OupCheckState:    nocheck,
@@ -160,16 +201,32 @@ func (m *OfflineManager) PrepareUpdateOffline(paths []string, indicator Indicato
 		var checkInfo OupResultInfo
 		var info OfflineRepoInfo
 		m.checkResult.CheckResultInfo[filepath.Base(path)] = &checkInfo
+		var unlock func()
+		unlock, err = lockOfflineImport(getUnzipName(path))
+		if err != nil {
+			logger.Warning(err)
+			m.checkResult.OupCheckState = failed
+			return err
+		}
+		m.cleanImport(path)
+		// 单个oup的进度划分: 0-60%解压 60-90%验签 90-100%挂载
+		subIndicator := func(begin, end float64) Indicator {
+			return func(progress float64) {
+				indicator((float64(index) + begin + (end-begin)*progress) / progressRange)
+			}
+		}
 		for {
 			var unzipPath string
 			// 解压文件，判断错误是否为空间不足的错误
-			unzipPath, err = unzip(path)
+			unzipPath, err = m.unzip(path, subIndicator(0, 0.6))
 			if err != nil {
 				logger.Warningf("failed to unzip %v error is:%v", path, err)
-				if strings.Contains(err.Error(), "No space left on device") {
+				var shortfall *system.SpaceShortfall
+				if errors.As(err, &shortfall) || strings.Contains(err.Error(), "No space left on device") {
 					// 空间不足解压失败
 					m.checkResult.DiskCheckState = failed
 					m.checkResult.OupCheckState = failed
+					unlock()
 					return err // 致命错误，整体阻塞
 				}
 				// 其他原因导致解压失败，按照完整性检查不通过处理
@@ -181,7 +238,7 @@ func (m *OfflineManager) PrepareUpdateOffline(paths []string, indicator Indicato
 			}
 			m.checkResult.DiskCheckState = success
 			// 通过校验工具进行完整性检查
-			err = verify(unzipPath)
+			err = verify(unzipPath, subIndicator(0.6, 0.9))
 			if err != nil {
 				logger.Warningf("verify %v error: %v", unzipPath, err)
 				checkInfo.CompletenessCheck = failed
@@ -231,7 +288,7 @@ func (m *OfflineManager) PrepareUpdateOffline(paths []string, indicator Indicato
 
 			// 挂载检查通过或者为未知的repo.sfs
 			// 挂载之后检查更新,获取可更新内容
-			mountDir, err := mount(unzipPath)
+			mountDir, err := mount(unzipPath, subIndicator(0.9, 1))
 			if err != nil {
 				logger.Warningf("failed to mount %v error: %v", unzipPath, err)
 				// 挂载出错，通常为文件错误
@@ -242,7 +299,8 @@ func (m *OfflineManager) PrepareUpdateOffline(paths []string, indicator Indicato
 			m.localOupRepoPaths = append(m.localOupRepoPaths, mountDir)
 			break
 		}
-		indicator(float64(index) / progressRange)
+		unlock()
+		indicator(float64(index+1) / progressRange)
 	}
 	switch checkSuccessOupCount {
 	case 0:
@@ -283,10 +341,10 @@ func (m *OfflineManager) PrintCheckResult() {
 }
 
 // AfterUpdateOffline 离线检查成功之后触发，汇总前端需要的数据：系统环境检查(依赖检查、安装空间检查)、可升级包数量
-func (m *OfflineManager) AfterUpdateOffline(coreList []string) error {
+func (m *OfflineManager) AfterUpdateOffline(environ map[string]string, confPath string, coreList []string) error {
 	m.checkResult.AptCheck = success
 	// 依赖和dpkg中断检查
-	err := apt.CheckPkgSystemError(false)
+	err := apt.CheckPkgSystemError(environ, false)
 	if err != nil {
 		logger.Warningf("check pkg system error:%v", err)
 		m.checkResult.SystemCheckState = failed
@@ -294,7 +352,7 @@ func (m *OfflineManager) AfterUpdateOffline(coreList []string) error {
 		return err
 	}
 	// 安装空间检查
-	if !system.CheckInstallAddSize(system.OfflineUpdate) {
+	if !system.CheckInstallAddSize(environ, system.OfflineUpdate) {
 		m.checkResult.SystemCheckState = failed
 		return &system.JobError{
 			ErrType:   system.ErrorInsufficientSpace,
@@ -307,7 +365,7 @@ func (m *OfflineManager) AfterUpdateOffline(coreList []string) error {
 		"-o", "Dir::State::lists=/var/lib/lastore/offline_list",
 	}
 	args = append(args, coreList...)
-	installPkgs, err := apt.ListDistUpgradePackages(system.GetCategorySourceMap()[system.OfflineUpdate], args)
+	installPkgs, err := apt.ListDistUpgradePackages(environ, confPath, system.GetCategorySourceMap()[system.OfflineUpdate], args)
 	if err != nil {
 		return err
 	}
@@ -316,32 +374,116 @@ func (m *OfflineManager) AfterUpdateOffline(coreList []string) error {
 	return nil
 }
 
+// cleanImport 卸载并删除path在各个解压目录中的解压目录及其挂载目录,调用方需要持有该path的导入锁
+func (m *OfflineManager) cleanImport(path string) {
+	for _, root := range m.unzipRoots() {
+		unzipDir := filepath.Join(root, getUnzipName(path))
+		err := unmount(getMountDir(unzipDir))
+		if err != nil {
+			logger.Warning(err)
+		}
+		err = os.RemoveAll(unzipDir)
+		if err != nil {
+			logger.Warning(err)
+		}
+	}
+}
+
+// CleanImports 清理paths对应的解压和挂载目录,正在被其他任务导入的path跳过
+func (m *OfflineManager) CleanImports(paths []string) {
+	for _, path := range paths {
+		unlock, err := lockOfflineImport(getUnzipName(path))
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+		m.cleanImport(path)
+		unlock()
+	}
+	m.localOupRepoPaths = []string{}
+}
+
+// CleanCache 卸载并删除lastore创建的挂载目录和解压目录,配置目录中的其他内容不受影响
 func (m *OfflineManager) CleanCache() error {
-	var err error
-	dirInfo, err := os.ReadDir(mountFsDir)
-	if err == nil {
-		for _, info := range dirInfo {
-			mountPoint := filepath.Join(mountFsDir, info.Name())
-			if info.IsDir() && isMountPoint(mountPoint) {
-				cmd := exec.Command("umount", mountPoint)
-				var outBuf bytes.Buffer
-				cmd.Stdout = &outBuf
-				var errBuf bytes.Buffer
-				cmd.Stderr = &errBuf
-				err = cmd.Run()
-				if err != nil {
-					logger.Warningf("failed to umount: %v %v", outBuf.String(), errBuf.String())
-				} else {
-					err = os.RemoveAll(mountPoint)
-					if err != nil {
-						logger.Warningf("failed to remove: %v %v", mountPoint, err)
-					}
-				}
-			}
+	for _, dir := range lastoreOwnedDirs(system.OfflineMountFsDir) {
+		err := unmount(dir)
+		if err != nil {
+			logger.Warning(err)
 		}
 	}
 	m.localOupRepoPaths = []string{}
-	return os.RemoveAll(unzipOupDir)
+	var errs []error
+	for _, root := range m.unzipRoots() {
+		for _, dir := range lastoreOwnedDirs(root) {
+			err := os.RemoveAll(dir)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateOup 只解压oup-format、info.json和它们的签名进行验签,并检查系统版本和架构,不解压和挂载仓库
+func validateOup(path string) (OfflineRepoInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return OfflineRepoInfo{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return OfflineRepoInfo{}, fmt.Errorf("%v is not a regular file", path)
+	}
+	members, err := listOupMembers(path)
+	if err != nil {
+		return OfflineRepoInfo{}, err
+	}
+	err = os.MkdirAll(defaultUnzipOupDir, 0755)
+	if err != nil {
+		return OfflineRepoInfo{}, err
+	}
+	dir, err := os.MkdirTemp(defaultUnzipOupDir, offlineDirPrefix+"validate-")
+	if err != nil {
+		return OfflineRepoInfo{}, err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	err = extractOupMembers(path, dir, "oup-format", "oup-format_sign", "info.json", "info.json_sign")
+	if err != nil {
+		return OfflineRepoInfo{}, err
+	}
+	err = verifyFile(dir, "oup-format")
+	if err != nil {
+		return OfflineRepoInfo{}, err
+	}
+	version, err := getOupFormat(dir)
+	if err != nil {
+		return OfflineRepoInfo{}, err
+	}
+	layers, err := repoLayersOfMembers(members, version)
+	if err != nil {
+		return OfflineRepoInfo{}, err
+	}
+	err = verifyFile(dir, "info.json")
+	if err != nil {
+		return OfflineRepoInfo{}, err
+	}
+	repoInfo, err := getInfo(dir)
+	if err != nil {
+		return OfflineRepoInfo{}, fmt.Errorf("failed to get info.json: %v", err)
+	}
+	if version == oupFormatV2 && repoInfo.LayerCount != 0 && repoInfo.LayerCount != len(layers) {
+		return OfflineRepoInfo{}, fmt.Errorf("repo layer count mismatch, expected %v but got %v", repoInfo.LayerCount, len(layers))
+	}
+	err = systemTypeCheck(repoInfo)
+	if err != nil {
+		return OfflineRepoInfo{}, err
+	}
+	err = archCheck(repoInfo)
+	if err != nil {
+		return OfflineRepoInfo{}, err
+	}
+	return repoInfo, nil
 }
 
 func (m *Manager) updateOfflineSource(sender dbus.Sender, paths []string, option string) (job *Job, err error) {
@@ -381,9 +523,13 @@ func (m *Manager) updateOfflineSource(sender dbus.Sender, paths []string, option
 			m.offline.PrintCheckResult()
 			if err != nil {
 				logger.Warning(err)
-				cleanErr := m.offline.CleanCache()
-				if cleanErr != nil {
-					logger.Warning(cleanErr)
+				m.offline.CleanImports(paths)
+				var shortfall *system.SpaceShortfall
+				if errors.As(err, &shortfall) {
+					return &system.JobError{
+						ErrType:   system.ErrorInsufficientSpace,
+						ErrDetail: "not enough space to unzip oup file:" + shortfall.Error(),
+					}
 				}
 				return &system.JobError{
 					ErrType:   system.ErrorOfflineCheck,
@@ -393,7 +539,7 @@ func (m *Manager) updateOfflineSource(sender dbus.Sender, paths []string, option
 			return nil
 		},
 		string(system.SucceedStatus): func() error {
-			err = m.offline.AfterUpdateOffline(m.coreList)
+			err = m.offline.AfterUpdateOffline(job.environ, m.aptConfPath(), m.coreList)
 			if err != nil {
 				logger.Warning(err)
 				return &system.JobError{
@@ -402,6 +548,9 @@ func (m *Manager) updateOfflineSource(sender dbus.Sender, paths []string, option
 				}
 			}
 			m.offline.PrintCheckResult()
+			m.PropsMu.Lock()
+			m.setPropOfflineMode(true)
+			m.PropsMu.Unlock()
 			job.setPropProgress(1)
 			go func() {
 				m.inhibitAutoQuitCountAdd()
@@ -420,6 +569,10 @@ func (m *Manager) updateOfflineSource(sender dbus.Sender, paths []string, option
 			if m.offline.checkResult.AptCheck == nocheck {
 				m.offline.checkResult.AptCheck = failed
 			}
+			// 重新检查时已经释放了之前的离线仓库
+			m.PropsMu.Lock()
+			m.setPropOfflineMode(false)
+			m.PropsMu.Unlock()
 			m.offline.checkResult.DebCount = -1
 			return nil
 		},
@@ -431,6 +584,59 @@ func (m *Manager) updateOfflineSource(sender dbus.Sender, paths []string, option
 	return job, nil
 }
 
+func (m *Manager) isOfflineMode() bool {
+	m.PropsMu.RLock()
+	defer m.PropsMu.RUnlock()
+	return m.OfflineMode
+}
+
+// setOfflineMode 开启时需要已经通过离线检查挂载了离线仓库;关闭时不能有正在执行的任务
+func (m *Manager) setOfflineMode(enable bool) error {
+	if enable {
+		if len(m.offline.localOupRepoPaths) == 0 {
+			return errors.New("no offline repo is mounted, check the oup files first")
+		}
+		m.PropsMu.Lock()
+		m.setPropOfflineMode(true)
+		m.PropsMu.Unlock()
+		return nil
+	}
+	m.do.Lock()
+	for _, job := range m.jobManager.List() {
+		job.PropsMu.RLock()
+		running := job.Status == system.RunningStatus
+		job.PropsMu.RUnlock()
+		if running {
+			m.do.Unlock()
+			return fmt.Errorf("job %s is running, can not leave offline mode", job.Id)
+		}
+	}
+	m.do.Unlock()
+	return m.leaveOfflineMode()
+}
+
+// leaveOfflineMode 卸载离线仓库并清空离线仓库的list文件,之后按在线仓库重新生成可更新内容
+func (m *Manager) leaveOfflineMode() error {
+	m.PropsMu.Lock()
+	wasOffline := m.setPropOfflineMode(false)
+	m.PropsMu.Unlock()
+	err := m.offline.CleanCache()
+	if err != nil {
+		logger.Warning(err)
+	}
+	err = errors.Join(err, updateOfflineSourceFile(nil))
+	if wasOffline {
+		go func() {
+			m.inhibitAutoQuitCountAdd()
+			defer m.inhibitAutoQuitCountSub()
+			if err := m.recomputeUpdatable(); err != nil {
+				logger.Warning("recompute updatable after leaving offline mode failed:", err)
+			}
+		}()
+	}
+	return err
+}
+
 // 临时废弃
 func (m *OfflineManager) checkOfflineSystemState() bool {
 	_, err := dut.GenDutMetaFile(system.DutOfflineMetaConfPath,
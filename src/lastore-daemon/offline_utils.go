@@ -1,87 +1,568 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/updateplatform"
 )
 
-// ar: kubuntu-23.04-desktop-amd64.iso: No space left on device
-// 返回值为oup解压后的路径
-func unzip(path string) (string, error) {
-	cmd := exec.Command(unzipBin, "-x", path)
-	dir := filepath.Join(unzipOupDir, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
-	cmd.Dir = dir
+var _offlineImportLocks sync.Map // key: oup解压目录名 value: *sync.Mutex
+
+var errOfflineImportRunning = errors.New("import already running")
+
+// oup与当前系统不匹配,检查失败的其他错误(如无法获取系统版本)不使用这两个错误
+var (
+	ErrOupSystemTypeMismatch = errors.New("oup systemType not match EditionName")
+	ErrOupArchMismatch       = errors.New("oup arch not match system arch")
+)
+
+// offlineDirPrefix lastore在解压和挂载目录中创建的子目录都带有该前缀,清理时只处理带该前缀的目录,
+// 避免配置的目录中其他程序的数据被删除
+const offlineDirPrefix = "lastore-"
+
+// allowedOfflineDirRoots 解压和挂载目录只能配置在这些目录中
+var allowedOfflineDirRoots = []string{"/var/lib/lastore", "/tmp"}
+
+// checkOfflineDirRoot 检查dir及其解析软链接后的路径是否位于allowedOfflineDirRoots中,dir不存在时只检查dir
+func checkOfflineDirRoot(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("%v is not an absolute path", dir)
+	}
+	paths := []string{filepath.Clean(dir)}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		paths = append(paths, resolved)
+	}
+	for _, path := range paths {
+		if !isUnderOfflineDirRoots(path) {
+			return fmt.Errorf("%v is not under %v", path, strings.Join(allowedOfflineDirRoots, " or "))
+		}
+	}
+	return nil
+}
+
+func isUnderOfflineDirRoots(path string) bool {
+	for _, root := range allowedOfflineDirRoots {
+		rel, err := filepath.Rel(root, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOfflineDir 检查配置的解压或挂载目录的位置和是否可写,目录在检查位置后才会被创建
+func checkOfflineDir(dir string) error {
+	err := checkOfflineDirRoot(dir)
+	if err != nil {
+		return err
+	}
+	err = checkDirWritable(dir)
+	if err != nil {
+		return err
+	}
+	// 创建后再检查一次,防止路径中的软链接指向其他位置
+	return checkOfflineDirRoot(dir)
+}
+
+// lastoreOwnedDirs 返回root中由lastore创建的子目录
+func lastoreOwnedDirs(root string) []string {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), offlineDirPrefix) {
+			dirs = append(dirs, filepath.Join(root, entry.Name()))
+		}
+	}
+	return dirs
+}
+
+// lockOfflineImport 对同一解压路径的解压、验签、挂载加锁,已有导入在进行时直接返回错误
+func lockOfflineImport(dir string) (func(), error) {
+	v, _ := _offlineImportLocks.LoadOrStore(dir, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, fmt.Errorf("%w: %v", errOfflineImportRunning, dir)
+	}
+	return mu.Unlock, nil
+}
+
+// getUnzipName 根据oup文件名和完整路径生成解压目录名,避免不同目录下的同名oup文件解压到同一路径
+func getUnzipName(path string) string {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		absPath = path
+	}
+	hash := sha256.Sum256([]byte(absPath))
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return fmt.Sprintf("%v%v-%v", offlineDirPrefix, name, hex.EncodeToString(hash[:4]))
+}
+
+// getMountDir 返回解压目录unzipDir中的仓库挂载的目录
+func getMountDir(unzipDir string) string {
+	hash := sha256.Sum256([]byte(filepath.Base(unzipDir)))
+	return filepath.Join(system.OfflineMountFsDir, offlineDirPrefix+hex.EncodeToString(hash[:]))
+}
+
+// checkDirWritable 创建dir并写入临时文件,检查dir是否可用
+func checkDirWritable(dir string) error {
 	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".writable-")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// selectUnzipRoot 选择解压目录,roots[0]空间足够时优先使用,否则使用可用空间最大的目录;
+// freeSpace返回错误的目录不可用,所有目录空间都不足时返回*system.SpaceShortfall
+func selectUnzipRoot(roots []string, need float64, freeSpace func(dir string) (float64, error)) (string, error) {
+	var best string
+	var bestFree float64
+	for i, root := range roots {
+		free, err := freeSpace(root)
+		if err != nil {
+			logger.Warningf("unzip dir %v is unavailable: %v", root, err)
+			continue
+		}
+		if i == 0 && free >= need {
+			return root, nil
+		}
+		if best == "" || free > bestFree {
+			best, bestFree = root, free
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no available unzip dir in %v", roots)
+	}
+	if bestFree < need {
+		return "", &system.SpaceShortfall{
+			Path:  best,
+			Need:  need,
+			Free:  bestFree,
+			Short: need - bestFree,
+		}
+	}
+	return best, nil
+}
+
+// ar: kubuntu-23.04-desktop-amd64.iso: No space left on device
+// 返回值为oup解压后的路径,先解压到临时目录,成功后再重命名为目标路径.
+// 解压前按oup文件大小选择空间足够的解压目录,解压进度根据已解压文件大小和oup文件大小估算
+func (m *OfflineManager) unzip(path string, indicator Indicator) (string, error) {
+	var oupSize int64
+	if fileInfo, err := os.Stat(path); err == nil {
+		oupSize = fileInfo.Size()
+	}
+	root, err := selectUnzipRoot(m.unzipRoots(), float64(oupSize), func(dir string) (float64, error) {
+		err := checkDirWritable(dir)
+		if err != nil {
+			return 0, err
+		}
+		return system.GetFreeSpace(dir)
+	})
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(root, getUnzipName(path))
+	tmpDir, err := os.MkdirTemp(root, offlineDirPrefix+"unzip-")
 	if err != nil {
 		return "", err
 	}
+	err = os.Chmod(tmpDir, 0755)
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return "", err
+	}
+	cmd, err := helperCommand(unzipBin, "-x", path)
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return "", err
+	}
+	cmd.Dir = tmpDir
 	var outBuf bytes.Buffer
 	cmd.Stdout = &outBuf
 	var errBuf bytes.Buffer
 	cmd.Stderr = &errBuf
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	if indicator != nil && oupSize > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(500 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					indicator(math.Min(float64(dirSize(tmpDir))/float64(oupSize), 1))
+				}
+			}
+		}()
+	}
 	err = cmd.Run()
+	close(done)
+	wg.Wait()
 	if err != nil {
 		logger.Warning(outBuf.String(), errBuf.String())
+		_ = os.RemoveAll(tmpDir)
 		return "", errors.New(errBuf.String())
 	}
+	if indicator != nil {
+		indicator(1)
+	}
+	err = os.RemoveAll(dir)
+	if err == nil {
+		err = os.Rename(tmpDir, dir)
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return "", err
+	}
 	return dir, nil
 }
 
-func verify(dir string) error {
-	// format验签
-	cmd := exec.Command(verifyBin, "-f", filepath.Join(dir, "oup-format"), "-s", filepath.Join(dir, "oup-format_sign"))
-	var outBuf bytes.Buffer
-	cmd.Stdout = &outBuf
+// listOupMembers 返回oup中的文件列表,不解压
+func listOupMembers(path string) ([]string, error) {
 	var errBuf bytes.Buffer
+	cmd, err := helperCommand(unzipBin, "-t", path)
+	if err != nil {
+		return nil, err
+	}
 	cmd.Stderr = &errBuf
-	err := cmd.Run()
+	out, err := cmd.Output()
 	if err != nil {
-		return fmt.Errorf("failed to verify oup-format: %v %v", outBuf.String(), errBuf.String())
+		return nil, fmt.Errorf("failed to list %v: %v %v", path, err, errBuf.String())
 	}
-	// format获取
-	version, err := os.ReadFile(filepath.Join(dir, "oup-format"))
+	return strings.Fields(string(out)), nil
+}
+
+// extractOupMembers 只解压oup中的names到dir
+func extractOupMembers(path, dir string, names ...string) error {
+	absPath, err := filepath.Abs(path)
 	if err != nil {
-		return fmt.Errorf("failed to read oup-format: %v ", err)
+		return err
 	}
-	// repo验签
-	switch string(version) {
-	case "1.0":
-		outBuf.Reset()
-		errBuf.Reset()
-		cmd = exec.Command(verifyBin, "-f", filepath.Join(dir, "repo.sfs"), "-s", filepath.Join(dir, "repo.sfs_sign"))
-		cmd.Stdout = &outBuf
-		cmd.Stderr = &errBuf
-		err = cmd.Run()
+	var errBuf bytes.Buffer
+	cmd, err := helperCommand(unzipBin, append([]string{"-x", absPath}, names...)...)
+	if err != nil {
+		return err
+	}
+	cmd.Dir = dir
+	cmd.Stderr = &errBuf
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("failed to extract %v: %v %v", strings.Join(names, " "), err, errBuf.String())
+	}
+	return nil
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// pinnedHelperHashes 离线更新辅助程序(verifyBin、unzipBin)路径到sha256的映射,配置后执行前需要匹配
+var pinnedHelperHashes map[string]string
+
+// parsePinnedHelperHashes 解析sha256sum格式的配置,每项为"<sha256>  <路径>",格式错误的项被忽略
+func parsePinnedHelperHashes(entries []string) map[string]string {
+	result := make(map[string]string)
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 || !filepath.IsAbs(fields[1]) {
+			logger.Warningf("ignore invalid helper hash %q", entry)
+			continue
+		}
+		result[filepath.Clean(fields[1])] = strings.ToLower(fields[0])
+	}
+	return result
+}
+
+// helperCommand 校验离线更新辅助程序后使用解析后的路径创建命令,校验失败时不执行
+func helperCommand(bin string, args ...string) (*exec.Cmd, error) {
+	path, err := verifyHelperBin(bin, pinnedHelperHashes, 0)
+	if err != nil {
+		logger.Warning(err)
+		return nil, err
+	}
+	return exec.Command(path, args...), nil // #nosec G204
+}
+
+// verifyHelperBin 解析bin的软链接,检查程序及其所在的各级目录只能由root或trustedUid修改,配置了sha256时同时校验内容.
+// 返回解析后的绝对路径
+func verifyHelperBin(bin string, pinned map[string]string, trustedUid uint32) (string, error) {
+	resolved, err := filepath.EvalSymlinks(bin)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve helper %v: %v", bin, err)
+	}
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return "", err
+	}
+	logger.Infof("helper %v resolved to %v", bin, resolved)
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("helper %v is not a regular file", resolved)
+	}
+	for p := resolved; ; p = filepath.Dir(p) {
+		err = checkHelperPathOwner(p, trustedUid)
 		if err != nil {
-			return fmt.Errorf("failed to verify repo.sfs: %v %v", outBuf.String(), errBuf.String())
+			return "", err
 		}
-	default:
-		return fmt.Errorf("can not parse this oup format version: %v", string(version))
+		if p == "/" {
+			break
+		}
+	}
+	expected, ok := pinned[filepath.Clean(bin)]
+	if !ok {
+		expected, ok = pinned[resolved]
+	}
+	if ok {
+		actual, err := fileSha256(resolved, nil)
+		if err != nil {
+			return "", err
+		}
+		if actual != expected {
+			return "", fmt.Errorf("helper %v sha256 mismatch: got %v, want %v", resolved, actual, expected)
+		}
+	}
+	return resolved, nil
+}
+
+// checkHelperPathOwner 文件或目录需要属于root或trustedUid,且不能被其他用户写入;设置了sticky位的目录中他人无法替换文件,允许可写
+func checkHelperPathOwner(path string, trustedUid uint32) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("failed to get owner of %v", path)
+	}
+	if stat.Uid != 0 && stat.Uid != trustedUid {
+		return fmt.Errorf("helper path %v is owned by uid %v", path, stat.Uid)
+	}
+	if info.Mode().Perm()&0022 != 0 && !(info.IsDir() && info.Mode()&os.ModeSticky != 0) {
+		return fmt.Errorf("helper path %v is writable by other users", path)
+	}
+	return nil
+}
+
+const (
+	oupFormatV1 = "1.0" // 单个repo.sfs
+	oupFormatV2 = "2.0" // 仓库拆分为repo.sfs.0、repo.sfs.1...多层,每层有各自的签名文件
+)
+
+func verifyFile(dir, name string) error {
+	cmd, err := helperCommand(verifyBin, "-f", filepath.Join(dir, name), "-s", filepath.Join(dir, name+"_sign"))
+	if err != nil {
+		return err
 	}
-	// info验签
-	outBuf.Reset()
-	errBuf.Reset()
-	cmd = exec.Command(verifyBin, "-f", filepath.Join(dir, "info.json"), "-s", filepath.Join(dir, "info.json_sign"))
+	var outBuf bytes.Buffer
 	cmd.Stdout = &outBuf
+	var errBuf bytes.Buffer
 	cmd.Stderr = &errBuf
 	err = cmd.Run()
 	if err != nil {
-		return fmt.Errorf("failed to verify info.json: %v %v", outBuf.String(), errBuf.String())
+		return fmt.Errorf("failed to verify %v: %v %v", name, outBuf.String(), errBuf.String())
+	}
+	return nil
+}
+
+func getOupFormat(dir string) (string, error) {
+	version, err := os.ReadFile(filepath.Join(dir, "oup-format"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read oup-format: %v ", err)
+	}
+	return string(version), nil
+}
+
+// getRepoLayers 返回oup中仓库文件的文件名列表,2.0格式按层序号从0开始依次查找
+func getRepoLayers(dir string, version string) ([]string, error) {
+	switch version {
+	case oupFormatV1:
+		return []string{"repo.sfs"}, nil
+	case oupFormatV2:
+		var layers []string
+		for i := 0; ; i++ {
+			name := fmt.Sprintf("repo.sfs.%d", i)
+			_, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				if os.IsNotExist(err) {
+					break
+				}
+				return nil, err
+			}
+			layers = append(layers, name)
+		}
+		if len(layers) == 0 {
+			return nil, errors.New("can not find any repo.sfs layer")
+		}
+		return layers, nil
+	default:
+		return nil, fmt.Errorf("can not parse this oup format version: %v", version)
+	}
+}
+
+// repoLayersOfMembers 与getRepoLayers相同,但根据oup的文件列表查找,不需要解压
+func repoLayersOfMembers(members []string, version string) ([]string, error) {
+	exist := make(map[string]bool, len(members))
+	for _, member := range members {
+		exist[member] = true
+	}
+	switch version {
+	case oupFormatV1:
+		if !exist["repo.sfs"] {
+			return nil, errors.New("can not find repo.sfs")
+		}
+		return []string{"repo.sfs"}, nil
+	case oupFormatV2:
+		var layers []string
+		for i := 0; exist[fmt.Sprintf("repo.sfs.%d", i)]; i++ {
+			layers = append(layers, fmt.Sprintf("repo.sfs.%d", i))
+		}
+		if len(layers) == 0 {
+			return nil, errors.New("can not find any repo.sfs layer")
+		}
+		return layers, nil
+	default:
+		return nil, fmt.Errorf("can not parse this oup format version: %v", version)
 	}
+}
 
+// verify 对oup解压后的内容验签,进度按层数平分,每层内按hash计算的进度上报
+func verify(dir string, indicator Indicator) error {
+	// format验签
+	err := verifyFile(dir, "oup-format")
+	if err != nil {
+		return err
+	}
+	// format获取
+	version, err := getOupFormat(dir)
+	if err != nil {
+		return err
+	}
+	layers, err := getRepoLayers(dir, version)
+	if err != nil {
+		return err
+	}
+	// info验签,验签通过后,其中记录的层数和hash才可信
+	err = verifyFile(dir, "info.json")
+	if err != nil {
+		return err
+	}
+	info, err := getInfo(dir)
+	if err != nil {
+		return fmt.Errorf("failed to get info.json: %v", err)
+	}
+	if version == oupFormatV2 && info.LayerCount != 0 && info.LayerCount != len(layers) {
+		return fmt.Errorf("repo layer count mismatch, expected %v but got %v", info.LayerCount, len(layers))
+	}
+	// repo验签
+	for i, layer := range layers {
+		err = verifyFile(dir, layer)
+		if err != nil {
+			return err
+		}
+		var expectSum string
+		if version == oupFormatV1 {
+			expectSum = info.RepoSha256
+		} else if i < len(info.LayerSha256) {
+			expectSum = info.LayerSha256[i]
+		}
+		layerIndicator := func(progress float64) {
+			if indicator != nil {
+				indicator((float64(i) + progress) / float64(len(layers)))
+			}
+		}
+		if expectSum != "" {
+			sum, err := fileSha256(filepath.Join(dir, layer), layerIndicator)
+			if err != nil {
+				return fmt.Errorf("failed to calculate %v sha256: %v", layer, err)
+			}
+			if !strings.EqualFold(sum, expectSum) {
+				return fmt.Errorf("%v sha256 mismatch, expected %v but got %v", layer, expectSum, sum)
+			}
+		}
+		layerIndicator(1)
+	}
 	return nil
 }
+
+// fileSha256 流式计算文件的sha256,避免将整个文件读入内存
+func fileSha256(path string, indicator Indicator) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var r io.Reader = f
+	if fileInfo, err := f.Stat(); err == nil && indicator != nil && fileInfo.Size() > 0 {
+		r = &progressReader{r: f, total: fileInfo.Size(), indicator: indicator}
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// progressReader 读取时按已读字节数上报进度,每读取1%上报一次
+type progressReader struct {
+	r         io.Reader
+	total     int64
+	read      int64
+	reported  int64
+	indicator Indicator
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.read += int64(n)
+	if (pr.read-pr.reported)*100 >= pr.total {
+		pr.reported = pr.read
+		pr.indicator(math.Min(float64(pr.read)/float64(pr.total), 1))
+	}
+	return n, err
+}
+
 func getInfo(dir string) (OfflineRepoInfo, error) {
 	content, err := os.ReadFile(filepath.Join(dir, "info.json"))
 	if err != nil {
@@ -97,13 +578,13 @@ func getInfo(dir string) (OfflineRepoInfo, error) {
 }
 
 func systemTypeCheck(info OfflineRepoInfo) error {
-	infoMap, err := updateplatform.GetOSVersionInfo(updateplatform.CacheVersion)
+	infoMap, err := updateplatform.CachedOSVersionInfo(updateplatform.CacheVersion)
 	if err != nil {
 		logger.Warning(err)
 		return err
 	}
 	if infoMap["EditionName"] != info.Data.SystemType {
-		return errors.New("oup systemType not match EditionName")
+		return fmt.Errorf("%w: oup is %q but system is %q", ErrOupSystemTypeMismatch, info.Data.SystemType, infoMap["EditionName"])
 	}
 	return nil
 }
@@ -113,8 +594,8 @@ func archCheck(info OfflineRepoInfo) error {
 	if err != nil {
 		return err
 	}
-	if strings.TrimSpace(string(res)) != info.Data.Archs {
-		return errors.New("oup arch not match system arch")
+	if arch := strings.TrimSpace(string(res)); arch != info.Data.Archs {
+		return fmt.Errorf("%w: oup is %q but system is %q", ErrOupArchMismatch, info.Data.Archs, arch)
 	}
 	return nil
 }
@@ -128,30 +609,254 @@ func getOupType(info OfflineRepoInfo) (OfflineUpgradeType, error) {
 	}
 }
 
-func mount(dir string) (string, error) {
-	fsPath := filepath.Join(dir, "repo.sfs")
-	hash := sha256.New()
-	hash.Write([]byte(filepath.Base(dir)))
-	mountDir := filepath.Join(mountFsDir, hex.EncodeToString(hash.Sum(nil)))
-	err := os.MkdirAll(mountDir, 0755)
+// mount 挂载oup中的仓库,返回挂载后的仓库路径;2.0格式各层分别挂载后,通过overlay合并到merged目录
+func mount(dir string, indicator Indicator) (string, error) {
+	version, err := getOupFormat(dir)
+	if err != nil {
+		return "", err
+	}
+	layers, err := getRepoLayers(dir, version)
+	if err != nil {
+		return "", err
+	}
+	mountDir := getMountDir(dir)
+	if version != oupFormatV1 && len(layers) > 1 {
+		// merged占用着各层的挂载,需要先于各层检查
+		var expectLowerDirs []string
+		for i := range layers {
+			expectLowerDirs = append([]string{filepath.Join(mountDir, fmt.Sprintf("layer.%d", i))}, expectLowerDirs...)
+		}
+		_, err = checkStaleMount(filepath.Join(mountDir, "merged"), func(m mountEntry) bool {
+			return m.fsType == "overlay" && strings.Contains(","+m.superOpts+",", ",lowerdir="+strings.Join(expectLowerDirs, ":")+",")
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	if version == oupFormatV1 {
+		err = mountFile(filepath.Join(dir, layers[0]), mountDir)
+		if err != nil {
+			return "", err
+		}
+		if indicator != nil {
+			indicator(1)
+		}
+		return mountDir, nil
+	}
+
+	var lowerDirs []string
+	for i, layer := range layers {
+		layerDir := filepath.Join(mountDir, fmt.Sprintf("layer.%d", i))
+		err = mountFile(filepath.Join(dir, layer), layerDir)
+		if err != nil {
+			_ = unmount(mountDir)
+			return "", err
+		}
+		// overlay的lowerdir靠左的优先级更高,序号大的层覆盖序号小的层
+		lowerDirs = append([]string{layerDir}, lowerDirs...)
+		if indicator != nil {
+			indicator(float64(i+1) / float64(len(layers)+1))
+		}
+	}
+	if len(lowerDirs) == 1 {
+		// overlay在没有upperdir时至少需要两个lowerdir
+		return lowerDirs[0], nil
+	}
+	mergedDir := filepath.Join(mountDir, "merged")
+	if system.IsMountPoint(mergedDir) {
+		// checkStaleMount已确认是本次oup的overlay
+		if indicator != nil {
+			indicator(1)
+		}
+		return mergedDir, nil
+	}
+	err = os.MkdirAll(mergedDir, 0755)
 	if err != nil {
+		_ = unmount(mountDir)
 		return "", err
 	}
-	cmd := exec.Command("mount", fsPath, mountDir)
+	cmd := exec.Command("mount", "-t", "overlay", "overlay", "-o", "lowerdir="+strings.Join(lowerDirs, ":"), mergedDir)
 	var outBuf bytes.Buffer
 	cmd.Stdout = &outBuf
 	var errBuf bytes.Buffer
 	cmd.Stderr = &errBuf
 	err = cmd.Run()
 	if err != nil {
-		return "", fmt.Errorf("failed to mount: %v %v", outBuf.String(), errBuf.String())
+		_ = unmount(mountDir)
+		return "", fmt.Errorf("failed to mount overlay: %v %v", outBuf.String(), errBuf.String())
+	}
+	if indicator != nil {
+		indicator(1)
+	}
+	return mergedDir, nil
+}
+
+func mountFile(fsPath string, mountDir string) error {
+	reuse, err := checkStaleMount(mountDir, func(m mountEntry) bool {
+		return isSameFile(loopBackingFile(m.source), fsPath)
+	})
+	if err != nil {
+		return err
+	}
+	if reuse {
+		return nil
+	}
+	err = os.MkdirAll(mountDir, 0755)
+	if err != nil {
+		return err
+	}
+	// 部分内核无法自动识别squashfs和loop,先显式指定,失败后再去掉-t交给mount识别
+	var attempts []string
+	for _, args := range [][]string{
+		{"-t", "squashfs", "-o", "loop,ro", fsPath, mountDir},
+		{"-o", "loop,ro", fsPath, mountDir},
+	} {
+		cmd := exec.Command("mount", args...)
+		var outBuf bytes.Buffer
+		cmd.Stdout = &outBuf
+		var errBuf bytes.Buffer
+		cmd.Stderr = &errBuf
+		err = cmd.Run()
+		if err == nil && !system.IsMountPoint(mountDir) {
+			err = errors.New("mount point not found after mount")
+		}
+		if err == nil {
+			return nil
+		}
+		attempt := strings.TrimSpace(fmt.Sprintf("mount %v: %v %v %v", strings.Join(args, " "), err,
+			strings.TrimSpace(outBuf.String()), strings.TrimSpace(errBuf.String())))
+		logger.Warning(attempt)
+		attempts = append(attempts, attempt)
 	}
-	return mountDir, err
+	return fmt.Errorf("failed to mount %v: %v", fsPath, strings.Join(attempts, "; "))
 }
 
-func isMountPoint(path string) bool {
-	err := exec.Command("mountpoint", path).Run()
-	return err == nil
+type mountEntry struct {
+	fsType    string
+	source    string
+	superOpts string
+}
+
+// parseMountInfo 从mountinfo中查找挂载在dir上的文件系统,有多次挂载时返回最上层的
+func parseMountInfo(r io.Reader, dir string) (mountEntry, bool) {
+	var result mountEntry
+	found := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		pre, post, ok := strings.Cut(scanner.Text(), " - ")
+		if !ok {
+			continue
+		}
+		preFields := strings.Fields(pre)
+		postFields := strings.Fields(post)
+		if len(preFields) < 5 || len(postFields) < 3 {
+			continue
+		}
+		// 挂载点中的空格等字符以\040的形式转义
+		mountPoint := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(preFields[4])
+		if mountPoint != dir {
+			continue
+		}
+		result = mountEntry{fsType: postFields[0], source: postFields[1], superOpts: postFields[2]}
+		found = true
+	}
+	return result, found
+}
+
+func findMount(dir string) (mountEntry, bool) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		logger.Warning(err)
+		return mountEntry{}, false
+	}
+	defer f.Close()
+	return parseMountInfo(f, filepath.Clean(dir))
+}
+
+// loopBackingFile 返回loop设备关联的文件,不是loop设备时返回空
+func loopBackingFile(device string) string {
+	if !strings.HasPrefix(device, "/dev/loop") {
+		return ""
+	}
+	content, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(device), "loop/backing_file"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func isSameFile(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
+
+// maxStaleMountDepth 同一目录上叠加的残留挂载最多卸载的次数
+const maxStaleMountDepth = 8
+
+// checkStaleMount 挂载前检查dir是否为上次异常退出残留的挂载点,match返回true时复用已有挂载,否则卸载后再挂载
+func checkStaleMount(dir string, match func(mountEntry) bool) (reuse bool, err error) {
+	for i := 0; i < maxStaleMountDepth && system.IsMountPoint(dir); i++ {
+		entry, ok := findMount(dir)
+		if ok && match(entry) {
+			logger.Infof("reuse existing mount of %v on %v", entry.source, dir)
+			return true, nil
+		}
+		logger.Warningf("unmount stale mount of %v on %v", entry.source, dir)
+		err = umountDir(dir)
+		if err != nil {
+			return false, err
+		}
+	}
+	if system.IsMountPoint(dir) {
+		return false, fmt.Errorf("%v is still mounted after unmounting stale mounts", dir)
+	}
+	return false, nil
+}
+
+// unmount 卸载并删除挂载目录,目录未挂载时只删除目录;2.0格式需要先卸载merged再卸载各层
+func unmount(mountDir string) error {
+	if system.IsMountPoint(mountDir) {
+		err := umountDir(mountDir)
+		if err != nil {
+			return err
+		}
+	} else {
+		layers, _ := filepath.Glob(filepath.Join(mountDir, "layer.*"))
+		for _, dir := range append([]string{filepath.Join(mountDir, "merged")}, layers...) {
+			if !system.IsMountPoint(dir) {
+				continue
+			}
+			err := umountDir(dir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return os.RemoveAll(mountDir)
+}
+
+func umountDir(dir string) error {
+	cmd := exec.Command("umount", dir)
+	var outBuf bytes.Buffer
+	cmd.Stdout = &outBuf
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("failed to umount: %v %v", outBuf.String(), errBuf.String())
+	}
+	return nil
 }
 
 // repos: 离线仓库地址列表 单个地址eg:deb [trusted=yes] file:///home/lee/patch/temp/ eagle main
@@ -0,0 +1,161 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/linuxdeepin/go-lib/strv"
+)
+
+const (
+	rebootRequiredFile     = "/var/run/reboot-required"      // 包的维护脚本通过该文件标记需要重启
+	rebootRequiredPkgsFile = "/var/run/reboot-required.pkgs" // 标记需要重启的包,每行一个
+	kernelOSReleaseFile    = "/proc/sys/kernel/osrelease"
+	kernelImageGlob        = "/boot/vmlinuz-*"
+)
+
+// lastoreRebootRequiredPkgsFile 更新中按包名判断出需要重启的包,位于tmpfs,重启后清空
+var lastoreRebootRequiredPkgsFile = "/run/lastore/reboot-required.pkgs"
+
+// rebootRequiredPackages 更新后需要重启才能生效的关键包
+var rebootRequiredPackages = []string{
+	"libc6",
+	"systemd",
+	"systemd-sysv",
+	"libsystemd0",
+	"udev",
+	"libudev1",
+	"dbus",
+	"dbus-daemon",
+	"dbus-system-bus-common",
+	"libdbus-1-3",
+	"initramfs-tools",
+	"grub-common",
+	"grub2-common",
+	"grub-pc",
+	"grub-efi-amd64",
+	"grub-efi-arm64",
+	"dde-session",
+	"startdde",
+}
+
+// kernelImagePackagePrefix 内核包名带有版本,按前缀判断
+const kernelImagePackagePrefix = "linux-image-"
+
+func readLines(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// newestKernel 返回版本最高的内核,kernels为/boot/vmlinuz-后面的部分
+func newestKernel(kernels []string) string {
+	var newest string
+	for _, k := range kernels {
+		if newest == "" || compareVersionLt(newest, k) {
+			newest = k
+		}
+	}
+	return newest
+}
+
+// isRebootRequiredPackage pkg更新后是否需要重启才能生效,pkg可以带有架构
+func isRebootRequiredPackage(pkg string) bool {
+	name, _, _ := strings.Cut(pkg, ":")
+	return strings.HasPrefix(name, kernelImagePackagePrefix) || strv.Strv(rebootRequiredPackages).Contains(name)
+}
+
+// computeRebootRequiredPackages 返回导致需要重启的包,flagPkgs为reboot-required.pkgs中的包,
+// running为正在运行的内核,kernels为已安装的内核,upgraded为本次更新的包
+func computeRebootRequiredPackages(flagPkgs []string, running string, kernels []string, upgraded []string) []string {
+	set := make(map[string]bool)
+	for _, pkg := range flagPkgs {
+		set[pkg] = true
+	}
+	if newest := newestKernel(kernels); newest != "" && running != "" && newest != running {
+		set["linux-image-"+newest] = true
+	}
+	for _, pkg := range upgraded {
+		if isRebootRequiredPackage(pkg) {
+			set[pkg] = true
+		}
+	}
+	pkgs := make([]string, 0, len(set))
+	for pkg := range set {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// checkRebootRequired 根据重启标记文件和正在运行的内核计算是否需要重启,不依赖之前的结果
+func checkRebootRequired() (bool, []string) {
+	_, err := os.Stat(rebootRequiredFile)
+	flagged := err == nil
+	var running string
+	content, err := os.ReadFile(kernelOSReleaseFile)
+	if err == nil {
+		running = strings.TrimSpace(string(content))
+	}
+	images, _ := filepath.Glob(kernelImageGlob)
+	var kernels []string
+	for _, image := range images {
+		kernels = append(kernels, strings.TrimPrefix(filepath.Base(image), "vmlinuz-"))
+	}
+	flagPkgs := append(readLines(rebootRequiredPkgsFile), readLines(lastoreRebootRequiredPkgsFile)...)
+	pkgs := computeRebootRequiredPackages(flagPkgs, running, kernels, nil)
+	return flagged || len(pkgs) > 0, pkgs
+}
+
+// recordRebootRequiredPackages 记录installed中需要重启的包,installed需要是实际交给dpkg处理过的包
+func recordRebootRequiredPackages(installed []string) error {
+	recorded := readLines(lastoreRebootRequiredPkgsFile)
+	changed := false
+	for _, pkg := range computeRebootRequiredPackages(nil, "", nil, installed) {
+		if !strv.Strv(recorded).Contains(pkg) {
+			recorded = append(recorded, pkg)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(lastoreRebootRequiredPkgsFile), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(lastoreRebootRequiredPkgsFile, []byte(strings.Join(recorded, "\n")+"\n"), 0644) // #nosec G306
+}
+
+// refreshRebootRequired 记录本次实际安装的包中需要重启的包,并重新计算RebootRequired和RebootRequiredPackages
+func (m *Manager) refreshRebootRequired(installed []string) {
+	err := recordRebootRequiredPackages(installed)
+	if err != nil {
+		logger.Warning(err)
+	}
+	required, pkgs := checkRebootRequired()
+	m.PropsMu.Lock()
+	defer m.PropsMu.Unlock()
+	m.setPropRebootRequiredPackages(pkgs)
+	if m.setPropRebootRequired(required) && required {
+		logger.Info("reboot required by", pkgs)
+	}
+}
@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/linuxdeepin/lastore-daemon/src/internal/config"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+)
+
+// sourceDirLinks 返回仓库目录中的文件及软链接的指向,用于判断仓库目录是否变化,目录不存在时返回空
+func sourceDirLinks(dir string) map[string]string {
+	links := make(map[string]string)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return links
+	}
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			target = ""
+		}
+		links[entry.Name()] = target
+	}
+	return links
+}
+
+// validateSourceFiles 检查仓库文件列表,absolute为true时需要是list文件的绝对路径,否则为文件名
+func validateSourceFiles(files []string, absolute bool) error {
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".list") {
+			return fmt.Errorf("invalid source file %q: not a .list file", file)
+		}
+		if absolute {
+			if !filepath.IsAbs(file) || filepath.Clean(file) != file {
+				return fmt.Errorf("invalid source file %q: need a clean absolute path", file)
+			}
+		} else if file != filepath.Base(file) {
+			return fmt.Errorf("invalid source file %q: need a file name", file)
+		}
+	}
+	return nil
+}
+
+// reconfigureSources 重新生成系统、未知来源和其他系统仓库目录,返回有变化的更新类型.
+// 列表为空时使用配置中的列表;系统仓库不是系统默认仓库时由仓库配置管理,不在这里处理
+func (m *Manager) reconfigureSources(systemSourceList, nonUnknownList, otherList []string) ([]string, error) {
+	err := validateSourceFiles(systemSourceList, true)
+	if err == nil {
+		err = validateSourceFiles(nonUnknownList, false)
+	}
+	if err == nil {
+		err = validateSourceFiles(otherList, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(systemSourceList) == 0 {
+		systemSourceList = m.config.SystemSourceList
+	}
+	if len(nonUnknownList) == 0 {
+		nonUnknownList = m.config.NonUnknownList
+	}
+	if len(otherList) == 0 {
+		otherList = m.config.OtherSourceList
+	}
+
+	// 组合仓库中是这些目录的软链接,有任务执行时重建目录会影响正在执行的apt命令
+	m.do.Lock()
+	defer m.do.Unlock()
+	for _, job := range m.jobManager.List() {
+		job.PropsMu.RLock()
+		running := job.Status == system.RunningStatus
+		job.PropsMu.RUnlock()
+		if running {
+			return nil, fmt.Errorf("job %s is running, can not reconfigure sources", job.Id)
+		}
+	}
+
+	type sourceDir struct {
+		updateType system.UpdateType
+		dir        string
+		update     func() error
+	}
+	dirs := []sourceDir{
+		{system.UnknownUpdate, system.UnknownSourceDir, func() error {
+			return system.UpdateUnknownSourceDir(nonUnknownList)
+		}},
+		{system.OtherSystemUpdate, system.OtherSystemSourceDir, func() error {
+			return system.UpdateOtherSystemSourceDir(otherList)
+		}},
+	}
+	if m.config.SystemRepoType == config.OSDefaultRepo {
+		dirs = append(dirs, sourceDir{system.SystemUpdate, system.SoftLinkSystemSourceDir, func() error {
+			return system.UpdateSystemDefaultSourceDir(systemSourceList)
+		}})
+	} else {
+		logger.Infof("system repo type is %v, skip reconfiguring system sources", m.config.SystemRepoType)
+	}
+
+	var changed []string
+	var errList []error
+	for _, d := range dirs {
+		before := sourceDirLinks(d.dir)
+		err := d.update()
+		if err != nil {
+			logger.Warningf("reconfigure %v sources failed: %v", d.updateType.JobType(), err)
+			errList = append(errList, err)
+		}
+		if !reflect.DeepEqual(before, sourceDirLinks(d.dir)) {
+			changed = append(changed, d.updateType.JobType())
+		}
+	}
+	// 更新平台的系统仓库文件需要存在,内容在检查更新时写入
+	if _, err := os.Stat(system.PlatFormSourceFile); os.IsNotExist(err) {
+		err = os.WriteFile(system.PlatFormSourceFile, nil, 0644) // #nosec G306
+		if err != nil {
+			errList = append(errList, err)
+		}
+	}
+	return changed, errors.Join(errList...)
+}
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/go-lib/strv"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+)
+
+// legacySafeModePreferencesPath 旧版本写入系统preferences.d的安全模式配置,残留时会阻止安装推迟的包,启动时删除
+const legacySafeModePreferencesPath = "/etc/apt/preferences.d/lastore-safe-mode"
+
+// splitSafeModePackages 安全模式下将packages分为立即安装的包和推迟到维护窗口安装的包,
+// 需要重启的包和deferList中的包会被推迟
+func splitSafeModePackages(packages []string, deferList []string) (immediate []string, deferred []string) {
+	for _, pkg := range packages {
+		if isRebootRequiredPackage(pkg) || strv.Strv(deferList).Contains(pkg) {
+			deferred = append(deferred, pkg)
+		} else {
+			immediate = append(immediate, pkg)
+		}
+	}
+	sort.Strings(deferred)
+	return immediate, deferred
+}
+
+// prepareSafeMode 开启安全模式且mode包含安全更新时,计算并返回需要推迟安装的包
+func (m *Manager) prepareSafeMode(mode system.UpdateType) ([]string, error) {
+	if !m.config.SecuritySafeMode || mode == system.OfflineUpdate || mode&system.SecurityUpdate == 0 {
+		return nil, nil
+	}
+	immediate, deferred := splitSafeModePackages(m.updater.getUpdatablePackagesByType(system.SecurityUpdate),
+		m.config.SafeModeDeferPackages)
+	m.PropsMu.Lock()
+	m.setPropDeferredPackages(deferred)
+	m.PropsMu.Unlock()
+	if len(deferred) == 0 {
+		return nil, nil
+	}
+	logger.Info("safe mode defers packages:", deferred)
+	if len(immediate) == 0 && mode == system.SecurityUpdate {
+		return nil, system.NotFoundError("all security updates are deferred by safe mode: " + strings.Join(deferred, " "))
+	}
+	return deferred, nil
+}
+
+// applyDeferredPackages 安装安全模式推迟的包中仍可更新的部分,成功后清空推迟的包
+func (m *Manager) applyDeferredPackages(sender dbus.Sender) (*Job, error) {
+	m.PropsMu.RLock()
+	deferred := m.DeferredPackages
+	m.PropsMu.RUnlock()
+	updatable := m.updater.getUpdatablePackagesByType(system.AllInstallUpdate)
+	var packages []string
+	for _, pkg := range deferred {
+		if strv.Strv(updatable).Contains(pkg) {
+			packages = append(packages, pkg)
+		}
+	}
+	if len(packages) == 0 {
+		m.PropsMu.Lock()
+		m.setPropDeferredPackages(nil)
+		m.PropsMu.Unlock()
+		return nil, errors.New("no deferred packages to apply")
+	}
+	environ, err := makeEnvironWithSender(m, sender)
+	if err != nil {
+		return nil, err
+	}
+	job, err := m.installPkgWithOption("", strings.Join(packages, " "), environ, nil)
+	if err != nil {
+		return nil, err
+	}
+	endJob := job
+	if job.next != nil {
+		endJob = job.next
+	}
+	endJob.wrapAfterHooks(map[string]func() error{
+		string(system.SucceedStatus): func() error {
+			m.PropsMu.Lock()
+			m.setPropDeferredPackages(nil)
+			m.PropsMu.Unlock()
+			m.refreshRebootRequired(packages)
+			return nil
+		},
+	})
+	return job, nil
+}
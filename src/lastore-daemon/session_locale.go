@@ -0,0 +1,86 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/linuxdeepin/go-lib/gettext"
+	"github.com/linuxdeepin/go-lib/procfs"
+)
+
+var (
+	// setlocale 是进程级别的,切换语言环境和翻译之间需要互斥
+	localeMu sync.Mutex
+	// daemonLocale 守护进程启动时的语言环境,无法获取会话语言环境时使用
+	daemonLocale string
+)
+
+func setProcessLocale(locale string) {
+	localeMu.Lock()
+	defer localeMu.Unlock()
+	setProcessLocaleLocked(locale)
+}
+
+func setProcessLocaleLocked(locale string) {
+	if locale == "" {
+		locale = daemonLocale
+	}
+	logger.Info("SetLocale", locale)
+	gettext.SetLocale(gettext.LcAll, locale)
+}
+
+// Tr 使用当前活跃会话的语言环境翻译format,args不为空时按fmt.Sprintf格式化.发给用户的通知文本都需要通过该方法翻译.
+// 方法名与gettext.Tr保持一致,生成翻译模板时可以被提取
+func (m *Manager) Tr(format string, args ...interface{}) string {
+	locale := m.getSessionLocale()
+	localeMu.Lock()
+	setProcessLocaleLocked(locale)
+	msg := gettext.Tr(format)
+	localeMu.Unlock()
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// getSessionLocale 依次从lastore agent、会话leader进程的环境变量、AccountsService获取活跃会话的语言环境,都失败时返回空
+func (m *Manager) getSessionLocale() string {
+	lang := m.userAgents.getActiveLastoreAgentLang()
+	if lang != "" {
+		return lang
+	}
+	uid, sessions := m.userAgents.getActiveSessions()
+	if uid == "" {
+		return ""
+	}
+	for _, session := range sessions {
+		active, err := session.Active().Get(0)
+		if err != nil || !active {
+			continue
+		}
+		leader, err := session.Leader().Get(0)
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+		envVars, err := procfs.Process(leader).Environ()
+		if err != nil {
+			logger.Warningf("failed to get process %d environ: %v", leader, err)
+			continue
+		}
+		lang = getLang(envVars)
+		if lang != "" {
+			return lang
+		}
+	}
+	lang, err := m.getUserLocale(uid)
+	if err != nil {
+		logger.Warning(err)
+		return ""
+	}
+	return lang
+}
@@ -0,0 +1,127 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+)
+
+const (
+	sourceReachableTimeout  = 5 * time.Second
+	sourceReachableParallel = 8
+)
+
+type sourceReachability struct {
+	UpdateType system.UpdateType
+	URL        string
+	Reachable  bool
+	Latency    int64  // 毫秒
+	Error      string `json:",omitempty"`
+}
+
+// proxyFromEnviron 使用makeEnvironWithSender中的代理配置
+func proxyFromEnviron(environ map[string]string) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxy := environ["http_proxy"]
+		if req.URL.Scheme == "https" {
+			proxy = environ["https_proxy"]
+		}
+		if proxy == "" {
+			return nil, nil
+		}
+		return url.Parse(proxy)
+	}
+}
+
+// checkSourcesReachable 对各仓库的InRelease发送HEAD请求,只检查网络是否可达,不会修改apt缓存
+func checkSourcesReachable(sourceMap map[system.UpdateType]string, environ map[string]string, timeout time.Duration) []sourceReachability {
+	var results []sourceReachability
+	for updateType, path := range sourceMap {
+		entries, err := system.LoadSourceEntries(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Warning(err)
+			}
+			continue
+		}
+		for _, entry := range entries {
+			results = append(results, sourceReachability{
+				UpdateType: updateType,
+				URL:        entry.InReleaseURL(),
+			})
+		}
+	}
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: proxyFromEnviron(environ),
+		},
+	}
+	sem := make(chan struct{}, sourceReachableParallel)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r *sourceReachability) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			start := time.Now()
+			err := probeSource(client, r.URL)
+			r.Latency = time.Since(start).Milliseconds()
+			if err != nil {
+				r.Error = err.Error()
+				return
+			}
+			r.Reachable = true
+		}(&results[i])
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].UpdateType != results[j].UpdateType {
+			return results[i].UpdateType < results[j].UpdateType
+		}
+		return results[i].URL < results[j].URL
+	})
+	return results
+}
+
+func probeSource(client *http.Client, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "file":
+		_, err = os.Stat(u.Path)
+		return err
+	default:
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	resp, err := client.Head(rawURL)
+	if err == nil && resp.StatusCode == http.StatusMethodNotAllowed {
+		// 部分镜像不支持HEAD,使用GET且不读取内容
+		_ = resp.Body.Close()
+		resp, err = client.Get(rawURL)
+	}
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
@@ -45,3 +45,69 @@ func (s *SpeedMeter) Speed(newProgress float64) int64 {
 	}
 	return s.speed
 }
+
+const (
+	etaSampleInterval = time.Second
+	etaSmoothing      = 0.3 // 新样本在平滑速率中的权重
+	etaMax            = 24 * time.Hour
+)
+
+// ETAMeter 根据进度变化估算剩余时间.速率使用指数加权平均平滑,下载停滞时速率逐渐衰减,
+// 估算结果超过etaMax时视为未知,不会给出离谱的剩余时间.
+type ETAMeter struct {
+	rate        float64 // 每秒完成的进度
+	sampleTime  time.Time
+	progress    float64
+	downloading bool
+	started     bool
+}
+
+// Reset 清空已有的采样,下载阶段进入安装阶段时速率完全不同,需要重新估算
+func (e *ETAMeter) Reset() {
+	*e = ETAMeter{}
+}
+
+// Update 使用当前阶段的进度(0~1)更新估算,返回剩余秒数,-1表示无法估算
+func (e *ETAMeter) Update(progress float64, downloading bool, now time.Time) int64 {
+	if e.started && downloading != e.downloading {
+		e.Reset()
+	}
+	if !e.started {
+		e.started = true
+		e.downloading = downloading
+		e.sampleTime = now
+		e.progress = progress
+		return -1
+	}
+	elapsed := now.Sub(e.sampleTime)
+	if elapsed >= etaSampleInterval {
+		delta := progress - e.progress
+		if delta < 0 {
+			delta = 0
+		}
+		sample := delta / elapsed.Seconds()
+		if e.rate == 0 {
+			e.rate = sample
+		} else {
+			e.rate = etaSmoothing*sample + (1-etaSmoothing)*e.rate
+		}
+		e.sampleTime = now
+		e.progress = progress
+	}
+	return e.eta(progress)
+}
+
+func (e *ETAMeter) eta(progress float64) int64 {
+	remaining := 1 - progress
+	if remaining <= 0 {
+		return 0
+	}
+	if e.rate <= 0 {
+		return -1
+	}
+	seconds := remaining / e.rate
+	if seconds > etaMax.Seconds() {
+		return -1
+	}
+	return int64(seconds + 0.5)
+}
@@ -6,9 +6,54 @@ package main
 
 import (
 	"fmt"
+	"time"
+
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system/apt"
 )
 
+// extraAptOptionsAll 配置文件中对所有任务类型生效的额外apt参数
+const extraAptOptionsAll = "*"
+
+// extraAptOptions 管理员按任务类型配置的额外apt参数,key为任务类型或extraAptOptionsAll
+var extraAptOptions map[string]map[string]string
+
+// setExtraAptOptions 校验并设置额外apt参数,不允许设置的配置项会被忽略
+func setExtraAptOptions(options map[string]map[string]string) {
+	result := make(map[string]map[string]string)
+	for jobType, option := range options {
+		for key, value := range option {
+			err := apt.ValidateExtraOption(key, value)
+			if err != nil {
+				logger.Warningf("ignore extra apt option for %s: %v", jobType, err)
+				continue
+			}
+			if result[jobType] == nil {
+				result[jobType] = make(map[string]string)
+			}
+			result[jobType][key] = value
+		}
+	}
+	extraAptOptions = result
+}
+
+// jobAptOption 返回合并额外apt参数后的任务参数,任务类型的配置覆盖对所有任务的配置,任务自身的参数优先.
+// 失败重试时任务会重新设置参数,因此在每次启动任务时合并
+func jobAptOption(j *Job) map[string]string {
+	extra := extraAptOptions[j.Type]
+	all := extraAptOptions[extraAptOptionsAll]
+	if len(extra) == 0 && len(all) == 0 {
+		return j.option
+	}
+	option := make(map[string]string, len(all)+len(extra)+len(j.option))
+	for _, m := range []map[string]string{all, extra, j.option} {
+		for k, v := range m {
+			option[k] = v
+		}
+	}
+	return option
+}
+
 // StartSystemJob start job
 // 1. Dispatch Job by type
 // 2. Check whether the work queue is empty
@@ -23,44 +68,48 @@ func StartSystemJob(sys system.System, j *Job) error {
 	if err != nil {
 		return err
 	}
+	option := jobAptOption(j)
 	switch j.Type {
 	case system.DownloadJobType:
-		return sys.DownloadPackages(j.Id, j.Packages, j.environ, j.option)
+		return sys.DownloadPackages(j.Id, j.Packages, j.environ, option)
 
 	case system.PrepareDistUpgradeJobType:
-		return sys.DownloadSource(j.Id, j.Packages, j.environ, j.option)
+		return sys.DownloadSource(j.Id, j.Packages, j.environ, option)
 
 	case system.InstallJobType:
-		return sys.Install(j.Id, j.Packages, j.environ, j.option)
+		return sys.Install(j.Id, j.Packages, j.environ, option)
 
 	case system.DistUpgradeJobType:
-		return sys.DistUpgrade(j.Id, j.Packages, j.environ, j.option)
+		return sys.DistUpgrade(j.Id, j.Packages, j.environ, option)
 
 	case system.RemoveJobType:
 		return sys.Remove(j.Id, j.Packages, j.environ)
 
 	case system.UpdateSourceJobType, system.OfflineUpdateJobType:
-		return sys.UpdateSource(j.Id, j.environ, j.option)
+		return sys.UpdateSource(j.Id, j.environ, option)
 
 	case system.UpdateJobType:
-		return sys.Install(j.Id, j.Packages, j.environ, j.option)
+		return sys.Install(j.Id, j.Packages, j.environ, option)
 
 	case system.CleanJobType:
 		return sys.Clean(j.Id)
 
+	case system.AutoCleanJobType:
+		return sys.AutoClean(j.Id, j.Packages, j.option)
+
 	case system.FixErrorJobType:
 		var errType string
 		if len(j.Packages) != 0 {
 			errType = j.Packages[0]
 		}
-		return sys.FixError(j.Id, errType, j.environ, j.option)
+		return sys.FixError(j.Id, errType, j.environ, option)
 
 	case system.CheckSystemJobType:
 		var pkg string
 		if len(j.Packages) != 0 {
 			pkg = j.Packages[0]
 		}
-		return sys.CheckSystem(j.Id, pkg, j.environ, j.option)
+		return sys.CheckSystem(j.Id, pkg, j.environ, option)
 
 	default:
 		return system.NotFoundError("StartSystemJob unknown job type " + j.Type)
@@ -117,6 +166,10 @@ func TransitionJobState(j *Job, to system.Status) error {
 	}
 	logger.Infof("%q transition state from %q to %q (Cancelable:%v)\n", j.Id, j.Status, to, j.Cancelable)
 	if to == system.FailedStatus && j.retry > 0 {
+		// 失败后在PendingJobs重新选中前设置重试时间
+		if j.retryDelayFn != nil {
+			j.retryAfter = time.Now().Add(j.retryDelayFn(j))
+		}
 		j.Status = to
 		return nil
 	}
@@ -130,6 +183,9 @@ func TransitionJobState(j *Job, to system.Status) error {
 			return err
 		}
 	}
+	if to == system.EndStatus {
+		j.endResult = j.Status
+	}
 	j.Status = to
 	if NotUseDBus {
 		return nil
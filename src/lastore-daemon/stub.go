@@ -137,9 +137,41 @@ func (u *Updater) setUpdatablePackages(ids []string) {
 		}
 	}
 	if changed {
+		added, removed := diffPackages(u.UpdatablePackages, ids)
 		u.UpdatablePackages = ids
 		_ = u.emitPropChangedUpdatablePackages(ids)
+		// 仅顺序变化时集合相同,不发送信号
+		if !NotUseDBus && (len(added) != 0 || len(removed) != 0) {
+			err := u.service.Emit(u, "UpdatablePackagesChanged", added, removed)
+			if err != nil {
+				logger.Warning(err)
+			}
+		}
+	}
+}
+
+// diffPackages 返回newList相对oldList新增和移除的包
+func diffPackages(oldList, newList []string) (added []string, removed []string) {
+	oldSet := make(map[string]struct{}, len(oldList))
+	for _, pkg := range oldList {
+		oldSet[pkg] = struct{}{}
+	}
+	newSet := make(map[string]struct{}, len(newList))
+	for _, pkg := range newList {
+		if _, ok := newSet[pkg]; ok {
+			continue
+		}
+		newSet[pkg] = struct{}{}
+		if _, ok := oldSet[pkg]; !ok {
+			added = append(added, pkg)
+		}
+	}
+	for _, pkg := range oldList {
+		if _, ok := newSet[pkg]; !ok {
+			removed = append(removed, pkg)
+		}
 	}
+	return added, removed
 }
 
 func DestroyJobDBus(j *Job) {
@@ -0,0 +1,233 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+)
+
+// updatableExportPath 可更新包的导出文件,供合规审计等外部工具读取,每次检查更新后刷新
+var updatableExportPath = "/var/lib/lastore/updatable.json"
+
+// updatablePreviousPath 上一次检查更新成功时的导出文件,用于计算两次检查之间的变化
+var updatablePreviousPath = "/var/lib/lastore/updatable.previous.json"
+
+// updatableExportSchemaVersion 导出文件格式变化时需要增加
+const updatableExportSchemaVersion = 1
+
+var updatableExportMu sync.Mutex
+
+// UpdatableExport updatableExportPath 的文件内容
+type UpdatableExport struct {
+	SchemaVersion int
+	GeneratedAt   time.Time
+	Packages      []UpdatableExportPackage
+}
+
+// UpdatableExportPackage 同一个包属于多个分类时每个分类一条记录
+type UpdatableExportPackage struct {
+	Name           string
+	CurrentVersion string // 未安装时为空
+	TargetVersion  string // 无法获取时为空
+	Category       string // UpdateType.JobType()
+}
+
+// buildUpdatableExport 按分类和包名排序,保证相同的更新状态生成相同的内容
+func buildUpdatableExport(classified map[string][]string, targets map[string]map[string]system.PackageInfo,
+	current map[string]string, now time.Time) UpdatableExport {
+	export := UpdatableExport{
+		SchemaVersion: updatableExportSchemaVersion,
+		GeneratedAt:   now,
+		Packages:      []UpdatableExportPackage{},
+	}
+	for category, packages := range classified {
+		for _, name := range packages {
+			export.Packages = append(export.Packages, UpdatableExportPackage{
+				Name:           name,
+				CurrentVersion: current[name],
+				TargetVersion:  targets[category][name].Version,
+				Category:       category,
+			})
+		}
+	}
+	sort.Slice(export.Packages, func(i, j int) bool {
+		a, b := export.Packages[i], export.Packages[j]
+		if a.Category != b.Category {
+			return a.Category < b.Category
+		}
+		return a.Name < b.Name
+	})
+	return export
+}
+
+// exportUpdatable 检查更新成功后生成可更新包的导出文件,并将原来的导出文件保存为上一次的记录,获取目标版本失败的分类TargetVersion为空.
+// 只能在检查更新成功后调用,其他刷新可更新内容的场景不能调用,否则会覆盖上一次检查的记录
+func (m *Manager) exportUpdatable(classified map[string][]string) error {
+	infos, err := m.getUpdatablePackageInfos()
+	if err != nil {
+		logger.Warning(err)
+	}
+	targets := make(map[string]map[string]system.PackageInfo)
+	for t, info := range infos {
+		targets[t.JobType()] = info
+	}
+	nameSet := make(map[string]struct{})
+	var names []string
+	for _, packages := range classified {
+		for _, name := range packages {
+			if _, ok := nameSet[name]; !ok {
+				nameSet[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+	return rotateUpdatableExport(buildUpdatableExport(classified, targets, m.pkgStatus.installedVersions(names), time.Now()))
+}
+
+// rotateUpdatableExport 将当前的导出文件保存为上一次的记录并写入export,两步在同一个锁内完成
+func rotateUpdatableExport(export UpdatableExport) error {
+	content, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+	updatableExportMu.Lock()
+	defer updatableExportMu.Unlock()
+	// 先写临时文件再rename,外部工具不会读到不完整的内容
+	tmp, err := os.CreateTemp(filepath.Dir(updatableExportPath), "."+filepath.Base(updatableExportPath))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(updatableExportPath, updatablePreviousPath)
+	if os.IsNotExist(err) {
+		// 没有导出文件时不能保留更早的记录,否则会和更早的检查比较
+		err = os.Remove(updatablePreviousPath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), updatableExportPath)
+}
+
+// UpdatesDelta 两次检查更新之间可更新内容的变化,同一个包的不同分类分别比较
+type UpdatesDelta struct {
+	FirstCheck bool // 没有上一次的记录,所有包都在Added中
+	Added      []UpdatableExportPackage
+	Removed    []UpdatableExportPackage
+	Changed    []UpdatesDeltaChange
+}
+
+// UpdatesDeltaChange 目标版本发生变化的包
+type UpdatesDeltaChange struct {
+	Name            string
+	Category        string
+	PreviousVersion string
+	TargetVersion   string
+	CurrentVersion  string
+}
+
+// diffUpdatableExport 比较两次导出的可更新内容,previous为nil时表示第一次检查
+func diffUpdatableExport(previous *UpdatableExport, current UpdatableExport) UpdatesDelta {
+	delta := UpdatesDelta{
+		Added:   []UpdatableExportPackage{},
+		Removed: []UpdatableExportPackage{},
+		Changed: []UpdatesDeltaChange{},
+	}
+	if previous == nil {
+		delta.FirstCheck = true
+		delta.Added = append(delta.Added, current.Packages...)
+		return delta
+	}
+	key := func(p UpdatableExportPackage) string {
+		return p.Category + "/" + p.Name
+	}
+	prevMap := make(map[string]UpdatableExportPackage, len(previous.Packages))
+	for _, p := range previous.Packages {
+		prevMap[key(p)] = p
+	}
+	curMap := make(map[string]bool, len(current.Packages))
+	for _, p := range current.Packages {
+		curMap[key(p)] = true
+		prev, ok := prevMap[key(p)]
+		if !ok {
+			delta.Added = append(delta.Added, p)
+			continue
+		}
+		if prev.TargetVersion == p.TargetVersion {
+			continue
+		}
+		result, err := system.CompareVersions(prev.TargetVersion, p.TargetVersion)
+		if err == nil && result == 0 {
+			continue
+		}
+		delta.Changed = append(delta.Changed, UpdatesDeltaChange{
+			Name:            p.Name,
+			Category:        p.Category,
+			PreviousVersion: prev.TargetVersion,
+			TargetVersion:   p.TargetVersion,
+			CurrentVersion:  p.CurrentVersion,
+		})
+	}
+	for _, p := range previous.Packages {
+		if !curMap[key(p)] {
+			delta.Removed = append(delta.Removed, p)
+		}
+	}
+	return delta
+}
+
+func readUpdatableExport(path string) (*UpdatableExport, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var export UpdatableExport
+	err = json.Unmarshal(content, &export)
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+// getUpdatesDelta 比较最近一次和上一次检查更新成功时的可更新内容
+func getUpdatesDelta() (UpdatesDelta, error) {
+	updatableExportMu.Lock()
+	defer updatableExportMu.Unlock()
+	current, err := readUpdatableExport(updatableExportPath)
+	if err != nil {
+		return UpdatesDelta{}, err
+	}
+	previous, err := readUpdatableExport(updatablePreviousPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warning(err)
+		}
+		previous = nil
+	}
+	return diffUpdatableExport(previous, *current), nil
+}
@@ -0,0 +1,164 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+)
+
+const (
+	updateHistoryFile    = "/var/lib/lastore/update_history.jsonl"
+	updateHistoryMaxSize = 1024 * 1024 // 超过1M后轮转
+)
+
+// 需要记录历史的job类型
+var updateHistoryJobTypes = []string{
+	system.DistUpgradeJobType,
+	system.InstallJobType,
+	system.RemoveJobType,
+	system.UpdateSourceJobType,
+	system.SystemUpgradeJobType,
+	system.AppStoreUpgradeJobType,
+	system.SecurityUpgradeJobType,
+	system.UnknownUpgradeJobType,
+	system.OfflineUpgradeJobType,
+}
+
+type updateHistoryEntry struct {
+	Time     int64 // unix时间戳
+	Id       string
+	Type     string
+	Packages []string
+	Result   system.Status
+	ErrType  system.JobErrorType `json:",omitempty"`
+}
+
+// updateHistory 以json lines格式记录完成的job
+type updateHistory struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+}
+
+func newUpdateHistory(path string) *updateHistory {
+	return &updateHistory{
+		path:    path,
+		maxSize: updateHistoryMaxSize,
+	}
+}
+
+func (h *updateHistory) recordJob(j *Job, result system.Status) {
+	if h == nil {
+		return
+	}
+	found := false
+	for _, typ := range updateHistoryJobTypes {
+		if j.Type == typ {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+	entry := updateHistoryEntry{
+		Time:     time.Now().Unix(),
+		Id:       j.Id,
+		Type:     j.Type,
+		Packages: j.Packages,
+		Result:   result,
+	}
+	if result == system.FailedStatus {
+		var jobErr system.JobError
+		if json.Unmarshal([]byte(j.Description), &jobErr) == nil {
+			entry.ErrType = jobErr.ErrType
+		}
+	}
+	err := h.append(entry)
+	if err != nil {
+		logger.Warning("record update history failed:", err)
+	}
+}
+
+func (h *updateHistory) append(entry updateHistoryEntry) error {
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(content, '\n'))
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	info, err := f.Stat()
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	if info.Size() > h.maxSize {
+		// 只保留一个轮转文件
+		return os.Rename(h.path, h.path+".1")
+	}
+	return nil
+}
+
+// list 返回最近的limit条记录,按时间倒序,limit <= 0 时返回全部
+func (h *updateHistory) list(limit int) ([]updateHistoryEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var entries []updateHistoryEntry
+	for _, path := range []string{h.path + ".1", h.path} {
+		err := readUpdateHistory(path, &entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func readUpdateHistory(path string, entries *[]updateHistoryEntry) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry updateHistoryEntry
+		err := json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			logger.Debug("skip invalid update history line:", err)
+			continue
+		}
+		*entries = append(*entries, entry)
+	}
+	return scanner.Err()
+}
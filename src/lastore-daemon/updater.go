@@ -10,16 +10,21 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	. "github.com/linuxdeepin/lastore-daemon/src/internal/config"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system/apt"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/updateplatform"
 
 	"github.com/godbus/dbus/v5"
 	systemd1 "github.com/linuxdeepin/go-dbus-factory/system/org.freedesktop.systemd1"
 	"github.com/linuxdeepin/go-lib/dbusutil"
+	"github.com/linuxdeepin/go-lib/strv"
 )
 
 const (
@@ -37,6 +42,76 @@ type idleDownloadConfig struct {
 	IdleDownloadEnabled bool
 	BeginTime           string
 	EndTime             string
+	Weekdays            []time.Weekday `json:",omitempty"` // 允许空闲下载的星期,为空时每天都允许
+	TimeZone            string         `json:",omitempty"` // BeginTime和EndTime所在时区,为空时使用本地时区
+}
+
+// 便于测试时冻结时钟
+var _timeNow = time.Now
+
+func (c idleDownloadConfig) location() *time.Location {
+	if c.TimeZone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		logger.Warningf("invalid idle download time zone %q: %v", c.TimeZone, err)
+		return time.Local
+	}
+	return loc
+}
+
+// now 返回配置时区下的当前时间
+func (c idleDownloadConfig) now() time.Time {
+	return _timeNow().In(c.location())
+}
+
+// inWindow 判断t是否处于空闲下载时间段内,支持跨零点的时间段,跨零点时按时间段开始的那天判断星期
+func (c idleDownloadConfig) inWindow(t time.Time) bool {
+	t = t.In(c.location())
+	begin, err := time.Parse(autoDownloadTimeLayout, c.BeginTime)
+	if err != nil {
+		logger.Warning(err)
+		return false
+	}
+	end, err := time.Parse(autoDownloadTimeLayout, c.EndTime)
+	if err != nil {
+		logger.Warning(err)
+		return false
+	}
+	minuteOfDay := func(t time.Time) int {
+		return t.Hour()*60 + t.Minute()
+	}
+	cur := minuteOfDay(t)
+	beginMinute := minuteOfDay(begin)
+	endMinute := minuteOfDay(end)
+	day := t.Weekday()
+	switch {
+	case beginMinute == endMinute:
+		return false
+	case beginMinute < endMinute:
+		if cur < beginMinute || cur >= endMinute {
+			return false
+		}
+	default:
+		if cur >= beginMinute {
+			// 当天开始的时间段
+		} else if cur < endMinute {
+			// 前一天开始的时间段
+			day = (day + 6) % 7
+		} else {
+			return false
+		}
+	}
+	if len(c.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range c.Weekdays {
+		if d == day {
+			return true
+		}
+	}
+	return false
 }
 
 type downloadSpeedLimitConfig struct {
@@ -61,6 +136,8 @@ type Updater struct {
 	UpdatablePackages []string
 	// dbusutil-gen: equal=nil
 	ClassifiedUpdatablePackages map[string][]string
+	// dbusutil-gen: equal=nil
+	ClassifiedRemovedPackages map[string][]string // 各分类更新时会被卸载的包,没有卸载的分类不在其中,用于提示用户
 
 	AutoInstallUpdates    bool              `prop:"access:rw"`
 	AutoInstallUpdateType system.UpdateType `prop:"access:rw"`
@@ -73,12 +150,33 @@ type Updater struct {
 	setDownloadSpeedLimitTimer *time.Timer
 	setIdleDownloadConfigTimer *time.Timer
 
-	UpdateTarget string
+	UpdateTarget string // 更新平台指定的目标版本json,包含Version、BuildId和NotesUrl,没有目标版本时为空
 
 	OfflineInfo string
 
 	P2PUpdateEnable  bool // p2p更新是否开启
 	P2PUpdateSupport bool // 是否支持p2p更新
+
+	PDiffsEnabled bool // 检查更新时是否使用增量索引
+
+	// dbusutil-gen: equal=nil
+	ExcludedPackages []string // 不参与自动下载和更新的包
+
+	StagingPolicy string // 自动下载策略,见 config.StagingPolicy
+
+	LastCheckTime      string // 最近一次检查更新结束的时间,RFC3339格式,从未检查过时为空
+	LastCheckSucceeded bool
+	LastCheckError     string // 最近一次检查更新失败的错误类型,成功时为空
+	LastCheckAttempt   int32  // 最近一次检查更新是第几次尝试的结果,失败重试时递增
+
+	//nolint
+	signals *struct {
+		// 可更新包集合变化时发送,added为新增的包,removed为移除的包
+		UpdatablePackagesChanged struct {
+			added   []string
+			removed []string
+		}
+	}
 }
 
 func NewUpdater(service *dbusutil.Service, m *Manager, config *Config) *Updater {
@@ -95,9 +193,20 @@ func NewUpdater(service *dbusutil.Service, m *Manager, config *Config) *Updater
 		IdleDownloadConfig:          config.IdleDownloadConfig,
 		DownloadSpeedLimitConfig:    config.DownloadSpeedLimitConfig,
 		ClassifiedUpdatablePackages: config.ClassifiedUpdatablePackages,
+		ExcludedPackages:            config.ExcludedPackages,
+		StagingPolicy:               string(config.StagingPolicy),
+		PDiffsEnabled:               config.PDiffsEnabled,
+		LastCheckTime:               formatCheckTime(config.LastCheckResult.Time),
+		LastCheckSucceeded:          config.LastCheckResult.Succeeded,
+		LastCheckError:              config.LastCheckResult.Error,
+		LastCheckAttempt:            int32(config.LastCheckResult.Attempt),
 		systemdManager:              systemd1.NewManager(service.Conn()),
 	}
-	err := json.Unmarshal([]byte(u.IdleDownloadConfig), &u.idleDownloadConfigObj)
+	err := writeBlockPreferences(legacyExcludedPreferencesPath, nil)
+	if err != nil {
+		logger.Warning(err)
+	}
+	err = json.Unmarshal([]byte(u.IdleDownloadConfig), &u.idleDownloadConfigObj)
 	if err != nil {
 		logger.Warning(err)
 	}
@@ -271,6 +380,12 @@ func (u *Updater) setClassifiedUpdatablePackages(infosMap map[string][]string) {
 	u.setPropClassifiedUpdatablePackages(infosMap)
 }
 
+func (u *Updater) setClassifiedRemovedPackages(removedMap map[string][]string) {
+	u.PropsMu.Lock()
+	defer u.PropsMu.Unlock()
+	u.setPropClassifiedRemovedPackages(removedMap)
+}
+
 func (u *Updater) autoInstallUpdatesWriteCallback(pw *dbusutil.PropertyWrite) *dbus.Error {
 	return dbusutil.ToError(u.config.SetAutoInstallUpdates(pw.Value.(bool)))
 }
@@ -279,6 +394,90 @@ func (u *Updater) autoInstallUpdatesSuitesWriteCallback(pw *dbusutil.PropertyWri
 	return dbusutil.ToError(u.config.SetAutoInstallUpdateType(system.UpdateType(pw.Value.(uint64))))
 }
 
+func (u *Updater) inIdleDownloadWindow() bool {
+	u.PropsMu.RLock()
+	defer u.PropsMu.RUnlock()
+	return u.idleDownloadConfigObj.inWindow(_timeNow())
+}
+
+// setStagingPolicy 保存自动下载策略,并同步AutoDownloadUpdates;关闭自动下载时空闲下载同样关闭
+func (u *Updater) setStagingPolicy(policy StagingPolicy) error {
+	if u.getStagingPolicy() == policy {
+		return nil
+	}
+	autoDownload := policy != StagingPolicyOff
+	u.PropsMu.Lock()
+	idleDownloadConfigObj := u.idleDownloadConfigObj
+	u.PropsMu.Unlock()
+	if !autoDownload && idleDownloadConfigObj.IdleDownloadEnabled {
+		idleDownloadConfigObj.IdleDownloadEnabled = false
+		idleDownloadByte, err := json.Marshal(idleDownloadConfigObj)
+		if err != nil {
+			logger.Warning(err)
+		} else {
+			busErr := u.SetIdleDownloadConfig(string(idleDownloadByte))
+			if busErr != nil {
+				logger.Warning(busErr)
+			}
+		}
+	}
+	// save the config to disk
+	err := u.config.SetStagingPolicy(policy)
+	if err != nil {
+		return err
+	}
+	err = u.config.SetAutoDownloadUpdates(autoDownload)
+	if err != nil {
+		return err
+	}
+
+	u.PropsMu.Lock()
+	u.setPropStagingPolicy(string(policy))
+	u.setPropAutoDownloadUpdates(autoDownload)
+	u.PropsMu.Unlock()
+	return nil
+}
+
+func formatCheckTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// setUpdateTarget 更新UpdateTarget属性,target为空时清除
+func (u *Updater) setUpdateTarget(target string) {
+	u.PropsMu.Lock()
+	defer u.PropsMu.Unlock()
+	u.setPropUpdateTarget(target)
+}
+
+// setLastCheckResult 检查更新任务结束时保存结果,相关属性同时更新
+func (u *Updater) setLastCheckResult(succeeded bool, errType string, attempt int) {
+	result := CheckResult{
+		Time:      time.Now(),
+		Succeeded: succeeded,
+		Error:     errType,
+		Attempt:   attempt,
+	}
+	u.PropsMu.Lock()
+	defer u.PropsMu.Unlock()
+	err := u.config.SetLastCheckResult(result)
+	if err != nil {
+		logger.Warning(err)
+	}
+	u.setPropLastCheckTime(formatCheckTime(result.Time))
+	u.setPropLastCheckSucceeded(result.Succeeded)
+	u.setPropLastCheckError(result.Error)
+	u.setPropLastCheckAttempt(int32(result.Attempt))
+}
+
+func (u *Updater) getStagingPolicy() StagingPolicy {
+	u.PropsMu.RLock()
+	defer u.PropsMu.RUnlock()
+	return StagingPolicy(u.StagingPolicy)
+}
+
 func (u *Updater) getIdleDownloadEnabled() bool {
 	u.PropsMu.RLock()
 	defer u.PropsMu.RUnlock()
@@ -297,7 +496,193 @@ func (u *Updater) getUpdatablePackagesByType(updateType system.UpdateType) []str
 			}
 		}
 	}
-	return updatableApps
+	return excludePackages(updatableApps, u.ExcludedPackages)
+}
+
+// getClassifiedPackagesByType 返回updateType包含的各分类可更新的包,已排除不更新的包
+func (u *Updater) getClassifiedPackagesByType(updateType system.UpdateType) map[string][]string {
+	u.PropsMu.RLock()
+	defer u.PropsMu.RUnlock()
+	packageMap := make(map[string][]string)
+	for _, t := range system.AllInstallUpdateType() {
+		if updateType&t != 0 {
+			packages := excludePackages(u.ClassifiedUpdatablePackages[t.JobType()], u.ExcludedPackages)
+			if len(packages) > 0 {
+				packageMap[t.JobType()] = packages
+			}
+		}
+	}
+	return packageMap
+}
+
+// legacyExcludedPreferencesPath 旧版本写入系统preferences.d的排除更新配置,会阻止用户手动安装这些包,启动时删除
+const legacyExcludedPreferencesPath = "/etc/apt/preferences.d/lastore-excluded"
+
+var (
+	// preferencesPartsRoot lastore任务使用的apt优先级配置片段目录的父目录
+	preferencesPartsRoot = "/var/lib/lastore/preferences"
+	// systemPreferencesParts 系统的apt优先级配置片段目录
+	systemPreferencesParts = "/etc/apt/preferences.d"
+)
+
+const (
+	// preferencesPartsKey 设置apt优先级配置片段目录的配置项
+	preferencesPartsKey = "Dir::Etc::PreferencesParts"
+	// blockPreferencesName 阻止安装的配置片段文件名,apt按文件名顺序读取,需要排在系统配置之前
+	blockPreferencesName = "00-lastore-block"
+)
+
+// newPreferencesParts 创建只给lastore的apt任务使用的优先级配置片段目录,包含系统preferences.d中的配置和阻止安装blocked的配置,
+// 通过Dir::Etc::PreferencesParts传给apt,不影响用户手动执行的apt命令.blocked为空时返回空字符串
+func newPreferencesParts(blocked []string) (string, error) {
+	if len(blocked) == 0 {
+		return "", nil
+	}
+	err := os.MkdirAll(preferencesPartsRoot, 0755)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(preferencesPartsRoot, "parts-")
+	if err != nil {
+		return "", err
+	}
+	err = fillPreferencesParts(dir, blocked)
+	if err != nil {
+		removePreferencesParts(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+func fillPreferencesParts(dir string, blocked []string) error {
+	entries, err := os.ReadDir(systemPreferencesParts)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == blockPreferencesName {
+			continue
+		}
+		err = os.Symlink(filepath.Join(systemPreferencesParts, entry.Name()), filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return writeBlockPreferences(filepath.Join(dir, blockPreferencesName), blocked)
+}
+
+// removePreferencesParts 删除newPreferencesParts创建的目录,不在preferencesPartsRoot下的目录不处理
+func removePreferencesParts(dir string) {
+	if dir == "" || filepath.Dir(dir) != preferencesPartsRoot {
+		return
+	}
+	err := os.RemoveAll(dir)
+	if err != nil {
+		logger.Warning(err)
+	}
+}
+
+// getBlockedUpdateAptOption 在getUpdateAptOption的基础上增加阻止安装排除更新的包和extraBlocked的优先级配置,
+// 防止apt通过依赖关系重新引入这些包,使用结束后需要调用cleanup删除配置
+func (u *Updater) getBlockedUpdateAptOption(extraBlocked []string) (option map[string]string, cleanup func(), err error) {
+	option = u.getUpdateAptOption()
+	blocked := append(append([]string{}, u.getExcludedPackages()...), extraBlocked...)
+	dir, err := newPreferencesParts(blocked)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dir == "" {
+		return option, func() {}, nil
+	}
+	option[preferencesPartsKey] = dir
+	return option, func() { removePreferencesParts(dir) }, nil
+}
+
+// writeBlockPreferences 写入阻止apt安装或升级packages的优先级配置,packages为空时删除path
+func writeBlockPreferences(path string, packages []string) error {
+	if len(packages) == 0 {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	content := fmt.Sprintf("Package: %v\nPin: version *\nPin-Priority: -1\n", strings.Join(packages, " "))
+	return os.WriteFile(path, []byte(content), 0644) // #nosec G306
+}
+
+func excludePackages(packages []string, excluded []string) []string {
+	if len(excluded) == 0 {
+		return packages
+	}
+	var r []string
+	for _, pkg := range packages {
+		if !strv.Strv(excluded).Contains(pkg) {
+			r = append(r, pkg)
+		}
+	}
+	return r
+}
+
+func (u *Updater) getExcludedPackages() []string {
+	u.PropsMu.RLock()
+	defer u.PropsMu.RUnlock()
+	return u.ExcludedPackages
+}
+
+// getUpdateAptOption 检查更新、下载和安装都需要使用的apt配置,保证各阶段计算出的可更新包一致
+func (u *Updater) getUpdateAptOption() map[string]string {
+	option := apt.PhasedUpdateOption(u.config.IgnorePhasedUpdates)
+	for k, v := range u.getDownloadAptOption() {
+		option[k] = v
+	}
+	if u.config.AllowUnauthenticated {
+		// 只有管理员显式开启时才允许,否则apt以ErrorUnauthenticatedPackages失败
+		logger.Warning("allow installing unauthenticated packages")
+		for k, v := range apt.UnauthenticatedOption(true) {
+			option[k] = v
+		}
+	}
+	return option
+}
+
+// getDownloadAptOption 返回下载并发相关的apt配置,配置非法时忽略,使用apt默认值
+func (u *Updater) getDownloadAptOption() map[string]string {
+	option, err := apt.DownloadConcurrencyOption(u.config.DownloadQueueMode, u.config.DownloadPipelineDepth,
+		u.config.DownloadPipelineDepthOverride)
+	if err != nil {
+		logger.Warning("ignore download concurrency config:", err)
+		return nil
+	}
+	return option
+}
+
+// getUpdateSourceAptOption 检查更新的apt参数,在下载参数的基础上设置是否下载增量索引
+func (u *Updater) getUpdateSourceAptOption() map[string]string {
+	option := u.getDownloadAptOption()
+	if option == nil {
+		option = make(map[string]string)
+	}
+	u.PropsMu.RLock()
+	option["Acquire::PDiffs"] = strconv.FormatBool(u.PDiffsEnabled)
+	u.PropsMu.RUnlock()
+	return option
+}
+
+func (u *Updater) setExcludedPackages(packages []string) error {
+	for _, pkg := range packages {
+		if !pkgNameRegexp.MatchString(pkg) || len(strings.Fields(pkg)) != 1 {
+			return fmt.Errorf("invalid package name %q", pkg)
+		}
+	}
+	err := u.config.SetExcludedPackages(packages)
+	if err != nil {
+		return err
+	}
+	u.PropsMu.Lock()
+	u.setPropExcludedPackages(packages)
+	u.PropsMu.Unlock()
+	return nil
 }
 
 func (u *Updater) GetLimitConfig() (bool, string) {
@@ -7,9 +7,11 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"time"
 
+	. "github.com/linuxdeepin/lastore-daemon/src/internal/config"
 	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
 
 	"github.com/godbus/dbus/v5"
@@ -118,30 +120,21 @@ func (u *Updater) SetAutoDownloadUpdates(enable bool) *dbus.Error {
 	if u.AutoDownloadUpdates == enable {
 		return nil
 	}
-	u.PropsMu.Lock()
-	idleDownloadConfigObj := u.idleDownloadConfigObj
-	u.PropsMu.Unlock()
-	if !enable && idleDownloadConfigObj.IdleDownloadEnabled == true {
-		idleDownloadConfigObj.IdleDownloadEnabled = false
-		idleDownloadByte, err := json.Marshal(idleDownloadConfigObj)
-		if err != nil {
-			logger.Warning(err)
-		} else {
-			err = u.SetIdleDownloadConfig(string(idleDownloadByte))
-			if err != nil {
-				logger.Warning(err)
-			}
-		}
-	}
-	// save the config to disk
-	err := u.config.SetAutoDownloadUpdates(enable)
-	if err != nil {
-		return dbusutil.ToError(err)
+	policy := StagingPolicyOff
+	if enable {
+		policy = StagingPolicyDownloadAndNotify
 	}
+	return dbusutil.ToError(u.setStagingPolicy(policy))
+}
 
-	u.AutoDownloadUpdates = enable
-	_ = u.emitPropChangedAutoDownloadUpdates(enable)
-	return nil
+// SetStagingPolicy 设置自动下载策略: off, download-only, download-and-notify
+func (u *Updater) SetStagingPolicy(policy string) *dbus.Error {
+	u.service.DelayAutoQuit()
+	p := StagingPolicy(policy)
+	if !p.IsValid() {
+		return dbusutil.ToError(fmt.Errorf("invalid staging policy: %q", policy))
+	}
+	return dbusutil.ToError(u.setStagingPolicy(p))
 }
 
 // SetMirrorSource 设置用于下载软件的镜像源
@@ -236,6 +229,22 @@ func (u *Updater) SetDownloadSpeedLimit(limitConfig string) *dbus.Error {
 	return nil
 }
 
+// SetPDiffsEnabled 设置检查更新时是否下载增量索引,关闭后每次都下载完整的索引
+func (u *Updater) SetPDiffsEnabled(enable bool) *dbus.Error {
+	u.service.DelayAutoQuit()
+	u.PropsMu.Lock()
+	defer u.PropsMu.Unlock()
+	if u.PDiffsEnabled == enable {
+		return nil
+	}
+	err := u.config.SetPDiffsEnabled(enable)
+	if err != nil {
+		return dbusutil.ToError(err)
+	}
+	u.setPropPDiffsEnabled(enable)
+	return nil
+}
+
 func (u *Updater) SetP2PUpdateEnable(enable bool) *dbus.Error {
 	err := u.setP2PUpdateEnable(enable)
 	if err != nil {
@@ -244,3 +253,21 @@ func (u *Updater) SetP2PUpdateEnable(enable bool) *dbus.Error {
 	}
 	return nil
 }
+
+// SetExcludedPackages 设置不参与自动下载和更新的包,需要管理员权限
+func (u *Updater) SetExcludedPackages(sender dbus.Sender, packages []string) *dbus.Error {
+	u.service.DelayAutoQuit()
+	// 管理员鉴权
+	err := checkInvokePermission(u.service, sender)
+	if err != nil {
+		logger.Warning(err)
+		return dbusutil.ToError(err)
+	}
+	err = u.setExcludedPackages(packages)
+	if err != nil {
+		logger.Warning(err)
+		return dbusutil.ToError(err)
+	}
+	u.manager.updateUpdatableProp(u.manager.updater.ClassifiedUpdatablePackages)
+	return nil
+}
@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system/apt"
+)
+
+// abRestorer A/B回滚需要的接口,abrecovery.ABRecovery实现了该接口
+type abRestorer interface {
+	CanRestore(flags dbus.Flags) (bool, error)
+	StartRestore(flags dbus.Flags) error
+}
+
+// postUpgradeHealthResult 更新后健康检查的结果,检查失败时通过reportLog上报
+type postUpgradeHealthResult struct {
+	Mode            string
+	Healthy         bool
+	Detail          string `json:",omitempty"`
+	AutoRollback    bool   // 是否开启了自动回滚
+	RollbackStarted bool
+	RollbackError   string `json:",omitempty"`
+}
+
+// runPostUpgradeHealthCheck 执行check,失败且开启自动回滚时通过restorer回滚到更新前的备份
+func runPostUpgradeHealthCheck(check func() error, autoRollback bool, restorer abRestorer) postUpgradeHealthResult {
+	result := postUpgradeHealthResult{
+		Healthy:      true,
+		AutoRollback: autoRollback,
+	}
+	err := check()
+	if err == nil {
+		return result
+	}
+	result.Healthy = false
+	result.Detail = err.Error()
+	if !autoRollback {
+		return result
+	}
+	canRestore, err := restorer.CanRestore(0)
+	if err == nil && !canRestore {
+		err = errors.New("no backup to restore")
+	}
+	if err == nil {
+		err = restorer.StartRestore(0)
+	}
+	if err != nil {
+		result.RollbackError = err.Error()
+		return result
+	}
+	result.RollbackStarted = true
+	return result
+}
+
+// postUpgradeHealthCheck 更新安装成功后检查依赖关系,损坏时按配置触发A/B回滚,返回的JobError会使更新任务失败
+func (m *Manager) postUpgradeHealthCheck(mode system.UpdateType) error {
+	result := runPostUpgradeHealthCheck(func() error {
+		return apt.CheckSystemHealth(m.proxyEnviron(), system.ThoroughCheckSystem, nil)
+	}, m.config.AutoRollbackOnBrokenUpgrade, m.abObj)
+	if result.Healthy {
+		return nil
+	}
+	result.Mode = mode.JobType()
+	content, err := json.Marshal(result)
+	if err != nil {
+		logger.Warning(err)
+	}
+	logger.Warning("post upgrade health check failed:", string(content))
+	go func() {
+		m.inhibitAutoQuitCountAdd()
+		defer m.inhibitAutoQuitCountSub()
+		m.reportLog(upgradeStatusReport, false, string(content))
+	}()
+	m.updatePlatform.PostStatusMessage(fmt.Sprintf("%v post upgrade health check failed, detail is: %v", mode.JobType(), string(content)))
+	return &system.JobError{
+		ErrType:   system.ErrorDependenciesBroken,
+		ErrDetail: string(content),
+	}
+}
@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2018 - 2023 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/linuxdeepin/lastore-daemon/src/internal/system"
+)
+
+// 管理员可以在以下目录放置可执行脚本,在系统更新前后按文件名顺序执行
+const (
+	preUpgradeHookDir     = "/etc/lastore/hooks/pre-upgrade.d"
+	postUpgradeHookDir    = "/etc/lastore/hooks/post-upgrade.d"
+	upgradeHookTimeout    = 10 * time.Minute
+	upgradeHookPackageEnv = "LASTORE_UPGRADE_PACKAGES"
+	upgradeHookModeEnv    = "LASTORE_UPGRADE_MODE"
+)
+
+// listHookScripts 返回目录中可执行的普通文件,跳过隐藏文件和dpkg遗留的配置文件
+func listHookScripts(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var scripts []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") || strings.Contains(name, ".dpkg-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		scripts = append(scripts, filepath.Join(dir, name))
+	}
+	return scripts, nil
+}
+
+func runHookScript(script string, env []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, script) // #nosec G204
+	cmd.Env = append(os.Environ(), env...)
+	// 超时后结束脚本创建的整个进程组
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("hook %s timed out after %v", script, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("hook %s failed: %v, output: %s", script, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// runHookScripts 依次执行dir中的脚本.stopOnError为true时遇到失败立即返回,否则执行完所有脚本后返回所有错误
+func runHookScripts(dir string, env []string, timeout time.Duration, stopOnError bool) error {
+	scripts, err := listHookScripts(dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, script := range scripts {
+		logger.Info("run upgrade hook:", script)
+		err := runHookScript(script, env, timeout)
+		if err != nil {
+			if stopOnError {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func upgradeHookEnv(mode system.UpdateType, packages []string) []string {
+	return []string{
+		upgradeHookPackageEnv + "=" + strings.Join(packages, " "),
+		fmt.Sprintf("%s=%d", upgradeHookModeEnv, mode),
+	}
+}
+
+// runPreUpgradeHooks 任一脚本失败都会中止更新
+func runPreUpgradeHooks(env []string) error {
+	err := runHookScripts(preUpgradeHookDir, env, upgradeHookTimeout, true)
+	if err != nil {
+		return &system.JobError{
+			ErrType:      system.ErrorScript,
+			ErrDetail:    err.Error(),
+			IsCheckError: true,
+		}
+	}
+	return nil
+}
+
+// runPostUpgradeHooks 更新已经完成,脚本失败只记录日志
+func runPostUpgradeHooks(env []string) {
+	err := runHookScripts(postUpgradeHookDir, env, upgradeHookTimeout, false)
+	if err != nil {
+		logger.Warning(err)
+	}
+}
@@ -88,7 +88,7 @@ func parseAptShowList(r io.Reader, title string) []string {
 }
 
 func queryDpkgUpgradeInfoByAptList(sourcePath string) ([]string, error) {
-	ps, err := apt.ListDistUpgradePackages(sourcePath, nil)
+	ps, err := apt.ListDistUpgradePackages(nil, apt.DefaultConfPath(), sourcePath, nil)
 	if err != nil {
 		return nil, err
 	}